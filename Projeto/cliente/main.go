@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 
+	"jogodistribuido/partida"
 	"jogodistribuido/protocolo"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -25,25 +27,25 @@ var (
 	oponenteNome  string
 	meuInventario []protocolo.Carta
 	turnoDeQuem   string // NOVO: Armazena o ID de quem tem o turno
+	tokenSessao   string // Token recebido no login, usado para retomar a sessão após reconectar
+	ofertaTroca   string // Proposta de troca pendente (feita ou recebida)
+
+	ofertaForaDePartida bool   // A proposta pendente é fora de partida (clientes/{id}/troca)
+	parceiroTrocaNome   string // Outro jogador da proposta fora de partida
 )
 
+// brokers são os brokers MQTT de cada servidor, pelo número mostrado no menu
+var brokers = map[int]string{
+	1: "tcp://broker1:1883",
+	2: "tcp://broker2:1883",
+	3: "tcp://broker3:1883",
+}
+
 func main() {
 	fmt.Println("=== Jogo de Cartas Multiplayer Distribuído ===")
 	scanner := bufio.NewScanner(os.Stdin)
 
-	fmt.Print("Digite seu nome: ")
-	scanner.Scan()
-	meuNome = strings.TrimSpace(scanner.Text())
-	if meuNome == "" {
-		meuNome = "Jogador"
-	}
-
 	// --- LÓGICA DE ESCOLHA CORRIGIDA ---
-	serverMap := map[int]string{
-		1: "tcp://broker1:1883",
-		2: "tcp://broker2:1883",
-		3: "tcp://broker3:1883",
-	}
 	fmt.Println("\nEscolha o servidor para conectar:")
 	fmt.Println("1. Servidor 1")
 	fmt.Println("2. Servidor 2")
@@ -52,10 +54,10 @@ func main() {
 	scanner.Scan()
 	opcaoStr := scanner.Text()
 	opcao, err := strconv.Atoi(opcaoStr)
-	if err != nil || serverMap[opcao] == "" {
+	if err != nil || brokers[opcao] == "" {
 		log.Fatalf("Opção inválida.")
 	}
-	brokerAddr := serverMap[opcao]
+	brokerAddr := brokers[opcao]
 	// --- FIM DA CORREÇÃO ---
 
 	fmt.Printf("\nConectando ao broker MQTT: %s\n", brokerAddr)
@@ -64,11 +66,30 @@ func main() {
 		log.Fatalf("Erro ao conectar ao MQTT: %v", err)
 	}
 
-	// --- LÓGICA DE LOGIN CORRIGIDA ---
-	if err := fazerLogin(); err != nil {
-		log.Fatalf("Erro no processo de login: %v", err)
+	// Login com conta: pede nome e senha até o servidor aceitar
+	for tentativa := 1; ; tentativa++ {
+		fmt.Print("\nDigite seu nome: ")
+		scanner.Scan()
+		meuNome = strings.TrimSpace(scanner.Text())
+		if meuNome == "" {
+			meuNome = "Jogador"
+		}
+		fmt.Print("Senha: ")
+		scanner.Scan()
+		senha := strings.TrimSpace(scanner.Text())
+		fmt.Print("Criar uma conta nova? (s/N): ")
+		scanner.Scan()
+		registrar := strings.EqualFold(strings.TrimSpace(scanner.Text()), "s")
+
+		err := fazerLogin(senha, registrar)
+		if err == nil {
+			break
+		}
+		if tentativa == 3 {
+			log.Fatalf("Erro no processo de login: %v", err)
+		}
+		fmt.Printf("[ERRO] %v\n", err)
 	}
-	// --- FIM DA CORREÇÃO ---
 
 	fmt.Printf("\nBem-vindo, %s! (Seu ID: %s)\n", meuNome, meuID)
 	fmt.Println("\nEntrando na fila de matchmaking...")
@@ -110,6 +131,8 @@ func conectarMQTT(broker string) error {
 				topicoPartida := fmt.Sprintf("partidas/%s/eventos", salaAtual)
 				client.Subscribe(topicoPartida, 0, handleEventoPartida)
 			}
+			// Pede ao servidor o estado atual: turnos e jogadas podem ter passado durante a queda
+			enviarReconexao()
 		}
 	})
 
@@ -120,7 +143,7 @@ func conectarMQTT(broker string) error {
 	return nil
 }
 
-func fazerLogin() error {
+func fazerLogin(senha string, registrar bool) error {
 	// Cria um canal para esperar a resposta do login de forma segura
 	loginResponseChan := make(chan protocolo.Mensagem)
 
@@ -139,7 +162,7 @@ func fazerLogin() error {
 	}
 
 	// Publica a mensagem de login num tópico que o servidor ouve
-	dadosLogin := protocolo.DadosLogin{Nome: meuNome}
+	dadosLogin := protocolo.DadosLogin{Nome: meuNome, Senha: senha, Registrar: registrar}
 	msgLogin := protocolo.Mensagem{Comando: "LOGIN", Dados: mustJSON(dadosLogin)}
 	payloadLogin, _ := json.Marshal(msgLogin)
 
@@ -150,12 +173,23 @@ func fazerLogin() error {
 	// Aguarda a resposta por um tempo limitado (sem time.Sleep!)
 	select {
 	case resp := <-loginResponseChan:
+		if resp.Comando == "ERRO" {
+			mqttClient.Unsubscribe(responseTopic)
+			var dados protocolo.DadosErro
+			json.Unmarshal(resp.Dados, &dados)
+			return fmt.Errorf("%s", dados.Mensagem)
+		}
 		if resp.Comando == "LOGIN_OK" {
-			var dados map[string]string
+			var dados protocolo.DadosLoginOK
 			json.Unmarshal(resp.Dados, &dados)
-			meuID = dados["cliente_id"] // Guarda o ID permanente recebido do servidor
-			servidor := dados["servidor"]
-			fmt.Printf("\n[LOGIN] Conectado ao servidor %s (ID: %s)\n", servidor, meuID)
+			meuID = dados.ClienteID // Guarda o ID permanente da conta
+			meuNome = dados.Nome
+			meuInventario = dados.Inventario
+			tokenSessao = dados.TokenSessao
+			fmt.Printf("\n[LOGIN] Conectado ao servidor %s (ID: %s, rating: %d, moedas: %d)\n", dados.Servidor, meuID, dados.Rating, dados.Moedas)
+			if len(meuInventario) > 0 {
+				fmt.Printf("[LOGIN] Seu inventário salvo tem %d cartas. Use /cartas para vê-las.\n", len(meuInventario))
+			}
 
 			// Limpa a inscrição temporária e inscreve-se na permanente
 			mqttClient.Unsubscribe(responseTopic)
@@ -166,13 +200,43 @@ func fazerLogin() error {
 			return nil
 		}
 		return fmt.Errorf("resposta de login inesperada: %s", resp.Comando)
-	case <-time.After(5 * time.Second): // Espera por 5 segundos
+	case <-time.After(15 * time.Second): // O registro de conta passa pelo log do cluster e pode demorar alguns segundos
 		return fmt.Errorf("não foi possível obter ID do servidor (timeout)")
 	}
 }
 
+// enviarReconexao pede ao servidor do broker atual que retome a sessão; a resposta
+// chega como SESSAO_RETOMADA
+func enviarReconexao() {
+	if tokenSessao == "" {
+		return
+	}
+	mensagem := protocolo.Mensagem{
+		Comando: "RECONNECT",
+		Dados:   mustJSON(protocolo.DadosReconectar{ClienteID: meuID, TokenSessao: tokenSessao}),
+	}
+	payload, _ := json.Marshal(mensagem)
+	// Sem Wait: roda dentro do OnConnect do paho, que não deve bloquear
+	mqttClient.Publish(fmt.Sprintf("clientes/%s/reconectar", meuID), 1, false, payload)
+}
+
+// trocarDeServidor desconecta do broker atual e conecta em outro; a sessão é
+// retomada pelo OnConnect
+func trocarDeServidor(opcao int) {
+	broker := brokers[opcao]
+	if broker == "" {
+		fmt.Println("[ERRO] Servidor inválido. Use 1, 2 ou 3.")
+		return
+	}
+	fmt.Printf("[INFO] Trocando para o broker %s...\n", broker)
+	mqttClient.Disconnect(250)
+	if err := conectarMQTT(broker); err != nil {
+		fmt.Printf("[ERRO] Não foi possível conectar: %v\n", err)
+	}
+}
+
 func entrarNaFila() {
-	dados := map[string]string{"cliente_id": meuID}
+	dados := map[string]string{"cliente_id": meuID, "token_sessao": tokenSessao}
 	payload, _ := json.Marshal(dados)
 
 	topico := fmt.Sprintf("clientes/%s/entrar_fila", meuID)
@@ -180,6 +244,36 @@ func entrarNaFila() {
 	token.Wait()
 }
 
+// sairDaFila desiste da busca por oponente; a confirmação chega como SAIU_DA_FILA
+func sairDaFila() {
+	dados := map[string]string{"cliente_id": meuID, "token_sessao": tokenSessao}
+	payload, _ := json.Marshal(dados)
+
+	topico := fmt.Sprintf("clientes/%s/sair_fila", meuID)
+	token := mqttClient.Publish(topico, 0, false, payload)
+	token.Wait()
+}
+
+// criarSalaPrivada pede um código de convite; a resposta chega como SALA_PRIVADA_CRIADA
+func criarSalaPrivada() {
+	dados := map[string]string{"cliente_id": meuID, "token_sessao": tokenSessao}
+	payload, _ := json.Marshal(dados)
+
+	topico := fmt.Sprintf("clientes/%s/criar_privada", meuID)
+	token := mqttClient.Publish(topico, 0, false, payload)
+	token.Wait()
+}
+
+// entrarSalaPrivada usa o código recebido de outro jogador; a sala chega como PARTIDA_ENCONTRADA
+func entrarSalaPrivada(codigo string) {
+	dados := map[string]string{"cliente_id": meuID, "codigo": codigo, "token_sessao": tokenSessao}
+	payload, _ := json.Marshal(dados)
+
+	topico := fmt.Sprintf("clientes/%s/entrar_privada", meuID)
+	token := mqttClient.Publish(topico, 0, false, payload)
+	token.Wait()
+}
+
 var messageChan = make(chan protocolo.Mensagem, 10)
 
 func handleMensagemServidor(client mqtt.Client, msg mqtt.Message) {
@@ -196,29 +290,127 @@ func handleMensagemServidor(client mqtt.Client, msg mqtt.Message) {
 func processarMensagemServidor(msg protocolo.Mensagem) {
 	switch msg.Comando {
 	case "LOGIN_OK":
-		var dados map[string]string
+		var dados protocolo.DadosLoginOK
 		json.Unmarshal(msg.Dados, &dados)
-		meuID = dados["cliente_id"]
-		servidor := dados["servidor"]
-		fmt.Printf("\n[LOGIN] Conectado ao servidor %s (ID: %s)\n", servidor, meuID)
+		meuID = dados.ClienteID
+		meuInventario = dados.Inventario
+		tokenSessao = dados.TokenSessao
+		fmt.Printf("\n[LOGIN] Conectado ao servidor %s (ID: %s)\n", dados.Servidor, meuID)
 
 		// Agora subscreve ao tópico correto com o ID
 		topico := fmt.Sprintf("clientes/%s/eventos", meuID)
 		token := mqttClient.Subscribe(topico, 0, handleMensagemServidor)
 		token.Wait()
 
+	case "SESSAO_RETOMADA":
+		var dados protocolo.DadosSessaoRetomada
+		json.Unmarshal(msg.Dados, &dados)
+		if dados.TokenSessao != "" {
+			tokenSessao = dados.TokenSessao
+		}
+		meuInventario = dados.Inventario
+
+		if dados.SalaID == "" {
+			fmt.Printf("\n[SESSAO] Sessão retomada. Você não está em uma partida (%d cartas no inventário).\n> ", len(meuInventario))
+			return
+		}
+		if dados.SalaID != salaAtual {
+			salaAtual = dados.SalaID
+			topicoPartida := fmt.Sprintf("partidas/%s/eventos", salaAtual)
+			mqttClient.Subscribe(topicoPartida, 0, handleEventoPartida)
+		}
+		oponenteID = dados.OponenteID
+		oponenteNome = dados.OponenteNome
+
+		fmt.Printf("\n[SESSAO] Sessão retomada na partida contra '%s' (Sala: %s, estado: %s)\n", oponenteNome, salaAtual, dados.Estado)
+		if dados.Atualizacao == nil {
+			fmt.Print("> ")
+			return
+		}
+		atualizacao := dados.Atualizacao
+		if atualizacao.TurnoDe != "" {
+			turnoDeQuem = atualizacao.TurnoDe
+		}
+		fmt.Printf("--- RODADA %d ---\n", atualizacao.NumeroRodada)
+		if len(atualizacao.UltimaJogada) > 0 {
+			fmt.Println("Cartas na mesa:")
+			for nome, carta := range atualizacao.UltimaJogada {
+				fmt.Printf("  %s: %s %s (Poder: %d)\n", nome, carta.Nome, carta.Naipe, carta.Valor)
+			}
+		}
+		if len(atualizacao.PontosRodada) > 0 {
+			fmt.Println("Placar da rodada:")
+			for nome, pontos := range atualizacao.PontosRodada {
+				fmt.Printf("  %s: %d\n", nome, pontos)
+			}
+		}
+		if dados.Estado == "JOGANDO" {
+			if turnoDeQuem == meuID {
+				fmt.Println(">>> É A SUA VEZ DE JOGAR! <<<")
+			} else {
+				fmt.Printf("(Aguardando jogada de %s)\n", oponenteNome)
+			}
+		}
+		fmt.Print("> ")
+
+	case "REPLAY_PARTIDA":
+		var dados protocolo.DadosReplayPartida
+		json.Unmarshal(msg.Dados, &dados)
+		arquivo := fmt.Sprintf("replay_%s.jsonl", dados.SalaID)
+		if err := os.WriteFile(arquivo, []byte(dados.Conteudo), 0644); err != nil {
+			fmt.Printf("\n[ERRO] Não foi possível salvar o replay: %v\n> ", err)
+			return
+		}
+		fmt.Printf("\n[REPLAY] Replay da partida salvo em %s. Use /replay %s para assistir.\n> ", arquivo, arquivo)
+
 	case "AGUARDANDO_OPONENTE":
 		fmt.Printf("\n[MATCHMAKING] Aguardando oponente...\n> ")
 
+	case "STATUS_FILA":
+		var dados protocolo.DadosStatusFila
+		json.Unmarshal(msg.Dados, &dados)
+		estimativa := "sem estimativa"
+		if dados.EsperaEstimadaSegundos > 0 {
+			estimativa = fmt.Sprintf("espera média %ds", dados.EsperaEstimadaSegundos)
+		}
+		fmt.Printf("\n[MATCHMAKING] Posição %d de %d | esperando há %ds (%s) | %d servidor(es) na busca | janela de rating ±%d\n> ",
+			dados.Posicao, dados.Total, dados.EsperandoSegundos, estimativa, dados.ServidoresConsultados, dados.JanelaRating)
+
+	case "SALA_PRIVADA_CRIADA":
+		var dados protocolo.DadosSalaPrivada
+		json.Unmarshal(msg.Dados, &dados)
+		fmt.Printf("\n[SALA PRIVADA] Código: %s (válido por %d min). Seu oponente deve usar /entrar %s\n> ",
+			dados.Codigo, dados.ExpiraEmSegundos/60, dados.Codigo)
+
+	case "SALA_PRIVADA_EXPIRADA":
+		var dados protocolo.DadosSalaPrivada
+		json.Unmarshal(msg.Dados, &dados)
+		fmt.Printf("\n[SALA PRIVADA] O código %s expirou sem oponente. Use /privada para criar outro.\n> ", dados.Codigo)
+
+	case "SAIU_DA_FILA":
+		fmt.Printf("\n[MATCHMAKING] Você saiu da fila. Use /fila para procurar uma partida de novo.\n> ")
+
 	case "PARTIDA_ENCONTRADA":
 		var dados protocolo.DadosPartidaEncontrada
 		json.Unmarshal(msg.Dados, &dados)
+		// Deixa de ouvir a partida anterior, se o jogador voltou para a fila depois dela
+		if salaAtual != "" && salaAtual != dados.SalaID {
+			mqttClient.Unsubscribe(fmt.Sprintf("partidas/%s/eventos", salaAtual))
+		}
 		salaAtual = dados.SalaID
 		oponenteID = dados.OponenteID
 		oponenteNome = dados.OponenteNome
 
-		fmt.Printf("\n[PARTIDA] Partida encontrada contra '%s'! (Sala: %s)\n", oponenteNome, salaAtual)
+		if dados.SalaAnterior != "" {
+			fmt.Printf("\n[REVANCHE] Revanche contra '%s'! (Sala: %s)\n", oponenteNome, salaAtual)
+			mostrarSerie(dados.Serie)
+		} else {
+			fmt.Printf("\n[PARTIDA] Partida encontrada contra '%s'! (Sala: %s)\n", oponenteNome, salaAtual)
+		}
 		fmt.Println("Use /comprar para adquirir seu pacote inicial de cartas.")
+		if dados.SegundosParaComprar > 0 {
+			fmt.Printf("⏱  A sala é cancelada se os dois não comprarem em %d segundos (/cancelar para sair).\n", dados.SegundosParaComprar)
+		}
 
 		// Subscreve aos eventos da partida
 		topicoPartida := fmt.Sprintf("partidas/%s/eventos", salaAtual)
@@ -226,9 +418,39 @@ func processarMensagemServidor(msg protocolo.Mensagem) {
 			log.Printf("Erro ao se inscrever no tópico da partida: %v", token.Error())
 		}
 
+	case "TROCA_PROPOSTA":
+		var dados protocolo.DadosOfertaTroca
+		json.Unmarshal(msg.Dados, &dados)
+		ofertaTroca = dados.Oferta.OfertaID
+		oferta := dados.Oferta
+		ofertaForaDePartida = dados.ForaDePartida
+		parceiroTrocaNome = oferta.NomeJogadorOferta
+		if oferta.IDJogadorOferta == meuID {
+			parceiroTrocaNome = oferta.NomeJogadorDesejado
+			fmt.Printf("\n[TROCA] Proposta enviada: sua '%s' pela '%s' de %s. Aguardando resposta (%ds)...\n> ",
+				dados.CartaOferecida.Nome, dados.CartaDesejada.Nome, oferta.NomeJogadorDesejado, dados.ExpiraEmSegundos)
+			return
+		}
+		tipo := "propõe uma troca"
+		if dados.Contraproposta {
+			tipo = "fez uma contraproposta"
+		}
+		fmt.Printf("\n[TROCA] %s %s: a '%s' (%d%s, %s) dele pela sua '%s'.\n",
+			oferta.NomeJogadorOferta, tipo, dados.CartaOferecida.Nome, dados.CartaOferecida.Valor, dados.CartaOferecida.Naipe, dados.CartaOferecida.Raridade, dados.CartaDesejada.Nome)
+		fmt.Printf("[TROCA] Use /aceitar, /recusar ou /contraproposta em até %ds.\n> ", dados.ExpiraEmSegundos)
+
+	case "TROCA_ENCERRADA":
+		var resp protocolo.TrocarCartasResp
+		json.Unmarshal(msg.Dados, &resp)
+		if resp.OfertaID == ofertaTroca {
+			ofertaTroca = ""
+		}
+		fmt.Printf("\n[TROCA] %s\n> ", resp.Mensagem)
+
 	case "TROCA_CONCLUIDA":
 		var resp protocolo.TrocarCartasResp
 		json.Unmarshal(msg.Dados, &resp)
+		ofertaTroca = ""
 		fmt.Printf("\n[TROCA] %s\n", resp.Mensagem)
 		// Atualiza o inventário se fornecido
 		if len(resp.InventarioAtualizado) > 0 {
@@ -241,7 +463,8 @@ func processarMensagemServidor(msg protocolo.Mensagem) {
 	case "PACOTE_RESULTADO":
 		var dados protocolo.ComprarPacoteResp
 		json.Unmarshal(msg.Dados, &dados)
-		meuInventario = dados.Cartas
+		// O servidor soma o pacote ao inventário salvo na conta
+		meuInventario = append(meuInventario, dados.Cartas...)
 
 		fmt.Printf("\n╔═══════════════════════════════════════╗\n")
 		fmt.Printf("║   PACOTE RECEBIDO!                    ║\n")
@@ -260,6 +483,80 @@ func processarMensagemServidor(msg protocolo.Mensagem) {
 		json.Unmarshal(msg.Dados, &dados)
 		fmt.Printf("\n[SISTEMA] %s\n> ", dados.Mensagem)
 
+	case "JOGADOR_ENCONTRADO":
+		var dados protocolo.DadosJogador
+		json.Unmarshal(msg.Dados, &dados)
+		situacao := "disponível para trocas"
+		if dados.EmPartida {
+			situacao = "em partida"
+		}
+		fmt.Printf("\n[JOGADOR] %s (%s, %s) tem %d cartas:\n", dados.Nome, dados.Servidor, situacao, len(dados.Inventario))
+		for i, carta := range dados.Inventario {
+			fmt.Printf("%2d. %-15s %s - Poder: %3d (Raridade: %s)\n", i+1, carta.Nome, carta.Naipe, carta.Valor, carta.Raridade)
+			fmt.Printf("    ID: %s\n", carta.ID)
+		}
+		fmt.Printf("Use /ofertar %s para propor uma troca.\n> ", dados.Nome)
+
+	case "MERCADO_ANUNCIOS":
+		var dados protocolo.DadosMercado
+		json.Unmarshal(msg.Dados, &dados)
+		fmt.Printf("\n[MERCADO] %d anúncios encontrados (seu saldo: %d moedas):\n", len(dados.Anuncios), dados.Moedas)
+		mostrarAnuncios(dados.Anuncios)
+		fmt.Print("Use /comprarcarta <ID_do_anúncio> para comprar.\n> ")
+
+	case "SALDO":
+		var dados protocolo.DadosMercado
+		json.Unmarshal(msg.Dados, &dados)
+		fmt.Printf("\n🪙 Saldo: %d moedas\n", dados.Moedas)
+		if len(dados.Anuncios) > 0 {
+			fmt.Println("Seus anúncios ativos:")
+			mostrarAnuncios(dados.Anuncios)
+		}
+		fmt.Print("> ")
+
+	case "MERCADO_RESULTADO":
+		var dados protocolo.DadosResultadoMercado
+		json.Unmarshal(msg.Dados, &dados)
+		carta := dados.Anuncio.Carta
+		switch dados.Operacao {
+		case "anunciada":
+			fmt.Printf("\n[MERCADO] %s anunciada por %d moedas (anúncio %s).\n", carta.Nome, dados.Anuncio.Preco, dados.Anuncio.ID)
+		case "comprada":
+			fmt.Printf("\n[MERCADO] Você comprou %s de %s por %d moedas.\n", carta.Nome, dados.Anuncio.VendedorNome, dados.Anuncio.Preco)
+		case "vendida":
+			fmt.Printf("\n[MERCADO] Sua carta %s foi vendida por %d moedas.\n", carta.Nome, dados.Anuncio.Preco)
+		case "cancelada":
+			fmt.Printf("\n[MERCADO] Anúncio de %s retirado; a carta voltou para o seu inventário.\n", carta.Nome)
+		}
+		if dados.Operacao != "vendida" {
+			meuInventario = dados.Inventario
+		}
+		fmt.Printf("🪙 Saldo: %d moedas\n> ", dados.Moedas)
+
+	case "RAZAO_HISTORICO":
+		var dados protocolo.DadosRazao
+		json.Unmarshal(msg.Dados, &dados)
+		if dados.CartaID != "" {
+			fmt.Printf("\n[ORIGEM] Carta %s: %d movimentos\n", dados.CartaID, len(dados.Movimentos))
+		} else {
+			fmt.Printf("\n[MOVIMENTOS] Suas últimas %d transferências de cartas:\n", len(dados.Movimentos))
+		}
+		for _, m := range dados.Movimentos {
+			de, para := m.DeNome, m.ParaNome
+			if de == "" {
+				de = "-"
+			}
+			if para == "" {
+				para = "-"
+			}
+			fmt.Printf("  %s  %-9s %-15s %s -> %s", m.Em.Local().Format("02/01 15:04:05"), m.Tipo, m.Carta.Nome, de, para)
+			if m.Referencia != "" {
+				fmt.Printf(" (%s)", m.Referencia)
+			}
+			fmt.Println()
+		}
+		fmt.Print("> ")
+
 	case "ERRO", "ERRO_JOGADA":
 		var dados protocolo.DadosErro
 		json.Unmarshal(msg.Dados, &dados)
@@ -325,7 +622,45 @@ func processarMensagemServidor(msg protocolo.Mensagem) {
 		if turnoDeQuem == meuID {
 			quemJoga = "Você"
 		}
-		fmt.Printf("(Aguardando jogada de %s)\n-------------------\n> ", quemJoga)
+		fmt.Printf("(Aguardando jogada de %s)\n", quemJoga)
+		mostrarPrazoTurno(dados.SegundosRestantes)
+		fmt.Print("-------------------\n> ")
+
+	case "PARTIDA_CANCELADA":
+		var dados protocolo.DadosPartidaCancelada
+		json.Unmarshal(msg.Dados, &dados)
+		if dados.SalaID == salaAtual {
+			mqttClient.Unsubscribe(fmt.Sprintf("partidas/%s/eventos", salaAtual))
+			salaAtual = ""
+			oponenteID = ""
+			oponenteNome = ""
+			turnoDeQuem = ""
+		}
+		motivo := "um jogador saiu da sala"
+		if dados.Motivo == "prazo_compra_esgotado" {
+			motivo = "o prazo para comprar o pacote esgotou"
+		}
+		fmt.Printf("\n[PARTIDA] Sala cancelada: %s.\n", motivo)
+		if dados.Reenfileirado {
+			fmt.Println("Você voltou para a fila de matchmaking.")
+		}
+		fmt.Print("> ")
+
+	case "REVANCHE_PEDIDA":
+		var dados protocolo.DadosRevanchePedida
+		json.Unmarshal(msg.Dados, &dados)
+		fmt.Printf("\n[REVANCHE] %s quer uma revanche! Use /revanche para aceitar ou /fila para procurar outro oponente.\n> ", dados.Nome)
+
+	case "JOGADA_AUTOMATICA":
+		var dados protocolo.DadosJogadaAutomatica
+		json.Unmarshal(msg.Dados, &dados)
+		removerCartaDoInventario(dados.Carta.ID)
+		fmt.Printf("\n[TEMPO] Seu tempo acabou! A carta %s %s (Poder: %d) foi jogada automaticamente.\n> ", dados.Carta.Nome, dados.Carta.Naipe, dados.Carta.Valor)
+
+	case "FIM_DE_JOGO":
+		var dados protocolo.DadosFimDeJogo
+		json.Unmarshal(msg.Dados, &dados)
+		mostrarFimDeJogo(dados)
 
 	default:
 		// Comando não reconhecido, ignora
@@ -387,6 +722,7 @@ func handleEventoPartida(client mqtt.Client, msg mqtt.Message) {
 		} else {
 			fmt.Printf("\n(Aguardando jogada de %s)\n", oponenteNome)
 		}
+		mostrarPrazoTurno(dados.SegundosRestantes)
 
 		fmt.Println("-------------------")
 		fmt.Print("> ")
@@ -394,15 +730,23 @@ func handleEventoPartida(client mqtt.Client, msg mqtt.Message) {
 	case "FIM_DE_JOGO":
 		var dados protocolo.DadosFimDeJogo
 		json.Unmarshal(mensagem.Dados, &dados)
+		mostrarFimDeJogo(dados)
 
-		fmt.Printf("\n╔═══════════════════════════════════════╗\n")
-		if dados.VencedorNome == "EMPATE" {
-			fmt.Printf("║   FIM DE JOGO - EMPATE!               ║\n")
+	case "FAILOVER_PARTIDA":
+		var dados protocolo.DadosFailoverPartida
+		json.Unmarshal(mensagem.Dados, &dados)
+
+		if dados.TurnoDe != "" {
+			turnoDeQuem = dados.TurnoDe
+		}
+
+		fmt.Printf("\n[FAILOVER] %s\n", dados.Mensagem)
+		fmt.Printf("A partida segue no servidor %s (rodada %d).\n", dados.NovoHost, dados.NumeroRodada)
+		if turnoDeQuem == meuID {
+			fmt.Println(">>> É A SUA VEZ DE JOGAR! <<<")
 		} else {
-			fmt.Printf("║   FIM DE JOGO!                        ║\n")
-			fmt.Printf("║   Vencedor: %-25s ║\n", dados.VencedorNome)
+			fmt.Printf("(Aguardando jogada de %s)\n", oponenteNome)
 		}
-		fmt.Printf("╚═══════════════════════════════════════╝\n")
 		fmt.Print("> ")
 
 	case "ERRO_JOGADA":
@@ -437,6 +781,61 @@ func handleEventoPartida(client mqtt.Client, msg mqtt.Message) {
 	}
 }
 
+// mostrarPrazoTurno mostra quanto tempo resta para o jogador da vez
+func mostrarPrazoTurno(segundos int) {
+	if segundos <= 0 {
+		return
+	}
+	if turnoDeQuem == meuID {
+		fmt.Printf("⏱  Você tem %d segundos para jogar.\n", segundos)
+	} else {
+		fmt.Printf("⏱  %s tem %d segundos para jogar.\n", oponenteNome, segundos)
+	}
+}
+
+// mostrarSerie mostra o placar da série de revanches, se houver
+func mostrarSerie(serie map[string]int) {
+	if len(serie) == 0 {
+		return
+	}
+	nomes := make([]string, 0, len(serie))
+	for nome := range serie {
+		nomes = append(nomes, nome)
+	}
+	sort.Strings(nomes)
+	placar := make([]string, 0, len(nomes))
+	for _, nome := range nomes {
+		placar = append(placar, fmt.Sprintf("%s %d", nome, serie[nome]))
+	}
+	fmt.Printf("🏆 Placar da série: %s\n", strings.Join(placar, " x "))
+}
+
+func mostrarFimDeJogo(dados protocolo.DadosFimDeJogo) {
+	fmt.Printf("\n╔═══════════════════════════════════════╗\n")
+	if dados.VencedorNome == "EMPATE" {
+		fmt.Printf("║   FIM DE JOGO - EMPATE!               ║\n")
+	} else {
+		fmt.Printf("║   FIM DE JOGO!                        ║\n")
+		fmt.Printf("║   Vencedor: %-25s ║\n", dados.VencedorNome)
+	}
+	fmt.Printf("╚═══════════════════════════════════════╝\n")
+	switch dados.Motivo {
+	case partida.MOTIVO_TEMPO_ESGOTADO:
+		fmt.Printf("Motivo: o tempo de turno de %s esgotou (W.O.).\n", dados.DesistenteNome)
+	case partida.MOTIVO_ABANDONO:
+		fmt.Printf("Motivo: %s abandonou a partida.\n", dados.DesistenteNome)
+	}
+	mostrarSerie(dados.Serie)
+	if rating, ok := dados.Ratings[meuNome]; ok {
+		fmt.Printf("📈 Seu novo rating: %d\n", rating)
+	}
+	if moedas, ok := dados.Moedas[meuNome]; ok {
+		fmt.Printf("🪙 Moedas ganhas: %d\n", moedas)
+	}
+	fmt.Println("Use /revanche para jogar de novo contra o mesmo oponente, /fila para procurar uma nova partida ou /replay para baixar esta.")
+	fmt.Print("> ")
+}
+
 func processarComando(entrada string) {
 	partes := strings.Fields(entrada)
 	if len(partes) == 0 {
@@ -468,6 +867,93 @@ func processarComando(entrada string) {
 		os.Exit(0)
 	case "/trocar":
 		iniciarProcessoDeTroca()
+	case "/jogador":
+		if len(partes) < 2 {
+			fmt.Println("[ERRO] Uso: /jogador <nome>")
+			return
+		}
+		buscarJogador(partes[1])
+	case "/ofertar":
+		if len(partes) < 2 {
+			fmt.Println("[ERRO] Uso: /ofertar <nome>")
+			return
+		}
+		ofertarTroca(partes[1])
+	case "/saldo":
+		enviarComandoMercado("MERCADO_SALDO", protocolo.MercadoReq{})
+	case "/mercado":
+		req, ok := lerFiltrosMercado(partes[1:])
+		if !ok {
+			fmt.Println("[ERRO] Uso: /mercado [raridade=<C|U|R|L>] [nome=<trecho>] [min=<poder>] [max=<poder>]")
+			return
+		}
+		enviarComandoMercado("MERCADO_LISTAR", req)
+	case "/vender":
+		preco := 0
+		if len(partes) == 3 {
+			preco, _ = strconv.Atoi(partes[2])
+		}
+		if preco <= 0 {
+			fmt.Println("[ERRO] Uso: /vender <ID_da_carta> <preço>")
+			return
+		}
+		enviarComandoMercado("MERCADO_ANUNCIAR", protocolo.MercadoReq{CartaID: partes[1], Preco: preco})
+	case "/comprarcarta":
+		if len(partes) < 2 {
+			fmt.Println("[ERRO] Uso: /comprarcarta <ID_do_anúncio>")
+			return
+		}
+		enviarComandoMercado("MERCADO_COMPRAR", protocolo.MercadoReq{AnuncioID: partes[1]})
+	case "/retirar":
+		if len(partes) < 2 {
+			fmt.Println("[ERRO] Uso: /retirar <ID_do_anúncio>")
+			return
+		}
+		enviarComandoMercado("MERCADO_CANCELAR", protocolo.MercadoReq{AnuncioID: partes[1]})
+	case "/origem":
+		if len(partes) < 2 {
+			fmt.Println("[ERRO] Uso: /origem <ID_da_carta>")
+			return
+		}
+		consultarRazao(partes[1])
+	case "/movimentos":
+		consultarRazao("")
+	case "/contraproposta":
+		fazerContraproposta()
+	case "/aceitar":
+		responderTroca("TROCA_ACEITAR")
+	case "/recusar":
+		responderTroca("TROCA_RECUSAR")
+	case "/cancelar":
+		cancelarPartida()
+	case "/fila":
+		fmt.Println("Entrando na fila de matchmaking...")
+		entrarNaFila()
+	case "/sairfila":
+		sairDaFila()
+	case "/privada":
+		criarSalaPrivada()
+	case "/entrar":
+		if len(partes) < 2 {
+			fmt.Println("[ERRO] Uso: /entrar <código>")
+			return
+		}
+		entrarSalaPrivada(partes[1])
+	case "/revanche":
+		pedirRevanche()
+	case "/reconectar":
+		if len(partes) < 2 {
+			fmt.Println("[ERRO] Uso: /reconectar <1|2|3>")
+			return
+		}
+		opcao, _ := strconv.Atoi(partes[1])
+		trocarDeServidor(opcao)
+	case "/replay":
+		if len(partes) < 2 {
+			solicitarReplay()
+		} else {
+			assistirReplay(partes[1])
+		}
 	default:
 		// Se não for um comando, envia como chat
 		if salaAtual != "" {
@@ -486,8 +972,9 @@ func comprarPacote() {
 
 	dados := map[string]string{"cliente_id": meuID}
 	mensagem := protocolo.Mensagem{
-		Comando: "COMPRAR_PACOTE",
-		Dados:   mustJSON(dados),
+		Comando:     "COMPRAR_PACOTE",
+		Dados:       mustJSON(dados),
+		TokenSessao: tokenSessao,
 	}
 
 	payload, _ := json.Marshal(mensagem)
@@ -531,8 +1018,9 @@ func jogarCarta(cartaID string) {
 		"carta_id":   cartaID,
 	}
 	mensagem := protocolo.Mensagem{
-		Comando: "JOGAR_CARTA",
-		Dados:   mustJSON(dados),
+		Comando:     "JOGAR_CARTA",
+		Dados:       mustJSON(dados),
+		TokenSessao: tokenSessao,
 	}
 
 	payload, _ := json.Marshal(mensagem)
@@ -566,8 +1054,9 @@ func enviarChat(texto string) {
 	}
 	dados := protocolo.DadosEnviarChat{ClienteID: meuID, Texto: texto}
 	msg := protocolo.Mensagem{
-		Comando: "CHAT",
-		Dados:   mustJSON(dados),
+		Comando:     "CHAT",
+		Dados:       mustJSON(dados),
+		TokenSessao: tokenSessao,
 	}
 
 	payload, _ := json.Marshal(msg)
@@ -601,6 +1090,27 @@ func mostrarAjuda() {
 	fmt.Println("  /comprar               - Compra um novo pacote de cartas")
 	fmt.Println("  /jogar <ID_da_carta>   - Joga uma carta da sua mão")
 	fmt.Println("  /trocar                - Propõe uma troca de cartas com o oponente")
+	fmt.Println("  /aceitar               - Aceita a proposta de troca recebida")
+	fmt.Println("  /recusar               - Recusa a proposta recebida (ou cancela a sua)")
+	fmt.Println("  /contraproposta        - Responde à proposta recebida com outras cartas")
+	fmt.Println("  /jogador <nome>        - Mostra as cartas de um jogador conectado ao cluster")
+	fmt.Println("  /ofertar <nome>        - Propõe uma troca a um jogador, fora de partida")
+	fmt.Println("  /saldo                 - Mostra suas moedas e seus anúncios no mercado")
+	fmt.Println("  /mercado [filtros]     - Lista as cartas à venda (raridade=, nome=, min=, max=)")
+	fmt.Println("  /vender <ID> <preço>   - Anuncia uma carta no mercado")
+	fmt.Println("  /comprarcarta <ID>     - Compra um anúncio do mercado")
+	fmt.Println("  /retirar <ID>          - Retira o seu anúncio e recebe a carta de volta")
+	fmt.Println("  /origem <ID_da_carta>  - Mostra todos os donos de uma carta")
+	fmt.Println("  /movimentos            - Mostra as cartas que você recebeu ou entregou")
+	fmt.Println("  /replay                - Baixa o replay da última partida (.jsonl)")
+	fmt.Println("  /replay <arquivo>      - Assiste um replay salvo, jogada a jogada")
+	fmt.Println("  /cancelar              - Sai da sala (antes do início) ou abandona a partida")
+	fmt.Println("  /fila                  - Volta para a fila depois de uma partida")
+	fmt.Println("  /sairfila              - Sai da fila de matchmaking")
+	fmt.Println("  /privada               - Cria uma sala privada e mostra o código de convite")
+	fmt.Println("  /entrar <código>       - Entra na sala privada de outro jogador")
+	fmt.Println("  /revanche              - Pede (ou aceita) uma revanche contra o mesmo oponente")
+	fmt.Println("  /reconectar <n>        - Troca para o servidor n e retoma a sessão")
 	fmt.Println("  /ajuda                 - Mostra esta lista de comandos")
 	fmt.Println("  /sair                  - Sai do jogo")
 	fmt.Println("  Qualquer outro texto será enviado como chat.")
@@ -616,38 +1126,122 @@ func iniciarProcessoDeTroca() {
 		return
 	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-
 	fmt.Println("\n--- Propor Troca de Cartas ---")
+	req, ok := lerCartasDaTroca(oponenteID, oponenteNome)
+	if !ok {
+		return
+	}
+
+	fmt.Printf("Enviando proposta de troca para %s...\n", oponenteNome)
+	enviarComandoTroca("TROCAR_CARTAS_OFERTA", req)
+}
+
+// buscarJogador pede as cartas de um jogador do cluster; a resposta chega como JOGADOR_ENCONTRADO
+func buscarJogador(nome string) {
+	dados := map[string]string{"cliente_id": meuID, "nome": nome, "token_sessao": tokenSessao}
+	payload, _ := json.Marshal(dados)
+
+	topico := fmt.Sprintf("clientes/%s/buscar_jogador", meuID)
+	token := mqttClient.Publish(topico, 0, false, payload)
+	token.Wait()
+}
+
+// ofertarTroca propõe uma troca a um jogador que não está em partida, em qualquer
+// servidor. O servidor encontra o jogador pelo nome; use /jogador para ver as cartas dele.
+func ofertarTroca(nome string) {
+	if salaAtual != "" {
+		fmt.Println("Você está em uma partida. Use /trocar para trocar com o oponente.")
+		return
+	}
+
+	fmt.Printf("\n--- Propor Troca de Cartas a %s ---\n", nome)
+	req, ok := lerCartasDaTroca("", nome)
+	if !ok {
+		return
+	}
+
+	fmt.Printf("Enviando proposta de troca para %s...\n", nome)
+	enviarComandoTrocaForaDePartida("TROCAR_CARTAS_OFERTA", req)
+}
+
+// fazerContraproposta substitui a proposta recebida por outra; o oponente passa a
+// ser quem precisa responder
+func fazerContraproposta() {
+	if ofertaTroca == "" {
+		fmt.Println("Não há proposta de troca pendente.")
+		return
+	}
+
+	fmt.Println("\n--- Contraproposta de Troca ---")
+	if ofertaForaDePartida {
+		req, ok := lerCartasDaTroca("", parceiroTrocaNome)
+		if !ok {
+			return
+		}
+		req.OfertaID = ofertaTroca
+
+		fmt.Printf("Enviando contraproposta para %s...\n", parceiroTrocaNome)
+		enviarComandoTrocaForaDePartida("TROCA_CONTRAPROPOSTA", req)
+		return
+	}
+	req, ok := lerCartasDaTroca(oponenteID, oponenteNome)
+	if !ok {
+		return
+	}
+	req.OfertaID = ofertaTroca
+
+	fmt.Printf("Enviando contraproposta para %s...\n", oponenteNome)
+	enviarComandoTroca("TROCA_CONTRAPROPOSTA", req)
+}
+
+// responderTroca aceita ou recusa a proposta pendente. A troca só acontece no
+// servidor depois do aceite; o resultado chega como TROCA_CONCLUIDA ou TROCA_ENCERRADA.
+func responderTroca(comando string) {
+	if ofertaTroca == "" || (salaAtual == "" && !ofertaForaDePartida) {
+		fmt.Println("Não há proposta de troca pendente.")
+		return
+	}
+	req := protocolo.TrocarCartasReq{OfertaID: ofertaTroca, ClienteID: meuID}
+	if ofertaForaDePartida {
+		enviarComandoTrocaForaDePartida(comando, req)
+		return
+	}
+	enviarComandoTroca(comando, req)
+}
+
+// lerCartasDaTroca pergunta as cartas de uma proposta para o outro jogador
+func lerCartasDaTroca(parceiroID, parceiroNome string) (protocolo.TrocarCartasReq, bool) {
+	scanner := bufio.NewScanner(os.Stdin)
 	mostrarCartas()
 
 	fmt.Print("Digite o ID da carta que você quer OFERECER: ")
 	scanner.Scan()
 	cartaOferecidaID := strings.TrimSpace(scanner.Text())
 
-	fmt.Print("Digite o ID da carta do oponente que você quer RECEBER: ")
+	fmt.Printf("Digite o ID da carta de %s que você quer RECEBER: ", parceiroNome)
 	scanner.Scan()
 	cartaDesejadaID := strings.TrimSpace(scanner.Text())
 
 	if cartaOferecidaID == "" || cartaDesejadaID == "" {
 		fmt.Println("IDs das cartas não podem ser vazios. Abortando troca.")
-		return
+		return protocolo.TrocarCartasReq{}, false
 	}
 
-	fmt.Printf("Enviando proposta de troca para %s...\n", oponenteNome)
-
-	req := protocolo.TrocarCartasReq{
+	return protocolo.TrocarCartasReq{
 		IDJogadorOferta:     meuID,
 		NomeJogadorOferta:   meuNome,
-		IDJogadorDesejado:   oponenteID,
-		NomeJogadorDesejado: oponenteNome,
+		IDJogadorDesejado:   parceiroID,
+		NomeJogadorDesejado: parceiroNome,
 		IDCartaOferecida:    cartaOferecidaID,
 		IDCartaDesejada:     cartaDesejadaID,
-	}
+	}, true
+}
 
+func enviarComandoTroca(comando string, req protocolo.TrocarCartasReq) {
 	msg := protocolo.Mensagem{
-		Comando: "TROCAR_CARTAS_OFERTA",
-		Dados:   mustJSON(req),
+		Comando:     comando,
+		Dados:       mustJSON(req),
+		TokenSessao: tokenSessao,
 	}
 
 	payload, _ := json.Marshal(msg)
@@ -655,6 +1249,215 @@ func iniciarProcessoDeTroca() {
 	mqttClient.Publish(topico, 0, false, payload)
 }
 
+// enviarComandoTrocaForaDePartida envia o comando pelo tópico do jogador; o servidor o
+// repassa ao servidor que coordena a proposta
+func enviarComandoTrocaForaDePartida(comando string, req protocolo.TrocarCartasReq) {
+	msg := protocolo.Mensagem{
+		Comando:     comando,
+		Dados:       mustJSON(req),
+		TokenSessao: tokenSessao,
+	}
+
+	payload, _ := json.Marshal(msg)
+	topico := fmt.Sprintf("clientes/%s/troca", meuID)
+	mqttClient.Publish(topico, 0, false, payload)
+}
+
+// enviarComandoMercado envia um comando do mercado pelo tópico do jogador; a resposta
+// chega como MERCADO_ANUNCIOS, SALDO ou MERCADO_RESULTADO
+func enviarComandoMercado(comando string, req protocolo.MercadoReq) {
+	msg := protocolo.Mensagem{
+		Comando:     comando,
+		Dados:       mustJSON(req),
+		TokenSessao: tokenSessao,
+	}
+
+	payload, _ := json.Marshal(msg)
+	topico := fmt.Sprintf("clientes/%s/mercado", meuID)
+	mqttClient.Publish(topico, 0, false, payload)
+}
+
+// consultarRazao pede ao servidor a história de uma carta (ou, sem carta, os
+// movimentos do jogador); a resposta chega como RAZAO_HISTORICO
+func consultarRazao(cartaID string) {
+	payload, _ := json.Marshal(map[string]string{"carta_id": cartaID, "token_sessao": tokenSessao})
+	topico := fmt.Sprintf("clientes/%s/razao", meuID)
+	mqttClient.Publish(topico, 0, false, payload)
+}
+
+// lerFiltrosMercado interpreta os filtros de /mercado no formato chave=valor
+func lerFiltrosMercado(args []string) (protocolo.MercadoReq, bool) {
+	var req protocolo.MercadoReq
+	for _, arg := range args {
+		chave, valor, ok := strings.Cut(arg, "=")
+		if !ok || valor == "" {
+			return req, false
+		}
+		switch strings.ToLower(chave) {
+		case "raridade":
+			req.Raridade = strings.ToUpper(valor)
+		case "nome":
+			req.Nome = valor
+		case "min":
+			req.ValorMin, _ = strconv.Atoi(valor)
+		case "max":
+			req.ValorMax, _ = strconv.Atoi(valor)
+		default:
+			return req, false
+		}
+	}
+	return req, true
+}
+
+func mostrarAnuncios(anuncios []protocolo.AnuncioMercado) {
+	for i, a := range anuncios {
+		fmt.Printf("%2d. %-15s %s - Poder: %3d (Raridade: %s) por %d moedas, de %s\n",
+			i+1, a.Carta.Nome, a.Carta.Naipe, a.Carta.Valor, a.Carta.Raridade, a.Preco, a.VendedorNome)
+		fmt.Printf("    Anúncio: %s\n", a.ID)
+	}
+}
+
+// cancelarPartida pede para sair da sala atual; a resposta chega como
+// PARTIDA_CANCELADA (lobby) ou FIM_DE_JOGO (partida em andamento)
+func cancelarPartida() {
+	if salaAtual == "" {
+		fmt.Println("[ERRO] Você não está em uma partida.")
+		return
+	}
+
+	mensagem := protocolo.Mensagem{
+		Comando:     "CANCELAR_PARTIDA",
+		Dados:       mustJSON(map[string]string{"cliente_id": meuID}),
+		TokenSessao: tokenSessao,
+	}
+	payload, _ := json.Marshal(mensagem)
+	topico := fmt.Sprintf("partidas/%s/comandos", salaAtual)
+	token := mqttClient.Publish(topico, 0, false, payload)
+	token.Wait()
+
+	fmt.Println("[INFO] Saindo da sala...")
+}
+
+// pedirRevanche pede para jogar de novo contra o mesmo oponente depois do fim da
+// partida; quando os dois pedem, a nova sala chega como PARTIDA_ENCONTRADA
+func pedirRevanche() {
+	if salaAtual == "" {
+		fmt.Println("[ERRO] Você não jogou nenhuma partida ainda.")
+		return
+	}
+
+	mensagem := protocolo.Mensagem{
+		Comando:     "REVANCHE",
+		Dados:       mustJSON(map[string]string{"cliente_id": meuID}),
+		TokenSessao: tokenSessao,
+	}
+	payload, _ := json.Marshal(mensagem)
+	topico := fmt.Sprintf("partidas/%s/comandos", salaAtual)
+	token := mqttClient.Publish(topico, 0, false, payload)
+	token.Wait()
+
+	fmt.Printf("[INFO] Revanche pedida. Aguardando %s...\n", oponenteNome)
+}
+
+// solicitarReplay pede ao servidor o log da última partida; a resposta chega como REPLAY_PARTIDA
+func solicitarReplay() {
+	if salaAtual == "" {
+		fmt.Println("[ERRO] Nenhuma partida para exportar.")
+		return
+	}
+
+	mensagem := protocolo.Mensagem{
+		Comando:     "EXPORTAR_REPLAY",
+		Dados:       mustJSON(map[string]string{"cliente_id": meuID}),
+		TokenSessao: tokenSessao,
+	}
+	payload, _ := json.Marshal(mensagem)
+	topico := fmt.Sprintf("partidas/%s/comandos", salaAtual)
+	token := mqttClient.Publish(topico, 0, false, payload)
+	token.Wait()
+
+	fmt.Println("[INFO] Replay solicitado ao servidor...")
+}
+
+// assistirReplay reaplica o log do arquivo evento a evento com o mesmo redutor do
+// servidor, mostrando a mesa e os placares após cada um.
+func assistirReplay(caminho string) {
+	f, err := os.Open(caminho)
+	if err != nil {
+		fmt.Printf("[ERRO] Não foi possível abrir %s: %v\n", caminho, err)
+		return
+	}
+	replay, err := partida.LerReplay(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("[ERRO] %v\n", err)
+		return
+	}
+
+	estado := partida.NovaMesa(replay.Cabecalho.SalaID, replay.Cabecalho.Jogadores)
+	nomes := make(map[string]string)
+	for _, j := range replay.Cabecalho.Jogadores {
+		nomes[j.ID] = j.Nome
+	}
+
+	fmt.Printf("\n=== REPLAY DA PARTIDA %s (%d eventos) ===\n", replay.Cabecalho.SalaID, len(replay.Eventos))
+	fmt.Println("Enter avança um evento, 'q' encerra o replay.")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for _, ev := range replay.Eventos {
+		// Guarda a mesa antes de aplicar: quando a jogada fecha a mesa, ela é limpa
+		mesa := make(map[string]protocolo.Carta)
+		for nome, carta := range estado.CartasNaMesa {
+			mesa[nome] = carta
+		}
+
+		vencedorJogada, err := partida.Aplicar(estado, ev)
+		if err != nil {
+			fmt.Printf("[ERRO] Evento %d inválido: %v. Replay interrompido.\n", ev.EventSeq, err)
+			return
+		}
+		if vencedorJogada == "" {
+			mesa = estado.CartasNaMesa
+		} else {
+			var dados partida.DadosCartaJogada
+			bruto, _ := json.Marshal(ev.Data)
+			json.Unmarshal(bruto, &dados)
+			mesa[nomes[ev.PlayerID]] = dados.Carta
+		}
+
+		fmt.Printf("\n[#%d %s] %s - %s\n", ev.EventSeq, ev.Timestamp.Format("15:04:05"), ev.EventType, nomes[ev.PlayerID])
+		fmt.Printf("Rodada %d | Estado: %s", estado.NumeroRodada, estado.Estado)
+		if estado.TurnoDe != "" && estado.Estado == "JOGANDO" {
+			fmt.Printf(" | Vez de: %s", nomes[estado.TurnoDe])
+		}
+		fmt.Println()
+
+		if len(mesa) > 0 {
+			fmt.Println("Cartas na mesa:")
+			for nome, carta := range mesa {
+				fmt.Printf("  %s: %s %s (Poder: %d)\n", nome, carta.Nome, carta.Naipe, carta.Valor)
+			}
+		}
+		if vencedorJogada != "" {
+			fmt.Printf("🏆 Vencedor da jogada: %s\n", vencedorJogada)
+		}
+		fmt.Printf("Pontos da rodada: %v | Pontos da partida: %v\n", estado.PontosRodada, estado.PontosPartida)
+
+		fmt.Print("[Enter] ")
+		if !scanner.Scan() || strings.TrimSpace(scanner.Text()) == "q" {
+			fmt.Println("Replay encerrado.")
+			return
+		}
+	}
+
+	fmt.Printf("\n=== FIM DO REPLAY - Vencedor: %s ===\n", partida.Vencedor(estado))
+	if partida.Hash(estado) == replay.Cabecalho.Hash {
+		fmt.Println("O estado reconstruído confere com o estado final do servidor.")
+	} else {
+		fmt.Println("[AVISO] O estado reconstruído NÃO confere com o hash exportado pelo servidor.")
+	}
+}
+
 func mustJSON(v interface{}) []byte {
 	b, _ := json.Marshal(v)
 	return b
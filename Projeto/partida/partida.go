@@ -0,0 +1,327 @@
+// Package partida tem o log de eventos de uma partida, o redutor que deriva o estado
+// da mesa a partir dele e o formato de replay. É compartilhado pelo servidor (que
+// aplica os eventos na Sala) e pelo cliente (que assiste ao replay).
+package partida
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"jogodistribuido/protocolo"
+	"time"
+)
+
+// Tipos de evento do log da partida. O estado de uma partida é o resultado de aplicar,
+// em ordem de EventSeq, todos os eventos do seu log a uma mesa nova.
+const (
+	EVENTO_JOGADOR_PRONTO   = "PLAYER_READY"   // Jogador comprou o pacote inicial
+	EVENTO_PARTIDA_INICIADA = "MATCH_STARTED"  // Dados: DadosPartidaIniciada
+	EVENTO_CARTA_JOGADA     = "CARD_PLAYED"    // Dados: DadosCartaJogada
+	EVENTO_CHAT             = "CHAT"           // Não altera o estado
+	EVENTO_DESISTENCIA      = "PLAYER_FORFEIT" // Dados: DadosDesistencia
+)
+
+// Motivos de fim de partida enviados em FIM_DE_JOGO
+const (
+	MOTIVO_CARTAS_ESGOTADAS = "cartas_esgotadas" // Todos jogaram todas as cartas
+	MOTIVO_TEMPO_ESGOTADO   = "tempo_esgotado"   // O jogador da vez deixou o prazo do turno esgotar
+	MOTIVO_ABANDONO         = "abandono"         // O jogador saiu da partida (CANCELAR_PARTIDA)
+)
+
+// DadosPartidaIniciada registra o sorteio do primeiro jogador.
+type DadosPartidaIniciada struct {
+	TurnoDe string `json:"turno_de"`
+}
+
+// DadosCartaJogada leva a carta completa (o Host pode não ter o inventário do
+// jogador) e a decisão do Host de encerrar a partida quando esta jogada fecha a
+// mesa e ninguém tem mais cartas.
+type DadosCartaJogada struct {
+	Carta          protocolo.Carta `json:"carta"`
+	EncerraPartida bool            `json:"encerra_partida,omitempty"`
+	Automatica     bool            `json:"automatica,omitempty"` // Jogada feita pelo Host quando o prazo do turno esgotou
+}
+
+// DadosDesistencia encerra a partida com derrota de quem gerou o evento.
+type DadosDesistencia struct {
+	Motivo string `json:"motivo"`
+}
+
+// Evento é uma entrada do log da partida
+type Evento struct {
+	EventSeq  int64       `json:"eventSeq"`  // Número sequencial do evento
+	MatchID   string      `json:"matchId"`   // ID da partida
+	Timestamp time.Time   `json:"timestamp"` // Quando o evento ocorreu
+	EventType string      `json:"eventType"` // Tipo do evento (CARD_PLAYED, ROUND_END, etc.)
+	PlayerID  string      `json:"playerId"`  // ID do jogador que gerou o evento
+	Data      interface{} `json:"data"`      // Dados específicos do evento
+	Signature string      `json:"signature"` // Assinatura HMAC do evento
+}
+
+// Jogador é o que o redutor precisa de cada jogador: o log usa o ID e o estado usa o nome.
+type Jogador struct {
+	ID   string `json:"id"`
+	Nome string `json:"nome"`
+}
+
+// Mesa é o estado da partida que o log determina. Os mapas são indexados pelo nome do jogador.
+type Mesa struct {
+	SalaID        string
+	Jogadores     []Jogador
+	Estado        string // "AGUARDANDO_COMPRA" | "JOGANDO" | "FINALIZADO"
+	CartasNaMesa  map[string]protocolo.Carta
+	PontosRodada  map[string]int
+	PontosPartida map[string]int
+	NumeroRodada  int
+	Prontos       map[string]bool
+	TurnoDe       string // ID do jogador que deve jogar
+	Desistente    string // ID de quem perdeu por desistência (PLAYER_FORFEIT)
+	MotivoFim     string // Motivo do fim registrado no log (vazio quando as cartas acabam)
+	EventSeq      int64
+}
+
+// NovaMesa cria uma mesa no estado inicial, antes de qualquer evento.
+func NovaMesa(salaID string, jogadores []Jogador) *Mesa {
+	return &Mesa{
+		SalaID:        salaID,
+		Jogadores:     jogadores,
+		Estado:        "AGUARDANDO_COMPRA",
+		CartasNaMesa:  make(map[string]protocolo.Carta),
+		PontosRodada:  make(map[string]int),
+		PontosPartida: make(map[string]int),
+		NumeroRodada:  1,
+		Prontos:       make(map[string]bool),
+	}
+}
+
+// Aplicar é o redutor da partida: aplica um evento à mesa. Não guarda o evento nem
+// faz I/O, e não altera a mesa quando devolve erro. Para CARD_PLAYED que fecha a
+// mesa, devolve o nome do vencedor da jogada ("EMPATE" em caso de empate).
+func Aplicar(mesa *Mesa, ev Evento) (string, error) {
+	jogador := jogadorDaMesa(mesa, ev.PlayerID)
+	vencedorJogada := ""
+
+	switch ev.EventType {
+	case EVENTO_JOGADOR_PRONTO:
+		if jogador == nil {
+			return "", fmt.Errorf("jogador %s não pertence à sala %s", ev.PlayerID, mesa.SalaID)
+		}
+		mesa.Prontos[jogador.Nome] = true
+
+	case EVENTO_PARTIDA_INICIADA:
+		var dados DadosPartidaIniciada
+		if err := decodificarDados(ev.Data, &dados); err != nil {
+			return "", err
+		}
+		if mesa.Estado == "JOGANDO" {
+			return "", fmt.Errorf("partida %s já iniciada", mesa.SalaID)
+		}
+		if jogadorDaMesa(mesa, dados.TurnoDe) == nil {
+			return "", fmt.Errorf("jogador inicial %s não pertence à sala %s", dados.TurnoDe, mesa.SalaID)
+		}
+		mesa.Estado = "JOGANDO"
+		mesa.TurnoDe = dados.TurnoDe
+
+	case EVENTO_CARTA_JOGADA:
+		var dados DadosCartaJogada
+		if err := decodificarDados(ev.Data, &dados); err != nil {
+			return "", err
+		}
+		if err := validarJogada(mesa, jogador, ev.PlayerID); err != nil {
+			return "", err
+		}
+		mesa.CartasNaMesa[jogador.Nome] = dados.Carta
+
+		if len(mesa.CartasNaMesa) < len(mesa.Jogadores) {
+			for _, j := range mesa.Jogadores {
+				if j.ID != jogador.ID {
+					mesa.TurnoDe = j.ID
+					break
+				}
+			}
+		} else {
+			vencedorJogada = resolverMesa(mesa)
+			if dados.EncerraPartida {
+				mesa.Estado = "FINALIZADO"
+			} else {
+				mesa.NumeroRodada++
+			}
+		}
+
+	case EVENTO_DESISTENCIA:
+		var dados DadosDesistencia
+		if err := decodificarDados(ev.Data, &dados); err != nil {
+			return "", err
+		}
+		if jogador == nil {
+			return "", fmt.Errorf("jogador %s não pertence à sala %s", ev.PlayerID, mesa.SalaID)
+		}
+		if mesa.Estado != "JOGANDO" {
+			return "", fmt.Errorf("a partida não está em andamento")
+		}
+		mesa.Estado = "FINALIZADO"
+		mesa.Desistente = jogador.ID
+		mesa.MotivoFim = dados.Motivo
+
+	case EVENTO_CHAT:
+		// Chat fica no log, mas não faz parte do estado da partida
+
+	default:
+		// Tipos desconhecidos são ignorados para que logs de versões mais novas ainda possam ser lidos
+	}
+
+	mesa.EventSeq = ev.EventSeq
+	return vencedorJogada, nil
+}
+
+// projecaoEstado é a parte do estado que o log determina; é o que entra no hash.
+type projecaoEstado struct {
+	Estado        string                     `json:"estado"`
+	CartasNaMesa  map[string]protocolo.Carta `json:"cartas_na_mesa"`
+	PontosRodada  map[string]int             `json:"pontos_rodada"`
+	PontosPartida map[string]int             `json:"pontos_partida"`
+	NumeroRodada  int                        `json:"numero_rodada"`
+	Prontos       map[string]bool            `json:"prontos"`
+	TurnoDe       string                     `json:"turno_de"`
+	Desistente    string                     `json:"desistente,omitempty"`
+	MotivoFim     string                     `json:"motivo_fim,omitempty"`
+	EventSeq      int64                      `json:"event_seq"`
+}
+
+// Hash resume o estado da mesa em um SHA-256. Host, Sombra e o replay do cliente
+// que aplicaram o mesmo log chegam ao mesmo hash.
+func Hash(mesa *Mesa) string {
+	return hashProjecao(projecaoEstado{
+		Estado:        mesa.Estado,
+		CartasNaMesa:  mesa.CartasNaMesa,
+		PontosRodada:  mesa.PontosRodada,
+		PontosPartida: mesa.PontosPartida,
+		NumeroRodada:  mesa.NumeroRodada,
+		Prontos:       mesa.Prontos,
+		TurnoDe:       mesa.TurnoDe,
+		Desistente:    mesa.Desistente,
+		MotivoFim:     mesa.MotivoFim,
+		EventSeq:      mesa.EventSeq,
+	})
+}
+
+func hashProjecao(p projecaoEstado) string {
+	// Mapas nil e vazios devem gerar o mesmo hash
+	if p.CartasNaMesa == nil {
+		p.CartasNaMesa = map[string]protocolo.Carta{}
+	}
+	if p.PontosRodada == nil {
+		p.PontosRodada = map[string]int{}
+	}
+	if p.PontosPartida == nil {
+		p.PontosPartida = map[string]int{}
+	}
+	if p.Prontos == nil {
+		p.Prontos = map[string]bool{}
+	}
+	// encoding/json ordena as chaves dos mapas, o que torna a serialização canônica
+	dados, _ := json.Marshal(p)
+	soma := sha256.Sum256(dados)
+	return hex.EncodeToString(soma[:])
+}
+
+// CompararCartas compara duas cartas pelo valor e, em caso de empate, pelo naipe.
+func CompararCartas(c1, c2 protocolo.Carta) int {
+	if c1.Valor != c2.Valor {
+		return c1.Valor - c2.Valor
+	}
+
+	// Desempate por naipe
+	naipes := map[string]int{"♠": 4, "♥": 3, "♦": 2, "♣": 1}
+	return naipes[c1.Naipe] - naipes[c2.Naipe]
+}
+
+// Vencedor devolve o nome de quem fez mais pontos na rodada ou "EMPATE". Numa
+// desistência, vence o outro jogador.
+func Vencedor(mesa *Mesa) string {
+	if mesa.Desistente != "" {
+		for _, j := range mesa.Jogadores {
+			if j.ID != mesa.Desistente {
+				return j.Nome
+			}
+		}
+	}
+
+	vencedor := "EMPATE"
+	maxPontos := -1
+	for _, j := range mesa.Jogadores {
+		pontos := mesa.PontosRodada[j.Nome]
+		if pontos > maxPontos {
+			maxPontos = pontos
+			vencedor = j.Nome
+		} else if pontos == maxPontos {
+			vencedor = "EMPATE"
+		}
+	}
+	return vencedor
+}
+
+// resolverMesa pontua a jogada com as duas cartas na mesa, limpa a mesa e passa o
+// turno ao vencedor (em caso de empate o turno não muda).
+func resolverMesa(mesa *Mesa) string {
+	j1 := mesa.Jogadores[0]
+	j2 := mesa.Jogadores[1]
+
+	vencedorJogada := "EMPATE"
+	resultado := CompararCartas(mesa.CartasNaMesa[j1.Nome], mesa.CartasNaMesa[j2.Nome])
+	if resultado > 0 {
+		vencedorJogada = j1.Nome
+		mesa.TurnoDe = j1.ID
+	} else if resultado < 0 {
+		vencedorJogada = j2.Nome
+		mesa.TurnoDe = j2.ID
+	}
+	if vencedorJogada != "EMPATE" {
+		mesa.PontosRodada[vencedorJogada]++
+	}
+
+	mesa.CartasNaMesa = make(map[string]protocolo.Carta)
+	return vencedorJogada
+}
+
+func validarJogada(mesa *Mesa, jogador *Jogador, playerID string) error {
+	if jogador == nil {
+		return fmt.Errorf("jogador %s não pertence à sala %s", playerID, mesa.SalaID)
+	}
+	if mesa.Estado != "JOGANDO" {
+		return fmt.Errorf("a partida não está em andamento")
+	}
+	if mesa.TurnoDe != jogador.ID {
+		return fmt.Errorf("não é a vez de %s", jogador.Nome)
+	}
+	if _, jaJogou := mesa.CartasNaMesa[jogador.Nome]; jaJogou {
+		return fmt.Errorf("%s já jogou nesta rodada", jogador.Nome)
+	}
+	if len(mesa.Jogadores) != 2 {
+		return fmt.Errorf("sala %s com %d jogadores", mesa.SalaID, len(mesa.Jogadores))
+	}
+	return nil
+}
+
+func jogadorDaMesa(mesa *Mesa, id string) *Jogador {
+	for i := range mesa.Jogadores {
+		if mesa.Jogadores[i].ID == id {
+			return &mesa.Jogadores[i]
+		}
+	}
+	return nil
+}
+
+// decodificarDados converte o campo Data (um map após passar por JSON, ou a struct
+// original no Host) para o tipo esperado.
+func decodificarDados(dados interface{}, destino interface{}) error {
+	bruto, err := json.Marshal(dados)
+	if err != nil {
+		return fmt.Errorf("dados do evento inválidos: %v", err)
+	}
+	if err := json.Unmarshal(bruto, destino); err != nil {
+		return fmt.Errorf("dados do evento inválidos: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,215 @@
+package partida
+
+import (
+	"encoding/json"
+	"jogodistribuido/protocolo"
+	"testing"
+)
+
+var jogadoresTeste = []Jogador{{ID: "a", Nome: "Ana"}, {ID: "b", Nome: "Bia"}}
+
+func carta(id string, valor int, naipe string) protocolo.Carta {
+	return protocolo.Carta{ID: id, Nome: id, Naipe: naipe, Valor: valor}
+}
+
+// mesaIniciada devolve uma mesa em andamento com a vez de `turnoDe`
+func mesaIniciada(t *testing.T, turnoDe string) *Mesa {
+	t.Helper()
+	mesa := NovaMesa("sala", jogadoresTeste)
+	eventos := []Evento{
+		{EventSeq: 1, EventType: EVENTO_JOGADOR_PRONTO, PlayerID: "a"},
+		{EventSeq: 2, EventType: EVENTO_JOGADOR_PRONTO, PlayerID: "b"},
+		{EventSeq: 3, EventType: EVENTO_PARTIDA_INICIADA, Data: DadosPartidaIniciada{TurnoDe: turnoDe}},
+	}
+	for _, ev := range eventos {
+		if _, err := Aplicar(mesa, ev); err != nil {
+			t.Fatalf("evento %d: %v", ev.EventSeq, err)
+		}
+	}
+	return mesa
+}
+
+func TestAplicar(t *testing.T) {
+	casos := []struct {
+		nome     string
+		eventos  []Evento
+		vencedor string // Vencedor devolvido pelo último evento
+		erro     bool   // O último evento deve ser recusado
+		turnoDe  string
+		estado   string
+		pontos   map[string]int
+		rodada   int
+	}{
+		{
+			nome:    "primeira carta passa a vez",
+			eventos: []Evento{{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "a", Data: DadosCartaJogada{Carta: carta("c1", 5, "♣")}}},
+			turnoDe: "b", estado: "JOGANDO", pontos: map[string]int{}, rodada: 1,
+		},
+		{
+			nome: "carta maior vence e fica com a vez",
+			eventos: []Evento{
+				{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "a", Data: DadosCartaJogada{Carta: carta("c1", 5, "♣")}},
+				{EventSeq: 5, EventType: EVENTO_CARTA_JOGADA, PlayerID: "b", Data: DadosCartaJogada{Carta: carta("c2", 9, "♣")}},
+			},
+			vencedor: "Bia", turnoDe: "b", estado: "JOGANDO", pontos: map[string]int{"Bia": 1}, rodada: 2,
+		},
+		{
+			nome: "valor igual desempata pelo naipe",
+			eventos: []Evento{
+				{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "a", Data: DadosCartaJogada{Carta: carta("c1", 7, "♠")}},
+				{EventSeq: 5, EventType: EVENTO_CARTA_JOGADA, PlayerID: "b", Data: DadosCartaJogada{Carta: carta("c2", 7, "♥")}},
+			},
+			vencedor: "Ana", turnoDe: "a", estado: "JOGANDO", pontos: map[string]int{"Ana": 1}, rodada: 2,
+		},
+		{
+			nome: "empate não pontua nem muda a vez",
+			eventos: []Evento{
+				{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "a", Data: DadosCartaJogada{Carta: carta("c1", 7, "♠")}},
+				{EventSeq: 5, EventType: EVENTO_CARTA_JOGADA, PlayerID: "b", Data: DadosCartaJogada{Carta: carta("c2", 7, "♠")}},
+			},
+			vencedor: "EMPATE", turnoDe: "b", estado: "JOGANDO", pontos: map[string]int{}, rodada: 2,
+		},
+		{
+			nome: "jogada que encerra a partida",
+			eventos: []Evento{
+				{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "a", Data: DadosCartaJogada{Carta: carta("c1", 2, "♣")}},
+				{EventSeq: 5, EventType: EVENTO_CARTA_JOGADA, PlayerID: "b", Data: DadosCartaJogada{Carta: carta("c2", 3, "♣"), EncerraPartida: true}},
+			},
+			vencedor: "Bia", turnoDe: "b", estado: "FINALIZADO", pontos: map[string]int{"Bia": 1}, rodada: 1,
+		},
+		{
+			nome:    "jogada fora da vez é recusada",
+			eventos: []Evento{{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "b", Data: DadosCartaJogada{Carta: carta("c2", 9, "♣")}}},
+			erro:    true, turnoDe: "a", estado: "JOGANDO", pontos: map[string]int{}, rodada: 1,
+		},
+		{
+			nome:    "jogador de fora da sala é recusado",
+			eventos: []Evento{{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "x", Data: DadosCartaJogada{Carta: carta("c9", 9, "♣")}}},
+			erro:    true, turnoDe: "a", estado: "JOGANDO", pontos: map[string]int{}, rodada: 1,
+		},
+		{
+			nome:    "partida iniciada de novo é recusada",
+			eventos: []Evento{{EventSeq: 4, EventType: EVENTO_PARTIDA_INICIADA, Data: DadosPartidaIniciada{TurnoDe: "b"}}},
+			erro:    true, turnoDe: "a", estado: "JOGANDO", pontos: map[string]int{}, rodada: 1,
+		},
+		{
+			nome:     "desistência encerra a partida",
+			eventos:  []Evento{{EventSeq: 4, EventType: EVENTO_DESISTENCIA, PlayerID: "a", Data: DadosDesistencia{Motivo: MOTIVO_ABANDONO}}},
+			vencedor: "", turnoDe: "a", estado: "FINALIZADO", pontos: map[string]int{}, rodada: 1,
+		},
+		{
+			nome:    "chat não muda o estado",
+			eventos: []Evento{{EventSeq: 4, EventType: EVENTO_CHAT, PlayerID: "b", Data: map[string]string{"texto": "oi"}}},
+			turnoDe: "a", estado: "JOGANDO", pontos: map[string]int{}, rodada: 1,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			mesa := mesaIniciada(t, "a")
+			var vencedor string
+			var err error
+			for i, ev := range c.eventos {
+				vencedor, err = Aplicar(mesa, ev)
+				if err != nil && i < len(c.eventos)-1 {
+					t.Fatalf("evento %d recusado: %v", ev.EventSeq, err)
+				}
+			}
+			if (err != nil) != c.erro {
+				t.Fatalf("erro = %v, esperado erro: %v", err, c.erro)
+			}
+			if vencedor != c.vencedor {
+				t.Errorf("vencedor = %q, esperado %q", vencedor, c.vencedor)
+			}
+			if mesa.TurnoDe != c.turnoDe {
+				t.Errorf("vez de %q, esperado %q", mesa.TurnoDe, c.turnoDe)
+			}
+			if mesa.Estado != c.estado {
+				t.Errorf("estado %q, esperado %q", mesa.Estado, c.estado)
+			}
+			if mesa.NumeroRodada != c.rodada {
+				t.Errorf("rodada %d, esperado %d", mesa.NumeroRodada, c.rodada)
+			}
+			for _, j := range mesa.Jogadores {
+				if mesa.PontosRodada[j.Nome] != c.pontos[j.Nome] {
+					t.Errorf("%s com %d pontos, esperado %d", j.Nome, mesa.PontosRodada[j.Nome], c.pontos[j.Nome])
+				}
+			}
+		})
+	}
+}
+
+func TestAplicarRecusadoNaoAlteraMesa(t *testing.T) {
+	mesa := mesaIniciada(t, "a")
+	antes := Hash(mesa)
+	if _, err := Aplicar(mesa, Evento{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "b", Data: DadosCartaJogada{Carta: carta("c2", 9, "♣")}}); err == nil {
+		t.Fatal("jogada fora da vez aceita")
+	}
+	if depois := Hash(mesa); depois != antes {
+		t.Errorf("hash mudou de %s para %s com um evento recusado", antes, depois)
+	}
+	if mesa.EventSeq != 3 {
+		t.Errorf("eventSeq %d, esperado 3", mesa.EventSeq)
+	}
+}
+
+func TestVencedorComDesistencia(t *testing.T) {
+	mesa := mesaIniciada(t, "a")
+	mesa.PontosRodada["Ana"] = 3
+	if _, err := Aplicar(mesa, Evento{EventSeq: 4, EventType: EVENTO_DESISTENCIA, PlayerID: "a", Data: DadosDesistencia{Motivo: MOTIVO_ABANDONO}}); err != nil {
+		t.Fatal(err)
+	}
+	if v := Vencedor(mesa); v != "Bia" {
+		t.Errorf("vencedor %q, esperado Bia (Ana desistiu)", v)
+	}
+}
+
+func TestHash(t *testing.T) {
+	log := []Evento{
+		{EventSeq: 1, EventType: EVENTO_JOGADOR_PRONTO, PlayerID: "a"},
+		{EventSeq: 2, EventType: EVENTO_JOGADOR_PRONTO, PlayerID: "b"},
+		{EventSeq: 3, EventType: EVENTO_PARTIDA_INICIADA, Data: DadosPartidaIniciada{TurnoDe: "a"}},
+		{EventSeq: 4, EventType: EVENTO_CARTA_JOGADA, PlayerID: "a", Data: DadosCartaJogada{Carta: carta("c1", 5, "♣")}},
+		{EventSeq: 5, EventType: EVENTO_CARTA_JOGADA, PlayerID: "b", Data: DadosCartaJogada{Carta: carta("c2", 9, "♣")}},
+	}
+	aplicar := func(eventos []Evento) *Mesa {
+		mesa := NovaMesa("sala", jogadoresTeste)
+		for _, ev := range eventos {
+			if _, err := Aplicar(mesa, ev); err != nil {
+				t.Fatalf("evento %d: %v", ev.EventSeq, err)
+			}
+		}
+		return mesa
+	}
+
+	// O log replicado chega como JSON: Data vira um map
+	var replicado []Evento
+	bruto, _ := json.Marshal(log)
+	if err := json.Unmarshal(bruto, &replicado); err != nil {
+		t.Fatal(err)
+	}
+
+	vazia := NovaMesa("sala", jogadoresTeste)
+	semMapas := NovaMesa("sala", jogadoresTeste)
+	semMapas.CartasNaMesa, semMapas.PontosRodada, semMapas.PontosPartida, semMapas.Prontos = nil, nil, nil, nil
+
+	casos := []struct {
+		nome  string
+		a, b  *Mesa
+		igual bool
+	}{
+		{nome: "mesmo log", a: aplicar(log), b: aplicar(log), igual: true},
+		{nome: "log replicado por JSON", a: aplicar(log), b: aplicar(replicado), igual: true},
+		{nome: "mapas nil e vazios", a: vazia, b: semMapas, igual: true},
+		{nome: "um evento a menos", a: aplicar(log), b: aplicar(log[:4]), igual: false},
+		{nome: "mesa nova e mesa jogada", a: vazia, b: aplicar(log), igual: false},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			ha, hb := Hash(c.a), Hash(c.b)
+			if (ha == hb) != c.igual {
+				t.Errorf("hashes %s e %s, esperado iguais: %v", ha, hb, c.igual)
+			}
+		})
+	}
+}
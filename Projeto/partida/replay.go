@@ -0,0 +1,82 @@
+package partida
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// FORMATO_REPLAY identifica a versão do arquivo de replay
+const FORMATO_REPLAY = "replay-partida/v1"
+
+// CabecalhoReplay é a primeira linha do arquivo de replay. As linhas seguintes são
+// os Evento da partida, um por linha, em ordem de EventSeq.
+type CabecalhoReplay struct {
+	Formato   string    `json:"formato"`
+	SalaID    string    `json:"sala_id"`
+	Jogadores []Jogador `json:"jogadores"`
+	Estado    string    `json:"estado"`
+	Vencedor  string    `json:"vencedor,omitempty"`
+	EventSeq  int64     `json:"eventSeq"`
+	Hash      string    `json:"hash"` // Hash do estado final, para conferir o replay
+}
+
+// Replay é um arquivo de replay já lido.
+type Replay struct {
+	Cabecalho CabecalhoReplay
+	Eventos   []Evento
+}
+
+// EscreverReplay escreve o cabeçalho e o log em JSON Lines.
+func EscreverReplay(w io.Writer, cabecalho CabecalhoReplay, eventos []Evento) error {
+	cabecalho.Formato = FORMATO_REPLAY
+
+	// json.Encoder termina cada valor com '\n', que é o separador do JSON Lines
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(cabecalho); err != nil {
+		return err
+	}
+	for _, ev := range eventos {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LerReplay lê um arquivo gerado por EscreverReplay.
+func LerReplay(r io.Reader) (*Replay, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+
+	replay := &Replay{}
+	linha := 0
+	for scanner.Scan() {
+		linha++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		if linha == 1 {
+			if err := json.Unmarshal(scanner.Bytes(), &replay.Cabecalho); err != nil {
+				return nil, fmt.Errorf("cabeçalho do replay inválido: %v", err)
+			}
+			if replay.Cabecalho.Formato != FORMATO_REPLAY {
+				return nil, fmt.Errorf("formato de replay desconhecido: %q", replay.Cabecalho.Formato)
+			}
+			continue
+		}
+		var ev Evento
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			return nil, fmt.Errorf("linha %d do replay inválida: %v", linha, err)
+		}
+		replay.Eventos = append(replay.Eventos, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if linha == 0 {
+		return nil, fmt.Errorf("arquivo de replay vazio")
+	}
+	return replay, nil
+}
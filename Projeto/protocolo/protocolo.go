@@ -1,11 +1,15 @@
 package protocolo
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Envelope base para todas as mensagens do protocolo
 type Mensagem struct {
-	Comando string          `json:"comando"` // Tipo da operação (LOGIN, JOGAR_CARTA, etc.)
-	Dados   json.RawMessage `json:"dados"`   // Payload específico de cada comando
+	Comando     string          `json:"comando"`                // Tipo da operação (LOGIN, JOGAR_CARTA, etc.)
+	Dados       json.RawMessage `json:"dados"`                  // Payload específico de cada comando
+	TokenSessao string          `json:"token_sessao,omitempty"` // Token do LOGIN_OK, exigido nos comandos feitos em nome da conta
 }
 
 /* ===================== Cartas / Inventário ===================== */
@@ -38,19 +42,139 @@ type TrocarCartasReq struct {
 	NomeJogadorDesejado string `json:"nome_jogador_desejado"`
 	IDCartaOferecida    string `json:"id_carta_oferecida"`
 	IDCartaDesejada     string `json:"id_carta_desejada"`
+
+	OfertaID  string `json:"oferta_id,omitempty"`  // Proposta a que o comando responde (contraproposta, aceitar, recusar)
+	ClienteID string `json:"cliente_id,omitempty"` // Quem aceita ou recusa
 }
 
 type TrocarCartasResp struct {
 	Sucesso              bool    `json:"sucesso"`
 	Mensagem             string  `json:"mensagem"`
 	InventarioAtualizado []Carta `json:"inventario_atualizado,omitempty"`
+
+	OfertaID string `json:"oferta_id,omitempty"`
+	Motivo   string `json:"motivo,omitempty"` // TROCA_ENCERRADA: "recusada" | "cancelada" | "expirada" | "falhou"
+}
+
+// Proposta de troca pendente (TROCA_PROPOSTA), enviada aos dois jogadores. Só
+// Oferta.IDJogadorDesejado pode aceitar ou fazer uma contraproposta.
+type DadosOfertaTroca struct {
+	Oferta           TrocarCartasReq `json:"oferta"`
+	CartaOferecida   Carta           `json:"carta_oferecida"`
+	CartaDesejada    Carta           `json:"carta_desejada"`
+	ExpiraEmSegundos int             `json:"expira_em_segundos"`
+	Contraproposta   bool            `json:"contraproposta,omitempty"`
+	ForaDePartida    bool            `json:"fora_de_partida,omitempty"` // Troca entre jogadores fora de uma sala (clientes/{id}/troca)
+}
+
+// Jogador encontrado pelo nome em algum servidor do cluster (JOGADOR_ENCONTRADO)
+type DadosJogador struct {
+	ClienteID  string  `json:"cliente_id"`
+	Nome       string  `json:"nome"`
+	Servidor   string  `json:"servidor"`
+	EmPartida  bool    `json:"em_partida"`
+	Inventario []Carta `json:"inventario"`
+}
+
+/* ===================== Mercado ===================== */
+
+// Pedido ao mercado de cartas (clientes/{id}/mercado). Os campos usados dependem do
+// comando: MERCADO_LISTAR, MERCADO_SALDO, MERCADO_ANUNCIAR, MERCADO_COMPRAR ou MERCADO_CANCELAR
+type MercadoReq struct {
+	CartaID   string `json:"carta_id,omitempty"`   // MERCADO_ANUNCIAR
+	Preco     int    `json:"preco,omitempty"`      // MERCADO_ANUNCIAR
+	AnuncioID string `json:"anuncio_id,omitempty"` // MERCADO_COMPRAR / MERCADO_CANCELAR
+
+	// Filtros de MERCADO_LISTAR (vazios/zero não filtram)
+	Raridade string `json:"raridade,omitempty"`
+	Nome     string `json:"nome,omitempty"` // Trecho do nome da carta
+	ValorMin int    `json:"valor_min,omitempty"`
+	ValorMax int    `json:"valor_max,omitempty"`
+}
+
+// Carta à venda no mercado. Enquanto o anúncio existe, a carta fica fora do inventário do vendedor
+type AnuncioMercado struct {
+	ID           string    `json:"id"`
+	VendedorID   string    `json:"vendedor_id"`
+	VendedorNome string    `json:"vendedor_nome"`
+	Carta        Carta     `json:"carta"`
+	Preco        int       `json:"preco"` // Em moedas
+	CriadoEm     time.Time `json:"criado_em"`
+}
+
+// Anúncios encontrados (MERCADO_ANUNCIOS) ou os do próprio jogador (SALDO), com o saldo dele
+type DadosMercado struct {
+	Anuncios []AnuncioMercado `json:"anuncios"`
+	Moedas   int              `json:"moedas"`
+}
+
+// Resultado de uma operação no mercado (MERCADO_RESULTADO)
+type DadosResultadoMercado struct {
+	Operacao   string         `json:"operacao"` // "anunciada" | "comprada" | "vendida" | "cancelada"
+	Anuncio    AnuncioMercado `json:"anuncio"`
+	Moedas     int            `json:"moedas"`               // Saldo depois da operação
+	Inventario []Carta        `json:"inventario,omitempty"` // Quando o inventário mudou
+}
+
+/* ===================== Livro-razão de cartas ===================== */
+
+// Transferência de uma carta registrada no livro-razão do cluster. De/Para são IDs de
+// conta; vazio quer dizer fora de qualquer inventário (estoque, mercado ou mesa)
+type MovimentoCarta struct {
+	ID         string    `json:"id"`
+	Indice     int64     `json:"indice"` // Entrada do log replicado que registrou o movimento
+	Tipo       string    `json:"tipo"`   // "cunhada" | "pacote" | "troca" | "consumida" | "anunciada" | "vendida" | "retirada" | "devolvida"
+	Carta      Carta     `json:"carta"`
+	De         string    `json:"de,omitempty"`
+	DeNome     string    `json:"de_nome,omitempty"`
+	Para       string    `json:"para,omitempty"`
+	ParaNome   string    `json:"para_nome,omitempty"`
+	Referencia string    `json:"referencia,omitempty"` // Sala, troca ou anúncio que causou o movimento
+	Servidor   string    `json:"servidor,omitempty"`   // Servidor que registrou (vazio nos derivados de entradas do mercado)
+	Em         time.Time `json:"em"`
+}
+
+// Movimentos de uma carta ou do próprio jogador (RAZAO_HISTORICO)
+type DadosRazao struct {
+	CartaID    string           `json:"carta_id,omitempty"` // Vazio = movimentos do jogador
+	Movimentos []MovimentoCarta `json:"movimentos"`
 }
 
 /* ===================== Login / Match / Chat ===================== */
 
 // Dados para autenticação do jogador
 type DadosLogin struct {
-	Nome string `json:"nome"` // Nome único do jogador no sistema
+	Nome      string `json:"nome"`                // Nome único do jogador no sistema
+	Senha     string `json:"senha"`               // Senha da conta
+	Registrar bool   `json:"registrar,omitempty"` // true para criar a conta em vez de entrar
+}
+
+// Resposta de login bem-sucedido
+type DadosLoginOK struct {
+	ClienteID   string  `json:"cliente_id"`   // ID estável da conta
+	Nome        string  `json:"nome"`         // Nome como foi registrado
+	Servidor    string  `json:"servidor"`     // Servidor que atendeu o login
+	Inventario  []Carta `json:"inventario"`   // Inventário salvo na conta
+	TokenSessao string  `json:"token_sessao"` // Usado no RECONNECT para retomar a sessão
+	Rating      int     `json:"rating"`       // Rating Elo da conta
+	Moedas      int     `json:"moedas"`       // Saldo de moedas da conta
+}
+
+// Pedido de retomada de sessão após queda da conexão (comando RECONNECT)
+type DadosReconectar struct {
+	ClienteID   string `json:"cliente_id"`
+	TokenSessao string `json:"token_sessao"`
+}
+
+// Estado enviado ao jogador quando a sessão é retomada (SESSAO_RETOMADA)
+type DadosSessaoRetomada struct {
+	SalaID       string                `json:"sala_id,omitempty"`     // Partida em andamento ("" se não houver)
+	OponenteID   string                `json:"oponente_id,omitempty"` // Oponente na partida
+	OponenteNome string                `json:"oponente_nome,omitempty"`
+	Estado       string                `json:"estado,omitempty"`       // Estado da sala (AGUARDANDO_COMPRA, JOGANDO, ...)
+	Atualizacao  *DadosAtualizacaoJogo `json:"atualizacao,omitempty"`  // Mesa, placar e turno atuais
+	Inventario   []Carta               `json:"inventario"`             // Inventário do jogador
+	TokenSessao  string                `json:"token_sessao,omitempty"` // Novo token, se a sessão mudou de servidor
 }
 
 // Notificação de que uma partida foi encontrada
@@ -58,6 +182,40 @@ type DadosPartidaEncontrada struct {
 	SalaID       string `json:"salaID"`       // ID único da sala de jogo criada
 	OponenteID   string `json:"oponenteID"`   // ID do oponente para referência
 	OponenteNome string `json:"oponenteNome"` // Nome do oponente encontrado
+
+	SegundosParaComprar int `json:"segundos_para_comprar,omitempty"` // Prazo para comprar o pacote antes de a sala ser cancelada
+
+	SalaAnterior string         `json:"sala_anterior,omitempty"` // Sala finalizada, quando a partida é uma revanche
+	Serie        map[string]int `json:"serie,omitempty"`         // Nome -> vitórias na série de revanches
+}
+
+// Pedido de revanche de um jogador, repassado ao oponente
+type DadosRevanchePedida struct {
+	SalaID string `json:"sala_id"`
+	Nome   string `json:"nome"` // Quem pediu a revanche
+}
+
+// Sala cancelada antes de a partida começar
+type DadosPartidaCancelada struct {
+	SalaID        string `json:"sala_id"`
+	Motivo        string `json:"motivo"`        // "prazo_compra_esgotado" | "cancelada_por_jogador"
+	Reenfileirado bool   `json:"reenfileirado"` // O jogador voltou para a fila de matchmaking
+}
+
+// Sala privada criada (SALA_PRIVADA_CRIADA) ou expirada sem oponente (SALA_PRIVADA_EXPIRADA)
+type DadosSalaPrivada struct {
+	Codigo           string `json:"codigo"`                       // Código a passar para o oponente (/entrar <código>)
+	ExpiraEmSegundos int    `json:"expira_em_segundos,omitempty"` // Validade do código
+}
+
+// Situação do jogador na fila de matchmaking, enviada periodicamente enquanto ele espera
+type DadosStatusFila struct {
+	Posicao                int `json:"posicao"`                  // 1 = próximo da fila do cluster
+	Total                  int `json:"total"`                    // Jogadores na fila do cluster
+	EsperandoSegundos      int `json:"esperando_segundos"`       // Há quanto tempo o jogador espera
+	EsperaEstimadaSegundos int `json:"espera_estimada_segundos"` // Espera média dos últimos pareados (0 = sem histórico)
+	ServidoresConsultados  int `json:"servidores_consultados"`   // Servidores cujas filas entram na busca
+	JanelaRating           int `json:"janela_rating"`            // Diferença de rating aceita neste momento
 }
 
 // Dados para envio de mensagens de chat
@@ -81,22 +239,36 @@ type DadosReceberChat struct {
 
 // Estrutura principal para atualizações do estado do jogo
 type DadosAtualizacaoJogo struct {
-	MensagemDoTurno string           `json:"mensagem_do_turno"` // Mensagem descritiva do que aconteceu
-	ContagemCartas  map[string]int   `json:"contagem_cartas"`   // nome -> cartas restantes no inventário
-	UltimaJogada    map[string]Carta `json:"ultima_jogada"`     // nome -> carta recém jogada na mesa
-	VencedorJogada  string           `json:"vencedor_jogada"`   // nome do vencedor da jogada atual / "EMPATE" / ""
-	VencedorRodada  string           `json:"vencedor_rodada"`   // nome do vencedor da rodada / "EMPATE" / ""
-	NumeroRodada    int              `json:"numero_rodada"`     // Número da rodada atual (1, 2, 3...)
-	PontosRodada    map[string]int   `json:"pontos_rodada"`     // nome -> pontos na rodada atual
-	PontosPartida   map[string]int   `json:"pontos_partida"`    // nome -> rodadas ganhas na partida
-	SalaID          string           `json:"sala_id"`           // ID da sala para roteamento na sombra
-	TurnoDe         string           `json:"turnoDe"`           // ID do jogador que deve jogar
+	MensagemDoTurno   string           `json:"mensagem_do_turno"`            // Mensagem descritiva do que aconteceu
+	ContagemCartas    map[string]int   `json:"contagem_cartas"`              // nome -> cartas restantes no inventário
+	UltimaJogada      map[string]Carta `json:"ultima_jogada"`                // nome -> carta recém jogada na mesa
+	VencedorJogada    string           `json:"vencedor_jogada"`              // nome do vencedor da jogada atual / "EMPATE" / ""
+	VencedorRodada    string           `json:"vencedor_rodada"`              // nome do vencedor da rodada / "EMPATE" / ""
+	NumeroRodada      int              `json:"numero_rodada"`                // Número da rodada atual (1, 2, 3...)
+	PontosRodada      map[string]int   `json:"pontos_rodada"`                // nome -> pontos na rodada atual
+	PontosPartida     map[string]int   `json:"pontos_partida"`               // nome -> rodadas ganhas na partida
+	SalaID            string           `json:"sala_id"`                      // ID da sala para roteamento na sombra
+	TurnoDe           string           `json:"turnoDe"`                      // ID do jogador que deve jogar
+	PrazoTurno        int64            `json:"prazo_turno,omitempty"`        // Fim do prazo do turno (Unix, em milissegundos)
+	SegundosRestantes int              `json:"segundos_restantes,omitempty"` // Segundos restantes para o jogador da vez
 }
 
 // Notificação de fim de partida
 type DadosFimDeJogo struct {
-	VencedorNome string `json:"vencedorNome"` // Nome do vencedor final / "EMPATE" em caso de empate
-	SalaID       string `json:"sala_id"`      // ID da sala para roteamento na sombra
+	VencedorNome   string `json:"vencedorNome"`              // Nome do vencedor final / "EMPATE" em caso de empate
+	SalaID         string `json:"sala_id"`                   // ID da sala para roteamento na sombra
+	Motivo         string `json:"motivo"`                    // "cartas_esgotadas" | "tempo_esgotado"
+	DesistenteNome string `json:"desistente_nome,omitempty"` // Quem perdeu por desistência, se for o caso
+
+	Serie   map[string]int `json:"serie,omitempty"`   // Placar da série de revanches contando esta partida
+	Ratings map[string]int `json:"ratings,omitempty"` // Nome -> rating depois desta partida
+	Moedas  map[string]int `json:"moedas,omitempty"`  // Nome -> moedas ganhas nesta partida
+}
+
+// Carta jogada pelo Host em nome do jogador quando o prazo do turno esgotou
+type DadosJogadaAutomatica struct {
+	SalaID string `json:"sala_id"`
+	Carta  Carta  `json:"carta"`
 }
 
 // Comando representa uma ação de um jogador em uma partida
@@ -106,6 +278,25 @@ type Comando struct {
 	Payload   json.RawMessage
 }
 
+// Replay de uma partida finalizada, no formato JSON Lines (cabeçalho + um GameEvent por linha)
+type DadosReplayPartida struct {
+	SalaID   string `json:"sala_id"`  // Partida exportada
+	Conteudo string `json:"conteudo"` // Arquivo .jsonl completo
+}
+
+/* ===================== Failover ===================== */
+
+// Notificação de que a Sombra assumiu a partida após a falha do servidor Host
+type DadosFailoverPartida struct {
+	SalaID       string `json:"sala_id"`       // ID da sala que mudou de Host
+	NovoHost     string `json:"novo_host"`     // Servidor que assumiu a partida
+	AntigoHost   string `json:"antigo_host"`   // Servidor que falhou
+	Mensagem     string `json:"mensagem"`      // Texto para exibir ao jogador
+	NumeroRodada int    `json:"numero_rodada"` // Rodada em que a partida foi retomada
+	TurnoDe      string `json:"turnoDe"`       // ID do jogador que deve jogar
+	EventSeq     int64  `json:"eventSeq"`      // Último evento conhecido pelo novo Host
+}
+
 /* ===================== Erro ===================== */
 
 // Estrutura para mensagens de erro
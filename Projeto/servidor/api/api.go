@@ -3,7 +3,12 @@ package api
 import (
 	"jogodistribuido/protocolo"
 	"jogodistribuido/servidor/cluster"
+	"jogodistribuido/servidor/historico"
+	"jogodistribuido/servidor/matchmaking"
+	"jogodistribuido/servidor/mercado"
+	"jogodistribuido/servidor/razao"
 	"jogodistribuido/servidor/tipos"
+	"jogodistribuido/servidor/troca"
 	"log"
 
 	"github.com/gin-gonic/gin"
@@ -12,7 +17,7 @@ import (
 // ServidorInterface define as operações que a API pode precisar do Servidor principal (não relacionadas a cluster)
 type ServidorInterface interface {
 	EncaminharParaLider(*gin.Context)
-	FormarPacote() ([]tipos.Carta, error)
+	FormarPacote(clienteID, salaID string) ([]tipos.Carta, error)
 	NotificarCompraSucesso(string, []tipos.Carta)
 	GetStatusEstoque() (map[string]int, int)
 	GetFilaDeEspera() []*tipos.Cliente
@@ -20,16 +25,44 @@ type ServidorInterface interface {
 	AtualizarEstadoSalaRemoto(estado tipos.EstadoPartida)
 	CriarSalaRemota(solicitante, oponente *tipos.Cliente)
 	CriarSalaRemotaComSombra(solicitante, oponente *tipos.Cliente, shadowAddr string) string
-	RemoverPrimeiroDaFila() *tipos.Cliente
+	AceitarConvite(codigo string, convidado *tipos.Cliente, sombraAddr string) (string, error)
+	EntrarFilaGlobal(entrada matchmaking.Entrada)
+	SairFilaGlobal(clienteID string) bool
+	SincronizarFilaGlobal(servidor string, entradas []matchmaking.Entrada) map[string]matchmaking.Status
+	GetFilaGlobal() []matchmaking.Entrada
+	ConfirmarPartida(msg matchmaking.Confirmacao) (string, error)
 	PublicarParaCliente(clienteID string, msg protocolo.Mensagem)
 	AjustarContagemCartasLocal(clienteID string, msg *protocolo.Mensagem)
 	ProcessarComandoRemoto(salaID string, comando protocolo.Mensagem) error
 	PublicarChatRemoto(salaID, nomeJogador, texto string) // Adicionado para chat cross-server
 	GetSalas() map[string]*tipos.Sala
+	GetStatusSala(salaID string) (estado string, eventSeq int64, sombra string, ok bool)
+	GetReplaySala(salaID string) (conteudo []byte, estado string, ok bool)
+	RetomarSessao(clienteID, gateway string) (*protocolo.DadosSessaoRetomada, bool)
+	LiberarSessao(clienteID, novoServidor string) error
+	ProcessarComandoPartida(salaID string, comando protocolo.Mensagem)
+	PublicarEventoPartida(salaID string, msg protocolo.Mensagem)
+	EncerrarLobby(salaID, motivo string, reenfileirar []string)
+	CriarRevancheComoSombra(salaAnterior, salaID string, serie map[string]int) bool
+	GetHistoricoJogador(clienteID string) []historico.Resumo
+	ReplicarEstadoComoShadow(remetente, matchID string, eventSeq int64, state tipos.EstadoPartida) (aceito bool, epoca int64, host string)
+	AssumirComoSombra(host string, estado tipos.EstadoPartida) bool
 	ProcessarEventoComoHost(sala *tipos.Sala, evento *tipos.GameEventRequest) *tipos.EstadoPartida
-	ProcessarTrocaDireta(sala *tipos.Sala, req *protocolo.TrocarCartasReq)
-	AplicarTrocaLocal(clienteID string, idCartaDesejada string, cartaOferecida tipos.Carta) (bool, tipos.Carta, []tipos.Carta)
+	ConferirEpocaEvento(matchID string, epoca int64) (atual bool, epocaSala int64, host string)
+	ProcessarTrocaDireta(sala *tipos.Sala, comando string, req *protocolo.TrocarCartasReq)
 	BuscarCartaEmCliente(clienteID, cartaID string) tipos.Carta
+	JogarAutomaticamente(salaID, clienteID string) bool
+	ParticiparTroca(p troca.Pedido) error
+	GetTransacaoTroca(trocaID string) (troca.Transacao, bool)
+	ResolverTroca(trocaID, decisao string) error
+	BuscarJogadorLocal(nome string) (protocolo.DadosJogador, bool)
+	ProcessarTrocaForaDePartida(comando string, req protocolo.TrocarCartasReq) error
+	AvisarOfertaTroca(aviso troca.Aviso)
+	OperarMercado(op mercado.Operacao) error
+	ListarMercado(filtro mercado.Filtro) []mercado.Anuncio
+	HistoricoCarta(cartaID string) []razao.Movimento
+	MovimentosDoJogador(clienteID string) []razao.Movimento
+	AuditarCartas() ([]razao.Inconsistencia, map[string][]string)
 }
 
 type Server struct {
@@ -64,24 +97,60 @@ func (s *Server) Run() {
 
 func (s *Server) setupRoutes() {
 	// Rotas públicas (sem autenticação)
-	s.router.POST("/register", s.handleRegister)
-	s.router.POST("/heartbeat", s.handleHeartbeat)
 	s.router.GET("/servers", s.handleGetServers)
 
-	// Rotas de eleição (usadas internamente pelos servidores)
-	election := s.router.Group("/election")
+	// Entrada e saída de membros do cluster (protegidas por JWT)
+	s.router.POST("/register", authMiddleware(), s.handleRegister)
+
+	// Heartbeats levam termo e líder, então também exigem o JWT de servidor
+	s.router.POST("/heartbeat", authMiddleware(), s.handleHeartbeat)
+	s.router.POST("/leave", authMiddleware(), s.handleLeave)
+
+	// Rotas de eleição (usadas internamente pelos servidores, protegidas por JWT)
+	election := s.router.Group("/election", authMiddleware())
 	{
 		election.POST("/vote", s.handleRequestVote)
 		election.POST("/leader", s.handleAnnounceLeader)
 	}
 
+	// Rotas do log replicado (protegidas por JWT)
+	raft := s.router.Group("/cluster", authMiddleware())
+	{
+		raft.POST("/append_entries", s.handleAppendEntries)
+		raft.POST("/install_snapshot", s.handleInstallSnapshot)
+		raft.POST("/propor", s.handlePropor)
+		raft.GET("/log", s.handleGetEstadoLog)
+	}
+
 	// Rotas de matchmaking (protegidas por JWT)
 	matchmaking := s.router.Group("/matchmaking", authMiddleware())
 	{
-		matchmaking.POST("/solicitar_oponente", s.handleSolicitarOponente)
 		matchmaking.POST("/confirmar_partida", s.handleConfirmarPartida)
 	}
 
+	// Fila de matchmaking do cluster (protegida por JWT e mantida pelo líder)
+	fila := s.router.Group("/matchmaking/fila", authMiddleware(), s.leaderOnlyMiddleware())
+	{
+		fila.POST("/entrar", s.handleEntrarFilaGlobal)
+		fila.POST("/sair", s.handleSairFilaGlobal)
+		fila.POST("/sincronizar", s.handleSincronizarFilaGlobal)
+		fila.GET("/status", s.handleStatusFilaGlobal)
+	}
+
+	// Transações de troca entre servidores (protegidas por JWT)
+	trocas := s.router.Group("/troca", authMiddleware())
+	{
+		trocas.POST("/participar", s.handleParticiparTroca)
+		trocas.GET("/transacao/:troca_id", s.handleTransacaoTroca)
+		trocas.POST("/transacao/:troca_id/resolver", s.handleResolverTroca)
+		trocas.GET("/jogador/:nome", s.handleBuscarJogador)
+		trocas.POST("/oferta/comando", s.handleComandoOfertaTroca)
+		trocas.POST("/oferta/avisar", s.handleAvisarOfertaTroca)
+	}
+
+	// Sessões de conta: o dono atual libera a sessão quando a conta entra em outro servidor
+	s.router.POST("/sessao/liberar", authMiddleware(), s.handleLiberarSessao)
+
 	// Adiciona rota para encaminhamento de chat
 	s.router.POST("/game/chat", authMiddleware(), s.handleEncaminharChat)
 
@@ -92,6 +161,18 @@ func (s *Server) setupRoutes() {
 		stock.GET("/status", s.handleGetEstoque)
 	}
 
+	// Mercado de cartas: as operações são validadas e comprometidas pelo líder
+	s.router.GET("/mercado/anuncios", authMiddleware(), s.handleListarMercado)
+	s.router.POST("/mercado/operar", authMiddleware(), s.leaderOnlyMiddleware(), s.handleOperarMercado)
+
+	// Livro-razão das cartas (cópia replicada, qualquer servidor responde)
+	livro := s.router.Group("/razao", authMiddleware())
+	{
+		livro.GET("/carta/:carta_id", s.handleHistoricoCarta)
+		livro.GET("/jogador/:cliente_id", s.handleMovimentosJogador)
+		livro.GET("/auditoria", s.handleAuditoriaCartas)
+	}
+
 	// Rotas para a lógica do jogo (sincronização Host/Sombra)
 	game := s.router.Group("/game", authMiddleware())
 	{
@@ -109,7 +190,17 @@ func (s *Server) setupRoutes() {
 		partida.POST("/iniciar_remoto", s.handleIniciarRemoto)
 		partida.POST("/atualizar_estado", s.handleAtualizarEstado)
 		partida.POST("/notificar_pronto", s.handleNotificarPronto)
-		partida.POST("/aplicar_troca_local", s.handleAplicarTrocaLocal)
 		partida.POST("/buscar_carta", s.handleBuscarCarta)
+		partida.POST("/jogada_automatica", s.handleJogadaAutomatica)
+		partida.GET("/status/:sala_id", s.handleStatusPartida)
+		partida.GET("/replay/:sala_id", s.handleReplayPartida)
+		partida.GET("/historico/:cliente_id", s.handleHistoricoJogador)
+		partida.POST("/retomar_sessao", s.handleRetomarSessao)
+		partida.POST("/comando_jogador", s.handleComandoJogador)
+		partida.POST("/publicar_evento", s.handlePublicarEvento)
+		partida.POST("/encerrar_lobby", s.handleEncerrarLobby)
+		partida.POST("/criar_revanche", s.handleCriarRevanche)
+		partida.POST("/aceitar_convite", s.handleAceitarConvite)
+		partida.POST("/assumir_sombra", s.handleAssumirSombra)
 	}
 }
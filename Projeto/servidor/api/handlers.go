@@ -2,12 +2,18 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"jogodistribuido/protocolo"
+	"jogodistribuido/servidor/contas"
+	"jogodistribuido/servidor/matchmaking"
+	"jogodistribuido/servidor/mercado"
 	"jogodistribuido/servidor/seguranca"
 	"jogodistribuido/servidor/tipos"
+	"jogodistribuido/servidor/troca"
 	"log"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,27 +23,47 @@ import (
 // authMiddleware middleware para validar JWT em requisições REST
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Cabeçalho de autorização ausente ou mal formatado"})
+		if !autenticarServidor(c) {
 			c.Abort()
 			return
 		}
+		c.Next()
+	}
+}
 
-		tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-		log.Printf("[AUTH_MIDDLEWARE] Recebido token para validação.")
-		serverID, err := seguranca.ValidateJWT(tokenString) // Usa a função do pacote de segurança
-		if err != nil {
-			log.Printf("[AUTH_MIDDLEWARE] Erro na validação do JWT: %v", err)
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Token inválido: " + err.Error()})
-			c.Abort()
-			return
-		}
+// autenticarServidor valida o JWT de outro servidor e guarda o server_id no contexto.
+// Se o token faltar ou for inválido, já responde 401 e devolve false.
+func autenticarServidor(c *gin.Context) bool {
+	authHeader := c.GetHeader("Authorization")
+	if authHeader == "" || !strings.HasPrefix(authHeader, "Bearer ") {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Cabeçalho de autorização ausente ou mal formatado"})
+		return false
+	}
 
-		log.Printf("[AUTH_MIDDLEWARE] Token validado com sucesso para server_id: %s", serverID)
-		c.Set("server_id", serverID)
-		c.Next()
+	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
+	log.Printf("[AUTH_MIDDLEWARE] Recebido token para validação.")
+	serverID, err := seguranca.ValidateJWT(tokenString) // Usa a função do pacote de segurança
+	if err != nil {
+		log.Printf("[AUTH_MIDDLEWARE] Erro na validação do JWT: %v", err)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Token inválido: " + err.Error()})
+		return false
 	}
+
+	log.Printf("[AUTH_MIDDLEWARE] Token validado com sucesso para server_id: %s", serverID)
+	c.Set("server_id", serverID)
+	return true
+}
+
+// remetenteAutenticado confere se o endereço que a mensagem de cluster diz ser o
+// remetente (candidato, líder) é o do JWT: os servidores assinam essas mensagens com
+// o próprio endereço. Se não for, já responde 403 e devolve false.
+func remetenteAutenticado(c *gin.Context, endereco string) bool {
+	if serverID := c.GetString("server_id"); serverID != endereco {
+		log.Printf("[AUTH_MIDDLEWARE] Token de %s usado em mensagem de %s", serverID, endereco)
+		c.JSON(http.StatusForbidden, gin.H{"error": "O remetente não corresponde ao token"})
+		return false
+	}
+	return true
 }
 
 // Handlers de descoberta
@@ -69,6 +95,20 @@ func (s *Server) handleRegister(c *gin.Context) {
 		return
 	}
 
+	// `operacao` opcional: "join" (padrão) ou "leave"
+	var op struct {
+		Operacao string `json:"operacao"`
+	}
+	json.Unmarshal(body, &op)
+	if op.Operacao == "leave" {
+		s.removerServidor(c, novoServidor.Endereco)
+		return
+	}
+	// Um servidor só registra a si mesmo
+	if !remetenteAutenticado(c, novoServidor.Endereco) {
+		return
+	}
+
 	// Atualiza metadados
 	novoServidor.UltimoPing = time.Now()
 	novoServidor.Ativo = true
@@ -78,6 +118,28 @@ func (s *Server) handleRegister(c *gin.Context) {
 	c.JSON(http.StatusOK, servidoresAtuais)
 }
 
+// handleLeave remove um servidor do cluster (saída voluntária). Protegido por JWT.
+func (s *Server) handleLeave(c *gin.Context) {
+	var req struct {
+		Endereco string `json:"endereco"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Endereco) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "campo 'endereco' obrigatório"})
+		return
+	}
+	s.removerServidor(c, strings.TrimSpace(req.Endereco))
+}
+
+func (s *Server) removerServidor(c *gin.Context, endereco string) {
+	if err := s.clusterManager.RemoverServidor(endereco, "saída voluntária"); err != nil {
+		log.Printf("Falha ao remover servidor %s: %v", endereco, err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("Servidor removido do cluster: %s", endereco)
+	c.JSON(http.StatusOK, gin.H{"status": "removido", "endereco": endereco})
+}
+
 func (s *Server) handleHeartbeat(c *gin.Context) {
 	var payload map[string]interface{}
 	if err := c.ShouldBindJSON(&payload); err != nil {
@@ -89,6 +151,9 @@ func (s *Server) handleHeartbeat(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Remetente do heartbeat ausente ou inválido"})
 		return
 	}
+	if !remetenteAutenticado(c, remetente) {
+		return
+	}
 	s.clusterManager.ProcessarHeartbeat(remetente, payload)
 	c.Status(http.StatusOK)
 }
@@ -100,14 +165,19 @@ func (s *Server) handleGetServers(c *gin.Context) {
 // Handlers de eleição
 func (s *Server) handleRequestVote(c *gin.Context) {
 	var req struct {
-		Candidato string `json:"candidato"`
-		Termo     int64  `json:"termo"`
+		Candidato    string `json:"candidato"`
+		Termo        int64  `json:"termo"`
+		UltimoIndice int64  `json:"ultimo_indice"`
+		UltimoTermo  int64  `json:"ultimo_termo"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição de voto inválida"})
 		return
 	}
-	votoConcedido, termoAtual := s.clusterManager.ProcessarVoto(req.Candidato, req.Termo)
+	if !remetenteAutenticado(c, req.Candidato) {
+		return
+	}
+	votoConcedido, termoAtual := s.clusterManager.ProcessarVoto(req.Candidato, req.Termo, req.UltimoIndice, req.UltimoTermo)
 	c.JSON(http.StatusOK, gin.H{
 		"voto_concedido": votoConcedido,
 		"termo":          termoAtual,
@@ -123,10 +193,62 @@ func (s *Server) handleAnnounceLeader(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Anúncio de líder inválido"})
 		return
 	}
+	if !remetenteAutenticado(c, req.NovoLider) {
+		return
+	}
 	s.clusterManager.DeclararLider(req.NovoLider, req.Termo)
 	c.JSON(http.StatusOK, gin.H{"status": "líder anunciado recebido"})
 }
 
+// Handlers do log replicado
+func (s *Server) handleAppendEntries(c *gin.Context) {
+	var req tipos.AppendEntriesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "AppendEntries inválido"})
+		return
+	}
+	if !remetenteAutenticado(c, req.Lider) {
+		return
+	}
+	c.JSON(http.StatusOK, s.clusterManager.ProcessarAppendEntries(req))
+}
+
+// handleInstallSnapshot recebe o snapshot do líder quando as entradas que faltam
+// a este nó já foram compactadas
+func (s *Server) handleInstallSnapshot(c *gin.Context) {
+	var req tipos.InstallSnapshotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "InstallSnapshot inválido"})
+		return
+	}
+	if !remetenteAutenticado(c, req.Lider) {
+		return
+	}
+	c.JSON(http.StatusOK, s.clusterManager.ProcessarInstallSnapshot(req))
+}
+
+// handlePropor recebe propostas encaminhadas por seguidores; só o líder as aceita
+func (s *Server) handlePropor(c *gin.Context) {
+	var req struct {
+		Tipo  string          `json:"tipo"`
+		Dados json.RawMessage `json:"dados"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Tipo == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Proposta inválida"})
+		return
+	}
+	indice, err := s.clusterManager.ProporComoLider(req.Tipo, req.Dados)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"indice": indice})
+}
+
+func (s *Server) handleGetEstadoLog(c *gin.Context) {
+	c.JSON(http.StatusOK, s.clusterManager.GetEstadoLog())
+}
+
 // Middleware para verificar se a requisição deve ser processada pelo líder
 func (s *Server) leaderOnlyMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -144,15 +266,20 @@ func (s *Server) leaderOnlyMiddleware() gin.HandlerFunc {
 func (s *Server) handleComprarPacote(c *gin.Context) {
 	var req struct {
 		ClienteID string `json:"cliente_id"`
+		SalaID    string `json:"sala_id"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
 		return
 	}
 
-	pacote, err := s.servidor.FormarPacote()
+	pacote, err := s.servidor.FormarPacote(req.ClienteID, req.SalaID)
+	if errors.Is(err, contas.ErrSaldoInsuficiente) {
+		c.JSON(http.StatusPaymentRequired, gin.H{"error": err.Error()})
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao formar pacote"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao formar pacote: " + err.Error()})
 		return
 	}
 
@@ -161,6 +288,52 @@ func (s *Server) handleComprarPacote(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"pacote": pacote, "mensagem": "Compra processada, notificação sendo enviada."})
 }
 
+// handleOperarMercado executa no líder um anúncio, compra ou cancelamento pedido
+// pelo servidor do jogador
+func (s *Server) handleOperarMercado(c *gin.Context) {
+	var op mercado.Operacao
+	if err := c.ShouldBindJSON(&op); err != nil || op.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	if err := s.servidor.OperarMercado(op); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleListarMercado devolve os anúncios ativos (?raridade=&nome=&valor_min=&valor_max=)
+func (s *Server) handleListarMercado(c *gin.Context) {
+	valorMin, _ := strconv.Atoi(c.Query("valor_min"))
+	valorMax, _ := strconv.Atoi(c.Query("valor_max"))
+	filtro := mercado.Filtro{
+		Raridade: c.Query("raridade"),
+		Nome:     c.Query("nome"),
+		ValorMin: valorMin,
+		ValorMax: valorMax,
+	}
+	c.JSON(http.StatusOK, gin.H{"anuncios": s.servidor.ListarMercado(filtro)})
+}
+
+// handleHistoricoCarta devolve todos os donos de uma carta, do mais antigo ao atual
+func (s *Server) handleHistoricoCarta(c *gin.Context) {
+	cartaID := c.Param("carta_id")
+	c.JSON(http.StatusOK, gin.H{"carta_id": cartaID, "movimentos": s.servidor.HistoricoCarta(cartaID)})
+}
+
+// handleMovimentosJogador devolve as cartas que o jogador recebeu ou entregou
+func (s *Server) handleMovimentosJogador(c *gin.Context) {
+	clienteID := c.Param("cliente_id")
+	c.JSON(http.StatusOK, gin.H{"cliente_id": clienteID, "movimentos": s.servidor.MovimentosDoJogador(clienteID)})
+}
+
+// handleAuditoriaCartas aponta movimentos inconsistentes e cartas em mais de uma conta
+func (s *Server) handleAuditoriaCartas(c *gin.Context) {
+	inconsistencias, duplicadas := s.servidor.AuditarCartas()
+	c.JSON(http.StatusOK, gin.H{"inconsistencias": inconsistencias, "duplicadas": duplicadas})
+}
+
 func (s *Server) handleGetEstoque(c *gin.Context) {
 	status, total := s.servidor.GetStatusEstoque()
 	c.JSON(http.StatusOK, gin.H{"status": status, "total": total})
@@ -181,7 +354,8 @@ func (s *Server) handleEncaminharComando(c *gin.Context) {
 	log.Printf("[ENCAMINHAMENTO_RX] Comando '%s' recebido para a sala %s", req.Comando.Comando, req.SalaID)
 
 	// Processa troca de cartas DIRETAMENTE no handler HTTP (já veio do Shadow)
-	if req.Comando.Comando == "TROCAR_CARTAS" {
+	switch req.Comando.Comando {
+	case "TROCAR_CARTAS", "TROCAR_CARTAS_OFERTA", "TROCA_CONTRAPROPOSTA", "TROCA_ACEITAR", "TROCA_RECUSAR":
 		var trocaReq protocolo.TrocarCartasReq
 		if err := json.Unmarshal(req.Comando.Dados, &trocaReq); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Dados de troca inválidos"})
@@ -201,7 +375,7 @@ func (s *Server) handleEncaminharComando(c *gin.Context) {
 		}
 
 		// Processa a troca imediatamente
-		s.servidor.ProcessarTrocaDireta(sala, &trocaReq)
+		s.servidor.ProcessarTrocaDireta(sala, req.Comando.Comando, &trocaReq)
 		c.JSON(http.StatusOK, gin.H{"status": "troca processada"})
 		return
 	}
@@ -264,36 +438,6 @@ func (s *Server) handleNotificarPronto(c *gin.Context) {
 	// ... (código a ser movido)
 }
 
-// Aplica a troca localmente para um cliente deste servidor: remove a carta desejada dele e adiciona a carta oferecida
-func (s *Server) handleAplicarTrocaLocal(c *gin.Context) {
-	var req struct {
-		ClienteID       string      `json:"cliente_id"`
-		CartaDesejadaID string      `json:"carta_desejada_id"`
-		CartaOferecida  tipos.Carta `json:"carta_oferecida"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload inválido"})
-		return
-	}
-
-	aplicado, cartaRemovida, inventario := s.servidor.AplicarTrocaLocal(req.ClienteID, req.CartaDesejadaID, req.CartaOferecida)
-	if !aplicado {
-		c.JSON(http.StatusBadRequest, gin.H{"status": "nao_aplicado"})
-		return
-	}
-	log.Printf("[APLICAR_TROCA_LOCAL] Retornando inventário com %d cartas", len(inventario))
-
-	// Notifica o cliente local com o inventário atualizado
-	resp := protocolo.TrocarCartasResp{
-		Sucesso:              true,
-		Mensagem:             fmt.Sprintf("Troca realizada! Você deu '%s' e recebeu '%s'.", cartaRemovida.Nome, req.CartaOferecida.Nome),
-		InventarioAtualizado: inventario,
-	}
-	s.servidor.PublicarParaCliente(req.ClienteID, protocolo.Mensagem{Comando: "TROCA_CONCLUIDA", Dados: seguranca.MustJSON(resp)})
-
-	c.JSON(http.StatusOK, gin.H{"status": "ok", "inventario": inventario})
-}
-
 // handleBuscarCarta busca uma carta específica no inventário de um cliente
 func (s *Server) handleBuscarCarta(c *gin.Context) {
 	var req struct {
@@ -321,52 +465,162 @@ func (s *Server) handleBuscarCarta(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"encontrada": true, "carta": cartaEncontrada})
 }
 
-// HANDLERS DE MATCHMAKING GLOBAL
-func (s *Server) handleSolicitarOponente(c *gin.Context) {
+// handleJogadaAutomatica é chamado pelo Host quando o prazo de um jogador deste
+// servidor esgotou. Responde 404 se o jogador não está aqui ou não tem carta.
+func (s *Server) handleJogadaAutomatica(c *gin.Context) {
 	var req struct {
-		SolicitanteID   string `json:"solicitante_id"`
-		SolicitanteNome string `json:"solicitante_nome"`
-		ServidorOrigem  string `json:"servidor_origem"`
+		SalaID    string `json:"sala_id"`
+		ClienteID string `json:"cliente_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.SalaID == "" || req.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload inválido"})
+		return
 	}
+	if !s.servidor.JogarAutomaticamente(req.SalaID, req.ClienteID) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Jogador sem carta para jogar neste servidor"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "jogada encaminhada"})
+}
 
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Dados inválidos"})
+// Handlers da fila do cluster (só no líder, pelo middleware)
+func (s *Server) handleEntrarFilaGlobal(c *gin.Context) {
+	var entrada matchmaking.Entrada
+	if err := c.ShouldBindJSON(&entrada); err != nil || entrada.ClienteID == "" || entrada.Servidor == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Entrada inválida"})
 		return
 	}
+	s.servidor.EntrarFilaGlobal(entrada)
+	c.JSON(http.StatusOK, gin.H{"status": "na_fila"})
+}
 
-	// Tenta encontrar um oponente na fila local
-	oponente := s.servidor.RemoverPrimeiroDaFila()
+func (s *Server) handleSairFilaGlobal(c *gin.Context) {
+	var req struct {
+		ClienteID string `json:"cliente_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"removido": s.servidor.SairFilaGlobal(req.ClienteID)})
+}
 
-	if oponente != nil {
-		// Oponente encontrado!
-		log.Printf("[MATCHMAKING_RX] Oponente '%s' encontrado localmente para solicitante '%s' de %s", oponente.Nome, req.SolicitanteNome, req.ServidorOrigem)
+func (s *Server) handleSincronizarFilaGlobal(c *gin.Context) {
+	var req struct {
+		Servidor string                `json:"servidor"`
+		Entradas []matchmaking.Entrada `json:"entradas"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Servidor == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": s.servidor.SincronizarFilaGlobal(req.Servidor, req.Entradas)})
+}
+
+func (s *Server) handleStatusFilaGlobal(c *gin.Context) {
+	c.JSON(http.StatusOK, s.servidor.GetFilaGlobal())
+}
 
-		// Cria um objeto Cliente para o solicitante remoto
-		solicitante := &tipos.Cliente{
-			ID:   req.SolicitanteID,
-			Nome: req.SolicitanteNome,
+// handleConfirmarPartida executa uma fase (preparar/confirmar/abortar) do handshake
+// coordenado pelo líder para um par da fila do cluster
+func (s *Server) handleConfirmarPartida(c *gin.Context) {
+	var msg matchmaking.Confirmacao
+	if err := c.ShouldBindJSON(&msg); err != nil || msg.Pareamento.ID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	salaID, err := s.servidor.ConfirmarPartida(msg)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": msg.Fase, "sala_id": salaID})
+}
+
+// handleParticiparTroca executa uma fase (preparar/confirmar/abortar) de uma
+// transação de troca para um jogador deste servidor. 409 = recusa definitiva.
+func (s *Server) handleParticiparTroca(c *gin.Context) {
+	var p troca.Pedido
+	if err := c.ShouldBindJSON(&p); err != nil || p.TrocaID == "" || p.Lado.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	if err := s.servidor.ParticiparTroca(p); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, troca.ErrRecusado) {
+			status = http.StatusConflict
 		}
+		c.JSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": p.Fase})
+}
 
-		// Cria a sala. Servidor local será o Host.
-		salaID := s.servidor.CriarSalaRemotaComSombra(solicitante, oponente, req.ServidorOrigem)
-		// Responde ao servidor de origem com sucesso
-		c.JSON(http.StatusOK, gin.H{
-			"partida_encontrada": true,
-			"sala_id":            salaID,                      // <-- CORREÇÃO: Envia o ID da sala
-			"servidor_host":      s.servidor.GetMeuEndereco(), // <-- CORREÇÃO: Informa quem é o Host
-			"oponente_nome":      oponente.Nome,               // Retorna o nome do jogador local para o solicitante
-			"oponente_id":        oponente.ID,
-		})
+// handleTransacaoTroca devolve o estado de uma troca coordenada por este servidor
+func (s *Server) handleTransacaoTroca(c *gin.Context) {
+	t, ok := s.servidor.GetTransacaoTroca(c.Param("troca_id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Troca não encontrada neste servidor"})
 		return
 	}
+	c.JSON(http.StatusOK, t)
+}
 
-	// Não encontrou oponente
-	log.Printf("[MATCHMAKING_RX] Nenhum oponente na fila para '%s'", req.SolicitanteNome)
-	c.JSON(http.StatusOK, gin.H{"partida_encontrada": false})
+// handleResolverTroca recebe a decisão do operador sobre uma troca suspensa
+// ({"decisao": "retomar"|"abortar"})
+func (s *Server) handleResolverTroca(c *gin.Context) {
+	var req struct {
+		Decisao string `json:"decisao"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Decisao == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "campo 'decisao' obrigatório"})
+		return
+	}
+	if err := s.servidor.ResolverTroca(c.Param("troca_id"), req.Decisao); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "decisão aplicada", "decisao": req.Decisao})
 }
 
-func (s *Server) handleConfirmarPartida(c *gin.Context) {
-	// ... (código a ser movido)
+// handleBuscarJogador procura pelo nome um jogador logado neste servidor
+func (s *Server) handleBuscarJogador(c *gin.Context) {
+	jogador, ok := s.servidor.BuscarJogadorLocal(c.Param("nome"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Jogador não está neste servidor"})
+		return
+	}
+	c.JSON(http.StatusOK, jogador)
+}
+
+// handleComandoOfertaTroca executa o comando de troca fora de partida que o servidor
+// do jogador encaminhou ao coordenador da proposta. 409 = comando recusado.
+func (s *Server) handleComandoOfertaTroca(c *gin.Context) {
+	var req struct {
+		Comando string                    `json:"comando"`
+		Req     protocolo.TrocarCartasReq `json:"req"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Req.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	if err := s.servidor.ProcessarTrocaForaDePartida(req.Comando, req.Req); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleAvisarOfertaTroca entrega a um jogador deste servidor uma mensagem do
+// coordenador de uma proposta de troca fora de partida
+func (s *Server) handleAvisarOfertaTroca(c *gin.Context) {
+	var aviso troca.Aviso
+	if err := c.ShouldBindJSON(&aviso); err != nil || aviso.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	s.servidor.AvisarOfertaTroca(aviso)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
 }
 
 // HANDLERS DOS NOVOS ENDPOINTS PADRÃO
@@ -403,6 +657,13 @@ func (s *Server) handleGameEvent(c *gin.Context) {
 		return
 	}
 
+	// Um evento de uma época anterior vem de uma Sombra que ainda não soube do
+	// failover: é recusado com a época e o Host atuais, e ela avisa o jogador
+	if atual, epoca, host := s.servidor.ConferirEpocaEvento(req.MatchID, req.Epoca); !atual {
+		c.JSON(http.StatusConflict, gin.H{"error": "Época da sala vencida", "epoca": epoca, "host": host})
+		return
+	}
+
 	// Processa o evento como Host
 	estado := s.servidor.ProcessarEventoComoHost(sala, &req)
 	if estado == nil {
@@ -414,7 +675,196 @@ func (s *Server) handleGameEvent(c *gin.Context) {
 }
 
 func (s *Server) handleGameReplicate(c *gin.Context) {
-	// ... (código a ser movido)
+	var req tipos.GameReplicateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload inválido"})
+		return
+	}
+
+	// Valida assinatura (mesmo formato usado pelo Host: "matchID:eventSeq")
+	data := fmt.Sprintf("%s:%d", req.MatchID, req.EventSeq)
+	if req.Signature != seguranca.GenerateHMAC(data, seguranca.JWT_SECRET) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Assinatura inválida"})
+		return
+	}
+
+	aceito, epoca, host := s.servidor.ReplicarEstadoComoShadow(req.Host, req.MatchID, req.EventSeq, req.State)
+	if !aceito {
+		// A época e o Host atuais permitem que um Host substituído se rebaixe
+		c.JSON(http.StatusConflict, gin.H{"error": "Estado desatualizado", "epoca": epoca, "host": host})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "estado_replicado"})
+}
+
+// handleAssumirSombra recebe do Host o estado completo de uma partida cuja Sombra foi perdida
+func (s *Server) handleAssumirSombra(c *gin.Context) {
+	var req tipos.AssumirSombraRequest
+	if err := c.ShouldBindJSON(&req); err != nil || req.Host == "" || req.Estado.SalaID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload inválido"})
+		return
+	}
+	if !s.servidor.AssumirComoSombra(req.Host, req.Estado) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Época da sala vencida"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "sombra_assumida"})
+}
+
+// handleStatusPartida é usado pela Sombra para verificar se o Host ainda atende a sala
+func (s *Server) handleStatusPartida(c *gin.Context) {
+	estado, eventSeq, sombra, ok := s.servidor.GetStatusSala(c.Param("sala_id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sala não encontrada"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"estado": estado, "eventSeq": eventSeq, "sombra": sombra})
+}
+
+// handleReplayPartida exporta o log de uma partida finalizada em JSON Lines
+func (s *Server) handleReplayPartida(c *gin.Context) {
+	salaID := c.Param("sala_id")
+	conteudo, estado, ok := s.servidor.GetReplaySala(salaID)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sala não encontrada"})
+		return
+	}
+	if estado != "FINALIZADO" {
+		c.JSON(http.StatusConflict, gin.H{"error": "Partida ainda não finalizada", "estado": estado})
+		return
+	}
+	if conteudo == nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Falha ao exportar replay"})
+		return
+	}
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=replay_%s.jsonl", salaID))
+	c.Data(http.StatusOK, "application/x-ndjson", conteudo)
+}
+
+// handleHistoricoJogador lista as partidas de um jogador arquivadas neste servidor
+func (s *Server) handleHistoricoJogador(c *gin.Context) {
+	partidas := s.servidor.GetHistoricoJogador(c.Param("cliente_id"))
+	c.JSON(http.StatusOK, gin.H{"partidas": partidas, "total": len(partidas)})
+}
+
+// handleRetomarSessao é chamado pelo servidor em que um jogador reconectou, quando a
+// sessão dele está aqui. A partir daí as mensagens do jogador vão para esse servidor.
+func (s *Server) handleRetomarSessao(c *gin.Context) {
+	var req struct {
+		ClienteID string `json:"cliente_id"`
+		Gateway   string `json:"gateway"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload inválido"})
+		return
+	}
+	sessao, ok := s.servidor.RetomarSessao(req.ClienteID, req.Gateway)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Sessão não encontrada"})
+		return
+	}
+	c.JSON(http.StatusOK, sessao)
+}
+
+// handleLiberarSessao é chamado pelo servidor em que a conta fez login. Responde
+// 409 se o jogador está numa partida em andamento aqui.
+func (s *Server) handleLiberarSessao(c *gin.Context) {
+	var req struct {
+		ClienteID string `json:"cliente_id"`
+		Servidor  string `json:"servidor"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.ClienteID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Payload inválido"})
+		return
+	}
+	if err := s.servidor.LiberarSessao(req.ClienteID, req.Servidor); err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "sessão liberada"})
+}
+
+// handleComandoJogador recebe o comando de um jogador cuja sessão foi retomada em outro servidor
+func (s *Server) handleComandoJogador(c *gin.Context) {
+	var req struct {
+		SalaID  string             `json:"sala_id"`
+		Comando protocolo.Mensagem `json:"comando"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.SalaID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	go s.servidor.ProcessarComandoPartida(req.SalaID, req.Comando)
+	c.JSON(http.StatusOK, gin.H{"status": "comando recebido"})
+}
+
+// handlePublicarEvento publica no broker local um evento de partida vindo do servidor de origem
+func (s *Server) handlePublicarEvento(c *gin.Context) {
+	var req struct {
+		SalaID   string             `json:"sala_id"`
+		Mensagem protocolo.Mensagem `json:"mensagem"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.SalaID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	s.servidor.PublicarEventoPartida(req.SalaID, req.Mensagem)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleEncerrarLobby é chamado pelo outro servidor da partida quando a sala é cancelada antes de começar
+func (s *Server) handleEncerrarLobby(c *gin.Context) {
+	var req struct {
+		SalaID       string   `json:"sala_id"`
+		Motivo       string   `json:"motivo"`
+		Reenfileirar []string `json:"reenfileirar"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.SalaID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	s.servidor.EncerrarLobby(req.SalaID, req.Motivo, req.Reenfileirar)
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleCriarRevanche é chamado pelo Host para a Sombra abrir a sua cópia da sala de revanche
+func (s *Server) handleCriarRevanche(c *gin.Context) {
+	var req struct {
+		SalaAnterior string         `json:"sala_anterior"`
+		SalaID       string         `json:"sala_id"`
+		Serie        map[string]int `json:"serie"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.SalaAnterior == "" || req.SalaID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	if !s.servidor.CriarRevancheComoSombra(req.SalaAnterior, req.SalaID, req.Serie) {
+		c.JSON(http.StatusConflict, gin.H{"error": "Jogador já saiu da sala anterior"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// handleAceitarConvite consome o código de uma sala privada criada neste servidor. O
+// servidor de quem usou o código (`servidor`) será a Sombra da partida.
+func (s *Server) handleAceitarConvite(c *gin.Context) {
+	var req struct {
+		Codigo    string `json:"codigo"`
+		ClienteID string `json:"cliente_id"`
+		Nome      string `json:"nome"`
+		Servidor  string `json:"servidor"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Codigo == "" || req.ClienteID == "" || req.Nome == "" || req.Servidor == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Requisição inválida"})
+		return
+	}
+	convidado := &tipos.Cliente{ID: req.ClienteID, Nome: req.Nome}
+	salaID, err := s.servidor.AceitarConvite(req.Codigo, convidado, req.Servidor)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"sala_id": salaID})
 }
 
 // handleEncaminharChat recebe uma mensagem de chat do Host e a retransmite para o cliente local (usado pelo Shadow)
@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"jogodistribuido/servidor/seguranca"
 	"jogodistribuido/servidor/tipos"
 	"log"
 	"math/rand"
@@ -30,11 +31,23 @@ type ClusterManagerInterface interface {
 	GetServidores() map[string]*tipos.InfoServidor
 	GetServidoresAtivos(meuEndereco string) []string
 	ProcessarHeartbeat(string, map[string]interface{})
-	ProcessarVoto(string, int64) (bool, int64)
+	ProcessarVoto(candidato string, termo, ultimoIndice, ultimoTermo int64) (bool, int64)
 	DeclararLider(string, int64)
 	RegistrarServidor(*tipos.InfoServidor) map[string]*tipos.InfoServidor
+	RemoverServidor(endereco, motivo string) error
+	Sair() error
 	GetLider() string
+	GetTermoAtual() int64
 	SouLider() bool
+	ProcessarAppendEntries(tipos.AppendEntriesRequest) tipos.AppendEntriesResponse
+	ProcessarInstallSnapshot(tipos.InstallSnapshotRequest) tipos.InstallSnapshotResponse
+	Propor(tipo string, dados interface{}) (int64, error)
+	ProporComoLider(tipo string, dados interface{}) (int64, error)
+	RegistrarAplicador(tipo string, fn Aplicador)
+	RegistrarEstado(nome string, estado EstadoReplicado)
+	GetEstadoLog() map[string]interface{}
+	AoSuspeitar(func(endereco string, phi float64))
+	GetDetector() FailureDetector
 	Run()
 }
 
@@ -48,32 +61,89 @@ type Manager struct {
 	LiderAtual      string
 	TermoAtual      int64
 	UltimoHeartbeat time.Time
+	raft            logReplicado         // Log replicado, commit index e estado de replicação
+	persistencia    *persistenciaRaft    // Termo, voto e log gravados em RAFT_DIR (nil = só memória)
+	removidos       map[string]time.Time // Peers que saíram do cluster e quando
+	foiRemovido     bool                 // A saída deste nó foi comprometida: não concorre nem manda heartbeats
+	detector        FailureDetector
+	aoSuspeitar     []func(endereco string, phi float64) // Callbacks disparados quando um peer vira suspeito
+	suspeitaLider   chan struct{}                        // Antecipa a eleição quando o líder é suspeito
 }
 
 func NewManager(s ServidorInterface) *Manager {
-	return &Manager{
-		servidor:   s,
-		Servidores: make(map[string]*tipos.InfoServidor),
+	m := &Manager{
+		servidor:      s,
+		Servidores:    make(map[string]*tipos.InfoServidor),
+		raft:          novoLogReplicado(),
+		removidos:     make(map[string]time.Time),
+		detector:      NewPhiAccrual(limiarPhi()),
+		suspeitaLider: make(chan struct{}, 1),
 	}
+	persistencia, gravado, err := abrirPersistenciaRaft(os.Getenv("RAFT_DIR"))
+	if err != nil {
+		log.Fatalf("Erro ao abrir o log replicado: %v", err)
+	}
+	m.persistencia = persistencia
+	m.TermoAtual = gravado.Estado.Termo
+	m.raft.votouEm = gravado.Estado.VotouEm
+	m.raft.snapshot = gravado.Snapshot
+	m.raft.entradas = gravado.Entradas
+	// Os estados registrados são refeitos do snapshot (restaurarSnapshotLocal) e das
+	// entradas seguintes, que por isso não podem ter sido gravadas em outro lugar
+	m.raft.commitIndex = gravado.Snapshot.Indice
+	m.raft.ultimoAplic = gravado.Snapshot.Indice
+	// Até o log dizer outra coisa, o cluster é este nó e os peers de PEERS
+	m.raft.membrosBase[s.GetMeuEndereco()] = true
+	for _, addr := range peersIniciais() {
+		m.raft.membrosBase[addr] = true
+	}
+	if membros, ok := membrosDoSnapshot(gravado.Snapshot); ok {
+		m.raft.membrosBase = membros
+	}
+	m.recalcularMembros()
+	m.registrarAplicadoresMembros()
+	m.raft.estados[ESTADO_MEMBROS] = membrosReplicados{m}
+	m.AoSuspeitar(func(endereco string, _ float64) {
+		if endereco == m.GetLider() {
+			select {
+			case m.suspeitaLider <- struct{}{}:
+			default:
+			}
+		}
+	})
+	return m
 }
 
 func (m *Manager) Run() {
+	m.restaurarSnapshotLocal()
 	go m.descobrirServidores()
 	go m.enviarHeartbeats()
 	go m.processoEleicao()
+	go m.loopReplicacao()
+	go m.monitorarMembros()
+	go m.monitorarSuspeitas()
+}
+
+// peersIniciais devolve os endereços da variável PEERS.
+func peersIniciais() []string {
+	peers := make([]string, 0)
+	for _, peerAddr := range strings.Split(os.Getenv("PEERS"), ",") {
+		if peerAddr = strings.TrimSpace(peerAddr); peerAddr != "" {
+			peers = append(peers, peerAddr)
+		}
+	}
+	return peers
 }
 
 // descobrirServidores tenta se conectar a peers conhecidos para se registrar.
 func (m *Manager) descobrirServidores() {
-	peersStr := os.Getenv("PEERS")
-	if peersStr == "" {
+	peers := peersIniciais()
+	if len(peers) == 0 {
 		log.Println("Nenhum peer inicial fornecido. Assumindo ser o primeiro nó.")
 		return
 	}
-	peers := strings.Split(peersStr, ",")
 	for _, peerAddr := range peers {
-		peerAddr = strings.TrimSpace(peerAddr)
-		if peerAddr != "" && peerAddr != m.servidor.GetMeuEndereco() {
+		if peerAddr != m.servidor.GetMeuEndereco() {
 			go m.registrarComPeer(peerAddr)
 		}
 	}
@@ -89,7 +159,7 @@ func (m *Manager) registrarComPeer(peerAddr string) {
 	body, _ := json.Marshal(meuInfo)
 
 	for i := 0; i < 5; i++ { // Tenta 5 vezes
-		resp, err := http.Post(endpoint, "application/json", bytes.NewBuffer(body))
+		resp, err := m.postComToken(endpoint, body, 5*time.Second)
 		if err != nil {
 			log.Printf("Falha ao registrar com o peer %s: %v. Tentando novamente em 5s...", peerAddr, err)
 			time.Sleep(5 * time.Second)
@@ -127,6 +197,10 @@ func (m *Manager) enviarHeartbeats() {
 	defer ticker.Stop()
 	for range ticker.C {
 		m.mutex.RLock()
+		if m.foiRemovido {
+			m.mutex.RUnlock()
+			continue
+		}
 		peers := make([]string, 0, len(m.Servidores))
 		for addr := range m.Servidores {
 			if addr != m.servidor.GetMeuEndereco() {
@@ -138,10 +212,11 @@ func (m *Manager) enviarHeartbeats() {
 		payload := map[string]interface{}{
 			"remetente": m.servidor.GetMeuEndereco(),
 		}
-		// Somente o líder anexa seu status ao heartbeat
+		// Somente o líder anexa seu status ao heartbeat, com o termo em que foi eleito
 		m.mutex.RLock()
 		if m.souLider {
 			payload["lider"] = m.LiderAtual
+			payload["termo"] = m.TermoAtual
 		}
 		m.mutex.RUnlock()
 
@@ -150,7 +225,9 @@ func (m *Manager) enviarHeartbeats() {
 		for _, addr := range peers {
 			go func(addr string) {
 				url := fmt.Sprintf("http://%s/heartbeat", addr)
-				http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+				if resp, err := m.postComToken(url, jsonData, 2*time.Second); err == nil {
+					resp.Body.Close()
+				}
 			}(addr)
 		}
 	}
@@ -166,16 +243,22 @@ func (m *Manager) processoEleicao() {
 		ultimoPingLider := m.UltimoHeartbeat
 		liderExiste := m.LiderAtual != ""
 		souLider := m.souLider
+		foiRemovido := m.foiRemovido
 		m.mutex.RUnlock()
 
 		// Se não sou o líder, verifico se o líder atual está ativo.
-		// Se não há líder ou o último heartbeat do líder foi há muito tempo, inicia a eleição.
-		if !souLider && (!liderExiste || time.Since(ultimoPingLider) > ELEICAO_TIMEOUT) {
+		// Se não há líder, o detector de falhas suspeita dele ou o último heartbeat do
+		// líder foi há muito tempo (líder sem histórico no detector), inicia a eleição.
+		liderSuspeito := liderExiste && m.detector.Suspeito(m.GetLider())
+		if !souLider && !foiRemovido && (!liderExiste || liderSuspeito || time.Since(ultimoPingLider) > ELEICAO_TIMEOUT) {
 			log.Printf("Líder inativo ou inexistente. Iniciando nova eleição.")
 			m.iniciarEleicao()
 		}
-		// Verifica a cada X segundos
-		time.Sleep(ELEICAO_TIMEOUT / 2)
+		// Verifica a cada X segundos, ou assim que o detector suspeitar do líder
+		select {
+		case <-time.After(ELEICAO_TIMEOUT / 2):
+		case <-m.suspeitaLider:
+		}
 	}
 }
 
@@ -183,6 +266,13 @@ func (m *Manager) iniciarEleicao() {
 	m.mutex.Lock()
 	m.TermoAtual++
 	termoCandidato := m.TermoAtual
+	m.raft.votouEm = m.servidor.GetMeuEndereco()
+	if err := m.salvarEstadoRaft(); err != nil {
+		m.mutex.Unlock()
+		log.Printf("[RAFT_ERRO] Eleição do termo %d cancelada: %v", termoCandidato, err)
+		return
+	}
+	ultimoIndice, ultimoTermo := m.ultimoIndiceTermo()
 	// Vota em si mesmo
 	votos := 1
 	m.mutex.Unlock()
@@ -190,20 +280,21 @@ func (m *Manager) iniciarEleicao() {
 	log.Printf("Iniciando eleição para o termo %d", termoCandidato)
 
 	m.mutex.RLock()
-	totalServidores := len(m.Servidores)
+	totalServidores := m.totalMembros()
 	peers := make([]string, 0, totalServidores)
-	for addr, srv := range m.Servidores {
-		// Envia pedido de voto para todos os outros servidores ativos
-		if addr != m.servidor.GetMeuEndereco() && srv.Ativo {
-			peers = append(peers, addr)
+	for addr := range m.raft.membros {
+		// Envia pedido de voto para os outros membros que não estão inativos
+		if srv, existe := m.Servidores[addr]; addr == m.servidor.GetMeuEndereco() || (existe && !srv.Ativo) {
+			continue
 		}
+		peers = append(peers, addr)
 	}
 	m.mutex.RUnlock()
 
 	// Se for o único servidor, torna-se líder imediatamente
 	if totalServidores <= 1 {
 		log.Println("Servidor único, tornando-se líder.")
-		m.tornarLider()
+		m.tornarLider(termoCandidato)
 		return
 	}
 
@@ -217,13 +308,16 @@ func (m *Manager) iniciarEleicao() {
 		go func(addr string) {
 			url := fmt.Sprintf("http://%s/election/vote", addr)
 			reqBody, _ := json.Marshal(map[string]interface{}{
-				"candidato": m.servidor.GetMeuEndereco(),
-				"termo":     termoCandidato,
+				"candidato":     m.servidor.GetMeuEndereco(),
+				"termo":         termoCandidato,
+				"ultimo_indice": ultimoIndice,
+				"ultimo_termo":  ultimoTermo,
 			})
 
 			httpClient := &http.Client{Timeout: 2 * time.Second}
 			req, _ := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(reqBody))
 			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+seguranca.GenerateJWT(m.servidor.GetMeuEndereco()))
 
 			resp, err := httpClient.Do(req)
 			if err == nil && resp.StatusCode == http.StatusOK {
@@ -246,7 +340,7 @@ func (m *Manager) iniciarEleicao() {
 			log.Printf("Voto recebido. Total de votos: %d/%d", votos, maioriaNecessaria)
 			if votos >= maioriaNecessaria {
 				log.Printf("Maioria alcançada. Tornando-se líder para o termo %d.", termoCandidato)
-				m.tornarLider()
+				m.tornarLider(termoCandidato)
 				return
 			}
 		case <-ctx.Done():
@@ -256,13 +350,22 @@ func (m *Manager) iniciarEleicao() {
 	}
 }
 
-func (m *Manager) tornarLider() {
+// tornarLider assume a liderança do termo em que a eleição foi vencida
+func (m *Manager) tornarLider(termoAtual int64) {
 	m.mutex.Lock()
+	if m.TermoAtual != termoAtual {
+		// Outro termo começou durante a contagem de votos; esta vitória não vale mais
+		m.mutex.Unlock()
+		log.Printf("Termo %d substituído durante a eleição. Abortando liderança.", termoAtual)
+		return
+	}
 	m.souLider = true
 	m.LiderAtual = m.servidor.GetMeuEndereco()
-	termoAtual := m.TermoAtual
+	m.prepararLideranca()
 	m.mutex.Unlock()
 
+	m.replicarParaPeers()
+
 	log.Printf("================ SOU O LÍDER (Termo: %d) ================", termoAtual)
 
 	// Notifica todos os outros servidores sobre a liderança
@@ -283,7 +386,9 @@ func (m *Manager) tornarLider() {
 	for _, addr := range peers {
 		go func(addr string) {
 			url := fmt.Sprintf("http://%s/election/leader", addr)
-			http.Post(url, "application/json", bytes.NewBuffer(reqBody))
+			if resp, err := m.postComToken(url, reqBody, 2*time.Second); err == nil {
+				resp.Body.Close()
+			}
 		}(addr)
 	}
 }
@@ -314,12 +419,17 @@ func (m *Manager) GetServidoresAtivos(meuEndereco string) []string {
 }
 
 func (m *Manager) ProcessarHeartbeat(endereco string, dados map[string]interface{}) {
+	m.detector.Heartbeat(endereco, time.Now())
+
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	if servidor, existe := m.Servidores[endereco]; existe {
 		servidor.UltimoPing = time.Now()
 		servidor.Ativo = true
+	} else if saiu, removido := m.removidos[endereco]; removido && time.Since(saiu) < MEMBRO_INATIVO_APOS {
+		// Heartbeat atrasado de um peer que acabou de sair; só volta via /register
+		return
 	} else {
 		m.Servidores[endereco] = &tipos.InfoServidor{
 			Endereco:   endereco,
@@ -328,41 +438,99 @@ func (m *Manager) ProcessarHeartbeat(endereco string, dados map[string]interface
 		}
 		log.Printf("Novo servidor descoberto via heartbeat: %s", endereco)
 	}
+	if m.souLider && !m.raft.membros[endereco] {
+		// Peer fora da configuração (novo, removido antes, ou cuja entrada foi adiada): registra a entrada no log
+		go m.proporEntradaMembro(endereco)
+	}
 
-	if lider, ok := dados["lider"].(string); ok && lider != "" {
-		if m.LiderAtual != lider {
-			log.Printf("Heartbeat recebido de %s, que reporta o líder como %s", endereco, lider)
-		}
-		m.LiderAtual = lider
-		m.souLider = (lider == m.servidor.GetMeuEndereco())
-		m.UltimoHeartbeat = time.Now()
+	lider, ok := dados["lider"].(string)
+	if !ok || lider == "" {
+		return
+	}
+	termoFloat, _ := dados["termo"].(float64) // Números de um map JSON chegam como float64
+	termo := int64(termoFloat)
+	if termo < m.TermoAtual {
+		// Líder deposto que ainda não soube da nova eleição
+		return
+	}
+	if termo > m.TermoAtual {
+		m.adotarTermo(termo)
+	}
+	// Só uma eleição vencida (tornarLider) promove este nó; um heartbeat apenas
+	// reconhece a liderança de outro servidor no termo atual
+	if lider == m.servidor.GetMeuEndereco() || m.souLider {
+		return
+	}
+	if m.LiderAtual != lider {
+		log.Printf("Heartbeat recebido de %s, que reporta o líder como %s (termo %d)", endereco, lider, termo)
 	}
+	m.LiderAtual = lider
+	m.UltimoHeartbeat = time.Now()
 }
 
-func (m *Manager) ProcessarVoto(candidato string, termo int64) (bool, int64) {
+func (m *Manager) ProcessarVoto(candidato string, termo, ultimoIndice, ultimoTermo int64) (bool, int64) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
+	if termo < m.TermoAtual {
+		return false, m.TermoAtual
+	}
 	if termo > m.TermoAtual {
-		m.TermoAtual = termo
-		m.LiderAtual = "" // Anula o líder ao votar em um novo termo
-		log.Printf("Votando em %s para termo %d", candidato, termo)
-		return true, m.TermoAtual
+		m.adotarTermo(termo)
+	}
+	if m.raft.votouEm != "" && m.raft.votouEm != candidato {
+		return false, m.TermoAtual
 	}
-	return false, m.TermoAtual
+	// Só vota em quem tem um log pelo menos tão atualizado quanto o meu
+	if !m.logAtualizado(ultimoIndice, ultimoTermo) {
+		log.Printf("Voto negado a %s para termo %d: log desatualizado (%d/%d)", candidato, termo, ultimoIndice, ultimoTermo)
+		return false, m.TermoAtual
+	}
+	// O voto só é dado depois de gravado: um reinício não pode votar de novo no termo
+	m.raft.votouEm = candidato
+	if err := m.salvarEstadoRaft(); err != nil {
+		m.raft.votouEm = ""
+		log.Printf("[RAFT_ERRO] Voto em %s não gravado: %v", candidato, err)
+		return false, m.TermoAtual
+	}
+	log.Printf("Votando em %s para termo %d", candidato, termo)
+	return true, m.TermoAtual
 }
 
 func (m *Manager) DeclararLider(novoLider string, termo int64) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
-	if termo >= m.TermoAtual {
-		m.TermoAtual = termo
-		m.LiderAtual = novoLider
-		m.souLider = (novoLider == m.servidor.GetMeuEndereco())
-		m.UltimoHeartbeat = time.Now()
-		log.Printf("Novo líder reconhecido via declaração: %s (termo %d)", novoLider, termo)
+	if termo < m.TermoAtual {
+		return
+	}
+	if termo > m.TermoAtual {
+		m.adotarTermo(termo)
+	}
+	// A declaração não promove este nó: isso só acontece em tornarLider
+	if novoLider == m.servidor.GetMeuEndereco() || m.souLider {
+		return
+	}
+	m.LiderAtual = novoLider
+	m.UltimoHeartbeat = time.Now()
+	log.Printf("Novo líder reconhecido via declaração: %s (termo %d)", novoLider, termo)
+}
+
+// adotarTermo passa para um termo maior como seguidor: o voto e o líder conhecidos
+// valiam para o termo anterior. Assume o lock ativo.
+func (m *Manager) adotarTermo(termo int64) {
+	m.TermoAtual = termo
+	m.raft.votouEm = ""
+	m.souLider = false
+	m.LiderAtual = ""
+	if err := m.salvarEstadoRaft(); err != nil {
+		log.Printf("[RAFT_ERRO] Termo %d não gravado: %v", termo, err)
 	}
 }
 
+// salvarEstadoRaft grava o termo atual e o voto dado nele. Assume o lock ativo.
+func (m *Manager) salvarEstadoRaft() error {
+	return m.persistencia.salvarEstado(estadoRaft{Termo: m.TermoAtual, VotouEm: m.raft.votouEm})
+}
+
 func (m *Manager) RegistrarServidor(novoServidor *tipos.InfoServidor) map[string]*tipos.InfoServidor {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -376,6 +544,12 @@ func (m *Manager) RegistrarServidor(novoServidor *tipos.InfoServidor) map[string
 	}
 
 	m.Servidores[novoServidor.Endereco] = novoServidor
+	delete(m.removidos, novoServidor.Endereco)
+	// Só o líder propõe: cada nó que recebe o mesmo /register proporia a mesma entrada.
+	// Se o novo servidor não falou com o líder, o heartbeat dele leva o líder a propor.
+	if m.souLider {
+		go m.proporEntradaMembro(novoServidor.Endereco)
+	}
 
 	return servidoresAtuais
 }
@@ -386,6 +560,12 @@ func (m *Manager) GetLider() string {
 	return m.LiderAtual
 }
 
+func (m *Manager) GetTermoAtual() int64 {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.TermoAtual
+}
+
 func (m *Manager) SouLider() bool {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
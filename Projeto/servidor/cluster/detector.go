@@ -0,0 +1,193 @@
+package cluster
+
+import (
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	PHI_LIMIAR_PADRAO    = 8.0                    // Phi a partir do qual um nó é considerado suspeito
+	PHI_JANELA           = 100                    // Número de intervalos guardados por nó
+	PHI_DESVIO_MINIMO    = 500 * time.Millisecond // Evita phi explosivo com heartbeats muito regulares
+	PHI_PAUSA_ACEITAVEL  = 2 * time.Second        // Atraso tolerado além da média (GC, rede)
+	DETECTOR_VERIFICACAO = 1 * time.Second        // Intervalo de avaliação das suspeitas
+)
+
+// FailureDetector avalia a vivacidade dos nós a partir das chegadas de heartbeat.
+type FailureDetector interface {
+	// Heartbeat registra a chegada de um heartbeat do nó.
+	Heartbeat(endereco string, chegada time.Time)
+	// Phi devolve o nível de suspeita atual do nó (0 = sem suspeita ou sem dados).
+	Phi(endereco string) float64
+	// Suspeito indica se o nível de suspeita passou do limiar configurado.
+	Suspeito(endereco string) bool
+	// Esquecer descarta o histórico do nó (ex.: ao sair do cluster).
+	Esquecer(endereco string)
+}
+
+// historicoChegadas guarda os últimos intervalos entre heartbeats de um nó.
+type historicoChegadas struct {
+	ultimaChegada time.Time
+	intervalos    []float64 // Em milissegundos
+	soma          float64
+	somaQuadrados float64
+}
+
+func (h *historicoChegadas) adicionar(intervalo float64) {
+	if len(h.intervalos) >= PHI_JANELA {
+		antigo := h.intervalos[0]
+		h.intervalos = h.intervalos[1:]
+		h.soma -= antigo
+		h.somaQuadrados -= antigo * antigo
+	}
+	h.intervalos = append(h.intervalos, intervalo)
+	h.soma += intervalo
+	h.somaQuadrados += intervalo * intervalo
+}
+
+// PhiAccrual implementa o detector phi-accrual (Hayashibara et al.): em vez de um
+// timeout fixo, phi cresce continuamente conforme o atraso fica improvável em
+// relação à distribuição observada dos intervalos entre heartbeats.
+type PhiAccrual struct {
+	mutex     sync.RWMutex
+	limiar    float64
+	historico map[string]*historicoChegadas
+}
+
+// NewPhiAccrual cria o detector com o limiar informado (<= 0 usa PHI_LIMIAR_PADRAO).
+func NewPhiAccrual(limiar float64) *PhiAccrual {
+	if limiar <= 0 {
+		limiar = PHI_LIMIAR_PADRAO
+	}
+	return &PhiAccrual{
+		limiar:    limiar,
+		historico: make(map[string]*historicoChegadas),
+	}
+}
+
+// limiarPhi lê PHI_LIMIAR do ambiente.
+func limiarPhi() float64 {
+	if v := os.Getenv("PHI_LIMIAR"); v != "" {
+		if limiar, err := strconv.ParseFloat(v, 64); err == nil && limiar > 0 {
+			return limiar
+		}
+		log.Printf("[DETECTOR] PHI_LIMIAR inválido (%q). Usando %.1f.", v, PHI_LIMIAR_PADRAO)
+	}
+	return PHI_LIMIAR_PADRAO
+}
+
+func (d *PhiAccrual) Heartbeat(endereco string, chegada time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	h, existe := d.historico[endereco]
+	if !existe {
+		d.historico[endereco] = &historicoChegadas{ultimaChegada: chegada}
+		return
+	}
+	if chegada.After(h.ultimaChegada) {
+		h.adicionar(float64(chegada.Sub(h.ultimaChegada).Milliseconds()))
+		h.ultimaChegada = chegada
+	}
+}
+
+func (d *PhiAccrual) Phi(endereco string) float64 {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	h, existe := d.historico[endereco]
+	if !existe || len(h.intervalos) == 0 {
+		return 0
+	}
+
+	n := float64(len(h.intervalos))
+	media := h.soma / n
+	variancia := h.somaQuadrados/n - media*media
+	desvio := math.Sqrt(math.Max(variancia, 0))
+	desvio = math.Max(desvio, float64(PHI_DESVIO_MINIMO.Milliseconds()))
+	media += float64(PHI_PAUSA_ACEITAVEL.Milliseconds())
+
+	decorrido := float64(time.Since(h.ultimaChegada).Milliseconds())
+	return phi(decorrido, media, desvio)
+}
+
+func (d *PhiAccrual) Suspeito(endereco string) bool {
+	return d.Phi(endereco) >= d.limiar
+}
+
+func (d *PhiAccrual) Esquecer(endereco string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	delete(d.historico, endereco)
+}
+
+// phi usa a aproximação logística da CDF normal (a mesma do Akka/Cassandra).
+func phi(decorrido, media, desvio float64) float64 {
+	y := (decorrido - media) / desvio
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if decorrido > media {
+		return -math.Log10(e / (1.0 + e))
+	}
+	return -math.Log10(1.0 - 1.0/(1.0+e))
+}
+
+// AoSuspeitar registra uma função chamada quando um nó passa a ser suspeito.
+func (m *Manager) AoSuspeitar(cb func(endereco string, phi float64)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.aoSuspeitar = append(m.aoSuspeitar, cb)
+}
+
+// GetDetector expõe o detector de falhas usado pelo manager.
+func (m *Manager) GetDetector() FailureDetector {
+	return m.detector
+}
+
+// monitorarSuspeitas avalia periodicamente os peers e dispara os callbacks apenas
+// na transição de confiável para suspeito.
+func (m *Manager) monitorarSuspeitas() {
+	suspeitos := make(map[string]bool)
+	ticker := time.NewTicker(DETECTOR_VERIFICACAO)
+	defer ticker.Stop()
+	for range ticker.C {
+		m.mutex.RLock()
+		peers := make([]string, 0, len(m.Servidores))
+		for addr := range m.Servidores {
+			if addr != m.servidor.GetMeuEndereco() {
+				peers = append(peers, addr)
+			}
+		}
+		callbacks := append([]func(string, float64){}, m.aoSuspeitar...)
+		m.mutex.RUnlock()
+
+		for _, addr := range peers {
+			nivel := m.detector.Phi(addr)
+			if !m.detector.Suspeito(addr) {
+				if suspeitos[addr] {
+					log.Printf("[DETECTOR] %s voltou a responder (phi %.2f)", addr, nivel)
+					delete(suspeitos, addr)
+				}
+				continue
+			}
+			if suspeitos[addr] {
+				continue
+			}
+			suspeitos[addr] = true
+			log.Printf("[DETECTOR] %s suspeito de falha (phi %.2f)", addr, nivel)
+
+			m.mutex.Lock()
+			if srv, existe := m.Servidores[addr]; existe {
+				srv.Ativo = false
+			}
+			m.mutex.Unlock()
+
+			for _, cb := range callbacks {
+				go cb(addr, nivel)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package cluster
+
+import (
+	"testing"
+	"time"
+)
+
+// heartbeatsRegulares registra `n` heartbeats separados por `intervalo`, o último
+// `atraso` antes de agora
+func heartbeatsRegulares(d *PhiAccrual, endereco string, n int, intervalo, atraso time.Duration) {
+	ultimo := time.Now().Add(-atraso)
+	for i := n - 1; i >= 0; i-- {
+		d.Heartbeat(endereco, ultimo.Add(-time.Duration(i)*intervalo))
+	}
+}
+
+func TestPhiAccrual(t *testing.T) {
+	casos := []struct {
+		nome     string
+		preparar func(d *PhiAccrual)
+		phiZero  bool
+		suspeito bool
+	}{
+		{
+			nome:     "nó desconhecido",
+			preparar: func(d *PhiAccrual) {},
+			phiZero:  true,
+		},
+		{
+			nome:     "um heartbeat só, sem intervalo",
+			preparar: func(d *PhiAccrual) { d.Heartbeat("n", time.Now().Add(-time.Minute)) },
+			phiZero:  true,
+		},
+		{
+			nome:     "heartbeat recente",
+			preparar: func(d *PhiAccrual) { heartbeatsRegulares(d, "n", 20, time.Second, 0) },
+		},
+		{
+			nome:     "atraso dentro da pausa aceitável",
+			preparar: func(d *PhiAccrual) { heartbeatsRegulares(d, "n", 20, time.Second, 2*time.Second) },
+		},
+		{
+			nome:     "heartbeats pararam",
+			preparar: func(d *PhiAccrual) { heartbeatsRegulares(d, "n", 20, time.Second, 30*time.Second) },
+			suspeito: true,
+		},
+		{
+			nome: "histórico esquecido",
+			preparar: func(d *PhiAccrual) {
+				heartbeatsRegulares(d, "n", 20, time.Second, 30*time.Second)
+				d.Esquecer("n")
+			},
+			phiZero: true,
+		},
+		{
+			nome: "heartbeat antigo fora de ordem é ignorado",
+			preparar: func(d *PhiAccrual) {
+				heartbeatsRegulares(d, "n", 20, time.Second, 0)
+				d.Heartbeat("n", time.Now().Add(-time.Hour))
+			},
+		},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			d := NewPhiAccrual(0)
+			c.preparar(d)
+			phi := d.Phi("n")
+			if (phi == 0) != c.phiZero {
+				t.Errorf("phi = %.2f, esperado zero: %v", phi, c.phiZero)
+			}
+			if got := d.Suspeito("n"); got != c.suspeito {
+				t.Errorf("suspeito = %v (phi %.2f), esperado %v", got, phi, c.suspeito)
+			}
+		})
+	}
+}
+
+func TestPhiCresceComOAtraso(t *testing.T) {
+	anterior := -1.0
+	for _, decorrido := range []float64{0, 1000, 2000, 3000, 5000, 8000} {
+		valor := phi(decorrido, 3000, 500)
+		if valor < anterior {
+			t.Errorf("phi(%.0f) = %.2f menor que o anterior %.2f", decorrido, valor, anterior)
+		}
+		anterior = valor
+	}
+	if valor := phi(3000, 3000, 500); valor < 0.29 || valor > 0.31 {
+		t.Errorf("phi na média = %.3f, esperado ~0.30 (metade da probabilidade)", valor)
+	}
+}
+
+func TestPhiAccrualLimiarEJanela(t *testing.T) {
+	if d := NewPhiAccrual(-1); d.limiar != PHI_LIMIAR_PADRAO {
+		t.Errorf("limiar %.1f, esperado o padrão %.1f", d.limiar, PHI_LIMIAR_PADRAO)
+	}
+
+	// Um limiar baixo deixa o mesmo atraso suspeito
+	d := NewPhiAccrual(0.5)
+	heartbeatsRegulares(d, "n", 20, time.Second, 4*time.Second)
+	if !d.Suspeito("n") {
+		t.Errorf("atraso de 4s não suspeito com limiar 0.5 (phi %.2f)", d.Phi("n"))
+	}
+
+	heartbeatsRegulares(d, "m", 2*PHI_JANELA, time.Second, 0)
+	if n := len(d.historico["m"].intervalos); n != PHI_JANELA {
+		t.Errorf("%d intervalos guardados, esperado %d", n, PHI_JANELA)
+	}
+}
@@ -0,0 +1,245 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"jogodistribuido/servidor/tipos"
+	"log"
+	"time"
+)
+
+const (
+	MEMBRO_INATIVO_APOS  = 3 * HEARTBEAT_INTERVALO // Sem ping por esse tempo, o peer é marcado como inativo
+	MEMBRO_REMOVIDO_APOS = 60 * time.Second        // Sem ping por esse tempo, o líder propõe a remoção do peer
+
+	ENTRADA_MEMBRO_ENTRADA = "MEMBRO_ENTRADA" // Servidor passa a fazer parte do cluster
+	ENTRADA_MEMBRO_SAIDA   = "MEMBRO_SAIDA"   // Servidor deixa o cluster (saída voluntária ou expulsão)
+)
+
+// mudancaMembro é o payload das entradas de membership no log replicado.
+type mudancaMembro struct {
+	Endereco string `json:"endereco"`
+	Motivo   string `json:"motivo,omitempty"`
+}
+
+// lerMudancaMembro decodifica uma entrada de membership. Devolve false para entradas
+// de outros tipos ou sem endereço.
+func lerMudancaMembro(entrada tipos.EntradaLog) (mudancaMembro, bool) {
+	var mudanca mudancaMembro
+	if entrada.Tipo != ENTRADA_MEMBRO_ENTRADA && entrada.Tipo != ENTRADA_MEMBRO_SAIDA {
+		return mudanca, false
+	}
+	if err := json.Unmarshal(entrada.Dados, &mudanca); err != nil || mudanca.Endereco == "" {
+		return mudanca, false
+	}
+	return mudanca, true
+}
+
+// membrosAte devolve a configuração do cluster depois das entradas de membership até
+// `indice`, a partir dos membros do snapshot. Assume o lock ativo.
+func (m *Manager) membrosAte(indice int64) map[string]bool {
+	membros := make(map[string]bool, len(m.raft.membrosBase)+1)
+	for addr := range m.raft.membrosBase {
+		membros[addr] = true
+	}
+	for _, entrada := range m.raft.entradas {
+		if entrada.Indice > indice {
+			break
+		}
+		mudanca, ok := lerMudancaMembro(entrada)
+		if !ok {
+			continue
+		}
+		if entrada.Tipo == ENTRADA_MEMBRO_ENTRADA {
+			membros[mudanca.Endereco] = true
+		} else {
+			delete(membros, mudanca.Endereco)
+		}
+	}
+	return membros
+}
+
+// recalcularMembros põe em uso a configuração do fim do log. Como no Raft, uma
+// mudança de membership vale assim que a entrada é anexada, comprometida ou não (e
+// deixa de valer se ela for truncada); com uma mudança de um servidor por vez, a
+// configuração antiga e a nova nunca formam maiorias separadas. Chamado sempre que
+// as entradas ou o snapshot mudam. Assume o lock ativo.
+func (m *Manager) recalcularMembros() {
+	ultimo, _ := m.ultimoIndiceTermo()
+	m.raft.membros = m.membrosAte(ultimo)
+}
+
+// membrosDoSnapshot lê os membros gravados no snapshot (false se ele não os tem).
+func membrosDoSnapshot(snapshot tipos.SnapshotLog) (map[string]bool, bool) {
+	conteudo, ok := snapshot.Estados[ESTADO_MEMBROS]
+	if !ok {
+		return nil, false
+	}
+	var enderecos []string
+	if err := json.Unmarshal(conteudo, &enderecos); err != nil {
+		log.Printf("[MEMBROS] Membros do snapshot do índice %d inválidos: %v", snapshot.Indice, err)
+		return nil, false
+	}
+	membros := make(map[string]bool, len(enderecos))
+	for _, addr := range enderecos {
+		membros[addr] = true
+	}
+	return membros, true
+}
+
+// conferirMudancaMembro decide, no líder, se a mudança pode entrar no log. Devolve
+// true se ela já vale e a entrada seria repetida (vários nós recebem o mesmo
+// /register e o mesmo peer manda vários heartbeats). Como no Raft, só uma mudança
+// fica pendente por vez, e só depois de o líder comprometer uma entrada do próprio
+// termo. A pendente só libera a próxima depois de aplicada, para que um heartbeat
+// atrasado de quem acabou de sair não seja tomado por uma nova entrada. Assume o lock ativo.
+func (m *Manager) conferirMudancaMembro(tipo string, mudanca mudancaMembro) (bool, error) {
+	for i := len(m.raft.entradas) - 1; i >= 0 && m.raft.entradas[i].Indice > m.raft.ultimoAplic; i-- {
+		if _, ok := lerMudancaMembro(m.raft.entradas[i]); ok {
+			return false, fmt.Errorf("a mudança de membership da entrada %d ainda não foi aplicada", m.raft.entradas[i].Indice)
+		}
+	}
+	if (tipo == ENTRADA_MEMBRO_ENTRADA) == m.raft.membros[mudanca.Endereco] {
+		return true, nil
+	}
+	if m.termoEm(m.raft.commitIndex) != m.TermoAtual {
+		return false, fmt.Errorf("o líder ainda não comprometeu uma entrada do termo %d", m.TermoAtual)
+	}
+	return false, nil
+}
+
+// registrarAplicadoresMembros liga as entradas de membership ao mapa de servidores.
+func (m *Manager) registrarAplicadoresMembros() {
+	m.raft.aplicadores[ENTRADA_MEMBRO_ENTRADA] = m.aplicarEntradaMembro
+	m.raft.aplicadores[ENTRADA_MEMBRO_SAIDA] = m.aplicarSaidaMembro
+}
+
+func (m *Manager) aplicarEntradaMembro(entrada tipos.EntradaLog) {
+	var mudanca mudancaMembro
+	if err := json.Unmarshal(entrada.Dados, &mudanca); err != nil || mudanca.Endereco == "" {
+		log.Printf("[MEMBROS] Entrada %d de membership inválida", entrada.Indice)
+		return
+	}
+
+	// O quórum já usa o membro desde que a entrada foi anexada (recalcularMembros)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if mudanca.Endereco == m.servidor.GetMeuEndereco() {
+		m.foiRemovido = false
+	}
+	delete(m.removidos, mudanca.Endereco)
+	if srv, existe := m.Servidores[mudanca.Endereco]; existe {
+		srv.Ativo = true
+		return
+	}
+	m.Servidores[mudanca.Endereco] = &tipos.InfoServidor{
+		Endereco:   mudanca.Endereco,
+		UltimoPing: time.Now(),
+		Ativo:      true,
+	}
+	if m.souLider {
+		ultimo, _ := m.ultimoIndiceTermo()
+		m.raft.nextIndex[mudanca.Endereco] = ultimo + 1
+	}
+	log.Printf("[MEMBROS] %s entrou no cluster (termo %d, índice %d)", mudanca.Endereco, entrada.Termo, entrada.Indice)
+}
+
+func (m *Manager) aplicarSaidaMembro(entrada tipos.EntradaLog) {
+	var mudanca mudancaMembro
+	if err := json.Unmarshal(entrada.Dados, &mudanca); err != nil || mudanca.Endereco == "" {
+		log.Printf("[MEMBROS] Entrada %d de membership inválida", entrada.Indice)
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if mudanca.Endereco == m.servidor.GetMeuEndereco() {
+		// Fora do quórum, concorrer só faria os restantes trocarem de termo à toa.
+		// Uma nova entrada de membership (via /register) devolve o nó ao cluster.
+		m.foiRemovido = true
+		m.souLider = false
+		log.Printf("[MEMBROS] Este servidor foi removido do cluster (%s); eleições e heartbeats suspensos", mudanca.Motivo)
+		return
+	}
+	delete(m.Servidores, mudanca.Endereco)
+	m.removidos[mudanca.Endereco] = time.Now()
+	delete(m.raft.nextIndex, mudanca.Endereco)
+	delete(m.raft.matchIndex, mudanca.Endereco)
+	m.detector.Esquecer(mudanca.Endereco)
+	log.Printf("[MEMBROS] %s saiu do cluster: %s (termo %d, índice %d)", mudanca.Endereco, mudanca.Motivo, entrada.Termo, entrada.Indice)
+}
+
+// proporEntradaMembro registra a entrada de um servidor no log. Só o líder propõe;
+// erros são apenas logados: o líder volta a propor quando receber o próximo
+// heartbeat do peer.
+func (m *Manager) proporEntradaMembro(endereco string) {
+	if _, err := m.Propor(ENTRADA_MEMBRO_ENTRADA, mudancaMembro{Endereco: endereco}); err != nil {
+		log.Printf("[MEMBROS] Falha ao registrar a entrada de %s no cluster: %v", endereco, err)
+	}
+}
+
+// RemoverServidor propõe a saída de um servidor do cluster e espera o commit.
+func (m *Manager) RemoverServidor(endereco, motivo string) error {
+	if endereco == "" {
+		return fmt.Errorf("endereço do servidor obrigatório")
+	}
+	_, err := m.Propor(ENTRADA_MEMBRO_SAIDA, mudancaMembro{Endereco: endereco, Motivo: motivo})
+	return err
+}
+
+// Sair anuncia a saída voluntária deste servidor (ex.: ao receber SIGTERM).
+func (m *Manager) Sair() error {
+	meuEndereco := m.servidor.GetMeuEndereco()
+	if !m.SouLider() {
+		return m.RemoverServidor(meuEndereco, "saída voluntária")
+	}
+	// O líder compromete a própria saída (o quórum ainda o conta) e só então abre mão
+	// do cargo, para que os restantes elejam um líder sem esperar a expulsão por inatividade
+	err := m.RemoverServidor(meuEndereco, "saída voluntária do líder")
+	if err != nil {
+		log.Printf("[MEMBROS] Saída do líder não comprometida: %v", err)
+	}
+	m.mutex.Lock()
+	m.souLider = false
+	m.LiderAtual = ""
+	m.mutex.Unlock()
+	log.Printf("[MEMBROS] Líder saindo do cluster; uma nova eleição será feita pelos peers")
+	return err
+}
+
+// monitorarMembros marca peers sem ping como inativos e, no líder, propõe a remoção
+// dos que passaram de MEMBRO_REMOVIDO_APOS.
+func (m *Manager) monitorarMembros() {
+	ticker := time.NewTicker(HEARTBEAT_INTERVALO)
+	defer ticker.Stop()
+	for range ticker.C {
+		expirados := make([]string, 0)
+
+		m.mutex.Lock()
+		for addr, srv := range m.Servidores {
+			if addr == m.servidor.GetMeuEndereco() {
+				continue
+			}
+			semPing := time.Since(srv.UltimoPing)
+			if srv.Ativo && semPing > MEMBRO_INATIVO_APOS {
+				srv.Ativo = false
+				log.Printf("[MEMBROS] %s sem heartbeat há %v. Marcado como inativo.", addr, semPing.Round(time.Second))
+			}
+			if semPing > MEMBRO_REMOVIDO_APOS {
+				expirados = append(expirados, addr)
+			}
+		}
+		souLider := m.souLider
+		m.mutex.Unlock()
+
+		if !souLider {
+			continue
+		}
+		for _, addr := range expirados {
+			log.Printf("[MEMBROS] Removendo %s do cluster por inatividade", addr)
+			if err := m.RemoverServidor(addr, "sem heartbeat"); err != nil {
+				log.Printf("[MEMBROS] Falha ao remover %s: %v", addr, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package cluster
+
+import (
+	"encoding/json"
+	"testing"
+
+	"jogodistribuido/servidor/tipos"
+)
+
+func entradaMembro(t *testing.T, indice, termo int64, tipo, endereco string) tipos.EntradaLog {
+	t.Helper()
+	dados, err := json.Marshal(mudancaMembro{Endereco: endereco})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tipos.EntradaLog{Indice: indice, Termo: termo, Tipo: tipo, Dados: dados}
+}
+
+// managerDeTeste cria um Manager em memória com este nó e `peers` como membros iniciais
+func managerDeTeste(t *testing.T, peers string) *Manager {
+	t.Helper()
+	t.Setenv("PEERS", peers)
+	t.Setenv("RAFT_DIR", "")
+	return NewManager(servidorTeste{})
+}
+
+func TestMembrosMudamAoAnexar(t *testing.T) {
+	m := managerDeTeste(t, "a:8080,b:8080")
+	m.TermoAtual = 2
+	if n := m.totalMembros(); n != 3 {
+		t.Fatalf("%d membros iniciais, esperado 3", n)
+	}
+
+	// A entrada de c vale no seguidor assim que chega, antes do commit
+	res := m.ProcessarAppendEntries(tipos.AppendEntriesRequest{
+		Termo: 2, Lider: "a:8080",
+		Entradas: []tipos.EntradaLog{entradaMembro(t, 1, 2, ENTRADA_MEMBRO_ENTRADA, "c:8080")},
+	})
+	if !res.Sucesso {
+		t.Fatal("AppendEntries recusado")
+	}
+	if !m.raft.membros["c:8080"] || m.totalMembros() != 4 {
+		t.Errorf("membros %v depois de anexar a entrada de c", m.raft.membros)
+	}
+	if m.raft.commitIndex != 0 {
+		t.Errorf("commitIndex %d, esperado 0", m.raft.commitIndex)
+	}
+
+	// Um novo líder sobrescreve a entrada não comprometida: c deixa de contar
+	res = m.ProcessarAppendEntries(tipos.AppendEntriesRequest{
+		Termo: 3, Lider: "b:8080",
+		Entradas: []tipos.EntradaLog{{Indice: 1, Termo: 3, Tipo: ENTRADA_NOOP}},
+	})
+	if !res.Sucesso {
+		t.Fatal("AppendEntries do novo líder recusado")
+	}
+	if m.raft.membros["c:8080"] || m.totalMembros() != 3 {
+		t.Errorf("membros %v depois de truncar a entrada de c", m.raft.membros)
+	}
+
+	// A saída de b também vale ao ser anexada
+	m.ProcessarAppendEntries(tipos.AppendEntriesRequest{
+		Termo: 3, Lider: "a:8080", PrevIndice: 1, PrevTermo: 3,
+		Entradas: []tipos.EntradaLog{entradaMembro(t, 2, 3, ENTRADA_MEMBRO_SAIDA, "b:8080")},
+	})
+	if m.raft.membros["b:8080"] || m.totalMembros() != 2 {
+		t.Errorf("membros %v depois de anexar a saída de b", m.raft.membros)
+	}
+}
+
+func TestConferirMudancaMembro(t *testing.T) {
+	casos := []struct {
+		nome     string
+		entradas func(t *testing.T) []tipos.EntradaLog
+		aplicado int64 // commitIndex e ultimoAplic
+		tipo     string
+		endereco string
+		jaVale   bool
+		erro     bool
+	}{
+		{
+			nome: "servidor novo",
+			entradas: func(t *testing.T) []tipos.EntradaLog {
+				return []tipos.EntradaLog{{Indice: 1, Termo: 2, Tipo: ENTRADA_NOOP}}
+			},
+			aplicado: 1, tipo: ENTRADA_MEMBRO_ENTRADA, endereco: "c:8080",
+		},
+		{
+			nome: "entrada de quem já é membro é descartada",
+			entradas: func(t *testing.T) []tipos.EntradaLog {
+				return []tipos.EntradaLog{{Indice: 1, Termo: 2, Tipo: ENTRADA_NOOP}}
+			},
+			aplicado: 1, tipo: ENTRADA_MEMBRO_ENTRADA, endereco: "a:8080", jaVale: true,
+		},
+		{
+			nome: "saída de quem não é membro é descartada",
+			entradas: func(t *testing.T) []tipos.EntradaLog {
+				return []tipos.EntradaLog{{Indice: 1, Termo: 2, Tipo: ENTRADA_NOOP}}
+			},
+			aplicado: 1, tipo: ENTRADA_MEMBRO_SAIDA, endereco: "c:8080", jaVale: true,
+		},
+		{
+			nome: "mudança anterior ainda pendente",
+			entradas: func(t *testing.T) []tipos.EntradaLog {
+				return []tipos.EntradaLog{{Indice: 1, Termo: 2, Tipo: ENTRADA_NOOP}, entradaMembro(t, 2, 2, ENTRADA_MEMBRO_ENTRADA, "c:8080")}
+			},
+			aplicado: 1, tipo: ENTRADA_MEMBRO_ENTRADA, endereco: "d:8080", erro: true,
+		},
+		{
+			nome: "repetição de uma mudança pendente",
+			entradas: func(t *testing.T) []tipos.EntradaLog {
+				return []tipos.EntradaLog{{Indice: 1, Termo: 2, Tipo: ENTRADA_NOOP}, entradaMembro(t, 2, 2, ENTRADA_MEMBRO_ENTRADA, "c:8080")}
+			},
+			aplicado: 1, tipo: ENTRADA_MEMBRO_ENTRADA, endereco: "c:8080", erro: true,
+		},
+		{
+			nome: "mudança anterior aplicada",
+			entradas: func(t *testing.T) []tipos.EntradaLog {
+				return []tipos.EntradaLog{{Indice: 1, Termo: 2, Tipo: ENTRADA_NOOP}, entradaMembro(t, 2, 2, ENTRADA_MEMBRO_ENTRADA, "c:8080")}
+			},
+			aplicado: 2, tipo: ENTRADA_MEMBRO_SAIDA, endereco: "b:8080",
+		},
+		{
+			nome: "líder sem entrada comprometida no próprio termo",
+			entradas: func(t *testing.T) []tipos.EntradaLog {
+				return []tipos.EntradaLog{{Indice: 1, Termo: 1, Tipo: ENTRADA_NOOP}, {Indice: 2, Termo: 2, Tipo: ENTRADA_NOOP}}
+			},
+			aplicado: 1, tipo: ENTRADA_MEMBRO_ENTRADA, endereco: "c:8080", erro: true,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			m := managerDeTeste(t, "a:8080,b:8080")
+			m.TermoAtual = 2
+			m.raft.entradas = c.entradas(t)
+			m.raft.commitIndex, m.raft.ultimoAplic = c.aplicado, c.aplicado
+			m.recalcularMembros()
+
+			jaVale, err := m.conferirMudancaMembro(c.tipo, mudancaMembro{Endereco: c.endereco})
+			if (err != nil) != c.erro {
+				t.Fatalf("erro = %v, esperado erro: %v", err, c.erro)
+			}
+			if jaVale != c.jaVale {
+				t.Errorf("jaVale = %v, esperado %v", jaVale, c.jaVale)
+			}
+		})
+	}
+}
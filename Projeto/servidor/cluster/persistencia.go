@@ -0,0 +1,233 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"jogodistribuido/servidor/tipos"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	ARQUIVO_ESTADO_RAFT   = "estado.json"   // Termo atual e voto dado nele
+	ARQUIVO_LOG_RAFT      = "log.jsonl"     // Entradas do log replicado depois do snapshot, uma por linha
+	ARQUIVO_SNAPSHOT_RAFT = "snapshot.json" // Último snapshot das máquinas de estados
+)
+
+// estadoRaft é o que um nó precisa lembrar antes de responder a um voto ou a um
+// AppendEntries: sem ele, um reinício permitiria votar duas vezes no mesmo termo.
+type estadoRaft struct {
+	Termo   int64  `json:"termo"`
+	VotouEm string `json:"votou_em,omitempty"`
+}
+
+// raftGravado é o que abrirPersistenciaRaft encontrou em disco.
+type raftGravado struct {
+	Estado   estadoRaft
+	Snapshot tipos.SnapshotLog // Indice 0 se ainda não houve compactação
+	Entradas []tipos.EntradaLog
+}
+
+// persistenciaRaft grava o termo, o voto, o snapshot e as entradas do log em
+// RAFT_DIR. Um ponteiro nil é válido e significa log só em memória.
+type persistenciaRaft struct {
+	diretorio  string
+	arquivoLog *os.File // Aberto em modo append
+}
+
+// abrirPersistenciaRaft carrega o estado, o snapshot e o log gravados em
+// `diretorio`. Com `diretorio` vazio devolve uma persistência nil (só memória).
+func abrirPersistenciaRaft(diretorio string) (*persistenciaRaft, raftGravado, error) {
+	var gravado raftGravado
+	if diretorio == "" {
+		return nil, gravado, nil
+	}
+	if err := os.MkdirAll(diretorio, 0o755); err != nil {
+		return nil, gravado, fmt.Errorf("erro ao criar diretório do log replicado: %v", err)
+	}
+	p := &persistenciaRaft{diretorio: diretorio}
+
+	if err := lerJSON(filepath.Join(diretorio, ARQUIVO_ESTADO_RAFT), &gravado.Estado); err != nil {
+		return nil, gravado, fmt.Errorf("erro ao ler estado do Raft: %v", err)
+	}
+	if err := lerJSON(filepath.Join(diretorio, ARQUIVO_SNAPSHOT_RAFT), &gravado.Snapshot); err != nil {
+		return nil, gravado, fmt.Errorf("erro ao ler snapshot do Raft: %v", err)
+	}
+
+	caminho := filepath.Join(diretorio, ARQUIVO_LOG_RAFT)
+	entradas, fimValido, err := carregarLogRaft(caminho, gravado.Snapshot.Indice)
+	if err != nil {
+		return nil, gravado, err
+	}
+	gravado.Entradas = entradas
+	arquivo, err := os.OpenFile(caminho, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, gravado, fmt.Errorf("erro ao abrir log do Raft: %v", err)
+	}
+	// Descarta a cauda incompleta para a próxima entrada não ser emendada nela
+	if err := arquivo.Truncate(fimValido); err != nil {
+		arquivo.Close()
+		return nil, gravado, fmt.Errorf("erro ao truncar log do Raft: %v", err)
+	}
+	p.arquivoLog = arquivo
+	log.Printf("[RAFT] Termo %d, snapshot no índice %d e %d entradas carregados de %s",
+		gravado.Estado.Termo, gravado.Snapshot.Indice, len(entradas), diretorio)
+	return p, gravado, nil
+}
+
+// lerJSON decodifica o arquivo em `destino`. Um arquivo inexistente não é erro.
+func lerJSON(caminho string, destino interface{}) error {
+	conteudo, err := os.ReadFile(caminho)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(conteudo, destino)
+}
+
+// carregarLogRaft lê as entradas gravadas depois de `base` (o índice do snapshot)
+// e devolve o tamanho da parte válida do arquivo (até a última linha completa,
+// legível e com o índice esperado). Entradas até `base` ficam no arquivo se a queda
+// veio entre gravar o snapshot e regravar o log; elas são puladas.
+func carregarLogRaft(caminho string, base int64) ([]tipos.EntradaLog, int64, error) {
+	entradas := make([]tipos.EntradaLog, 0)
+	f, err := os.Open(caminho)
+	if os.IsNotExist(err) {
+		return entradas, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("erro ao ler log do Raft: %v", err)
+	}
+	defer f.Close()
+
+	var fimValido int64
+	leitor := bufio.NewReader(f)
+	for {
+		linha, err := leitor.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				return nil, 0, fmt.Errorf("erro ao ler log do Raft: %v", err)
+			}
+			if len(linha) > 0 {
+				log.Printf("[RAFT] Entrada incompleta no fim do log descartada (%d bytes)", len(linha))
+			}
+			break
+		}
+		var entrada tipos.EntradaLog
+		err = json.Unmarshal(linha, &entrada)
+		if err == nil && entrada.Indice <= base {
+			fimValido += int64(len(linha))
+			continue
+		}
+		if err != nil || entrada.Indice != base+int64(len(entradas))+1 {
+			log.Printf("[RAFT] Entrada inválida no log; descartando o restante: %v", err)
+			break
+		}
+		fimValido += int64(len(linha))
+		entradas = append(entradas, entrada)
+	}
+	return entradas, fimValido, nil
+}
+
+// salvarEstado regrava o termo e o voto (tmp + rename).
+func (p *persistenciaRaft) salvarEstado(estado estadoRaft) error {
+	if p == nil {
+		return nil
+	}
+	conteudo, err := json.Marshal(estado)
+	if err != nil {
+		return err
+	}
+	return gravarAtomico(filepath.Join(p.diretorio, ARQUIVO_ESTADO_RAFT), conteudo)
+}
+
+// salvarSnapshot regrava o snapshot (tmp + rename). O log é regravado em seguida
+// por quem chama; até lá, as entradas cobertas pelo snapshot são puladas na carga.
+func (p *persistenciaRaft) salvarSnapshot(snapshot tipos.SnapshotLog) error {
+	if p == nil {
+		return nil
+	}
+	conteudo, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	return gravarAtomico(filepath.Join(p.diretorio, ARQUIVO_SNAPSHOT_RAFT), conteudo)
+}
+
+// anexar acrescenta entradas ao fim do arquivo do log.
+func (p *persistenciaRaft) anexar(entradas []tipos.EntradaLog) error {
+	if p == nil || len(entradas) == 0 {
+		return nil
+	}
+	buf, err := serializarEntradas(entradas)
+	if err != nil {
+		return err
+	}
+	if _, err := p.arquivoLog.Write(buf); err != nil {
+		return fmt.Errorf("erro ao gravar entradas do Raft: %v", err)
+	}
+	return p.arquivoLog.Sync()
+}
+
+// reescrever substitui o arquivo do log pelas `entradas` (após um conflito com o
+// líder apagar a cauda ou um snapshot cobrir o início).
+func (p *persistenciaRaft) reescrever(entradas []tipos.EntradaLog) error {
+	if p == nil {
+		return nil
+	}
+	buf, err := serializarEntradas(entradas)
+	if err != nil {
+		return err
+	}
+	caminho := filepath.Join(p.diretorio, ARQUIVO_LOG_RAFT)
+	if err := gravarAtomico(caminho, buf); err != nil {
+		return err
+	}
+	arquivo, err := os.OpenFile(caminho, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("erro ao reabrir log do Raft: %v", err)
+	}
+	p.arquivoLog.Close()
+	p.arquivoLog = arquivo
+	return nil
+}
+
+// serializarEntradas converte as entradas para o formato do arquivo (JSON por linha).
+func serializarEntradas(entradas []tipos.EntradaLog) ([]byte, error) {
+	buf := make([]byte, 0)
+	for _, entrada := range entradas {
+		linha, err := json.Marshal(entrada)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(append(buf, linha...), '\n')
+	}
+	return buf, nil
+}
+
+// gravarAtomico grava o conteúdo num temporário e o renomeia sobre `caminho`.
+func gravarAtomico(caminho string, conteudo []byte) error {
+	tmp := caminho + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("erro ao criar %s: %v", tmp, err)
+	}
+	if _, err := f.Write(conteudo); err != nil {
+		f.Close()
+		return fmt.Errorf("erro ao gravar %s: %v", tmp, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("erro ao sincronizar %s: %v", tmp, err)
+	}
+	f.Close()
+	if err := os.Rename(tmp, caminho); err != nil {
+		return fmt.Errorf("erro ao substituir %s: %v", caminho, err)
+	}
+	return nil
+}
@@ -0,0 +1,537 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"jogodistribuido/servidor/seguranca"
+	"jogodistribuido/servidor/tipos"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	APPEND_INTERVALO = 2 * time.Second  // Intervalo entre rodadas de AppendEntries do líder
+	PROPOSTA_TIMEOUT = 10 * time.Second // Tempo máximo de espera pelo commit de uma proposta
+
+	ENTRADA_NOOP = "NOOP" // Entrada anexada pelo líder ao assumir, para comprometer entradas de termos anteriores
+)
+
+// Aplicador é chamado, em ordem de índice e em todos os nós, para cada entrada comprometida do seu tipo.
+type Aplicador func(entrada tipos.EntradaLog)
+
+// logReplicado guarda o estado do log no estilo Raft. Protegido por Manager.mutex.
+type logReplicado struct {
+	entradas     []tipos.EntradaLog // entradas[i].Indice == snapshot.Indice+i+1
+	snapshot     tipos.SnapshotLog  // Último snapshot; cobre as entradas até snapshot.Indice
+	commitIndex  int64
+	ultimoAplic  int64
+	votouEm      string           // Candidato que recebeu o voto no TermoAtual
+	membros      map[string]bool  // Configuração em uso (recalcularMembros): só esses membros contam no quórum
+	membrosBase  map[string]bool  // Membros no índice do snapshot (sem snapshot, este nó e os de PEERS)
+	nextIndex    map[string]int64 // Próxima entrada a enviar para cada peer (somente líder)
+	matchIndex   map[string]int64 // Maior entrada sabidamente replicada em cada peer (somente líder)
+	replicando   map[string]bool  // Evita AppendEntries concorrentes para o mesmo peer
+	pendente     map[string]bool  // Nova rodada pedida enquanto outra estava em andamento
+	aplicadores  map[string]Aplicador
+	estados      map[string]EstadoReplicado // Partes da máquina de estados gravadas no snapshot
+	aguardando   map[int64]chan int64       // Propostas locais esperando o commit (recebem o termo aplicado)
+	aplicarMutex chan struct{}              // Serializa a aplicação fora do lock principal
+}
+
+func novoLogReplicado() logReplicado {
+	return logReplicado{
+		membros:      make(map[string]bool),
+		membrosBase:  make(map[string]bool),
+		nextIndex:    make(map[string]int64),
+		matchIndex:   make(map[string]int64),
+		replicando:   make(map[string]bool),
+		pendente:     make(map[string]bool),
+		aplicadores:  make(map[string]Aplicador),
+		estados:      make(map[string]EstadoReplicado),
+		aguardando:   make(map[int64]chan int64),
+		aplicarMutex: make(chan struct{}, 1),
+	}
+}
+
+// ultimoIndiceTermo devolve o índice e o termo da última entrada (ou do snapshot,
+// se o log estiver vazio depois dele). Assume o lock ativo.
+func (m *Manager) ultimoIndiceTermo() (int64, int64) {
+	n := len(m.raft.entradas)
+	if n == 0 {
+		return m.raft.snapshot.Indice, m.raft.snapshot.Termo
+	}
+	return m.raft.entradas[n-1].Indice, m.raft.entradas[n-1].Termo
+}
+
+// termoEm devolve o termo da entrada em `indice` (0 se não existir ou já tiver sido
+// compactada antes do snapshot). Assume o lock ativo.
+func (m *Manager) termoEm(indice int64) int64 {
+	base := m.raft.snapshot.Indice
+	if indice == base {
+		return m.raft.snapshot.Termo
+	}
+	if indice < base || indice > base+int64(len(m.raft.entradas)) {
+		return 0
+	}
+	return m.raft.entradas[indice-base-1].Termo
+}
+
+// totalMembros conta os membros da configuração em uso. Servidores conhecidos só por
+// heartbeat ou /register ficam fora até a entrada deles chegar ao log, então todos os
+// nós com o mesmo log concordam sobre a maioria. Assume o lock ativo.
+func (m *Manager) totalMembros() int {
+	return len(m.raft.membros)
+}
+
+// RegistrarAplicador associa uma função ao tipo de entrada. Deve ser chamado antes de Run().
+func (m *Manager) RegistrarAplicador(tipo string, fn Aplicador) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.raft.aplicadores[tipo] = fn
+}
+
+// Propor anexa uma entrada ao log replicado e espera até ela ser comprometida por
+// uma maioria. Em um seguidor, a proposta é encaminhada ao líder atual.
+func (m *Manager) Propor(tipo string, dados interface{}) (int64, error) {
+	if m.SouLider() {
+		return m.ProporComoLider(tipo, dados)
+	}
+
+	lider := m.GetLider()
+	if lider == "" {
+		return 0, fmt.Errorf("nenhum líder disponível para a proposta %s", tipo)
+	}
+
+	payload, err := json.Marshal(dados)
+	if err != nil {
+		return 0, err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"tipo":  tipo,
+		"dados": json.RawMessage(payload),
+	})
+
+	url := fmt.Sprintf("http://%s/cluster/propor", lider)
+	resp, err := m.postComToken(url, body, PROPOSTA_TIMEOUT+2*time.Second)
+	if err != nil {
+		return 0, fmt.Errorf("falha ao encaminhar proposta ao líder %s: %v", lider, err)
+	}
+	defer resp.Body.Close()
+
+	var res struct {
+		Indice int64  `json:"indice"`
+		Error  string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("líder %s recusou a proposta %s: %s", lider, tipo, res.Error)
+	}
+	return res.Indice, nil
+}
+
+// ProporComoLider anexa a entrada ao log local e espera o commit. Falha se este nó não for o líder.
+func (m *Manager) ProporComoLider(tipo string, dados interface{}) (int64, error) {
+	payload, err := json.Marshal(dados)
+	if err != nil {
+		return 0, err
+	}
+
+	m.mutex.Lock()
+	if !m.souLider {
+		m.mutex.Unlock()
+		return 0, fmt.Errorf("este servidor não é o líder")
+	}
+	if mudanca, ok := lerMudancaMembro(tipos.EntradaLog{Tipo: tipo, Dados: payload}); ok {
+		jaVale, err := m.conferirMudancaMembro(tipo, mudanca)
+		if err != nil || jaVale {
+			commit := m.raft.commitIndex
+			m.mutex.Unlock()
+			if err != nil {
+				return 0, fmt.Errorf("%s de %s adiada: %v", tipo, mudanca.Endereco, err)
+			}
+			return commit, nil
+		}
+	}
+	entrada := m.anexarComoLider(tipo, payload)
+	pronto := make(chan int64, 1)
+	m.raft.aguardando[entrada.Indice] = pronto
+	m.mutex.Unlock()
+
+	m.replicarParaPeers()
+
+	var termo int64
+	select {
+	case termo = <-pronto:
+	case <-time.After(PROPOSTA_TIMEOUT):
+		m.mutex.Lock()
+		delete(m.raft.aguardando, entrada.Indice)
+		m.mutex.Unlock()
+		return 0, fmt.Errorf("timeout aguardando commit da entrada %d (%s)", entrada.Indice, tipo)
+	}
+
+	// A entrada pode ter sido sobrescrita por outro líder; só vale se o termo aplicado bate
+	if termo != entrada.Termo {
+		return 0, fmt.Errorf("entrada %d (%s) descartada por troca de liderança", entrada.Indice, tipo)
+	}
+	return entrada.Indice, nil
+}
+
+// anexarComoLider cria a próxima entrada no termo atual. Assume o lock ativo.
+func (m *Manager) anexarComoLider(tipo string, dados json.RawMessage) tipos.EntradaLog {
+	ultimo, _ := m.ultimoIndiceTermo()
+	entrada := tipos.EntradaLog{
+		Termo:  m.TermoAtual,
+		Indice: ultimo + 1,
+		Tipo:   tipo,
+		Dados:  dados,
+	}
+	m.raft.entradas = append(m.raft.entradas, entrada)
+	if _, ok := lerMudancaMembro(entrada); ok {
+		m.recalcularMembros()
+	}
+	// Sem gravar, o líder não conta a si mesmo na maioria; os seguidores ainda podem comprometê-la
+	if err := m.persistencia.anexar([]tipos.EntradaLog{entrada}); err != nil {
+		log.Printf("[RAFT_ERRO] Entrada %d não gravada no líder: %v", entrada.Indice, err)
+	} else {
+		m.raft.matchIndex[m.servidor.GetMeuEndereco()] = entrada.Indice
+	}
+	m.avancarCommit()
+	return entrada
+}
+
+// prepararLideranca reinicia o estado de replicação e anexa um NOOP do novo termo.
+// Assume o lock ativo.
+func (m *Manager) prepararLideranca() {
+	ultimo, _ := m.ultimoIndiceTermo()
+	m.raft.nextIndex = make(map[string]int64)
+	m.raft.matchIndex = make(map[string]int64)
+	for addr := range m.Servidores {
+		m.raft.nextIndex[addr] = ultimo + 1
+	}
+	m.anexarComoLider(ENTRADA_NOOP, json.RawMessage("null"))
+}
+
+// loopReplicacao envia AppendEntries periódicos enquanto este nó for o líder.
+func (m *Manager) loopReplicacao() {
+	ticker := time.NewTicker(APPEND_INTERVALO)
+	defer ticker.Stop()
+	for range ticker.C {
+		if m.SouLider() {
+			m.replicarParaPeers()
+		}
+	}
+}
+
+func (m *Manager) replicarParaPeers() {
+	m.mutex.RLock()
+	// Membros comprometidos entram mesmo que ainda não tenham mandado heartbeat
+	destinos := make(map[string]bool, len(m.Servidores)+len(m.raft.membros))
+	for addr := range m.Servidores {
+		destinos[addr] = true
+	}
+	for addr := range m.raft.membros {
+		destinos[addr] = true
+	}
+	delete(destinos, m.servidor.GetMeuEndereco())
+	m.mutex.RUnlock()
+
+	for addr := range destinos {
+		go m.replicarPara(addr)
+	}
+	// Em um cluster de um nó só o commit já avançou no anexar
+	m.aplicarComprometidas()
+}
+
+// replicarPara envia ao peer as entradas a partir de nextIndex e ajusta o estado
+// conforme a resposta (log matching do Raft).
+func (m *Manager) replicarPara(addr string) {
+	m.mutex.Lock()
+	if !m.souLider {
+		m.mutex.Unlock()
+		return
+	}
+	if m.raft.replicando[addr] {
+		m.raft.pendente[addr] = true
+		m.mutex.Unlock()
+		return
+	}
+	m.raft.replicando[addr] = true
+
+	ultimo, _ := m.ultimoIndiceTermo()
+	next, ok := m.raft.nextIndex[addr]
+	if !ok || next < 1 {
+		next = ultimo + 1
+	}
+	if next <= m.raft.snapshot.Indice {
+		// As entradas que faltam ao peer já foram compactadas: ele recebe o snapshot
+		req := tipos.InstallSnapshotRequest{
+			Termo:    m.TermoAtual,
+			Lider:    m.servidor.GetMeuEndereco(),
+			Snapshot: m.raft.snapshot,
+		}
+		m.mutex.Unlock()
+		defer m.fimReplicacao(addr)
+		m.enviarSnapshot(addr, req)
+		return
+	}
+	prev := next - 1
+	entradas := append([]tipos.EntradaLog{}, m.raft.entradas[prev-m.raft.snapshot.Indice:]...)
+	req := tipos.AppendEntriesRequest{
+		Termo:       m.TermoAtual,
+		Lider:       m.servidor.GetMeuEndereco(),
+		PrevIndice:  prev,
+		PrevTermo:   m.termoEm(prev),
+		Entradas:    entradas,
+		LiderCommit: m.raft.commitIndex,
+	}
+	m.mutex.Unlock()
+	defer m.fimReplicacao(addr)
+
+	body, _ := json.Marshal(req)
+	resp, err := m.postComToken(fmt.Sprintf("http://%s/cluster/append_entries", addr), body, 3*time.Second)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	var res tipos.AppendEntriesResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&res) != nil {
+		return
+	}
+
+	m.mutex.Lock()
+	if res.Termo > m.TermoAtual {
+		log.Printf("[RAFT] Peer %s está no termo %d (> %d). Deixando a liderança.", addr, res.Termo, m.TermoAtual)
+		m.adotarTermo(res.Termo)
+		m.mutex.Unlock()
+		return
+	}
+	if !m.souLider || req.Termo != m.TermoAtual {
+		m.mutex.Unlock()
+		return
+	}
+	if res.Sucesso {
+		match := prev + int64(len(entradas))
+		if match > m.raft.matchIndex[addr] {
+			m.raft.matchIndex[addr] = match
+		}
+		m.raft.nextIndex[addr] = match + 1
+		m.avancarCommit()
+	} else {
+		// Recua até o ponto em que os logs concordam
+		novoNext := next - 1
+		if res.UltimoIndice+1 < novoNext {
+			novoNext = res.UltimoIndice + 1
+		}
+		if novoNext < 1 {
+			novoNext = 1
+		}
+		m.raft.nextIndex[addr] = novoNext
+		log.Printf("[RAFT] Log de %s divergente em %d. Reenviando a partir de %d.", addr, prev, novoNext)
+	}
+	m.mutex.Unlock()
+
+	m.aplicarComprometidas()
+}
+
+// fimReplicacao libera o peer para a próxima rodada e a dispara se alguma foi pedida
+// durante esta.
+func (m *Manager) fimReplicacao(addr string) {
+	m.mutex.Lock()
+	delete(m.raft.replicando, addr)
+	repetir := m.raft.pendente[addr]
+	delete(m.raft.pendente, addr)
+	m.mutex.Unlock()
+	if repetir {
+		go m.replicarPara(addr)
+	}
+}
+
+// avancarCommit move o commitIndex para o maior índice replicado na maioria cujo
+// termo é o atual (entradas de termos anteriores são comprometidas indiretamente).
+// Assume o lock ativo.
+func (m *Manager) avancarCommit() {
+	maioria := m.totalMembros()/2 + 1
+	ultimo, _ := m.ultimoIndiceTermo()
+	for n := ultimo; n > m.raft.commitIndex; n-- {
+		if m.termoEm(n) != m.TermoAtual {
+			break
+		}
+		replicas := 0
+		for addr, match := range m.raft.matchIndex {
+			if match >= n && m.raft.membros[addr] {
+				replicas++
+			}
+		}
+		if replicas >= maioria {
+			m.raft.commitIndex = n
+			return
+		}
+	}
+}
+
+// aplicarComprometidas chama os aplicadores para as entradas entre o último índice
+// aplicado e o commitIndex, fora do lock principal e em ordem. A cada
+// SNAPSHOT_INTERVALO entradas aplicadas, o log é compactado.
+func (m *Manager) aplicarComprometidas() {
+	m.raft.aplicarMutex <- struct{}{}
+	defer func() { <-m.raft.aplicarMutex }()
+
+	for {
+		m.mutex.Lock()
+		if m.raft.ultimoAplic >= m.raft.commitIndex {
+			m.mutex.Unlock()
+			return
+		}
+		m.raft.ultimoAplic++
+		entrada := m.raft.entradas[m.raft.ultimoAplic-m.raft.snapshot.Indice-1]
+		aplicador := m.raft.aplicadores[entrada.Tipo]
+		pronto := m.raft.aguardando[entrada.Indice]
+		delete(m.raft.aguardando, entrada.Indice)
+		compactar := m.raft.ultimoAplic-m.raft.snapshot.Indice >= SNAPSHOT_INTERVALO
+		m.mutex.Unlock()
+
+		if aplicador != nil {
+			aplicador(entrada)
+		} else if entrada.Tipo != ENTRADA_NOOP {
+			log.Printf("[RAFT] Nenhum aplicador para a entrada %d do tipo %s", entrada.Indice, entrada.Tipo)
+		}
+		if pronto != nil {
+			pronto <- entrada.Termo
+		}
+		if compactar {
+			m.compactar()
+		}
+	}
+}
+
+// ProcessarAppendEntries trata o AppendEntries recebido do líder.
+func (m *Manager) ProcessarAppendEntries(req tipos.AppendEntriesRequest) tipos.AppendEntriesResponse {
+	m.mutex.Lock()
+
+	if req.Termo < m.TermoAtual {
+		ultimo, _ := m.ultimoIndiceTermo()
+		res := tipos.AppendEntriesResponse{Termo: m.TermoAtual, Sucesso: false, UltimoIndice: ultimo}
+		m.mutex.Unlock()
+		return res
+	}
+
+	if req.Termo > m.TermoAtual {
+		m.adotarTermo(req.Termo)
+	}
+	if m.LiderAtual != req.Lider {
+		log.Printf("[RAFT] Líder %s reconhecido via AppendEntries (termo %d)", req.Lider, req.Termo)
+	}
+	m.LiderAtual = req.Lider
+	m.souLider = false
+	m.UltimoHeartbeat = time.Now()
+
+	// Verificação de consistência: o log precisa conter PrevIndice com PrevTermo. O
+	// que vem até o snapshot já foi comprometido e casa com o líder.
+	base := m.raft.snapshot.Indice
+	ultimo, _ := m.ultimoIndiceTermo()
+	if req.PrevIndice > ultimo || (req.PrevIndice >= base && m.termoEm(req.PrevIndice) != req.PrevTermo) {
+		dica := ultimo
+		if req.PrevIndice-1 < dica {
+			dica = req.PrevIndice - 1
+		}
+		m.mutex.Unlock()
+		return tipos.AppendEntriesResponse{Termo: req.Termo, Sucesso: false, UltimoIndice: dica}
+	}
+
+	// O novo log é montado à parte e só substitui o atual depois de gravado
+	entradas := m.raft.entradas
+	novas := make([]tipos.EntradaLog, 0, len(req.Entradas))
+	truncou, mudouMembros := false, false
+	for _, entrada := range req.Entradas {
+		if entrada.Indice <= base {
+			continue
+		}
+		if posicao := entrada.Indice - base; posicao <= int64(len(entradas)) {
+			if entradas[posicao-1].Termo == entrada.Termo {
+				continue
+			}
+			// Conflito: descarta a entrada e tudo o que vem depois
+			if entrada.Indice <= m.raft.commitIndex {
+				log.Printf("[RAFT_ERRO] Líder %s tentou sobrescrever a entrada comprometida %d", req.Lider, entrada.Indice)
+				m.mutex.Unlock()
+				return tipos.AppendEntriesResponse{Termo: req.Termo, Sucesso: false, UltimoIndice: m.raft.commitIndex}
+			}
+			entradas = entradas[: posicao-1 : posicao-1] // Cópia no próximo append
+			truncou = true
+		}
+		if _, ok := lerMudancaMembro(entrada); ok {
+			mudouMembros = true
+		}
+		entradas = append(entradas, entrada)
+		novas = append(novas, entrada)
+	}
+	var err error
+	if truncou {
+		err = m.persistencia.reescrever(entradas)
+	} else {
+		err = m.persistencia.anexar(novas)
+	}
+	if err != nil {
+		log.Printf("[RAFT_ERRO] Entradas de %s não gravadas: %v", req.Lider, err)
+		m.mutex.Unlock()
+		return tipos.AppendEntriesResponse{Termo: req.Termo, Sucesso: false, UltimoIndice: req.PrevIndice}
+	}
+	m.raft.entradas = entradas
+	if truncou || mudouMembros {
+		m.recalcularMembros()
+	}
+
+	ultimoNovo := req.PrevIndice + int64(len(req.Entradas))
+	if req.LiderCommit > m.raft.commitIndex {
+		m.raft.commitIndex = req.LiderCommit
+		if ultimoNovo < m.raft.commitIndex {
+			m.raft.commitIndex = ultimoNovo
+		}
+	}
+	ultimo, _ = m.ultimoIndiceTermo()
+	m.mutex.Unlock()
+
+	m.aplicarComprometidas()
+	return tipos.AppendEntriesResponse{Termo: req.Termo, Sucesso: true, UltimoIndice: ultimo}
+}
+
+// logAtualizado indica se o log de um candidato é pelo menos tão recente quanto o
+// local (último termo maior, ou mesmo termo com índice maior ou igual). Assume o lock ativo.
+func (m *Manager) logAtualizado(ultimoIndice, ultimoTermo int64) bool {
+	meuIndice, meuTermo := m.ultimoIndiceTermo()
+	if ultimoTermo != meuTermo {
+		return ultimoTermo > meuTermo
+	}
+	return ultimoIndice >= meuIndice
+}
+
+// GetEstadoLog resume o estado do log para diagnóstico.
+func (m *Manager) GetEstadoLog() map[string]interface{} {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	ultimo, ultimoTermo := m.ultimoIndiceTermo()
+	return map[string]interface{}{
+		"termo":         m.TermoAtual,
+		"lider":         m.LiderAtual,
+		"ultimo_indice": ultimo,
+		"ultimo_termo":  ultimoTermo,
+		"commit_index":  m.raft.commitIndex,
+		"aplicado":      m.raft.ultimoAplic,
+		"snapshot":      m.raft.snapshot.Indice,
+		"membros":       m.totalMembros(),
+	}
+}
+
+func (m *Manager) postComToken(url string, body []byte, timeout time.Duration) (*http.Response, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+seguranca.GenerateJWT(m.servidor.GetMeuEndereco()))
+	httpClient := &http.Client{Timeout: timeout}
+	return httpClient.Do(req)
+}
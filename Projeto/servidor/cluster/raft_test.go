@@ -0,0 +1,170 @@
+package cluster
+
+import (
+	"testing"
+
+	"jogodistribuido/servidor/tipos"
+)
+
+type servidorTeste struct{}
+
+func (servidorTeste) GetMeuEndereco() string { return "seguidor:8080" }
+
+// entradasComTermos monta entradas NOOP a partir de `primeiro` com os termos informados
+func entradasComTermos(primeiro int64, termos ...int64) []tipos.EntradaLog {
+	entradas := make([]tipos.EntradaLog, len(termos))
+	for i, termo := range termos {
+		entradas[i] = tipos.EntradaLog{Termo: termo, Indice: primeiro + int64(i), Tipo: ENTRADA_NOOP}
+	}
+	return entradas
+}
+
+func termosDe(entradas []tipos.EntradaLog) []int64 {
+	termos := make([]int64, len(entradas))
+	for i, e := range entradas {
+		termos[i] = e.Termo
+	}
+	return termos
+}
+
+func mesmosTermos(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestProcessarAppendEntries(t *testing.T) {
+	// O seguidor está no termo 3 com as entradas 1..4 nos termos 1, 1, 2, 2 e a
+	// entrada 1 comprometida (a não ser que o caso diga outra coisa)
+	casos := []struct {
+		nome     string
+		snapshot tipos.SnapshotLog
+		termos   []int64 // Termos das entradas depois do snapshot
+		commit   int64
+		req      tipos.AppendEntriesRequest
+		sucesso  bool
+		ultimo   int64   // UltimoIndice da resposta (dica para o líder na recusa)
+		log      []int64 // Termos das entradas depois da chamada
+		commitOK int64
+	}{
+		{
+			nome:    "heartbeat que casa com o log",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 4, PrevTermo: 2, LiderCommit: 1},
+			sucesso: true, ultimo: 4, log: []int64{1, 1, 2, 2}, commitOK: 1,
+		},
+		{
+			nome:    "líder num termo anterior",
+			req:     tipos.AppendEntriesRequest{Termo: 2, PrevIndice: 4, PrevTermo: 2},
+			sucesso: false, ultimo: 4, log: []int64{1, 1, 2, 2}, commitOK: 1,
+		},
+		{
+			nome:    "PrevIndice depois do fim do log",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 6, PrevTermo: 3},
+			sucesso: false, ultimo: 4, log: []int64{1, 1, 2, 2}, commitOK: 1,
+		},
+		{
+			nome:    "PrevTermo diferente",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 3, PrevTermo: 3},
+			sucesso: false, ultimo: 2, log: []int64{1, 1, 2, 2}, commitOK: 1,
+		},
+		{
+			nome:    "entradas repetidas não mudam o log",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 2, PrevTermo: 1, Entradas: entradasComTermos(3, 2, 2)},
+			sucesso: true, ultimo: 4, log: []int64{1, 1, 2, 2}, commitOK: 1,
+		},
+		{
+			nome:    "reenvio atrasado não trunca o que vem depois",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 1, PrevTermo: 1, Entradas: entradasComTermos(2, 1)},
+			sucesso: true, ultimo: 4, log: []int64{1, 1, 2, 2}, commitOK: 1,
+		},
+		{
+			nome:    "conflito descarta a entrada e as seguintes",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 2, PrevTermo: 1, Entradas: entradasComTermos(3, 3)},
+			sucesso: true, ultimo: 3, log: []int64{1, 1, 3}, commitOK: 1,
+		},
+		{
+			nome:    "conflito no meio das entradas recebidas",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 2, PrevTermo: 1, Entradas: entradasComTermos(3, 2, 3, 3)},
+			sucesso: true, ultimo: 5, log: []int64{1, 1, 2, 3, 3}, commitOK: 1,
+		},
+		{
+			nome:    "conflito numa entrada comprometida é recusado",
+			commit:  3,
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 2, PrevTermo: 1, Entradas: entradasComTermos(3, 3)},
+			sucesso: false, ultimo: 3, log: []int64{1, 1, 2, 2}, commitOK: 3,
+		},
+		{
+			nome:    "commit limitado à última entrada recebida",
+			req:     tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 2, PrevTermo: 1, Entradas: entradasComTermos(3, 2), LiderCommit: 10},
+			sucesso: true, ultimo: 4, log: []int64{1, 1, 2, 2}, commitOK: 3,
+		},
+		{
+			nome:     "entradas cobertas pelo snapshot são ignoradas",
+			snapshot: tipos.SnapshotLog{Indice: 2, Termo: 1},
+			termos:   []int64{2, 2},
+			req:      tipos.AppendEntriesRequest{Termo: 3, PrevIndice: 1, PrevTermo: 1, Entradas: entradasComTermos(2, 1, 2, 3)},
+			sucesso:  true, ultimo: 4, log: []int64{2, 3}, commitOK: 2,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			t.Setenv("PEERS", "")
+			t.Setenv("RAFT_DIR", t.TempDir())
+			m := NewManager(servidorTeste{})
+			termos := c.termos
+			if termos == nil {
+				termos = []int64{1, 1, 2, 2}
+			}
+			commit := c.commit
+			if commit < 1 {
+				commit = 1
+			}
+			if commit < c.snapshot.Indice {
+				commit = c.snapshot.Indice
+			}
+			m.TermoAtual = 3
+			m.raft.snapshot = c.snapshot
+			m.raft.entradas = entradasComTermos(c.snapshot.Indice+1, termos...)
+			m.raft.commitIndex, m.raft.ultimoAplic = commit, commit
+			if c.snapshot.Indice > 0 {
+				if err := m.persistencia.salvarSnapshot(c.snapshot); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := m.persistencia.reescrever(m.raft.entradas); err != nil {
+				t.Fatal(err)
+			}
+
+			c.req.Lider = "lider:8080"
+			res := m.ProcessarAppendEntries(c.req)
+			if res.Sucesso != c.sucesso {
+				t.Errorf("sucesso = %v, esperado %v", res.Sucesso, c.sucesso)
+			}
+			if res.UltimoIndice != c.ultimo {
+				t.Errorf("UltimoIndice = %d, esperado %d", res.UltimoIndice, c.ultimo)
+			}
+			if got := termosDe(m.raft.entradas); !mesmosTermos(got, c.log) {
+				t.Errorf("log com termos %v, esperado %v", got, c.log)
+			}
+			if m.raft.commitIndex != c.commitOK {
+				t.Errorf("commitIndex %d, esperado %d", m.raft.commitIndex, c.commitOK)
+			}
+
+			// O log gravado é o mesmo que ficou em memória
+			_, gravado, err := abrirPersistenciaRaft(m.persistencia.diretorio)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := termosDe(gravado.Entradas); !mesmosTermos(got, c.log) {
+				t.Errorf("log gravado com termos %v, esperado %v", got, c.log)
+			}
+		})
+	}
+}
@@ -0,0 +1,252 @@
+package cluster
+
+import (
+	"encoding/json"
+	"fmt"
+	"jogodistribuido/servidor/tipos"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const (
+	SNAPSHOT_INTERVALO = 500              // Entradas aplicadas entre compactações do log
+	SNAPSHOT_TIMEOUT   = 10 * time.Second // Tempo máximo para um peer instalar o snapshot
+
+	ESTADO_MEMBROS = "membros" // Nome do estado com os servidores do cluster no snapshot
+)
+
+// EstadoReplicado é uma parte da máquina de estados alimentada pelos aplicadores.
+// Exportar é chamado entre duas entradas aplicadas; Importar substitui o estado
+// pelo de um snapshot (ao reiniciar, ou quando o líder envia um snapshot).
+type EstadoReplicado interface {
+	Exportar() (json.RawMessage, error)
+	Importar(dados json.RawMessage) error
+}
+
+// RegistrarEstado inclui o estado nos snapshots do log. Todo estado mudado por um
+// aplicador precisa estar registrado, senão ele se perde quando as entradas são
+// compactadas. Deve ser chamado antes de Run().
+func (m *Manager) RegistrarEstado(nome string, estado EstadoReplicado) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.raft.estados[nome] = estado
+}
+
+// estadosRegistrados copia os estados para usá-los fora do lock principal.
+func (m *Manager) estadosRegistrados() map[string]EstadoReplicado {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	estados := make(map[string]EstadoReplicado, len(m.raft.estados))
+	for nome, estado := range m.raft.estados {
+		estados[nome] = estado
+	}
+	return estados
+}
+
+// compactar exporta os estados no último índice aplicado, grava o snapshot e
+// descarta do log as entradas cobertas por ele. Roda com aplicarMutex ativo, então
+// nenhuma entrada é aplicada durante a exportação.
+func (m *Manager) compactar() {
+	m.mutex.RLock()
+	indice := m.raft.ultimoAplic
+	termo := m.termoEm(indice)
+	m.mutex.RUnlock()
+
+	snapshot := tipos.SnapshotLog{Indice: indice, Termo: termo, Estados: make(map[string]json.RawMessage)}
+	for nome, estado := range m.estadosRegistrados() {
+		conteudo, err := estado.Exportar()
+		if err != nil {
+			// O log continua inteiro; a compactação é tentada na próxima entrada
+			log.Printf("[RAFT_ERRO] Snapshot do índice %d adiado: estado %s: %v", indice, nome, err)
+			return
+		}
+		snapshot.Estados[nome] = conteudo
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.persistencia.salvarSnapshot(snapshot); err != nil {
+		log.Printf("[RAFT_ERRO] Snapshot do índice %d não gravado: %v", indice, err)
+		return
+	}
+	m.instalarBase(snapshot)
+	if err := m.persistencia.reescrever(m.raft.entradas); err != nil {
+		log.Printf("[RAFT_ERRO] Log não regravado após o snapshot do índice %d: %v", indice, err)
+	}
+	log.Printf("[RAFT] Snapshot do índice %d (termo %d) gravado; %d entradas restantes no log", indice, termo, len(m.raft.entradas))
+}
+
+// instalarBase faz o log começar depois do snapshot. As entradas seguintes só são
+// mantidas se o log local contém a entrada do snapshot com o mesmo termo. Assume o
+// lock ativo.
+func (m *Manager) instalarBase(snapshot tipos.SnapshotLog) {
+	ultimo, _ := m.ultimoIndiceTermo()
+	restantes := make([]tipos.EntradaLog, 0)
+	if snapshot.Indice <= ultimo && m.termoEm(snapshot.Indice) == snapshot.Termo {
+		restantes = append(restantes, m.raft.entradas[snapshot.Indice-m.raft.snapshot.Indice:]...)
+	}
+	m.raft.entradas = restantes
+	m.raft.snapshot = snapshot
+	if membros, ok := membrosDoSnapshot(snapshot); ok {
+		m.raft.membrosBase = membros
+	}
+	m.recalcularMembros()
+	if m.raft.commitIndex < snapshot.Indice {
+		m.raft.commitIndex = snapshot.Indice
+	}
+	if m.raft.ultimoAplic < snapshot.Indice {
+		m.raft.ultimoAplic = snapshot.Indice
+	}
+}
+
+// restaurarEstados importa cada estado registrado a partir do snapshot.
+func (m *Manager) restaurarEstados(snapshot tipos.SnapshotLog) error {
+	for nome, estado := range m.estadosRegistrados() {
+		conteudo, ok := snapshot.Estados[nome]
+		if !ok {
+			log.Printf("[RAFT] Snapshot do índice %d sem o estado %s", snapshot.Indice, nome)
+			continue
+		}
+		if err := estado.Importar(conteudo); err != nil {
+			return fmt.Errorf("estado %s: %v", nome, err)
+		}
+	}
+	return nil
+}
+
+// restaurarSnapshotLocal põe as máquinas de estados no snapshot carregado de
+// RAFT_DIR. As entradas seguintes são reaplicadas quando o commit chegar a elas.
+func (m *Manager) restaurarSnapshotLocal() {
+	m.mutex.RLock()
+	snapshot := m.raft.snapshot
+	m.mutex.RUnlock()
+	if snapshot.Indice == 0 {
+		return
+	}
+	if err := m.restaurarEstados(snapshot); err != nil {
+		log.Fatalf("Erro ao restaurar o snapshot do índice %d: %v", snapshot.Indice, err)
+	}
+	log.Printf("[RAFT] Estados restaurados do snapshot do índice %d (termo %d)", snapshot.Indice, snapshot.Termo)
+}
+
+// enviarSnapshot instala o snapshot do líder num peer que ficou antes do início do
+// log e, se ele aceitar, continua a replicação logo depois do snapshot.
+func (m *Manager) enviarSnapshot(addr string, req tipos.InstallSnapshotRequest) {
+	log.Printf("[RAFT] Enviando o snapshot do índice %d para %s", req.Snapshot.Indice, addr)
+	body, _ := json.Marshal(req)
+	resp, err := m.postComToken(fmt.Sprintf("http://%s/cluster/install_snapshot", addr), body, SNAPSHOT_TIMEOUT)
+	if err != nil {
+		log.Printf("[RAFT] Falha ao enviar o snapshot para %s: %v", addr, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	var res tipos.InstallSnapshotResponse
+	if resp.StatusCode != http.StatusOK || json.NewDecoder(resp.Body).Decode(&res) != nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if res.Termo > m.TermoAtual {
+		log.Printf("[RAFT] Peer %s está no termo %d (> %d). Deixando a liderança.", addr, res.Termo, m.TermoAtual)
+		m.adotarTermo(res.Termo)
+		return
+	}
+	if !m.souLider || req.Termo != m.TermoAtual || !res.Sucesso {
+		return
+	}
+	if req.Snapshot.Indice > m.raft.matchIndex[addr] {
+		m.raft.matchIndex[addr] = req.Snapshot.Indice
+	}
+	m.raft.nextIndex[addr] = req.Snapshot.Indice + 1
+}
+
+// ProcessarInstallSnapshot trata o snapshot enviado pelo líder: os estados passam
+// ao do snapshot e o log recomeça depois dele.
+func (m *Manager) ProcessarInstallSnapshot(req tipos.InstallSnapshotRequest) tipos.InstallSnapshotResponse {
+	m.mutex.Lock()
+	if req.Termo < m.TermoAtual {
+		res := tipos.InstallSnapshotResponse{Termo: m.TermoAtual}
+		m.mutex.Unlock()
+		return res
+	}
+	if req.Termo > m.TermoAtual {
+		m.adotarTermo(req.Termo)
+	}
+	m.LiderAtual = req.Lider
+	m.souLider = false
+	m.UltimoHeartbeat = time.Now()
+	m.mutex.Unlock()
+
+	// A aplicação fica parada enquanto os estados são substituídos
+	m.raft.aplicarMutex <- struct{}{}
+	defer func() { <-m.raft.aplicarMutex }()
+
+	m.mutex.RLock()
+	jaAplicado := req.Snapshot.Indice <= m.raft.ultimoAplic
+	m.mutex.RUnlock()
+	if jaAplicado {
+		return tipos.InstallSnapshotResponse{Termo: req.Termo, Sucesso: true}
+	}
+
+	if err := m.restaurarEstados(req.Snapshot); err != nil {
+		log.Printf("[RAFT_ERRO] Snapshot do índice %d recebido de %s não restaurado: %v", req.Snapshot.Indice, req.Lider, err)
+		return tipos.InstallSnapshotResponse{Termo: req.Termo}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.persistencia.salvarSnapshot(req.Snapshot); err != nil {
+		log.Printf("[RAFT_ERRO] Snapshot do índice %d recebido de %s não gravado: %v", req.Snapshot.Indice, req.Lider, err)
+		return tipos.InstallSnapshotResponse{Termo: req.Termo}
+	}
+	m.instalarBase(req.Snapshot)
+	if err := m.persistencia.reescrever(m.raft.entradas); err != nil {
+		log.Printf("[RAFT_ERRO] Log não regravado após o snapshot do índice %d: %v", req.Snapshot.Indice, err)
+	}
+	log.Printf("[RAFT] Snapshot do índice %d (termo %d) instalado a partir de %s", req.Snapshot.Indice, req.Snapshot.Termo, req.Lider)
+	return tipos.InstallSnapshotResponse{Termo: req.Termo, Sucesso: true}
+}
+
+// membrosReplicados leva os membros do índice do snapshot para ele, já que as
+// entradas de membership também são compactadas. A base do quórum sai daí
+// (instalarBase); Importar só cuida da lista de servidores.
+type membrosReplicados struct {
+	m *Manager
+}
+
+func (e membrosReplicados) Exportar() (json.RawMessage, error) {
+	// Exportar roda com a aplicação parada em ultimoAplic, o índice do snapshot; as
+	// mudanças anexadas depois dele ficam nas entradas que sobram
+	e.m.mutex.RLock()
+	membros := e.m.membrosAte(e.m.raft.ultimoAplic)
+	e.m.mutex.RUnlock()
+	enderecos := make([]string, 0, len(membros))
+	for addr := range membros {
+		enderecos = append(enderecos, addr)
+	}
+	sort.Strings(enderecos)
+	return json.Marshal(enderecos)
+}
+
+// Importar acrescenta os membros do snapshot que este nó não conhece à lista de
+// servidores. Os que saíram depois são removidos pelas entradas seguintes.
+func (e membrosReplicados) Importar(dados json.RawMessage) error {
+	var enderecos []string
+	if err := json.Unmarshal(dados, &enderecos); err != nil {
+		return err
+	}
+	e.m.mutex.Lock()
+	defer e.m.mutex.Unlock()
+	for _, addr := range enderecos {
+		if _, existe := e.m.Servidores[addr]; existe {
+			continue
+		}
+		delete(e.m.removidos, addr)
+		e.m.Servidores[addr] = &tipos.InfoServidor{Endereco: addr, UltimoPing: time.Now(), Ativo: true}
+	}
+	return nil
+}
@@ -0,0 +1,476 @@
+package contas
+
+import (
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jogodistribuido/servidor/ranking"
+	"jogodistribuido/servidor/tipos"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ARQUIVO_CONTAS    = "contas.json"
+	PBKDF2_ITERACOES  = 100000
+	PBKDF2_TAMANHO    = 32
+	SAL_TAMANHO       = 16
+	SENHA_TAMANHO_MIN = 4
+
+	MOEDAS_INICIAIS = 100 // Saldo de uma conta nova (e das contas anteriores à carteira)
+	MOEDAS_VITORIA  = 30  // Prêmio do vencedor de uma partida avaliada
+	MOEDAS_EMPATE   = 15  // Prêmio de cada jogador num empate
+	MOEDAS_DERROTA  = 5   // Prêmio de consolação do perdedor
+)
+
+var (
+	ErrNomeEmUso         = errors.New("nome de jogador já está em uso")
+	ErrCredencialErrada  = errors.New("nome ou senha incorretos")
+	ErrSaldoInsuficiente = errors.New("saldo de moedas insuficiente")
+)
+
+// Conta é a conta persistente de um jogador. O ID é estável entre logins e é o
+// mesmo em todos os servidores do cluster.
+type Conta struct {
+	ID         string        `json:"id"`
+	Nome       string        `json:"nome"`
+	SenhaHash  string        `json:"senha_hash"` // PBKDF2-SHA256 em hex
+	Sal        string        `json:"sal"`        // Sal aleatório em hex
+	Inventario []tipos.Carta `json:"inventario"`
+	CriadaEm   time.Time     `json:"criada_em"`
+
+	Rating            int      `json:"rating"`                       // Rating Elo (ranking.RATING_INICIAL para contas antigas)
+	Partidas          int      `json:"partidas"`                     // Partidas avaliadas
+	PartidasAvaliadas []string `json:"partidas_avaliadas,omitempty"` // Salas já contadas no rating (o log pode ser reaplicado)
+
+	Moedas     int      `json:"moedas"`
+	Carteira   bool     `json:"carteira,omitempty"`   // Já recebeu MOEDAS_INICIAIS
+	Movimentos []string `json:"movimentos,omitempty"` // Movimentações de moedas já aplicadas (o log pode ser reaplicado)
+}
+
+// Repositorio guarda as contas de todos os jogadores do cluster. As alterações
+// chegam pelo log replicado (mesma ordem em todos os nós); se `arquivo` não for
+// vazio, o estado é gravado em disco a cada alteração e recarregado ao iniciar.
+type Repositorio struct {
+	mutex   sync.RWMutex
+	contas  map[string]*Conta // ID -> Conta
+	porNome map[string]string // nome normalizado -> ID
+	arquivo string
+}
+
+// NovoRepositorio cria o repositório. Com `diretorio` vazio as contas ficam só em memória.
+func NovoRepositorio(diretorio string) (*Repositorio, error) {
+	r := &Repositorio{
+		contas:  make(map[string]*Conta),
+		porNome: make(map[string]string),
+	}
+	if diretorio == "" {
+		return r, nil
+	}
+
+	if err := os.MkdirAll(diretorio, 0o755); err != nil {
+		return nil, fmt.Errorf("erro ao criar diretório das contas: %v", err)
+	}
+	r.arquivo = filepath.Join(diretorio, ARQUIVO_CONTAS)
+
+	dados, err := os.ReadFile(r.arquivo)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, fmt.Errorf("erro ao ler contas: %v", err)
+	}
+	var salvas []*Conta
+	if err := json.Unmarshal(dados, &salvas); err != nil {
+		return nil, fmt.Errorf("arquivo de contas corrompido: %v", err)
+	}
+	for _, c := range salvas {
+		if c.Rating == 0 {
+			c.Rating = ranking.RATING_INICIAL
+		}
+		abrirCarteira(c)
+		r.contas[c.ID] = c
+		r.porNome[normalizarNome(c.Nome)] = c.ID
+	}
+	log.Printf("[CONTAS] %d contas carregadas de %s", len(salvas), r.arquivo)
+	return r, nil
+}
+
+// NovaConta monta uma conta com a senha já protegida, pronta para ser proposta no log.
+func NovaConta(id, nome, senha string) (*Conta, error) {
+	if len(senha) < SENHA_TAMANHO_MIN {
+		return nil, fmt.Errorf("a senha deve ter pelo menos %d caracteres", SENHA_TAMANHO_MIN)
+	}
+	sal := make([]byte, SAL_TAMANHO)
+	if _, err := rand.Read(sal); err != nil {
+		return nil, err
+	}
+	hash, err := derivarSenha(senha, sal)
+	if err != nil {
+		return nil, err
+	}
+	return &Conta{
+		ID:         id,
+		Nome:       nome,
+		SenhaHash:  hash,
+		Sal:        hex.EncodeToString(sal),
+		Inventario: make([]tipos.Carta, 0),
+		CriadaEm:   time.Now(),
+		Rating:     ranking.RATING_INICIAL,
+		Moedas:     MOEDAS_INICIAIS,
+		Carteira:   true,
+	}, nil
+}
+
+// AplicarCriacao adiciona uma conta comprometida no log. Se o nome já pertence a
+// outra conta (dois servidores registraram o mesmo nome ao mesmo tempo), a primeira
+// entrada do log vence e esta é descartada com ErrNomeEmUso.
+func (r *Repositorio) AplicarCriacao(conta Conta) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	chave := normalizarNome(conta.Nome)
+	if id, existe := r.porNome[chave]; existe && id != conta.ID {
+		return ErrNomeEmUso
+	}
+	if _, existe := r.contas[conta.ID]; !existe {
+		if conta.Inventario == nil {
+			conta.Inventario = make([]tipos.Carta, 0)
+		}
+		if conta.Rating == 0 {
+			conta.Rating = ranking.RATING_INICIAL
+		}
+		abrirCarteira(&conta)
+		r.contas[conta.ID] = &conta
+		r.porNome[chave] = conta.ID
+	}
+	r.salvar()
+	return nil
+}
+
+// AplicarInventario substitui o inventário salvo de uma conta.
+func (r *Repositorio) AplicarInventario(id string, inventario []tipos.Carta) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conta, existe := r.contas[id]
+	if !existe {
+		return fmt.Errorf("conta %s não encontrada", id)
+	}
+	conta.Inventario = append(make([]tipos.Carta, 0, len(inventario)), inventario...)
+	r.salvar()
+	return nil
+}
+
+// AdicionarCarta coloca a carta no inventário salvo da conta, se ainda não estiver lá.
+func (r *Repositorio) AdicionarCarta(id string, carta tipos.Carta) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conta, existe := r.contas[id]
+	if !existe {
+		return fmt.Errorf("conta %s não encontrada", id)
+	}
+	for _, c := range conta.Inventario {
+		if c.ID == carta.ID {
+			return nil
+		}
+	}
+	conta.Inventario = append(conta.Inventario, carta)
+	r.salvar()
+	return nil
+}
+
+// RemoverCarta tira a carta do inventário salvo da conta, se estiver lá.
+func (r *Repositorio) RemoverCarta(id, cartaID string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	conta, existe := r.contas[id]
+	if !existe {
+		return fmt.Errorf("conta %s não encontrada", id)
+	}
+	for i, c := range conta.Inventario {
+		if c.ID == cartaID {
+			conta.Inventario = append(conta.Inventario[:i:i], conta.Inventario[i+1:]...)
+			r.salvar()
+			return nil
+		}
+	}
+	return nil
+}
+
+// AplicarMovimento soma `variacoes` (ID da conta -> moedas, negativo para débito)
+// aos saldos, tudo ou nada. Um movimento já aplicado é ignorado; se algum saldo
+// ficaria negativo, nada muda e o erro é ErrSaldoInsuficiente.
+func (r *Repositorio) AplicarMovimento(movimentoID string, variacoes map[string]int) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for id, valor := range variacoes {
+		conta := r.contas[id]
+		if conta == nil {
+			return fmt.Errorf("conta %s não encontrada", id)
+		}
+		for _, m := range conta.Movimentos {
+			if m == movimentoID {
+				return nil
+			}
+		}
+		if conta.Moedas+valor < 0 {
+			return ErrSaldoInsuficiente
+		}
+	}
+	for id, valor := range variacoes {
+		conta := r.contas[id]
+		conta.Moedas += valor
+		conta.Movimentos = append(conta.Movimentos, movimentoID)
+	}
+	r.salvar()
+	return nil
+}
+
+// Moedas devolve o saldo de uma conta e se ela existe.
+func (r *Repositorio) Moedas(id string) (int, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conta, existe := r.contas[id]
+	if !existe {
+		return 0, false
+	}
+	return conta.Moedas, true
+}
+
+// Premios devolve as moedas ganhas por A e por B numa partida em que A fez `pontosA`.
+func Premios(pontosA float64) (int, int) {
+	switch pontosA {
+	case 1:
+		return MOEDAS_VITORIA, MOEDAS_DERROTA
+	case 0:
+		return MOEDAS_DERROTA, MOEDAS_VITORIA
+	}
+	return MOEDAS_EMPATE, MOEDAS_EMPATE
+}
+
+// AplicarResultado atualiza o rating dos dois jogadores de uma partida e credita os
+// prêmios em moedas. pontosA é 1 se A venceu, 0.5 no empate e 0 se B venceu. Uma
+// sala já contada é ignorada.
+func (r *Repositorio) AplicarResultado(salaID, idA, idB string, pontosA float64) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	contaA, contaB := r.contas[idA], r.contas[idB]
+	if contaA == nil || contaB == nil {
+		return fmt.Errorf("conta de %s ou %s não encontrada", idA, idB)
+	}
+	for _, id := range contaA.PartidasAvaliadas {
+		if id == salaID {
+			return nil
+		}
+	}
+	contaA.Rating, contaB.Rating = ranking.Atualizar(contaA.Rating, contaB.Rating, pontosA)
+	premioA, premioB := Premios(pontosA)
+	contaA.Moedas += premioA
+	contaB.Moedas += premioB
+	for _, conta := range []*Conta{contaA, contaB} {
+		conta.Partidas++
+		conta.PartidasAvaliadas = append(conta.PartidasAvaliadas, salaID)
+	}
+	r.salvar()
+	return nil
+}
+
+// PartidaAvaliada diz se o resultado da sala já foi aplicado à conta
+func (r *Repositorio) PartidaAvaliada(id, salaID string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conta, existe := r.contas[id]
+	if !existe {
+		return false
+	}
+	for _, avaliada := range conta.PartidasAvaliadas {
+		if avaliada == salaID {
+			return true
+		}
+	}
+	return false
+}
+
+// MovimentoAplicado diz se a movimentação de moedas já foi aplicada à conta
+func (r *Repositorio) MovimentoAplicado(id, movimentoID string) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conta, existe := r.contas[id]
+	if !existe {
+		return false
+	}
+	for _, m := range conta.Movimentos {
+		if m == movimentoID {
+			return true
+		}
+	}
+	return false
+}
+
+// Rating devolve o rating de uma conta e se ela existe.
+func (r *Repositorio) Rating(id string) (int, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conta, existe := r.contas[id]
+	if !existe {
+		return ranking.RATING_INICIAL, false
+	}
+	return conta.Rating, true
+}
+
+// Autenticar confere nome e senha e devolve uma cópia da conta.
+func (r *Repositorio) Autenticar(nome, senha string) (*Conta, error) {
+	r.mutex.RLock()
+	id, existe := r.porNome[normalizarNome(nome)]
+	var conta *Conta
+	if existe {
+		conta = r.contas[id]
+	}
+	r.mutex.RUnlock()
+	if conta == nil {
+		return nil, ErrCredencialErrada
+	}
+
+	sal, err := hex.DecodeString(conta.Sal)
+	if err != nil {
+		return nil, ErrCredencialErrada
+	}
+	hash, err := derivarSenha(senha, sal)
+	if err != nil || subtle.ConstantTimeCompare([]byte(hash), []byte(conta.SenhaHash)) != 1 {
+		return nil, ErrCredencialErrada
+	}
+	return r.BuscarPorID(id), nil
+}
+
+// BuscarPorID devolve uma cópia da conta ou nil.
+func (r *Repositorio) BuscarPorID(id string) *Conta {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	conta, existe := r.contas[id]
+	if !existe {
+		return nil
+	}
+	copia := *conta
+	copia.Inventario = append(make([]tipos.Carta, 0, len(conta.Inventario)), conta.Inventario...)
+	copia.PartidasAvaliadas = append([]string(nil), conta.PartidasAvaliadas...)
+	copia.Movimentos = append([]string(nil), conta.Movimentos...)
+	return &copia
+}
+
+// CartasEmMaisDeUmaConta devolve as cartas salvas no inventário de mais de uma
+// conta (cartaID -> IDs das contas), o que indica uma carta duplicada.
+func (r *Repositorio) CartasEmMaisDeUmaConta() map[string][]string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	donos := make(map[string][]string)
+	for _, conta := range r.contas {
+		for _, c := range conta.Inventario {
+			donos[c.ID] = append(donos[c.ID], conta.ID)
+		}
+	}
+	for cartaID, ids := range donos {
+		if len(ids) < 2 {
+			delete(donos, cartaID)
+		}
+	}
+	return donos
+}
+
+// BuscarPorNome devolve uma cópia da conta com esse nome (sem diferenciar maiúsculas) ou nil.
+func (r *Repositorio) BuscarPorNome(nome string) *Conta {
+	r.mutex.RLock()
+	id, existe := r.porNome[normalizarNome(nome)]
+	r.mutex.RUnlock()
+	if !existe {
+		return nil
+	}
+	return r.BuscarPorID(id)
+}
+
+// Exportar devolve as contas para o snapshot do log replicado
+func (r *Repositorio) Exportar() (json.RawMessage, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	lista := make([]*Conta, 0, len(r.contas))
+	for _, c := range r.contas {
+		lista = append(lista, c)
+	}
+	return json.Marshal(lista)
+}
+
+// Importar substitui as contas pelas de um snapshot do log replicado
+func (r *Repositorio) Importar(dados json.RawMessage) error {
+	var lista []*Conta
+	if err := json.Unmarshal(dados, &lista); err != nil {
+		return fmt.Errorf("contas do snapshot inválidas: %v", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.contas = make(map[string]*Conta, len(lista))
+	r.porNome = make(map[string]string, len(lista))
+	for _, c := range lista {
+		r.contas[c.ID] = c
+		r.porNome[normalizarNome(c.Nome)] = c.ID
+	}
+	r.salvar()
+	return nil
+}
+
+// salvar grava todas as contas em disco (arquivo temporário + rename). Assume o lock ativo.
+func (r *Repositorio) salvar() {
+	if r.arquivo == "" {
+		return
+	}
+	lista := make([]*Conta, 0, len(r.contas))
+	for _, c := range r.contas {
+		lista = append(lista, c)
+	}
+	dados, err := json.Marshal(lista)
+	if err != nil {
+		log.Printf("[CONTAS] Erro ao serializar contas: %v", err)
+		return
+	}
+	tmp := r.arquivo + ".tmp"
+	if err := os.WriteFile(tmp, dados, 0o600); err != nil {
+		log.Printf("[CONTAS] Erro ao gravar contas: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, r.arquivo); err != nil {
+		log.Printf("[CONTAS] Erro ao substituir arquivo de contas: %v", err)
+	}
+}
+
+// abrirCarteira dá MOEDAS_INICIAIS às contas criadas antes da carteira existir.
+// Roda na carga e na aplicação do log, então é igual em todos os nós.
+func abrirCarteira(c *Conta) {
+	if !c.Carteira {
+		c.Moedas += MOEDAS_INICIAIS
+		c.Carteira = true
+	}
+}
+
+func derivarSenha(senha string, sal []byte) (string, error) {
+	chave, err := pbkdf2.Key(sha256.New, senha, sal, PBKDF2_ITERACOES, PBKDF2_TAMANHO)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(chave), nil
+}
+
+func normalizarNome(nome string) string {
+	return strings.ToLower(strings.TrimSpace(nome))
+}
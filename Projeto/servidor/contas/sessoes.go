@@ -0,0 +1,58 @@
+package contas
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Sessoes diz em qual servidor cada conta está logada. Cada servidor tem a sua
+// cópia, montada a partir do log replicado: só o servidor dono da sessão mantém o
+// Cliente da conta (e grava o inventário dela).
+type Sessoes struct {
+	mutex      sync.RWMutex
+	servidores map[string]string // ID da conta -> servidor que atende a sessão
+}
+
+func NovasSessoes() *Sessoes {
+	return &Sessoes{servidores: make(map[string]string)}
+}
+
+// Servidor devolve o dono da sessão da conta ("" se ninguém abriu sessão)
+func (s *Sessoes) Servidor(clienteID string) string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.servidores[clienteID]
+}
+
+// Mover passa a sessão para `servidor` se ela ainda estiver em `anterior`. Dois
+// logins simultâneos propõem a partir do mesmo dono; só o primeiro comprometido
+// vale. Devolve false quando a proposta chegou tarde.
+func (s *Sessoes) Mover(clienteID, anterior, servidor string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.servidores[clienteID] != anterior {
+		return false
+	}
+	s.servidores[clienteID] = servidor
+	return true
+}
+
+// Exportar devolve as sessões para o snapshot do log replicado
+func (s *Sessoes) Exportar() (json.RawMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return json.Marshal(s.servidores)
+}
+
+// Importar substitui as sessões pelas de um snapshot do log replicado
+func (s *Sessoes) Importar(dados json.RawMessage) error {
+	servidores := make(map[string]string)
+	if err := json.Unmarshal(dados, &servidores); err != nil {
+		return fmt.Errorf("sessões do snapshot inválidas: %v", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.servidores = servidores
+	return nil
+}
@@ -0,0 +1,124 @@
+package game
+
+import (
+	"fmt"
+	"io"
+	"jogodistribuido/partida"
+	"jogodistribuido/servidor/tipos"
+)
+
+// O redutor e o formato de replay ficam no pacote partida, compartilhado com o
+// cliente. As funções abaixo só fazem a ponte entre a Sala e a partida.Mesa.
+
+// NovaSala cria uma sala no estado inicial, antes de qualquer evento.
+func NovaSala(id string, jogadores []*tipos.Cliente) *tipos.Sala {
+	mesa := partida.NovaMesa(id, nil)
+	sala := &tipos.Sala{ID: id, Jogadores: jogadores}
+	gravarMesa(sala, mesa)
+	return sala
+}
+
+// Aplicar aplica um evento à sala com partida.Aplicar. Assume o lock da sala ativo.
+func Aplicar(sala *tipos.Sala, ev tipos.GameEvent) (string, error) {
+	mesa := mesaDaSala(sala)
+	vencedorJogada, err := partida.Aplicar(mesa, ev)
+	if err != nil {
+		return "", err
+	}
+	gravarMesa(sala, mesa)
+	return vencedorJogada, nil
+}
+
+// Reconstruir refaz uma sala do zero aplicando o log em ordem. Os EventSeq devem ser
+// contíguos a partir de 1.
+func Reconstruir(salaID string, jogadores []*tipos.Cliente, eventos []tipos.GameEvent) (*tipos.Sala, error) {
+	copias := make([]*tipos.Cliente, len(jogadores))
+	for i, j := range jogadores {
+		copias[i] = &tipos.Cliente{ID: j.ID, Nome: j.Nome}
+	}
+	sala := NovaSala(salaID, copias)
+
+	for _, ev := range eventos {
+		if ev.EventSeq != sala.EventSeq+1 {
+			return nil, fmt.Errorf("log da sala %s com lacuna: esperado eventSeq %d, obtido %d", salaID, sala.EventSeq+1, ev.EventSeq)
+		}
+		if _, err := Aplicar(sala, ev); err != nil {
+			return nil, fmt.Errorf("evento %d (%s) inválido: %v", ev.EventSeq, ev.EventType, err)
+		}
+	}
+	sala.EventLog = eventos
+	return sala, nil
+}
+
+// CopiarEstado substitui o estado derivado do log em `destino` pelo de `origem`.
+// Jogadores, Host e Sombra não são alterados. Assume o lock de `destino` ativo.
+func CopiarEstado(destino, origem *tipos.Sala) {
+	gravarMesa(destino, mesaDaSala(origem))
+	destino.EventLog = origem.EventLog
+}
+
+// HashSala resume o estado da sala em um SHA-256 (partida.Hash). Assume o lock da sala ativo.
+func HashSala(sala *tipos.Sala) string {
+	return partida.Hash(mesaDaSala(sala))
+}
+
+// Vencedor devolve o nome de quem fez mais pontos na rodada ou "EMPATE" (partida.Vencedor).
+func Vencedor(sala *tipos.Sala) string {
+	return partida.Vencedor(mesaDaSala(sala))
+}
+
+// ExportarReplay escreve o log da sala em JSON Lines. Assume o lock da sala ativo.
+func ExportarReplay(w io.Writer, sala *tipos.Sala) error {
+	cabecalho := partida.CabecalhoReplay{
+		SalaID:    sala.ID,
+		Jogadores: jogadoresDaSala(sala),
+		Estado:    sala.Estado,
+		EventSeq:  sala.EventSeq,
+		Hash:      HashSala(sala),
+	}
+	if sala.Estado == "FINALIZADO" {
+		cabecalho.Vencedor = Vencedor(sala)
+	}
+	return partida.EscreverReplay(w, cabecalho, sala.EventLog)
+}
+
+// mesaDaSala monta a partida.Mesa com os campos da sala. Os mapas são os mesmos da
+// sala; partida.Aplicar só os altera quando o evento é aceito.
+func mesaDaSala(sala *tipos.Sala) *partida.Mesa {
+	return &partida.Mesa{
+		SalaID:        sala.ID,
+		Jogadores:     jogadoresDaSala(sala),
+		Estado:        sala.Estado,
+		CartasNaMesa:  sala.CartasNaMesa,
+		PontosRodada:  sala.PontosRodada,
+		PontosPartida: sala.PontosPartida,
+		NumeroRodada:  sala.NumeroRodada,
+		Prontos:       sala.Prontos,
+		TurnoDe:       sala.TurnoDe,
+		Desistente:    sala.Desistente,
+		MotivoFim:     sala.MotivoFim,
+		EventSeq:      sala.EventSeq,
+	}
+}
+
+// gravarMesa copia o estado da mesa de volta para a sala.
+func gravarMesa(sala *tipos.Sala, mesa *partida.Mesa) {
+	sala.Estado = mesa.Estado
+	sala.CartasNaMesa = mesa.CartasNaMesa
+	sala.PontosRodada = mesa.PontosRodada
+	sala.PontosPartida = mesa.PontosPartida
+	sala.NumeroRodada = mesa.NumeroRodada
+	sala.Prontos = mesa.Prontos
+	sala.TurnoDe = mesa.TurnoDe
+	sala.Desistente = mesa.Desistente
+	sala.MotivoFim = mesa.MotivoFim
+	sala.EventSeq = mesa.EventSeq
+}
+
+func jogadoresDaSala(sala *tipos.Sala) []partida.Jogador {
+	jogadores := make([]partida.Jogador, len(sala.Jogadores))
+	for i, j := range sala.Jogadores {
+		jogadores[i] = partida.Jogador{ID: j.ID, Nome: j.Nome}
+	}
+	return jogadores
+}
@@ -0,0 +1,156 @@
+package historico
+
+import (
+	"bytes"
+	"fmt"
+	"jogodistribuido/partida"
+	"jogodistribuido/servidor/game"
+	"jogodistribuido/servidor/tipos"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const EXTENSAO_ARQUIVO = ".jsonl"
+
+// Resumo é o que o histórico guarda em memória de cada partida arquivada: o
+// cabeçalho do replay e quando ela foi arquivada.
+type Resumo struct {
+	partida.CabecalhoReplay
+	ArquivadaEm time.Time `json:"arquivada_em"`
+}
+
+// Arquivo guarda as partidas finalizadas deste servidor no mesmo formato do replay
+// (game.ExportarReplay), um arquivo por sala. Com `diretorio` vazio as partidas
+// ficam só em memória.
+type Arquivo struct {
+	mutex     sync.RWMutex
+	resumos   map[string]Resumo // salaID -> Resumo
+	conteudos map[string][]byte // salaID -> replay (só sem diretório)
+	diretorio string
+}
+
+// NovoArquivo abre o histórico e carrega os resumos das partidas já arquivadas.
+func NovoArquivo(diretorio string) (*Arquivo, error) {
+	a := &Arquivo{
+		resumos:   make(map[string]Resumo),
+		conteudos: make(map[string][]byte),
+		diretorio: diretorio,
+	}
+	if diretorio == "" {
+		return a, nil
+	}
+
+	if err := os.MkdirAll(diretorio, 0o755); err != nil {
+		return nil, fmt.Errorf("erro ao criar diretório do histórico: %v", err)
+	}
+	entradas, err := os.ReadDir(diretorio)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler histórico: %v", err)
+	}
+	for _, e := range entradas {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), EXTENSAO_ARQUIVO) {
+			continue
+		}
+		caminho := filepath.Join(diretorio, e.Name())
+		f, err := os.Open(caminho)
+		if err != nil {
+			log.Printf("[HISTORICO] Erro ao abrir %s: %v", caminho, err)
+			continue
+		}
+		replay, err := partida.LerReplay(f)
+		f.Close()
+		if err != nil {
+			log.Printf("[HISTORICO] Ignorando %s: %v", caminho, err)
+			continue
+		}
+		resumo := Resumo{CabecalhoReplay: replay.Cabecalho}
+		if info, err := e.Info(); err == nil {
+			resumo.ArquivadaEm = info.ModTime()
+		}
+		a.resumos[replay.Cabecalho.SalaID] = resumo
+	}
+	log.Printf("[HISTORICO] %d partidas carregadas de %s", len(a.resumos), diretorio)
+	return a, nil
+}
+
+// Arquivar grava a partida (cabeçalho + EventLog). Assume o lock da sala ativo.
+func (a *Arquivo) Arquivar(sala *tipos.Sala) error {
+	var buf bytes.Buffer
+	if err := game.ExportarReplay(&buf, sala); err != nil {
+		return err
+	}
+	replay, err := partida.LerReplay(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.diretorio == "" {
+		a.conteudos[sala.ID] = buf.Bytes()
+	} else {
+		caminho := filepath.Join(a.diretorio, sala.ID+EXTENSAO_ARQUIVO)
+		tmp := caminho + ".tmp"
+		if err := os.WriteFile(tmp, buf.Bytes(), 0o644); err != nil {
+			return fmt.Errorf("erro ao gravar partida %s: %v", sala.ID, err)
+		}
+		if err := os.Rename(tmp, caminho); err != nil {
+			return fmt.Errorf("erro ao substituir partida %s: %v", sala.ID, err)
+		}
+	}
+	a.resumos[sala.ID] = Resumo{CabecalhoReplay: replay.Cabecalho, ArquivadaEm: time.Now()}
+	return nil
+}
+
+// Replay devolve o arquivo de replay de uma partida arquivada.
+func (a *Arquivo) Replay(salaID string) ([]byte, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	if _, existe := a.resumos[salaID]; !existe {
+		return nil, false
+	}
+	if a.diretorio == "" {
+		return a.conteudos[salaID], true
+	}
+	conteudo, err := os.ReadFile(filepath.Join(a.diretorio, salaID+EXTENSAO_ARQUIVO))
+	if err != nil {
+		log.Printf("[HISTORICO] Erro ao ler partida %s: %v", salaID, err)
+		return nil, false
+	}
+	return conteudo, true
+}
+
+// PartidasDoJogador lista as partidas arquivadas de um jogador, da mais recente para a mais antiga.
+func (a *Arquivo) PartidasDoJogador(jogadorID string) []Resumo {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	partidas := make([]Resumo, 0)
+	for _, r := range a.resumos {
+		for _, j := range r.Jogadores {
+			if j.ID == jogadorID {
+				partidas = append(partidas, r)
+				break
+			}
+		}
+	}
+	sort.Slice(partidas, func(i, k int) bool {
+		return partidas[i].ArquivadaEm.After(partidas[k].ArquivadaEm)
+	})
+	return partidas
+}
+
+// Resumo devolve o resumo de uma partida arquivada.
+func (a *Arquivo) Resumo(salaID string) (Resumo, bool) {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	r, existe := a.resumos[salaID]
+	return r, existe
+}
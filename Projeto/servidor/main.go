@@ -2,25 +2,35 @@ package main
 
 import (
 	"bytes"
-	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
+	"jogodistribuido/partida"
 	"jogodistribuido/protocolo"
 	"jogodistribuido/servidor/api"
 	"jogodistribuido/servidor/cluster"
+	"jogodistribuido/servidor/contas"
 	"jogodistribuido/servidor/game"
+	"jogodistribuido/servidor/historico"
+	"jogodistribuido/servidor/matchmaking"
+	"jogodistribuido/servidor/mercado"
 	mqttManager "jogodistribuido/servidor/mqtt"
+	"jogodistribuido/servidor/ranking"
+	"jogodistribuido/servidor/razao"
 	"jogodistribuido/servidor/seguranca"
 	"jogodistribuido/servidor/store"
 	"jogodistribuido/servidor/tipos"
+	"jogodistribuido/servidor/troca"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -35,8 +45,71 @@ const (
 	ELEICAO_TIMEOUT     = 30 * time.Second // Aumentado para 30 segundos
 	HEARTBEAT_INTERVALO = 5 * time.Second  // Aumentado para 5 segundos
 	PACOTE_SIZE         = 5
+	PACOTE_PRECO        = 20                                 // Moedas debitadas em cada COMPRAR_PACOTE
 	JWT_SECRET          = "jogo_distribuido_secret_key_2025" // Chave secreta compartilhada entre servidores
 	JWT_EXPIRATION      = 24 * time.Hour                     // Tokens expiram em 24 horas
+
+	ENTRADA_PACOTE_COMPRA       = "PACOTE_COMPRA"       // Compra de pacote: débito, retirada do estoque, cunhagem e entrega numa entrada só
+	ENTRADA_PACOTE_CANCELAMENTO = "PACOTE_CANCELAMENTO" // Anula uma compra de pacote se ela ainda não foi aplicada
+	SUFIXO_COMPRA_CANCELADA     = "/cancelada"          // Movimento que marca na conta uma compra de pacote anulada
+	ESTOQUE_SEMENTE_PADRAO      = 2025                  // Semente do estoque inicial quando ESTOQUE_SEED não é definida
+
+	COMPRA_PACOTE_TIMEOUT = 2*cluster.PROPOSTA_TIMEOUT + 10*time.Second // Espera do seguidor pelo líder: compra, cancelamento e folga
+
+	HOST_MONITOR_INTERVALO = 3 * time.Second // Intervalo em que a Sombra verifica o Host de cada partida
+	HOST_FALHAS_MAXIMAS    = 3               // Verificações seguidas sem resposta antes de assumir a partida
+	HOST_STATUS_TIMEOUT    = 2 * time.Second // Tempo máximo de cada verificação do Host pela Sombra
+	SOMBRA_NOVA_INTERVALO  = 5 * time.Second // Intervalo entre tentativas de eleger uma nova Sombra
+
+	ENTRADA_CONTA_CRIADA        = "CONTA_CRIADA"        // Entrada do log replicado com o registro de uma conta
+	ENTRADA_CONTA_INVENTARIO    = "CONTA_INVENTARIO"    // Entrada do log replicado com o inventário salvo de uma conta
+	ENTRADA_CONTA_TRANSFERENCIA = "CONTA_TRANSFERENCIA" // Inventários mudados por uma troca ou jogada, com os movimentos do livro-razão
+	ENTRADA_CONTA_RESULTADO     = "CONTA_RESULTADO"     // Entrada do log replicado com o resultado de uma partida (rating)
+	CONTA_ESPERA_APLICACAO      = 5 * time.Second       // Tempo máximo para a conta registrada aparecer no repositório local
+	RESULTADO_REPETICAO         = 5 * time.Second       // Intervalo entre as tentativas de comprometer o resultado de uma partida
+	ENTRADA_SESSAO              = "SESSAO"              // Entrada do log replicado que move a sessão de uma conta para um servidor
+
+	TURNO_DURACAO_PADRAO        = 30 * time.Second // Prazo de cada turno quando TEMPO_TURNO não é definida
+	TURNO_VERIFICACAO_INTERVALO = 1 * time.Second  // Intervalo em que o Host confere os prazos das suas partidas
+	TURNOS_EXPIRADOS_MAXIMOS    = 2                // Prazos esgotados seguidos antes de o jogador perder por W.O.
+	TURNO_PRAZO_MINIMO_FAILOVER = 10 * time.Second // Prazo mínimo que o jogador da vez recebe quando a Sombra assume
+
+	LOBBY_PRAZO_PRONTOS     = 60 * time.Second // Prazo para os dois jogadores comprarem o pacote inicial
+	LOBBY_TOLERANCIA_SOMBRA = 15 * time.Second // Tempo extra antes de a Sombra encerrar sozinha um lobby vencido (Host fora)
+	MOTIVO_LOBBY_PRAZO      = "prazo_compra_esgotado"
+	MOTIVO_LOBBY_CANCELADO  = "cancelada_por_jogador"
+
+	SALA_GC_INTERVALO        = 30 * time.Second // Intervalo do coletor de salas finalizadas
+	SALA_RETENCAO_FINALIZADA = 2 * time.Minute  // Tempo que uma sala finalizada fica em memória antes de ser arquivada
+
+	FILA_GLOBAL_INTERVALO    = 1 * time.Second  // Intervalo em que o líder pareia a fila do cluster
+	FILA_SINCRONIA_INTERVALO = 5 * time.Second  // Intervalo em que cada servidor reenvia a sua fila local ao líder
+	FILA_GLOBAL_EXPIRACAO    = 15 * time.Second // Entradas não confirmadas por esse tempo saem da fila do cluster
+	PAREAMENTO_RESERVA_PRAZO = 20 * time.Second // Tempo que um jogador fica reservado esperando a confirmação do par
+	PAREAMENTO_SALA_MEMORIA  = 5 * time.Minute  // Tempo que a sala criada para um par é lembrada (confirmações repetidas e abortos)
+	PAREAMENTO_TENTATIVAS    = 3                // Envios de cada confirmação antes de o líder abortar o par
+
+	ENTRADA_CONVITE_CRIADO    = "CONVITE_CRIADO"    // Entrada do log replicado com o código de uma sala privada
+	ENTRADA_CONVITE_ENCERRADO = "CONVITE_ENCERRADO" // Entrada do log replicado com um código usado, cancelado ou expirado
+	CONVITE_PRAZO             = 10 * time.Minute    // Validade do código de uma sala privada
+
+	TROCA_OFERTA_PRAZO    = 60 * time.Second // Tempo que uma proposta de troca espera a resposta do outro jogador
+	TROCA_RESERVA_PRAZO   = 2 * time.Minute  // Tempo sem decisão depois do qual o participante consulta o coordenador da troca
+	TROCA_DIARIO_RETENCAO = 24 * time.Hour   // Tempo que uma troca terminada fica no diário do coordenador
+
+	ENTRADA_MERCADO_ANUNCIO      = "MERCADO_ANUNCIO"      // Entrada do log replicado com uma carta posta à venda
+	ENTRADA_MERCADO_VENDA        = "MERCADO_VENDA"        // Entrada do log replicado com a compra de um anúncio
+	ENTRADA_MERCADO_CANCELAMENTO = "MERCADO_CANCELAMENTO" // Entrada do log replicado com um anúncio retirado pelo vendedor
+
+	RAZAO_LIMITE_CLIENTE = 50 // Movimentos mais recentes enviados ao cliente em RAZAO_HISTORICO
+
+	// Estados mudados pelos aplicadores, com o nome que recebem no snapshot do log replicado
+	ESTADO_ESTOQUE  = "estoque"
+	ESTADO_CONTAS   = "contas"
+	ESTADO_SESSOES  = "sessoes"
+	ESTADO_CONVITES = "convites"
+	ESTADO_MERCADO  = "mercado"
+	ESTADO_RAZAO    = "razao"
 )
 
 // ==================== TIPOS ====================
@@ -52,18 +125,43 @@ type Servidor struct {
 	MQTTClient      mqtt.Client
 	ClusterManager  cluster.ClusterManagerInterface
 	Store           store.StoreInterface
+	Contas          *contas.Repositorio
+	Sessoes         *contas.Sessoes // Servidor que atende a sessão de cada conta (log replicado)
+	Historico       *historico.Arquivo
+	Razao           *razao.Livro       // Livro-razão das transferências de cartas (log replicado)
+	Trocas          *troca.Coordenador // Transações de troca entre servidores iniciadas aqui
+	ReservasTroca   *troca.Reservas    // Cartas dos jogadores daqui prometidas a uma troca (gravadas em TROCAS_DIR)
+	OfertasTroca    *troca.Ofertas     // Propostas de troca fora de partida coordenadas aqui ou recebidas por jogadores daqui
 	GameManager     game.GameManagerInterface
 	MQTTManager     mqttManager.MQTTManagerInterface
 
 	// Gerenciamento de Partidas
-	Clientes        map[string]*tipos.Cliente // clienteID -> Cliente
-	mutexClientes   sync.RWMutex
-	Salas           map[string]*tipos.Sala // salaID -> Sala
-	mutexSalas      sync.RWMutex
-	FilaDeEspera    []*tipos.Cliente
-	mutexFila       sync.Mutex
-	ComandosPartida map[string]chan protocolo.Comando
-	mutexComandos   sync.Mutex
+	Clientes      map[string]*tipos.Cliente // clienteID -> Cliente
+	mutexClientes sync.RWMutex
+	Salas         map[string]*tipos.Sala // salaID -> Sala
+	mutexSalas    sync.RWMutex
+	FilaDeEspera  []*tipos.Cliente
+	mutexFila     sync.Mutex
+	FilaGlobal    *matchmaking.Fila     // Fila do cluster, usada enquanto este servidor é o líder
+	Convites      *matchmaking.Convites // Códigos de salas privadas ativos no cluster (log replicado)
+	Mercado       *mercado.Mercado      // Anúncios do mercado de cartas (log replicado)
+
+	reservasPareamento map[string]*reservaPareamento // pareamentoID/clienteID -> jogador retirado da fila (protegido por mutexFila)
+	salasPareamento    map[string]salaPareamento     // pareamentoID -> sala criada aqui pela confirmação (protegido por mutexPareamentos)
+	mutexPareamentos   sync.Mutex                    // Serializa as confirmações de pares neste servidor
+	ComandosPartida    map[string]chan protocolo.Comando
+	mutexComandos      sync.Mutex
+
+	salasMonitoradas map[string]bool // Salas cujo Host esta Sombra está monitorando (protegido por mutexSalas)
+	mutexInventarios sync.Mutex      // Serializa as propostas de inventário (salvarInventario)
+	mutexMercado     sync.Mutex      // No líder, serializa as validações de saldo e anúncios com a proposta
+	duracaoTurno     time.Duration   // Prazo de cada turno (TEMPO_TURNO)
+
+	// Sessões retomadas por outro servidor (protegidos por mutexSessoes)
+	gatewaysClientes map[string]string          // clienteID -> servidor que atende a sessão retomada (no servidor de origem)
+	gatewaysSalas    map[string]map[string]bool // salaID -> servidores que repetem os eventos da sala (no servidor de origem)
+	salasViaGateway  map[string]string          // salaID -> servidor de origem dos jogadores atendidos aqui
+	mutexSessoes     sync.RWMutex
 }
 
 // ==================== INICIALIZAÇÃO ====================
@@ -93,14 +191,33 @@ func (s *Servidor) Run() {
 	// Inicia processos concorrentes
 	// O ClusterManager é iniciado primeiro para que a descoberta comece imediatamente
 	s.ClusterManager.Run()
-	go s.tentarMatchmakingGlobalPeriodicamente() // Inicia a busca proativa
+	go s.sincronizarFilaComLider()
+	go s.coordenarFilaGlobal()
+	go s.monitorarPrazos()
+	go s.coletarSalasFinalizadas()
+	go s.vigiarReservasTroca()
 
 	// A API Server agora recebe o servidor e o cluster manager
 	apiServer := api.NewServer(s.MeuEndereco, s, s.ClusterManager)
 	go apiServer.Run()
+	s.Trocas.Recuperar() // Depois da API: as trocas retomadas podem ter lados neste servidor
 
 	log.Println("Servidor pronto e operacional")
-	select {} // Mantém o programa rodando
+
+	// Mantém o programa rodando até SIGINT/SIGTERM e então anuncia a saída do cluster
+	sinais := make(chan os.Signal, 1)
+	signal.Notify(sinais, syscall.SIGINT, syscall.SIGTERM)
+	<-sinais
+	log.Println("Encerrando: saindo do cluster...")
+	if err := s.ClusterManager.Sair(); err != nil {
+		log.Printf("Falha ao anunciar saída do cluster: %v", err)
+	}
+	// O estoque persistente grava um snapshot final e fecha o WAL
+	if fechavel, ok := s.Store.(interface{ Fechar() error }); ok {
+		if err := fechavel.Fechar(); err != nil {
+			log.Printf("Falha ao fechar o estoque: %v", err)
+		}
+	}
 }
 
 // Interface methods for managers
@@ -153,6 +270,9 @@ func (s *Servidor) GetMQTTManager() mqttManager.MQTTManagerInterface {
 }
 
 func (s *Servidor) PublicarParaCliente(clienteID string, msg protocolo.Mensagem) {
+	if msg.Comando == "PARTIDA_ENCONTRADA" {
+		s.herdarOrigemDaRevanche(msg)
+	}
 	s.publicarParaCliente(clienteID, msg)
 }
 
@@ -236,9 +356,14 @@ func (s *Servidor) AtualizarEstadoSalaRemoto(estado tipos.EstadoPartida) {
 
 	sala.Mutex.Lock()
 
+	// Guarda o estado completo para reconstruir a partida se o Host falhar
+	ultimoEstado := estado
+	sala.UltimoEstadoHost = &ultimoEstado
+
 	// Atualiza estado da sala
 	sala.Estado = estado.Estado
 	sala.TurnoDe = estado.TurnoDe
+	sala.PrazoTurno = estado.PrazoTurno
 
 	// ATUALIZA TAMBÉM OS INVENTÁRIOS DOS JOGADORES REAIS
 	// Importante: sincronizar as mudanças do estado para os jogadores reais do Shadow
@@ -257,6 +382,7 @@ func (s *Servidor) AtualizarEstadoSalaRemoto(estado tipos.EstadoPartida) {
 				oldCount := len(jogadorReal.Inventario)
 				jogadorReal.Inventario = jogadorEstado.Inventario
 				jogadorReal.Mutex.Unlock()
+				go s.salvarInventario(jogadorReal.ID)
 				log.Printf("[SYNC_SOMBRA] Inventário real atualizado para jogador local %s (%d -> %d cartas)", jogadorReal.Nome, oldCount, len(jogadorEstado.Inventario))
 
 				// Se o inventário mudou, notifica o cliente com o inventário atualizado
@@ -292,8 +418,13 @@ func (s *Servidor) AtualizarEstadoSalaRemoto(estado tipos.EstadoPartida) {
 		}
 	}
 
+	souSombra := sala.ServidorSombra == s.MeuEndereco
 	sala.Mutex.Unlock()
 
+	if souSombra && estado.Estado == "JOGANDO" {
+		s.iniciarMonitorHost(sala.ID)
+	}
+
 	log.Printf("[SYNC_SOMBRA_OK] Sala %s atualizada. Novo estado: %s, Turno de: %s", sala.ID, sala.Estado, sala.TurnoDe)
 	log.Printf("[SYNC_SOMBRA_DEBUG] Jogadores na sala: %v", func() []string {
 		ids := make([]string, len(sala.Jogadores))
@@ -314,24 +445,13 @@ func (s *Servidor) CriarSalaRemota(solicitante, oponente *tipos.Cliente) {
 
 func (s *Servidor) CriarSalaRemotaComSombra(solicitante, oponente *tipos.Cliente, sombraAddr string) string {
 	// A ordem dos jogadores aqui é crucial.
-	// Em handleSolicitarOponente:
-	//  'oponente' é o jogador local (j1)
-	//  'solicitante' é o jogador remoto (j2)
+	// Em AceitarConvite:
+	//  'oponente' é o jogador local (j1), criador do convite
+	//  'solicitante' é quem usou o código (j2), remoto se sombraAddr não é vazio
 	// Portanto, chamamos criarSala com (oponente, solicitante, sombraAddr)
 	return s.criarSala(oponente, solicitante, sombraAddr)
 }
 
-func (s *Servidor) RemoverPrimeiroDaFila() *tipos.Cliente {
-	s.mutexFila.Lock()
-	defer s.mutexFila.Unlock()
-	if len(s.FilaDeEspera) == 0 {
-		return nil
-	}
-	oponente := s.FilaDeEspera[0]
-	s.FilaDeEspera = s.FilaDeEspera[1:]
-	return oponente
-}
-
 func (s *Servidor) ProcessarComandoRemoto(salaID string, mensagem protocolo.Mensagem) error {
 	s.mutexSalas.RLock()
 	_, ok := s.Salas[salaID]
@@ -376,15 +496,57 @@ func novoServidor(endereco, broker string) *Servidor {
 		MeuEndereco:     endereco,
 		MeuEnderecoHTTP: "http://" + endereco,
 		BrokerMQTT:      broker,
-		Store:           store.NewStore(),
+		Store:           criarStore(),
+		Contas:          criarRepositorioContas(),
+		Sessoes:         contas.NovasSessoes(),
+		Historico:       criarHistorico(),
+		Razao:           criarLivroRazao(),
 		Clientes:        make(map[string]*tipos.Cliente),
 		Salas:           make(map[string]*tipos.Sala),
 		FilaDeEspera:    make([]*tipos.Cliente, 0),
-		ComandosPartida: make(map[string]chan protocolo.Comando),
+		FilaGlobal:      matchmaking.NovaFila(),
+		Convites:        matchmaking.NovosConvites(),
+		Mercado:         mercado.NovoMercado(),
+		OfertasTroca:    troca.NovasOfertas(),
+
+		reservasPareamento: make(map[string]*reservaPareamento),
+		salasPareamento:    make(map[string]salaPareamento),
+		ComandosPartida:    make(map[string]chan protocolo.Comando),
+
+		salasMonitoradas: make(map[string]bool),
+		duracaoTurno:     duracaoTurno(),
+		gatewaysClientes: make(map[string]string),
+		gatewaysSalas:    make(map[string]map[string]bool),
+		salasViaGateway:  make(map[string]string),
 	}
 
 	// Initialize managers
 	servidor.ClusterManager = cluster.NewManager(servidor)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_PACOTE_COMPRA, servidor.aplicarCompraPacote)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_PACOTE_CANCELAMENTO, servidor.aplicarCancelamentoPacote)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_CONTA_CRIADA, servidor.aplicarCriacaoConta)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_CONTA_INVENTARIO, servidor.aplicarInventarioConta)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_CONTA_RESULTADO, servidor.aplicarResultadoConta)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_SESSAO, servidor.aplicarSessao)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_CONVITE_CRIADO, servidor.aplicarConviteCriado)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_CONVITE_ENCERRADO, servidor.aplicarConviteEncerrado)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_MERCADO_ANUNCIO, servidor.aplicarAnuncioMercado)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_MERCADO_VENDA, servidor.aplicarVendaMercado)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_MERCADO_CANCELAMENTO, servidor.aplicarCancelamentoMercado)
+	servidor.ClusterManager.RegistrarAplicador(ENTRADA_CONTA_TRANSFERENCIA, servidor.aplicarTransferenciaCartas)
+	servidor.ClusterManager.RegistrarEstado(ESTADO_ESTOQUE, servidor.Store)
+	servidor.ClusterManager.RegistrarEstado(ESTADO_CONTAS, servidor.Contas)
+	servidor.ClusterManager.RegistrarEstado(ESTADO_SESSOES, servidor.Sessoes)
+	servidor.ClusterManager.RegistrarEstado(ESTADO_CONVITES, servidor.Convites)
+	servidor.ClusterManager.RegistrarEstado(ESTADO_MERCADO, servidor.Mercado)
+	servidor.ClusterManager.RegistrarEstado(ESTADO_RAZAO, servidor.Razao)
+	servidor.ClusterManager.AoSuspeitar(servidor.promoverSalasDoHostSuspeito)
+
+	servidor.Trocas = troca.NovoCoordenador(criarDiarioTrocas(), servidor.enviarPedidoTroca)
+	servidor.ReservasTroca = criarReservasTroca()
+	servidor.Trocas.AoConfirmar = func(t troca.Transacao, lado troca.Lado) {
+		servidor.atualizarCopiaDaTroca(t.SalaID, lado.ClienteID, lado.CartaSai, lado.CartaEntra)
+	}
 	// TODO: Initialize game and MQTT managers when interfaces are simplified
 	// servidor.GameManager = game.NewManager(servidor)
 	// servidor.MQTTManager = mqttManager.NewManager(servidor)
@@ -392,6 +554,131 @@ func novoServidor(endereco, broker string) *Servidor {
 	return servidor
 }
 
+// estadoNoLogReplicado diz se o log replicado é gravado em RAFT_DIR. Nesse caso o
+// estoque, as contas e o livro-razão ficam em memória e são refeitos a partir do
+// snapshot e das entradas do log ao reiniciar: arquivos próprios, já com parte das
+// entradas aplicadas, receberiam essas entradas uma segunda vez.
+func estadoNoLogReplicado() bool {
+	return os.Getenv("RAFT_DIR") != ""
+}
+
+// criarStore escolhe a implementação do estoque pela variável STORE_TIPO:
+// "memoria" (padrão) ou "persistente" (WAL + snapshots em STORE_DIR). Com RAFT_DIR
+// o estoque fica sempre em memória.
+func criarStore() store.StoreInterface {
+	tipo := os.Getenv("STORE_TIPO")
+	semente := sementeEstoque()
+	if estadoNoLogReplicado() && tipo == "persistente" {
+		log.Println("Estoque refeito a partir do log replicado em RAFT_DIR; STORE_DIR ignorado")
+		tipo = "memoria"
+	}
+	switch tipo {
+	case "", "memoria":
+		log.Println("Usando estoque em memória")
+		return store.NewStoreComSemente(semente)
+	case "persistente":
+		dir := os.Getenv("STORE_DIR")
+		if dir == "" {
+			dir = "/data/estoque"
+		}
+		st, err := store.NewStorePersistente(dir, semente)
+		if err != nil {
+			log.Fatalf("Erro ao abrir estoque persistente: %v", err)
+		}
+		return st
+	default:
+		log.Fatalf("STORE_TIPO desconhecido: %s (use 'memoria' ou 'persistente')", tipo)
+		return nil
+	}
+}
+
+// criarRepositorioContas abre as contas dos jogadores. Com CONTAS_DIR definida (e
+// sem RAFT_DIR) elas são gravadas em disco; senão ficam só em memória (e no log
+// replicado do cluster).
+func criarRepositorioContas() *contas.Repositorio {
+	dir := os.Getenv("CONTAS_DIR")
+	if estadoNoLogReplicado() && dir != "" {
+		log.Println("Contas refeitas a partir do log replicado em RAFT_DIR; CONTAS_DIR ignorado")
+		dir = ""
+	}
+	repo, err := contas.NovoRepositorio(dir)
+	if err != nil {
+		log.Fatalf("Erro ao abrir contas: %v", err)
+	}
+	return repo
+}
+
+// criarHistorico abre o histórico local de partidas em HISTORICO_DIR (vazio = só memória).
+func criarHistorico() *historico.Arquivo {
+	arquivo, err := historico.NovoArquivo(os.Getenv("HISTORICO_DIR"))
+	if err != nil {
+		log.Fatalf("Erro ao abrir histórico de partidas: %v", err)
+	}
+	return arquivo
+}
+
+// criarDiarioTrocas abre o diário das transações de troca em TROCAS_DIR (vazio = só
+// memória, e trocas interrompidas por um reinício não são retomadas).
+func criarDiarioTrocas() *troca.Diario {
+	diario, err := troca.NovoDiario(os.Getenv("TROCAS_DIR"))
+	if err != nil {
+		log.Fatalf("Erro ao abrir diário de trocas: %v", err)
+	}
+	return diario
+}
+
+// criarReservasTroca abre as reservas de troca dos jogadores deste servidor, também
+// em TROCAS_DIR.
+func criarReservasTroca() *troca.Reservas {
+	reservas, err := troca.NovasReservas(os.Getenv("TROCAS_DIR"))
+	if err != nil {
+		log.Fatalf("Erro ao abrir reservas de troca: %v", err)
+	}
+	return reservas
+}
+
+// criarLivroRazao abre o livro-razão das cartas em RAZAO_DIR (vazio, ou com
+// RAFT_DIR = só memória, refeito a partir do log replicado).
+func criarLivroRazao() *razao.Livro {
+	dir := os.Getenv("RAZAO_DIR")
+	if estadoNoLogReplicado() && dir != "" {
+		log.Println("Livro-razão refeito a partir do log replicado em RAFT_DIR; RAZAO_DIR ignorado")
+		dir = ""
+	}
+	livro, err := razao.NovoLivro(dir)
+	if err != nil {
+		log.Fatalf("Erro ao abrir livro-razão: %v", err)
+	}
+	return livro
+}
+
+// duracaoTurno lê o prazo de cada turno, em segundos, da variável TEMPO_TURNO.
+func duracaoTurno() time.Duration {
+	v := os.Getenv("TEMPO_TURNO")
+	if v == "" {
+		return TURNO_DURACAO_PADRAO
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		log.Fatalf("TEMPO_TURNO inválida: %q", v)
+	}
+	return time.Duration(n) * time.Second
+}
+
+// sementeEstoque lê ESTOQUE_SEED. Todos os servidores do cluster devem usar a mesma
+// semente para que o estoque replicado parta do mesmo estado.
+func sementeEstoque() int64 {
+	v := os.Getenv("ESTOQUE_SEED")
+	if v == "" {
+		return ESTOQUE_SEMENTE_PADRAO
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Fatalf("ESTOQUE_SEED inválida: %v", err)
+	}
+	return n
+}
+
 // ==================== MQTT ====================
 
 func (s *Servidor) conectarMQTT() error {
@@ -424,6 +711,14 @@ func (s *Servidor) subscreverTopicos() {
 
 	s.MQTTClient.Subscribe("clientes/+/login", 0, s.handleClienteLogin)
 	s.MQTTClient.Subscribe("clientes/+/entrar_fila", 0, s.handleClienteEntrarFila)
+	s.MQTTClient.Subscribe("clientes/+/sair_fila", 0, s.handleClienteSairFila)
+	s.MQTTClient.Subscribe("clientes/+/criar_privada", 0, s.handleClienteCriarPrivada)
+	s.MQTTClient.Subscribe("clientes/+/entrar_privada", 0, s.handleClienteEntrarPrivada)
+	s.MQTTClient.Subscribe("clientes/+/reconectar", 0, s.handleClienteReconectar)
+	s.MQTTClient.Subscribe("clientes/+/troca", 0, s.handleClienteTroca)
+	s.MQTTClient.Subscribe("clientes/+/buscar_jogador", 0, s.handleClienteBuscarJogador)
+	s.MQTTClient.Subscribe("clientes/+/mercado", 0, s.handleClienteMercado)
+	s.MQTTClient.Subscribe("clientes/+/razao", 0, s.handleClienteRazao)
 	s.MQTTClient.Subscribe("partidas/+/comandos", 0, s.handleComandoPartida)
 	log.Println("Subscreveu aos tópicos MQTT essenciais")
 }
@@ -455,9 +750,6 @@ func (s *Servidor) handleInfoRequest(client mqtt.Client, msg mqtt.Message) {
 }
 
 func (s *Servidor) handleClienteLogin(client mqtt.Client, msg mqtt.Message) {
-	s.mutexClientes.Lock()         // Bloqueia logo no início
-	defer s.mutexClientes.Unlock() // Garante que desbloqueia ao sair
-
 	parts := strings.Split(msg.Topic(), "/")
 	if len(parts) < 3 {
 		log.Printf("[LOGIN_ERRO:%s] Tópico de login inválido: %s", s.ServerID, msg.Topic())
@@ -466,7 +758,6 @@ func (s *Servidor) handleClienteLogin(client mqtt.Client, msg mqtt.Message) {
 	tempClientID := parts[1]
 
 	var mensagem protocolo.Mensagem
-	log.Printf("[LOGIN_DEBUG:%s] Payload recebido: %s", s.ServerID, string(msg.Payload()))
 	if err := json.Unmarshal(msg.Payload(), &mensagem); err != nil {
 		log.Printf("[LOGIN_ERRO:%s] Erro ao decodificar mensagem: %v", s.ServerID, err)
 		return
@@ -477,7 +768,8 @@ func (s *Servidor) handleClienteLogin(client mqtt.Client, msg mqtt.Message) {
 		log.Printf("[LOGIN_ERRO:%s] Erro ao decodificar dados de login: %v", s.ServerID, err)
 		return
 	}
-	log.Printf("[LOGIN_DEBUG:%s] Dados decodificados - Nome: '%s' (len=%d)", s.ServerID, dados.Nome, len(dados.Nome))
+	dados.Nome = strings.TrimSpace(dados.Nome)
+	log.Printf("[LOGIN_DEBUG:%s] Dados decodificados - Nome: '%s' (len=%d), registrar: %v", s.ServerID, dados.Nome, len(dados.Nome), dados.Registrar)
 	if dados.Nome == "" {
 		log.Printf("[LOGIN_ERRO:%s] Nome do jogador vazio recebido no login.", s.ServerID)
 		erroMsg := protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Nome de usuário não pode ser vazio."})}
@@ -485,494 +777,1813 @@ func (s *Servidor) handleClienteLogin(client mqtt.Client, msg mqtt.Message) {
 		return
 	}
 
-	log.Printf("[LOGIN_DEBUG:%s] Nome válido, criando cliente...", s.ServerID)
-	clienteID := uuid.New().String() // ID permanente
-	novoCliente := &tipos.Cliente{
-		ID:         clienteID,
-		Nome:       dados.Nome,
-		Inventario: make([]protocolo.Carta, 0),
+	// A conta vem do repositório replicado: o registro passa pelo log do cluster e o
+	// login só confere a senha na cópia local. Nenhum lock é mantido durante a proposta.
+	var conta *contas.Conta
+	var err error
+	if dados.Registrar {
+		conta, err = s.registrarConta(dados.Nome, dados.Senha)
+	} else {
+		conta, err = s.Contas.Autenticar(dados.Nome, dados.Senha)
+	}
+	if err != nil {
+		log.Printf("[LOGIN_ERRO:%s] Login de '%s' recusado: %v", s.ServerID, dados.Nome, err)
+		erroMsg := protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: err.Error()})}
+		s.publicarParaCliente(tempClientID, erroMsg)
+		return
+	}
+
+	// Uma conta só é atendida por um servidor: sem a sessão, dois servidores gravariam
+	// inventários diferentes da mesma conta
+	if err := s.tomarSessao(conta.ID); err != nil {
+		log.Printf("[LOGIN_ERRO:%s] Sessão de '%s' não aberta: %v", s.ServerID, dados.Nome, err)
+		erroMsg := protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: err.Error()})}
+		s.publicarParaCliente(tempClientID, erroMsg)
+		return
+	}
+
+	s.mutexClientes.Lock()
+	cliente, jaConectado := s.Clientes[conta.ID]
+	if !jaConectado {
+		cliente = &tipos.Cliente{
+			ID:         conta.ID, // ID permanente da conta
+			Nome:       conta.Nome,
+			Inventario: conta.Inventario,
+		}
+		s.Clientes[conta.ID] = cliente
 	}
+	s.mutexClientes.Unlock()
 
-	log.Printf("[LOGIN_DEBUG:%s] Adicionando cliente ao mapa...", s.ServerID)
-	s.Clientes[clienteID] = novoCliente
-	log.Printf("[LOGIN_DEBUG:%s] Cliente adicionado ao mapa.", s.ServerID)
+	// Se a conta já estava conectada a este servidor, mantém o mesmo Cliente (e a sala dele)
+	cliente.Mutex.Lock()
+	inventario := make([]tipos.Carta, len(cliente.Inventario))
+	copy(inventario, cliente.Inventario)
+	cliente.Mutex.Unlock()
 
-	log.Printf("[LOGIN:%s] Cliente %s (ID temp: %s, ID perm: %s) registrado e pronto.", s.ServerID, dados.Nome, tempClientID, clienteID)
+	log.Printf("[LOGIN:%s] Cliente %s (ID temp: %s, ID da conta: %s) autenticado com %d cartas. Já conectado: %v", s.ServerID, conta.Nome, tempClientID, conta.ID, len(inventario), jaConectado)
 
 	// Envia confirmação de volta para o TÓPICO TEMPORÁRIO
-	log.Printf("[LOGIN_DEBUG:%s] Enviando resposta LOGIN_OK...", s.ServerID)
 	resposta := protocolo.Mensagem{
 		Comando: "LOGIN_OK",
-		Dados:   seguranca.MustJSON(map[string]string{"cliente_id": clienteID, "servidor": s.MeuEndereco}),
+		Dados: seguranca.MustJSON(protocolo.DadosLoginOK{
+			ClienteID:   conta.ID,
+			Nome:        conta.Nome,
+			Servidor:    s.MeuEndereco,
+			Inventario:  inventario,
+			TokenSessao: seguranca.GerarTokenSessao(conta.ID, s.MeuEndereco),
+			Rating:      conta.Rating,
+			Moedas:      conta.Moedas,
+		}),
 	}
 	s.publicarParaCliente(tempClientID, resposta)
-	log.Printf("[LOGIN_DEBUG:%s] Resposta LOGIN_OK enviada.", s.ServerID)
 }
 
-func (s *Servidor) handleClienteEntrarFila(client mqtt.Client, msg mqtt.Message) {
-	var dados map[string]string
-	if err := json.Unmarshal(msg.Payload(), &dados); err != nil {
-		log.Printf("[ENTRAR_FILA_ERRO:%s] Erro ao decodificar JSON: %v", s.ServerID, err)
+// ==================== SESSÕES ====================
+
+// handleClienteReconectar trata o RECONNECT de um cliente que perdeu a conexão. O
+// token de sessão indica o servidor de origem (onde está o Cliente e a sala). Se for
+// este servidor, a sessão é retomada aqui; se não, este servidor passa a atender o
+// jogador em nome da origem, repassando comandos e eventos.
+func (s *Servidor) handleClienteReconectar(client mqtt.Client, msg mqtt.Message) {
+	partes := strings.Split(msg.Topic(), "/")
+	if len(partes) < 3 {
+		log.Printf("[SESSAO_ERRO:%s] Tópico de reconexão inválido: %s", s.ServerID, msg.Topic())
 		return
 	}
-	clienteID := dados["cliente_id"] // ID PERMANENTE enviado pelo cliente
+	idTopico := partes[1]
 
-	s.mutexClientes.RLock() // Lock de leitura para verificar
-	cliente, existe := s.Clientes[clienteID]
-	nomeCliente := ""
-	if existe {
-		cliente.Mutex.Lock() // Lock no cliente específico para ler o nome
-		nomeCliente = cliente.Nome
-		cliente.Mutex.Unlock()
+	var mensagem protocolo.Mensagem
+	if err := json.Unmarshal(msg.Payload(), &mensagem); err != nil {
+		log.Printf("[SESSAO_ERRO:%s] Erro ao decodificar mensagem: %v", s.ServerID, err)
+		return
 	}
-	s.mutexClientes.RUnlock()
-
-	// Verifica se o cliente existe E se o nome não está vazio
-	if !existe || nomeCliente == "" {
-		log.Printf("[ENTRAR_FILA_ERRO:%s] Cliente %s não encontrado ou nome ainda vazio (login pode não ter sido concluído).", s.ServerID, clienteID)
-		// Notificar o cliente seria ideal aqui
-		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Erro ao entrar na fila. Tente novamente."})})
+	var dados protocolo.DadosReconectar
+	if err := json.Unmarshal(mensagem.Dados, &dados); err != nil {
+		log.Printf("[SESSAO_ERRO:%s] Erro ao decodificar dados de reconexão: %v", s.ServerID, err)
 		return
 	}
 
-	// Se chegou aqui, o cliente existe e tem nome (login concluído)
-	log.Printf("[ENTRAR_FILA:%s] Cliente %s (%s) encontrado. Adicionando à fila.", s.ServerID, nomeCliente, clienteID)
-	s.entrarFila(cliente) // Chama a função que adiciona à fila e inicia a busca
-}
-
-func (s *Servidor) handleComandoPartida(client mqtt.Client, msg mqtt.Message) {
-	// CORREÇÃO: Adicionar logs detalhados para debugging
-	timestamp := time.Now().Format("15:04:05.000")
-	log.Printf("[%s][COMANDO_DEBUG] === INÍCIO PROCESSAMENTO COMANDO ===", timestamp)
-
-	// Extrai o ID da sala do tópico
-	topico := msg.Topic()
-	// topico formato: "partidas/{salaID}/comandos"
-	partes := strings.Split(topico, "/")
-	if len(partes) < 2 {
-		log.Printf("[%s][COMANDO_ERRO] Tópico inválido: %s", timestamp, topico)
+	clienteID, origem, err := seguranca.ValidarTokenSessao(dados.TokenSessao)
+	if err != nil || clienteID != idTopico {
+		log.Printf("[SESSAO_ERRO:%s] Token de sessão recusado para %s: %v", s.ServerID, idTopico, err)
+		s.publicarParaCliente(idTopico, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Sessão inválida ou expirada. Faça login novamente."})})
 		return
 	}
-	salaID := partes[1]
-
-	log.Printf("[%s][COMANDO_DEBUG] Comando recebido no tópico: %s", timestamp, topico)
-	log.Printf("[%s][COMANDO_DEBUG] Payload: %s", timestamp, string(msg.Payload()))
 
-	var mensagem protocolo.Mensagem
-	if err := json.Unmarshal(msg.Payload(), &mensagem); err != nil {
-		log.Printf("[%s][COMANDO_ERRO] Erro ao decodificar comando: %v", timestamp, err)
+	// 1. A sessão está neste servidor
+	if sessao, ok := s.RetomarSessao(clienteID, s.MeuEndereco); ok {
+		log.Printf("[SESSAO:%s] Sessão de %s retomada localmente (sala: %s)", s.ServerID, clienteID, sessao.SalaID)
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "SESSAO_RETOMADA", Dados: seguranca.MustJSON(sessao)})
 		return
 	}
 
-	log.Printf("[%s][COMANDO_DEBUG] Comando decodificado: %s", timestamp, mensagem.Comando)
-
-	s.mutexSalas.RLock()
-	sala, existe := s.Salas[salaID]
-	s.mutexSalas.RUnlock()
+	// 2. A sessão está no servidor de origem: este servidor vira o ponto de acesso do jogador
+	if origem != "" && origem != s.MeuEndereco {
+		sessao, err := s.retomarSessaoNaOrigem(origem, clienteID)
+		if err == nil {
+			if sessao.SalaID != "" {
+				s.mutexSessoes.Lock()
+				s.salasViaGateway[sessao.SalaID] = origem
+				s.mutexSessoes.Unlock()
+			}
+			log.Printf("[SESSAO:%s] Sessão de %s retomada via origem %s (sala: %s)", s.ServerID, clienteID, origem, sessao.SalaID)
+			s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "SESSAO_RETOMADA", Dados: seguranca.MustJSON(sessao)})
+			return
+		}
+		log.Printf("[SESSAO:%s] Não foi possível retomar a sessão de %s na origem %s: %v", s.ServerID, clienteID, origem, err)
+	}
 
-	if !existe {
-		log.Printf("Sala %s não encontrada", salaID)
+	// 3. Nenhum servidor tem a sessão: recria o cliente a partir da conta, sem partida
+	conta := s.Contas.BuscarPorID(clienteID)
+	if conta == nil {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Sessão não encontrada. Faça login novamente."})})
+		return
+	}
+	if err := s.tomarSessao(conta.ID); err != nil {
+		log.Printf("[SESSAO_ERRO:%s] Sessão de %s não recriada: %v", s.ServerID, clienteID, err)
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: err.Error()})})
 		return
 	}
+	s.mutexClientes.Lock()
+	s.Clientes[conta.ID] = &tipos.Cliente{ID: conta.ID, Nome: conta.Nome, Inventario: conta.Inventario}
+	s.mutexClientes.Unlock()
 
-	// Verifica se este servidor é o Host ou Sombra
-	sala.Mutex.Lock()
-	servidorHost := sala.ServidorHost
-	servidorSombra := sala.ServidorSombra
-	sala.Mutex.Unlock()
+	sessao, _ := s.RetomarSessao(clienteID, s.MeuEndereco)
+	sessao.TokenSessao = seguranca.GerarTokenSessao(clienteID, s.MeuEndereco)
+	log.Printf("[SESSAO:%s] Sessão de %s recriada a partir da conta", s.ServerID, clienteID)
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "SESSAO_RETOMADA", Dados: seguranca.MustJSON(sessao)})
+}
 
-	// Processa comando baseado no tipo
-	switch mensagem.Comando {
-	case "COMPRAR_PACOTE":
-		var dados map[string]string
-		json.Unmarshal(mensagem.Dados, &dados)
-		clienteID := dados["cliente_id"]
+// sessaoConfere diz se o token de sessão enviado com um comando é da conta em nome da
+// qual o comando age. O ID da conta está nos tópicos e é mostrado aos outros
+// jogadores (busca, mercado, livro-razão), então sozinho não prova quem publicou.
+func sessaoConfere(clienteID, token string) bool {
+	dono, _, err := seguranca.ValidarTokenSessao(token)
+	return err == nil && clienteID != "" && dono == clienteID
+}
 
-		// CORREÇÃO: Aplicar lógica Host/Shadow
-		sala.Mutex.Lock()
-		servidorHost := sala.ServidorHost
-		servidorSombra := sala.ServidorSombra
-		sala.Mutex.Unlock()
+// comandoAutenticado confere o token de sessão de um comando de `clienteID` e, se ele
+// não confere, descarta o comando avisando a conta.
+func (s *Servidor) comandoAutenticado(clienteID, token, comando string) bool {
+	if sessaoConfere(clienteID, token) {
+		return true
+	}
+	log.Printf("[SESSAO_ERRO:%s] %s em nome de %s recusado: token de sessão ausente ou de outra conta", s.ServerID, comando, clienteID)
+	if clienteID != "" {
+		s.notificarErro(clienteID, "Sessão inválida ou expirada. Faça login novamente.")
+	}
+	return false
+}
 
-		// Sempre processa compra localmente
-		s.processarCompraPacote(clienteID, sala)
+// sessaoConta é o dado da entrada ENTRADA_SESSAO
+type sessaoConta struct {
+	ClienteID string `json:"cliente_id"`
+	Anterior  string `json:"anterior"` // Dono da sessão quando a mudança foi proposta
+	Servidor  string `json:"servidor"`
+}
 
-		// AGORA, notificamos o Host se formos o Shadow
-		if servidorHost == s.MeuEndereco {
-			// Eu sou o Host. processarCompraPacote já chamou verificarEIniciarPartidaSeProntos.
-			log.Printf("[HOST] Compra processada localmente para %s. Verificando prontos.", clienteID)
-		} else if servidorSombra == s.MeuEndereco {
-			// Eu sou o Shadow. Além de processar a compra,
-			// devo notificar o Host que este jogador está PRONTO.
-			log.Printf("[SHADOW] Compra processada localmente para %s. Notificando Host %s que estou pronto.", clienteID, servidorHost)
-			go s.encaminharEventoParaHost(sala, clienteID, "PLAYER_READY", nil)
+// tomarSessao faz deste servidor o dono da sessão da conta. Se outro servidor ativo
+// atende a conta, ele precisa liberá-la antes (recusa se o jogador estiver numa
+// partida lá); um dono fora do cluster perde a sessão sem ser consultado. Devolve
+// erro se a sessão não pôde ser movida ou se outro login chegou antes ao log.
+func (s *Servidor) tomarSessao(clienteID string) error {
+	anterior := s.Sessoes.Servidor(clienteID)
+	if anterior == s.MeuEndereco {
+		return nil
+	}
+	if anterior != "" && s.servidorAtivo(anterior) {
+		if err := s.pedirLiberacaoSessao(anterior, clienteID); err != nil {
+			return err
 		}
+	}
 
-	case "JOGAR_CARTA":
-		var dados map[string]interface{}
-		json.Unmarshal(mensagem.Dados, &dados)
-		clienteID := dados["cliente_id"].(string)
-		cartaID := dados["carta_id"].(string)
+	mudanca := sessaoConta{ClienteID: clienteID, Anterior: anterior, Servidor: s.MeuEndereco}
+	if _, err := s.ClusterManager.Propor(ENTRADA_SESSAO, mudanca); err != nil {
+		log.Printf("[SESSAO_ERRO:%s] Sessão de %s não confirmada pela maioria: %v", s.ServerID, clienteID, err)
+		return fmt.Errorf("não foi possível abrir a sessão agora, tente novamente")
+	}
 
-		// Se este servidor é o Host, processa diretamente
-		if servidorHost == s.MeuEndereco {
-			// CORREÇÃO: Construir o objeto GameEventRequest
-			eventoReq := &tipos.GameEventRequest{
-				MatchID:   sala.ID,
-				EventSeq:  0, // O Host definirá o eventSeq correto
-				EventType: "CARD_PLAYED",
-				PlayerID:  clienteID,
-				Data: map[string]interface{}{
-					"carta_id": cartaID,
-				},
+	// Em um seguidor a entrada é aplicada no próximo AppendEntries
+	limite := time.Now().Add(CONTA_ESPERA_APLICACAO)
+	for time.Now().Before(limite) {
+		if dono := s.Sessoes.Servidor(clienteID); dono != anterior {
+			if dono != s.MeuEndereco {
+				return fmt.Errorf("a conta acabou de entrar em outro servidor")
 			}
-			s.processarEventoComoHost(sala, eventoReq) // <-- CHAMADA CORRIGIDA
-
-		} else if servidorSombra == s.MeuEndereco {
-			// Se é a Sombra, encaminha para o Host via API REST
-			s.encaminharJogadaParaHost(sala, clienteID, cartaID)
+			return nil
 		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("não foi possível abrir a sessão agora, tente novamente")
+}
 
-	// Em func (s *Servidor) handleComandoPartida
-	case "CHAT":
-		var dadosCliente protocolo.DadosEnviarChat
-		if err := json.Unmarshal(mensagem.Dados, &dadosCliente); err != nil {
-			log.Printf("[CHAT_ERRO] Erro ao decodificar dados do chat: %v", err)
-			return
+// servidorAtivo diz se o endereço é de um peer que ainda manda heartbeats
+func (s *Servidor) servidorAtivo(endereco string) bool {
+	for _, addr := range s.ClusterManager.GetServidoresAtivos(s.MeuEndereco) {
+		if addr == endereco {
+			return true
 		}
+	}
+	return false
+}
 
-		// CORREÇÃO: Aplicar lógica Host/Shadow
-		sala.Mutex.Lock()
-		servidorHost := sala.ServidorHost
-		servidorSombra := sala.ServidorSombra
-		sala.Mutex.Unlock()
-
-		s.mutexClientes.RLock()
-		cliente := s.Clientes[dadosCliente.ClienteID]
-		s.mutexClientes.RUnlock()
-		if cliente == nil {
-			return
-		}
+// pedirLiberacaoSessao pede ao dono atual que encerre a sessão da conta
+func (s *Servidor) pedirLiberacaoSessao(dono, clienteID string) error {
+	body, _ := json.Marshal(map[string]string{"cliente_id": clienteID, "servidor": s.MeuEndereco})
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/sessao/liberar", dono), body)
+	if err != nil {
+		log.Printf("[SESSAO_ERRO:%s] %s não respondeu ao pedido de liberar a sessão de %s: %v", s.ServerID, dono, clienteID, err)
+		return fmt.Errorf("a conta está conectada em outro servidor, tente novamente")
+	}
+	defer resp.Body.Close()
 
-		if servidorHost == s.MeuEndereco {
-			// Eu sou o Host, eu faço o broadcast
-			log.Printf("[HOST-CHAT] Recebido chat de %s. Fazendo broadcast.", cliente.Nome)
-			s.retransmitirChat(sala, cliente, dadosCliente.Texto)
-		} else if servidorSombra == s.MeuEndereco {
-			// Eu sou o Shadow, encaminho para o Host
-			log.Printf("[SHADOW-CHAT] Recebido chat de %s. Encaminhando para Host %s.", cliente.Nome, servidorHost)
-			dadosEvento := map[string]interface{}{
-				"texto": dadosCliente.Texto,
-			}
-			go s.encaminharEventoParaHost(sala, dadosCliente.ClienteID, "CHAT", dadosEvento)
+	if resp.StatusCode != http.StatusOK {
+		var res struct {
+			Error string `json:"error"`
 		}
-
-	case "TROCAR_CARTAS", "TROCAR_CARTAS_OFERTA":
-		var req protocolo.TrocarCartasReq
-		if err := json.Unmarshal(mensagem.Dados, &req); err != nil {
-			log.Printf("[TROCA_ERRO] Erro ao decodificar requisição de troca: %v", err)
-			return
+		json.NewDecoder(resp.Body).Decode(&res)
+		if res.Error == "" {
+			res.Error = fmt.Sprintf("status %d", resp.StatusCode)
 		}
-		s.processarTrocaCartas(sala, &req)
+		return fmt.Errorf("a conta está conectada em outro servidor: %s", res.Error)
 	}
+	return nil
 }
 
-func (s *Servidor) publicarParaCliente(clienteID string, msg protocolo.Mensagem) {
-	payload, _ := json.Marshal(msg)
-	topico := fmt.Sprintf("clientes/%s/eventos", clienteID)
-	log.Printf("[PUBLICAR_CLIENTE] Enviando para %s no tópico %s: %s", clienteID, topico, string(payload))
-	s.MQTTClient.Publish(topico, 0, false, payload)
+// LiberarSessao encerra aqui a sessão de uma conta que está entrando em outro
+// servidor. Recusa se o jogador estiver numa partida em andamento (ele deve usar a
+// reconexão, que mantém a partida onde está) ou com uma carta reservada para uma troca.
+func (s *Servidor) LiberarSessao(clienteID, novoServidor string) error {
+	if s.ReservasTroca.DoJogador(clienteID) {
+		// A confirmação da troca precisa encontrar a conta neste servidor
+		return fmt.Errorf("o jogador tem uma troca em andamento")
+	}
+	cliente := s.getClienteLocal(clienteID)
+	if cliente == nil {
+		return nil
+	}
+	if _, emAndamento := salaDoCliente(cliente); emAndamento {
+		return fmt.Errorf("o jogador está em uma partida em andamento")
+	}
+	s.encerrarSessaoLocal(clienteID, novoServidor)
+	return nil
 }
 
-func (s *Servidor) publicarEventoPartida(salaID string, msg protocolo.Mensagem) {
-	payload, _ := json.Marshal(msg)
-	topico := fmt.Sprintf("partidas/%s/eventos", salaID)
-	s.MQTTClient.Publish(topico, 0, false, payload)
-}
+// encerrarSessaoLocal tira o cliente deste servidor (fila, gateways e mapa de
+// clientes) e avisa o jogador. O inventário já está no log replicado.
+func (s *Servidor) encerrarSessaoLocal(clienteID, novoServidor string) {
+	s.sairDaFilaPublica(clienteID)
 
-// ==================== MATCHMAKING E LÓGICA DE JOGO ====================
+	s.mutexSessoes.Lock()
+	delete(s.gatewaysClientes, clienteID)
+	s.mutexSessoes.Unlock()
 
-func (s *Servidor) tentarMatchmakingGlobalPeriodicamente() {
-	// Aguarda um pouco no início para a rede de servidores se estabilizar
-	time.Sleep(10 * time.Second)
+	s.mutexClientes.Lock()
+	_, existia := s.Clientes[clienteID]
+	delete(s.Clientes, clienteID)
+	s.mutexClientes.Unlock()
+	if !existia {
+		return
+	}
 
-	ticker := time.NewTicker(5 * time.Second) // Tenta a cada 5 segundos
-	defer ticker.Stop()
+	log.Printf("[SESSAO:%s] Sessão de %s encerrada aqui: a conta entrou em %s", s.ServerID, clienteID, novoServidor)
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Sua conta entrou em outro servidor. Esta sessão foi encerrada."})})
+}
 
-	for range ticker.C {
-		s.mutexFila.Lock()
-		if len(s.FilaDeEspera) == 0 {
-			s.mutexFila.Unlock()
-			continue // Pula se a fila estiver vazia
-		}
-		// Pega o primeiro jogador sem removê-lo ainda
-		jogadorLocal := s.FilaDeEspera[0]
-		s.mutexFila.Unlock()
+// aplicarSessao move a sessão de uma conta. Se este servidor perdeu a sessão sem
+// tê-la liberado (ficou fora do cluster), o cliente local é descartado.
+func (s *Servidor) aplicarSessao(entrada tipos.EntradaLog) {
+	var dados sessaoConta
+	if err := json.Unmarshal(entrada.Dados, &dados); err != nil || dados.ClienteID == "" {
+		log.Printf("[SESSAO] Entrada %d de sessão inválida", entrada.Indice)
+		return
+	}
+	if !s.Sessoes.Mover(dados.ClienteID, dados.Anterior, dados.Servidor) {
+		log.Printf("[SESSAO] Entrada %d descartada: a sessão de %s já tinha mudado de servidor", entrada.Indice, dados.ClienteID)
+		return
+	}
+	if dados.Anterior == s.MeuEndereco && dados.Servidor != s.MeuEndereco {
+		go s.encerrarSessaoLocal(dados.ClienteID, dados.Servidor)
+	}
+}
 
-		log.Printf("[MATCHMAKING-GLOBAL] Buscando oponente para %s (%s)...", jogadorLocal.Nome, jogadorLocal.ID)
+// RetomarSessao reata um cliente deste servidor à sua sala e devolve o estado para
+// enviar a ele. `gateway` é o servidor que agora atende o jogador (este servidor,
+// se ele voltou para cá). Devolve false se o cliente não tem sessão aqui.
+func (s *Servidor) RetomarSessao(clienteID, gateway string) (*protocolo.DadosSessaoRetomada, bool) {
+	cliente := s.getClienteLocal(clienteID)
+	if cliente == nil {
+		return nil, false
+	}
 
-		// Pega a lista de servidores ativos, excluindo a si mesmo
-		servidoresAtivos := s.ClusterManager.GetServidoresAtivos(s.MeuEndereco)
+	sessao := s.montarSessaoRetomada(cliente)
 
-		// Itera sobre os outros servidores para encontrar um oponente
-		for _, addr := range servidoresAtivos {
-			if s.realizarSolicitacaoMatchmaking(addr, jogadorLocal) {
-				// Sucesso! A partida foi formada. O jogador já foi removido da fila pela lógica de sucesso.
-				// A `realizarSolicitacaoMatchmaking` agora precisa remover o jogador da fila em caso de sucesso.
-				break // Para de procurar por este jogador
+	s.mutexSessoes.Lock()
+	if gateway == "" || gateway == s.MeuEndereco {
+		delete(s.gatewaysClientes, clienteID)
+	} else {
+		s.gatewaysClientes[clienteID] = gateway
+		if sessao.SalaID != "" {
+			if s.gatewaysSalas[sessao.SalaID] == nil {
+				s.gatewaysSalas[sessao.SalaID] = make(map[string]bool)
 			}
+			s.gatewaysSalas[sessao.SalaID][gateway] = true
 		}
 	}
+	s.mutexSessoes.Unlock()
+
+	return sessao, true
 }
 
-func (s *Servidor) entrarFila(cliente *tipos.Cliente) {
-	s.mutexFila.Lock()
-	// Tenta encontrar oponente na fila local primeiro
-	if len(s.FilaDeEspera) > 0 {
-		oponente := s.FilaDeEspera[0]
-		s.FilaDeEspera = s.FilaDeEspera[1:]
-		s.mutexFila.Unlock()
+// montarSessaoRetomada junta o inventário do cliente e o estado da partida dele
+func (s *Servidor) montarSessaoRetomada(cliente *tipos.Cliente) *protocolo.DadosSessaoRetomada {
+	cliente.Mutex.Lock()
+	sessao := &protocolo.DadosSessaoRetomada{Inventario: make([]tipos.Carta, len(cliente.Inventario))}
+	copy(sessao.Inventario, cliente.Inventario)
+	cliente.Mutex.Unlock()
 
-		// Cria sala localmente
-		s.criarSala(oponente, cliente, "")
-		return
+	sala := s.salaAtivaDoCliente(cliente.ID)
+	if sala == nil {
+		return sessao
 	}
 
-	// Se não encontrou, adiciona à fila local
-	s.FilaDeEspera = append(s.FilaDeEspera, cliente)
-	s.mutexFila.Unlock()
-
-	log.Printf("Cliente %s (%s) entrou na fila de espera.", cliente.Nome, cliente.ID)
-	s.publicarParaCliente(cliente.ID, protocolo.Mensagem{
-		Comando: "AGUARDANDO_OPONENTE",
-		Dados:   seguranca.MustJSON(map[string]string{"mensagem": "Procurando oponente em todos os servidores..."}),
-	})
-
-	// O matchmaking global já é persistente, não precisamos mais do 'go func' aqui
-	// O go s.tentarMatchmakingGlobalPeriodicamente() no 'Run' cuidará disso
-}
+	sala.Mutex.Lock()
+	defer sala.Mutex.Unlock()
 
-// gerenciarBuscaGlobalPersistente tenta encontrar um oponente global periodicamente.
-func (s *Servidor) gerenciarBuscaGlobalPersistente(cliente *tipos.Cliente) {
-	ticker := time.NewTicker(5 * time.Second) // Tenta a cada 5 segundos
-	defer ticker.Stop()
+	atualizacao := &protocolo.DadosAtualizacaoJogo{
+		MensagemDoTurno: "Sessão retomada.",
+		ContagemCartas:  make(map[string]int),
+		UltimaJogada:    make(map[string]Carta),
+		NumeroRodada:    sala.NumeroRodada,
+		PontosRodada:    make(map[string]int),
+		PontosPartida:   make(map[string]int),
+		SalaID:          sala.ID,
+		TurnoDe:         sala.TurnoDe,
+	}
+	if sala.Estado == "JOGANDO" {
+		atualizacao.PrazoTurno, atualizacao.SegundosRestantes = contagemRegressiva(sala.PrazoTurno)
+	}
+	for nome, carta := range sala.CartasNaMesa {
+		atualizacao.UltimaJogada[nome] = carta
+	}
+	for nome, pontos := range sala.PontosRodada {
+		atualizacao.PontosRodada[nome] = pontos
+	}
+	for nome, pontos := range sala.PontosPartida {
+		atualizacao.PontosPartida[nome] = pontos
+	}
+	for _, j := range sala.Jogadores {
+		// Busca jogadores do mapa global para contagem atualizada
+		jogador := s.getClienteLocal(j.ID)
+		if jogador == nil {
+			jogador = j
+		}
+		jogador.Mutex.Lock()
+		atualizacao.ContagemCartas[j.Nome] = len(jogador.Inventario)
+		jogador.Mutex.Unlock()
 
-	// Cria um contexto para poder cancelar esta goroutine se o cliente sair/for matchado
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel() // Garante que o cancelamento seja chamado ao sair
+		if j.ID != cliente.ID {
+			sessao.OponenteID = j.ID
+			sessao.OponenteNome = j.Nome
+		}
+	}
 
-	// Armazena a função de cancelamento para uso posterior (ex: quando o cliente for matchado localmente)
-	// Assumindo que você adicione um campo `cancelBuscaGlobal context.CancelFunc` à struct Cliente
-	// cliente.cancelBuscaGlobal = cancel // (Descomente se adicionar o campo)
+	sessao.SalaID = sala.ID
+	sessao.Estado = sala.Estado
+	sessao.Atualizacao = atualizacao
+	return sessao
+}
 
-	for {
-		select {
-		case <-ticker.C:
-			// 1. Verifica se o cliente AINDA está na fila deste servidor
-			s.mutexFila.Lock()
-			aindaNaFila := false
-			for _, c := range s.FilaDeEspera {
-				if c.ID == cliente.ID {
-					aindaNaFila = true
-					break
-				}
-			}
-			s.mutexFila.Unlock()
+// salaAtivaDoCliente devolve a sala do cliente, preferindo uma partida não finalizada
+func (s *Servidor) salaAtivaDoCliente(clienteID string) *tipos.Sala {
+	s.mutexSalas.RLock()
+	defer s.mutexSalas.RUnlock()
 
-			if !aindaNaFila {
-				log.Printf("[MATCHMAKING-PERSIST] Cliente %s (%s) não está mais na fila local. Parando busca global.", cliente.Nome, cliente.ID)
-				return // Cliente já foi matchado (localmente ou por outra tentativa), sai da rotina
+	var encontrada *tipos.Sala
+	for _, sala := range s.Salas {
+		sala.Mutex.Lock()
+		participa := false
+		for _, j := range sala.Jogadores {
+			if j.ID == clienteID {
+				participa = true
+				break
 			}
+		}
+		ativa := sala.Estado != "FINALIZADO"
+		sala.Mutex.Unlock()
 
-			// 2. Tenta encontrar um oponente global AGORA (sem remover da fila!)
-			log.Printf("[MATCHMAKING-PERSIST] Tentando busca global para %s (%s)", cliente.Nome, cliente.ID)
-			encontrou := s.tentarMatchmakingGlobalAgora(cliente)
-
-			if encontrou {
-				log.Printf("[MATCHMAKING-PERSIST] Busca global para %s (%s) encontrou partida! A busca será finalizada.", cliente.Nome, cliente.ID)
-				// A remoção da fila agora é feita dentro de `realizarSolicitacaoMatchmaking` no momento da confirmação.
-				// Apenas precisamos parar a busca.
-				return // Encontrou, sai da rotina
+		if participa && (encontrada == nil || ativa) {
+			encontrada = sala
+			if ativa {
+				break
 			}
-			// Se não encontrou, o loop continua na próxima iteração do ticker.
-
-		case <-ctx.Done():
-			log.Printf("[MATCHMAKING-PERSIST] Busca global para %s (%s) cancelada.", cliente.Nome, cliente.ID)
-			return // Sai da rotina se o contexto for cancelado
 		}
 	}
+	return encontrada
 }
 
-// tentarMatchmakingGlobalAgora faz UMA tentativa de encontrar um oponente global.
-func (s *Servidor) tentarMatchmakingGlobalAgora(cliente *tipos.Cliente) bool {
-	// Busca oponente em outros servidores ATIVOS
-	servidores := s.ClusterManager.GetServidores()
-	servidoresAtivos := make([]string, 0, len(servidores))
-	for addr, info := range servidores {
-		if addr != s.MeuEndereco && info.Ativo {
-			servidoresAtivos = append(servidoresAtivos, addr)
-		}
+// retomarSessaoNaOrigem pede ao servidor de origem que reate a sessão e passe a
+// enviar as mensagens do jogador para este servidor
+func (s *Servidor) retomarSessaoNaOrigem(origem, clienteID string) (*protocolo.DadosSessaoRetomada, error) {
+	body, _ := json.Marshal(map[string]string{
+		"cliente_id": clienteID,
+		"gateway":    s.MeuEndereco,
+	})
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/partida/retomar_sessao", origem), body)
+	if err != nil {
+		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if len(servidoresAtivos) == 0 {
-		// log.Printf("[MATCHMAKING-AGORA] Nenhum outro servidor ativo para buscar oponente para %s.", cliente.Nome)
-		return false // Não há ninguém para perguntar
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("origem respondeu status %d", resp.StatusCode)
+	}
+	var sessao protocolo.DadosSessaoRetomada
+	if err := json.NewDecoder(resp.Body).Decode(&sessao); err != nil {
+		return nil, err
 	}
+	return &sessao, nil
+}
 
-	// Embaralha a ordem para não sobrecarregar sempre o mesmo servidor
-	rand.Shuffle(len(servidoresAtivos), func(i, j int) {
-		servidoresAtivos[i], servidoresAtivos[j] = servidoresAtivos[j], servidoresAtivos[i]
+// encaminharComandoParaOrigem repassa o comando de um jogador atendido aqui para o
+// servidor de origem dele
+func (s *Servidor) encaminharComandoParaOrigem(origem, salaID string, mensagem protocolo.Mensagem) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"sala_id": salaID,
+		"comando": mensagem,
 	})
-
-	for _, addr := range servidoresAtivos {
-		if s.realizarSolicitacaoMatchmaking(addr, cliente) {
-			return true // Encontrou partida! A função interna já tratou de tudo.
-		}
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/partida/comando_jogador", origem), body)
+	if err != nil {
+		log.Printf("[SESSAO] Erro ao encaminhar comando %s da sala %s para a origem %s: %v", mensagem.Comando, salaID, origem, err)
+		return
 	}
-
-	// Se chegou aqui, não encontrou oponente em NENHUM servidor nesta tentativa.
-	return false
+	resp.Body.Close()
 }
 
-// realizarSolicitacaoMatchmaking envia uma requisição de oponente para um servidor específico.
-func (s *Servidor) realizarSolicitacaoMatchmaking(addr string, cliente *tipos.Cliente) bool {
-	log.Printf("[MATCHMAKING-TX] Enviando solicitação para %s", addr)
-	reqBody, _ := json.Marshal(map[string]string{
-		"solicitante_id":   cliente.ID,
-		"solicitante_nome": cliente.Nome,
-		"servidor_origem":  s.MeuEndereco,
+// publicarEventoEmGateway pede ao servidor que atende uma sessão retomada que
+// publique o evento da partida no broker dele
+func (s *Servidor) publicarEventoEmGateway(gateway, salaID string, msg protocolo.Mensagem) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"sala_id":  salaID,
+		"mensagem": msg,
 	})
-
-	httpClient := &http.Client{Timeout: 15 * time.Second}
-	req, err := http.NewRequest("POST", fmt.Sprintf("http://%s/matchmaking/solicitar_oponente", addr), bytes.NewBuffer(reqBody))
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/partida/publicar_evento", gateway), body)
 	if err != nil {
-		log.Printf("[MATCHMAKING-TX] Erro ao criar requisição para %s: %v", addr, err)
-		return false
+		log.Printf("[SESSAO] Erro ao repetir evento da sala %s em %s: %v", salaID, gateway, err)
+		return
 	}
+	resp.Body.Close()
+}
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+seguranca.GenerateJWT(s.ServerID))
+// ==================== CONTAS DE JOGADORES ====================
 
-	resp, err := httpClient.Do(req)
+// registrarConta cria uma conta nova propondo-a no log replicado, para que todos os
+// servidores do cluster passem a reconhecê-la.
+func (s *Servidor) registrarConta(nome, senha string) (*contas.Conta, error) {
+	if s.Contas.BuscarPorNome(nome) != nil {
+		return nil, contas.ErrNomeEmUso
+	}
+	conta, err := contas.NovaConta(uuid.New().String(), nome, senha)
 	if err != nil {
-		log.Printf("[MATCHMAKING-TX] Erro ao contatar servidor %s: %v", addr, err)
-		return false
+		return nil, err
+	}
+	if _, err := s.ClusterManager.Propor(ENTRADA_CONTA_CRIADA, conta); err != nil {
+		log.Printf("[CONTAS] Registro de '%s' não confirmado pela maioria: %v", nome, err)
+		return nil, fmt.Errorf("não foi possível registrar a conta agora, tente novamente")
 	}
-	defer resp.Body.Close()
 
-	var res struct {
-		PartidaEncontrada bool   `json:"partida_encontrada"`
-		SalaID            string `json:"sala_id"`
-		OponenteNome      string `json:"oponente_nome"`
-		OponenteID        string `json:"oponente_id"`
-		ServidorHost      string `json:"servidor_host"`
+	// Em um seguidor a entrada é aplicada no próximo AppendEntries; espera para saber
+	// se outro servidor registrou o mesmo nome antes
+	limite := time.Now().Add(CONTA_ESPERA_APLICACAO)
+	for time.Now().Before(limite) {
+		if existente := s.Contas.BuscarPorNome(nome); existente != nil {
+			if existente.ID != conta.ID {
+				return nil, contas.ErrNomeEmUso
+			}
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
 	}
+	log.Printf("[CONTAS] Conta '%s' registrada (ID: %s)", nome, conta.ID)
+	return conta, nil
+}
 
-	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
-		log.Printf("[MATCHMAKING-TX] Erro ao decodificar resposta de %s: %v", addr, err)
-		return false
+// aplicarCriacaoConta aplica um registro de conta comprometido no log
+func (s *Servidor) aplicarCriacaoConta(entrada tipos.EntradaLog) {
+	var conta contas.Conta
+	if err := json.Unmarshal(entrada.Dados, &conta); err != nil {
+		log.Printf("[CONTAS] Entrada %d de conta inválida: %v", entrada.Indice, err)
+		return
 	}
+	if err := s.Contas.AplicarCriacao(conta); err != nil {
+		log.Printf("[CONTAS] Registro de '%s' (entrada %d) descartado: %v", conta.Nome, entrada.Indice, err)
+	}
+}
 
-	if res.PartidaEncontrada {
-		log.Printf("[MATCHMAKING-TX] Partida encontrada no servidor %s! Oponente: %s", addr, res.OponenteNome)
+// inventarioConta é o dado da entrada ENTRADA_CONTA_INVENTARIO
+type inventarioConta struct {
+	ID         string        `json:"id"`
+	Inventario []tipos.Carta `json:"inventario"`
+}
+
+// salvarInventario grava no log replicado o inventário atual de um cliente deste
+// servidor. Clientes de outros servidores são ignorados: quem salva é o servidor do
+// jogador. As gravações são serializadas para que a última proposta seja sempre o
+// inventário mais recente.
+func (s *Servidor) salvarInventario(clienteID string) {
+	cliente := s.getClienteLocal(clienteID)
+	if cliente == nil {
+		return
+	}
 
-		// A requisição foi bem-sucedida, então removemos nosso cliente da fila local.
-		s.RemoverPrimeiroDaFila()
+	s.mutexInventarios.Lock()
+	defer s.mutexInventarios.Unlock()
 
-		// Cria um objeto Cliente para o oponente remoto
+	cliente.Mutex.Lock()
+	dados := inventarioConta{ID: cliente.ID, Inventario: make([]tipos.Carta, len(cliente.Inventario))}
+	copy(dados.Inventario, cliente.Inventario)
+	cliente.Mutex.Unlock()
 
-		s.criarSalaComoSombra(cliente, res.SalaID, res.OponenteID, res.OponenteNome, res.ServidorHost)
-		return true // Sucesso!
+	if _, err := s.ClusterManager.Propor(ENTRADA_CONTA_INVENTARIO, dados); err != nil {
+		log.Printf("[CONTAS] Inventário de %s não confirmado pela maioria: %v", clienteID, err)
 	}
+}
 
-	log.Printf("[MATCHMAKING-TX] Servidor %s não encontrou oponente.", addr)
-	return false
+// aplicarInventarioConta aplica um inventário comprometido no log
+func (s *Servidor) aplicarInventarioConta(entrada tipos.EntradaLog) {
+	var dados inventarioConta
+	if err := json.Unmarshal(entrada.Dados, &dados); err != nil {
+		log.Printf("[CONTAS] Entrada %d de inventário inválida: %v", entrada.Indice, err)
+		return
+	}
+	if err := s.Contas.AplicarInventario(dados.ID, dados.Inventario); err != nil {
+		log.Printf("[CONTAS] Inventário da entrada %d descartado: %v", entrada.Indice, err)
+	}
 }
 
-// Em: servidor/main.go
-// ADICIONAR esta nova função
-// Em: servidor/main.go
-// SUBSTITUA a função 'criarSalaComoSombra' (Etapa 7) por esta:
+// resultadoPartida é o dado da entrada ENTRADA_CONTA_RESULTADO
+type resultadoPartida struct {
+	SalaID   string  `json:"sala_id"`
+	JogadorA string  `json:"jogador_a"`
+	JogadorB string  `json:"jogador_b"`
+	PontosA  float64 `json:"pontos_a"` // 1 vitória de A, 0.5 empate, 0 vitória de B
+}
 
-func (s *Servidor) criarSalaComoSombra(jogadorLocal *tipos.Cliente, salaID string, oponenteID string, oponenteNome string, hostAddr string) {
-	// Cria objeto para oponente remoto (o Host)
-	oponenteRemoto := &tipos.Cliente{
-		ID:   oponenteID,
-		Nome: oponenteNome,
+// registrarResultado grava no log replicado o resultado de uma partida para o
+// rating dos jogadores. Chamado pelo Host ao finalizar a partida, já anunciado aos
+// jogadores: repete a proposta até ela ser comprometida. Uma proposta que falhou por
+// prazo pode ter sido comprometida depois; o aplicador ignora a sala repetida e a
+// cópia local diz quando parar.
+func (s *Servidor) registrarResultado(resultado resultadoPartida) {
+	for tentativa := 1; ; tentativa++ {
+		if s.Contas.PartidaAvaliada(resultado.JogadorA, resultado.SalaID) {
+			return
+		}
+		_, err := s.ClusterManager.Propor(ENTRADA_CONTA_RESULTADO, resultado)
+		if err == nil {
+			return
+		}
+		log.Printf("[RATING] Resultado da sala %s não confirmado pela maioria (tentativa %d): %v", resultado.SalaID, tentativa, err)
+		time.Sleep(RESULTADO_REPETICAO)
 	}
+}
 
-	// Busca info completa do jogador local (que ESTÁ no mapa)
-	s.mutexClientes.RLock()
-	clienteLocalCompleto, ok := s.Clientes[jogadorLocal.ID]
-	s.mutexClientes.RUnlock()
-	if !ok || clienteLocalCompleto == nil {
-		log.Printf("[CRIAR_SALA_SOMBRA_ERRO] Cliente local %s não encontrado no mapa principal.", jogadorLocal.ID)
+// aplicarResultadoConta aplica um resultado de partida comprometido no log
+func (s *Servidor) aplicarResultadoConta(entrada tipos.EntradaLog) {
+	var dados resultadoPartida
+	if err := json.Unmarshal(entrada.Dados, &dados); err != nil {
+		log.Printf("[RATING] Entrada %d de resultado inválida: %v", entrada.Indice, err)
 		return
 	}
+	if err := s.Contas.AplicarResultado(dados.SalaID, dados.JogadorA, dados.JogadorB, dados.PontosA); err != nil {
+		log.Printf("[RATING] Resultado da entrada %d descartado: %v", entrada.Indice, err)
+	}
+}
 
-	clienteLocalCompleto.Mutex.Lock()
-	nomeJ1 := clienteLocalCompleto.Nome
-	clienteLocalCompleto.Mutex.Unlock()
-
-	nomeJ2 := oponenteRemoto.Nome // Nome do oponente remoto (Host)
+func (s *Servidor) handleClienteEntrarFila(client mqtt.Client, msg mqtt.Message) {
+	var dados map[string]string
+	if err := json.Unmarshal(msg.Payload(), &dados); err != nil {
+		log.Printf("[ENTRAR_FILA_ERRO:%s] Erro ao decodificar JSON: %v", s.ServerID, err)
+		return
+	}
+	clienteID := dados["cliente_id"] // ID PERMANENTE enviado pelo cliente
+	if !s.comandoAutenticado(clienteID, dados["token_sessao"], "ENTRAR_FILA") {
+		return
+	}
 
-	log.Printf("[CRIAR_SALA_SOMBRA:%s] Criando sala %s (Host: %s) para %s vs %s", s.ServerID, salaID, hostAddr, nomeJ1, nomeJ2)
+	s.mutexClientes.RLock() // Lock de leitura para verificar
+	cliente, existe := s.Clientes[clienteID]
+	nomeCliente := ""
+	if existe {
+		cliente.Mutex.Lock() // Lock no cliente específico para ler o nome
+		nomeCliente = cliente.Nome
+		cliente.Mutex.Unlock()
+	}
+	s.mutexClientes.RUnlock()
 
-	novaSala := &tipos.Sala{
-		ID:             salaID,
-		Jogadores:      []*tipos.Cliente{clienteLocalCompleto, oponenteRemoto}, // Usa o local (completo) e o remoto (DTO)
-		Estado:         "AGUARDANDO_COMPRA",
-		CartasNaMesa:   make(map[string]Carta),
-		PontosRodada:   make(map[string]int),
-		PontosPartida:  make(map[string]int),
-		NumeroRodada:   1,
-		Prontos:        make(map[string]bool),
-		ServidorHost:   hostAddr,      // Aponta para o Host
-		ServidorSombra: s.MeuEndereco, // Eu sou a Sombra
+	// Verifica se o cliente existe E se o nome não está vazio
+	if !existe || nomeCliente == "" {
+		log.Printf("[ENTRAR_FILA_ERRO:%s] Cliente %s não encontrado ou nome ainda vazio (login pode não ter sido concluído).", s.ServerID, clienteID)
+		// Notificar o cliente seria ideal aqui
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Erro ao entrar na fila. Tente novamente."})})
+		return
 	}
 
-	s.mutexSalas.Lock()
-	s.Salas[salaID] = novaSala
-	s.mutexSalas.Unlock()
+	if !s.liberarDaPartidaAnterior(cliente) {
+		return
+	}
 
-	// Associa a sala ao jogador LOCAL
-	clienteLocalCompleto.Mutex.Lock()
-	clienteLocalCompleto.Sala = novaSala
-	clienteLocalCompleto.Mutex.Unlock()
+	s.mutexFila.Lock()
+	for _, c := range s.FilaDeEspera {
+		if c.ID == clienteID {
+			s.mutexFila.Unlock()
+			log.Printf("[ENTRAR_FILA:%s] Cliente %s já está na fila.", s.ServerID, clienteID)
+			return
+		}
+	}
+	// Um jogador reservado para um par ainda pode voltar para a fila se o par for abortado
+	for _, r := range s.reservasPareamento {
+		if r.cliente.ID == clienteID {
+			s.mutexFila.Unlock()
+			log.Printf("[ENTRAR_FILA:%s] Cliente %s está reservado para uma partida.", s.ServerID, clienteID)
+			return
+		}
+	}
+	s.mutexFila.Unlock()
 
-	// Associa a sala ao jogador REMOTO (DTO)
-	oponenteRemoto.Mutex.Lock()
-	oponenteRemoto.Sala = novaSala
-	oponenteRemoto.Mutex.Unlock()
+	// Se chegou aqui, o cliente existe e tem nome (login concluído)
+	log.Printf("[ENTRAR_FILA:%s] Cliente %s (%s) encontrado. Adicionando à fila.", s.ServerID, nomeCliente, clienteID)
+	s.entrarFila(cliente) // Chama a função que adiciona à fila e inicia a busca
+}
 
-	log.Printf("Sala %s criada como SOMBRA. Host: %s", salaID, hostAddr)
+// liberarDaPartidaAnterior desassocia o cliente de uma sala já terminada. Quem terminou
+// uma partida pode procurar outra sem novo login; quem está numa partida em andamento,
+// não (recebe um ERRO e a função devolve false).
+func (s *Servidor) liberarDaPartidaAnterior(cliente *tipos.Cliente) bool {
+	salaAnterior, emAndamento := salaDoCliente(cliente)
+	if salaAnterior == nil {
+		return true
+	}
+	if emAndamento {
+		s.publicarParaCliente(cliente.ID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Você já está em uma partida. Use /cancelar para sair dela."})})
+		return false
+	}
+	cliente.Mutex.Lock()
+	if cliente.Sala == salaAnterior {
+		cliente.Sala = nil
+	}
+	cliente.Mutex.Unlock()
+	return true
+}
 
-	// Notifica jogador local (o Sombra notifica seu jogador)
-	msg := protocolo.Mensagem{
-		Comando: "PARTIDA_ENCONTRADA",
-		Dados:   seguranca.MustJSON(protocolo.DadosPartidaEncontrada{SalaID: salaID, OponenteID: oponenteID, OponenteNome: oponenteNome}),
+// salaDoCliente devolve a sala associada ao cliente e se a partida dela ainda não terminou
+func salaDoCliente(cliente *tipos.Cliente) (*tipos.Sala, bool) {
+	cliente.Mutex.Lock()
+	sala := cliente.Sala
+	cliente.Mutex.Unlock()
+	if sala == nil {
+		return nil, false
 	}
-	s.publicarParaCliente(jogadorLocal.ID, msg)
+	sala.Mutex.Lock()
+	defer sala.Mutex.Unlock()
+	return sala, sala.Estado != "FINALIZADO" && sala.Estado != "CANCELADA"
 }
 
-// Em: servidor/main.go
-// SUBSTITUA a função 'criarSala' (Etapa 1) por esta:
+// handleClienteSairFila tira o jogador da fila local e da fila do cluster. Se ele já
+// estava reservado para um par ainda não confirmado, a reserva é desfeita e o líder
+// aborta o par (o oponente volta para a fila).
+func (s *Servidor) handleClienteSairFila(client mqtt.Client, msg mqtt.Message) {
+	var dados map[string]string
+	if err := json.Unmarshal(msg.Payload(), &dados); err != nil {
+		log.Printf("[SAIR_FILA_ERRO:%s] Erro ao decodificar JSON: %v", s.ServerID, err)
+		return
+	}
+	clienteID := dados["cliente_id"]
+	if !s.comandoAutenticado(clienteID, dados["token_sessao"], "SAIR_FILA") {
+		return
+	}
 
-func (s *Servidor) criarSala(j1 *tipos.Cliente, j2 *tipos.Cliente, sombraAddr string) string {
-	salaID := uuid.New().String()
+	if !s.sairDaFilaPublica(clienteID) {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Você não está na fila."})})
+		return
+	}
 
-	// --- LÓGICA DE BUSCA CORRIGIDA ---
-	// j1 é o jogador local (oponente) que ESTÁ no mapa.
-	// j2 é o jogador remoto (solicitante) que NÃO ESTÁ no mapa.
+	log.Printf("[SAIR_FILA:%s] Cliente %s saiu da fila.", s.ServerID, clienteID)
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{
+		Comando: "SAIU_DA_FILA",
+		Dados:   seguranca.MustJSON(map[string]string{"mensagem": "Você saiu da fila de matchmaking."}),
+	})
+}
 
-	s.mutexClientes.RLock()
-	// Busca o struct completo do jogador local
-	cliente1Completo, ok1 := s.Clientes[j1.ID]
-	s.mutexClientes.RUnlock()
+// sairDaFilaPublica tira o jogador da fila local, desfaz as suas reservas e avisa o
+// líder. Devolve false se ele não estava na fila nem reservado.
+func (s *Servidor) sairDaFilaPublica(clienteID string) bool {
+	naFila := s.retirarDaFila(clienteID) != nil
+	reservado := s.cancelarReservasDe(clienteID)
+	if !naFila && !reservado {
+		return false
+	}
+	go s.enviarSaidaFila(clienteID)
+	return true
+}
 
-	if !ok1 {
-		log.Printf("[CRIAR_SALA_ERRO:%s] Falha ao buscar informações completas do JOGADOR LOCAL %s (%s) no mapa principal.", s.ServerID, j1.Nome, j1.ID)
-		return "" // Aborta
+// clienteLogado devolve o cliente deste servidor que já concluiu o login, ou nil
+func (s *Servidor) clienteLogado(clienteID string) *tipos.Cliente {
+	cliente := s.getClienteLocal(clienteID)
+	if cliente == nil {
+		return nil
+	}
+	cliente.Mutex.Lock()
+	defer cliente.Mutex.Unlock()
+	if cliente.Nome == "" {
+		return nil
+	}
+	return cliente
+}
+
+// handleClienteCriarPrivada cria uma sala privada: o jogador sai da fila pública e
+// recebe um código que o oponente usa com /entrar, em qualquer servidor do cluster.
+// Este servidor será o Host da partida.
+func (s *Servidor) handleClienteCriarPrivada(client mqtt.Client, msg mqtt.Message) {
+	var dados map[string]string
+	if err := json.Unmarshal(msg.Payload(), &dados); err != nil {
+		log.Printf("[PRIVADA_ERRO:%s] Erro ao decodificar JSON: %v", s.ServerID, err)
+		return
+	}
+	clienteID := dados["cliente_id"]
+	if !s.comandoAutenticado(clienteID, dados["token_sessao"], "CRIAR_PRIVADA") {
+		return
+	}
+	cliente := s.clienteLogado(clienteID)
+	if cliente == nil {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Erro ao criar a sala privada. Tente novamente."})})
+		return
+	}
+	if !s.liberarDaPartidaAnterior(cliente) {
+		return
+	}
+	s.sairDaFilaPublica(clienteID)
+
+	// Cada jogador tem no máximo um código aberto
+	for _, codigo := range s.Convites.DoCliente(clienteID) {
+		s.encerrarConvite(codigo)
+	}
+
+	cliente.Mutex.Lock()
+	nome := cliente.Nome
+	cliente.Mutex.Unlock()
+	convite := matchmaking.Convite{
+		Codigo:    s.Convites.NovoCodigo(),
+		ClienteID: clienteID,
+		Nome:      nome,
+		Servidor:  s.MeuEndereco,
+		ExpiraEm:  time.Now().Add(CONVITE_PRAZO),
+	}
+	if _, err := s.ClusterManager.Propor(ENTRADA_CONVITE_CRIADO, convite); err != nil {
+		log.Printf("[PRIVADA_ERRO:%s] Convite de %s não confirmado pela maioria: %v", s.ServerID, nome, err)
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Não foi possível criar a sala privada agora. Tente novamente."})})
+		return
+	}
+	s.Convites.Registrar(convite) // Não espera a aplicação do log para aceitar o código
+	time.AfterFunc(CONVITE_PRAZO, func() { s.expirarConvite(convite) })
+
+	log.Printf("[PRIVADA:%s] %s criou a sala privada %s", s.ServerID, nome, convite.Codigo)
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{
+		Comando: "SALA_PRIVADA_CRIADA",
+		Dados:   seguranca.MustJSON(protocolo.DadosSalaPrivada{Codigo: convite.Codigo, ExpiraEmSegundos: int(CONVITE_PRAZO / time.Second)}),
+	})
+}
+
+// handleClienteEntrarPrivada usa o código de uma sala privada. O servidor do criador
+// cria a sala como Host; se o jogador está em outro servidor, este vira a Sombra.
+func (s *Servidor) handleClienteEntrarPrivada(client mqtt.Client, msg mqtt.Message) {
+	var dados map[string]string
+	if err := json.Unmarshal(msg.Payload(), &dados); err != nil {
+		log.Printf("[PRIVADA_ERRO:%s] Erro ao decodificar JSON: %v", s.ServerID, err)
+		return
+	}
+	clienteID := dados["cliente_id"]
+	if !s.comandoAutenticado(clienteID, dados["token_sessao"], "ENTRAR_PRIVADA") {
+		return
+	}
+	codigo := matchmaking.NormalizarCodigo(dados["codigo"])
+	cliente := s.clienteLogado(clienteID)
+	if cliente == nil {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Erro ao entrar na sala privada. Tente novamente."})})
+		return
+	}
+	if !s.liberarDaPartidaAnterior(cliente) {
+		return
+	}
+
+	convite, ok := s.Convites.Buscar(codigo)
+	if !ok {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: fmt.Sprintf("Código %s inválido ou expirado.", codigo)})})
+		return
+	}
+	if convite.ClienteID == clienteID {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Esse é o código da sua sala. Passe-o para o seu oponente."})})
+		return
+	}
+
+	estavaNaFila := s.sairDaFilaPublica(clienteID)
+	cliente.Mutex.Lock()
+	nome := cliente.Nome
+	cliente.Mutex.Unlock()
+
+	var salaID string
+	var err error
+	if convite.Servidor == s.MeuEndereco {
+		salaID, err = s.AceitarConvite(codigo, cliente, "")
+	} else {
+		salaID, err = s.aceitarConviteRemoto(convite, clienteID, nome)
+		if err == nil {
+			if err = s.criarSalaComoSombra(cliente, salaID, convite.ClienteID, convite.Nome, convite.Servidor); err != nil {
+				// O Host já criou a sala: ela é cancelada lá
+				s.encerrarLobbyRemoto(convite.Servidor, salaID, MOTIVO_LOBBY_CANCELADO, nil)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("[PRIVADA_ERRO:%s] %s não entrou na sala %s: %v", s.ServerID, nome, codigo, err)
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: fmt.Sprintf("Não foi possível entrar na sala %s: %v", codigo, err)})})
+		if estavaNaFila {
+			s.devolverAFila(cliente)
+		}
+		return
+	}
+	log.Printf("[PRIVADA:%s] %s entrou na sala privada %s (sala %s, Host %s)", s.ServerID, nome, codigo, salaID, convite.Servidor)
+}
+
+// AceitarConvite consome o código (só no servidor do criador) e cria a sala com o
+// criador e o convidado. `sombraAddr` é o servidor do convidado, vazio se for este.
+func (s *Servidor) AceitarConvite(codigo string, convidado *tipos.Cliente, sombraAddr string) (string, error) {
+	if convite, ok := s.Convites.Buscar(codigo); !ok || convite.Servidor != s.MeuEndereco {
+		return "", fmt.Errorf("código inválido ou expirado")
+	}
+	convite, ok := s.Convites.Tomar(codigo)
+	if !ok {
+		return "", fmt.Errorf("código já usado")
+	}
+	go s.proporConviteEncerrado(codigo)
+
+	criador := s.clienteLogado(convite.ClienteID)
+	if criador == nil {
+		return "", fmt.Errorf("%s não está mais conectado", convite.Nome)
+	}
+	if _, emAndamento := salaDoCliente(criador); emAndamento {
+		return "", fmt.Errorf("%s já está em outra partida", convite.Nome)
+	}
+	s.sairDaFilaPublica(criador.ID)
+
+	salaID := s.CriarSalaRemotaComSombra(convidado, criador, sombraAddr)
+	if salaID == "" {
+		return "", fmt.Errorf("falha ao criar a sala")
+	}
+	s.mutexSalas.RLock()
+	sala := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+	if sala != nil {
+		sala.Mutex.Lock()
+		sala.Privada = true
+		sala.Mutex.Unlock()
+	}
+	log.Printf("[PRIVADA:%s] Código %s usado por %s: sala %s (Sombra: %s)", s.ServerID, codigo, convidado.Nome, salaID, sombraAddr)
+	return salaID, nil
+}
+
+// aceitarConviteRemoto pede ao servidor do criador que crie a sala privada
+func (s *Servidor) aceitarConviteRemoto(convite matchmaking.Convite, clienteID, nome string) (string, error) {
+	body, _ := json.Marshal(map[string]string{
+		"codigo":     convite.Codigo,
+		"cliente_id": clienteID,
+		"nome":       nome,
+		"servidor":   s.MeuEndereco,
+	})
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/partida/aceitar_convite", convite.Servidor), body)
+	if err != nil {
+		return "", fmt.Errorf("servidor de %s indisponível", convite.Nome)
+	}
+	defer resp.Body.Close()
+	var res struct {
+		SalaID string `json:"sala_id"`
+		Erro   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK {
+		if res.Erro == "" {
+			res.Erro = fmt.Sprintf("status %d", resp.StatusCode)
+		}
+		return "", fmt.Errorf("%s", res.Erro)
+	}
+	return res.SalaID, nil
+}
+
+// encerrarConvite cancela um código ainda não usado
+func (s *Servidor) encerrarConvite(codigo string) {
+	if s.Convites.Remover(codigo) {
+		go s.proporConviteEncerrado(codigo)
+	}
+}
+
+// expirarConvite encerra o código que ninguém usou dentro de CONVITE_PRAZO e avisa o criador
+func (s *Servidor) expirarConvite(convite matchmaking.Convite) {
+	if !s.Convites.Remover(convite.Codigo) {
+		return // Já foi usado ou cancelado
+	}
+	s.proporConviteEncerrado(convite.Codigo)
+	log.Printf("[PRIVADA:%s] Código %s de %s expirou sem oponente", s.ServerID, convite.Codigo, convite.Nome)
+	s.publicarParaCliente(convite.ClienteID, protocolo.Mensagem{
+		Comando: "SALA_PRIVADA_EXPIRADA",
+		Dados:   seguranca.MustJSON(protocolo.DadosSalaPrivada{Codigo: convite.Codigo}),
+	})
+}
+
+func (s *Servidor) proporConviteEncerrado(codigo string) {
+	if _, err := s.ClusterManager.Propor(ENTRADA_CONVITE_ENCERRADO, codigo); err != nil {
+		log.Printf("[PRIVADA_ERRO:%s] Encerramento do código %s não confirmado pela maioria: %v", s.ServerID, codigo, err)
+	}
+}
+
+// aplicarConviteCriado registra um código comprometido no log
+func (s *Servidor) aplicarConviteCriado(entrada tipos.EntradaLog) {
+	var convite matchmaking.Convite
+	if err := json.Unmarshal(entrada.Dados, &convite); err != nil {
+		log.Printf("[PRIVADA] Entrada %d de convite inválida: %v", entrada.Indice, err)
+		return
+	}
+	s.Convites.Registrar(convite)
+}
+
+// aplicarConviteEncerrado remove um código usado, cancelado ou expirado
+func (s *Servidor) aplicarConviteEncerrado(entrada tipos.EntradaLog) {
+	var codigo string
+	if err := json.Unmarshal(entrada.Dados, &codigo); err != nil {
+		log.Printf("[PRIVADA] Entrada %d de convite encerrado inválida: %v", entrada.Indice, err)
+		return
+	}
+	s.Convites.Remover(codigo)
+}
+
+func (s *Servidor) handleComandoPartida(client mqtt.Client, msg mqtt.Message) {
+	// CORREÇÃO: Adicionar logs detalhados para debugging
+	timestamp := time.Now().Format("15:04:05.000")
+	log.Printf("[%s][COMANDO_DEBUG] === INÍCIO PROCESSAMENTO COMANDO ===", timestamp)
+
+	// Extrai o ID da sala do tópico
+	topico := msg.Topic()
+	// topico formato: "partidas/{salaID}/comandos"
+	partes := strings.Split(topico, "/")
+	if len(partes) < 2 {
+		log.Printf("[%s][COMANDO_ERRO] Tópico inválido: %s", timestamp, topico)
+		return
+	}
+	salaID := partes[1]
+
+	log.Printf("[%s][COMANDO_DEBUG] Comando recebido no tópico: %s", timestamp, topico)
+
+	var mensagem protocolo.Mensagem
+	if err := json.Unmarshal(msg.Payload(), &mensagem); err != nil {
+		log.Printf("[%s][COMANDO_ERRO] Erro ao decodificar comando: %v", timestamp, err)
+		return
+	}
+
+	log.Printf("[%s][COMANDO_DEBUG] Comando decodificado: %s", timestamp, mensagem.Comando)
+
+	// Os comandos repassados entre servidores (Sombra, sessão retomada) já foram
+	// conferidos aqui, no servidor que os recebeu do jogador
+	if !s.comandoAutenticado(autorDoComando(mensagem), mensagem.TokenSessao, mensagem.Comando) {
+		return
+	}
+
+	s.processarComandoPartida(salaID, mensagem)
+}
+
+// autorDoComando devolve a conta em nome da qual um comando de partida age: o
+// cliente_id ou, nas propostas de troca, o id_jogador_oferta. Devolve "" se o comando
+// não diz quem age ou se os dois campos apontam para contas diferentes.
+func autorDoComando(mensagem protocolo.Mensagem) string {
+	var dados struct {
+		ClienteID       string `json:"cliente_id"`
+		IDJogadorOferta string `json:"id_jogador_oferta"`
+	}
+	if json.Unmarshal(mensagem.Dados, &dados) != nil {
+		return ""
+	}
+	if dados.ClienteID != "" && dados.IDJogadorOferta != "" && dados.ClienteID != dados.IDJogadorOferta {
+		return ""
+	}
+	if dados.ClienteID != "" {
+		return dados.ClienteID
+	}
+	return dados.IDJogadorOferta
+}
+
+// ProcessarComandoPartida é chamado pela API quando um servidor que atende a sessão
+// retomada de um jogador encaminha o comando dele para cá
+func (s *Servidor) ProcessarComandoPartida(salaID string, mensagem protocolo.Mensagem) {
+	s.processarComandoPartida(salaID, mensagem)
+}
+
+// processarComandoPartida executa um comando de jogador para uma sala
+func (s *Servidor) processarComandoPartida(salaID string, mensagem protocolo.Mensagem) {
+	s.mutexSalas.RLock()
+	sala, existe := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+
+	if !existe {
+		// O replay de uma sala já coletada sai do histórico
+		if mensagem.Comando == "EXPORTAR_REPLAY" {
+			if _, arquivada := s.Historico.Resumo(salaID); arquivada {
+				var dados map[string]string
+				json.Unmarshal(mensagem.Dados, &dados)
+				s.enviarReplayArquivado(salaID, dados["cliente_id"])
+				return
+			}
+		}
+
+		// A sessão do jogador pode ter sido retomada por este servidor: o comando vai
+		// para o servidor de origem, que participa da partida
+		s.mutexSessoes.RLock()
+		origem := s.salasViaGateway[salaID]
+		s.mutexSessoes.RUnlock()
+		if origem != "" {
+			s.encaminharComandoParaOrigem(origem, salaID, mensagem)
+			return
+		}
+		log.Printf("Sala %s não encontrada", salaID)
+		return
+	}
+
+	// Verifica se este servidor é o Host ou Sombra
+	sala.Mutex.Lock()
+	servidorHost := sala.ServidorHost
+	servidorSombra := sala.ServidorSombra
+	sala.Mutex.Unlock()
+
+	// Processa comando baseado no tipo
+	switch mensagem.Comando {
+	case "COMPRAR_PACOTE":
+		var dados map[string]string
+		json.Unmarshal(mensagem.Dados, &dados)
+		clienteID := dados["cliente_id"]
+
+		// CORREÇÃO: Aplicar lógica Host/Shadow
+		sala.Mutex.Lock()
+		servidorHost := sala.ServidorHost
+		servidorSombra := sala.ServidorSombra
+		sala.Mutex.Unlock()
+
+		// Sempre processa compra localmente
+		s.processarCompraPacote(clienteID, sala)
+
+		// AGORA, notificamos o Host se formos o Shadow
+		if servidorHost == s.MeuEndereco {
+			// Eu sou o Host. processarCompraPacote já chamou verificarEIniciarPartidaSeProntos.
+			log.Printf("[HOST] Compra processada localmente para %s. Verificando prontos.", clienteID)
+		} else if servidorSombra == s.MeuEndereco {
+			// Eu sou o Shadow. Além de processar a compra,
+			// devo notificar o Host que este jogador está PRONTO.
+			log.Printf("[SHADOW] Compra processada localmente para %s. Notificando Host %s que estou pronto.", clienteID, servidorHost)
+			go s.encaminharEventoParaHost(sala, clienteID, "PLAYER_READY", nil)
+		}
+
+	case "JOGAR_CARTA":
+		var dados map[string]interface{}
+		json.Unmarshal(mensagem.Dados, &dados)
+		clienteID := dados["cliente_id"].(string)
+		cartaID := dados["carta_id"].(string)
+		// A reserva de troca é conferida ao tirar a carta da mão (tirarCartaDaMao)
+
+		// Se este servidor é o Host, processa diretamente
+		if servidorHost == s.MeuEndereco {
+			// CORREÇÃO: Construir o objeto GameEventRequest
+			eventoReq := &tipos.GameEventRequest{
+				MatchID:   sala.ID,
+				EventSeq:  0, // O Host definirá o eventSeq correto
+				EventType: "CARD_PLAYED",
+				PlayerID:  clienteID,
+				Data: map[string]interface{}{
+					"carta_id": cartaID,
+				},
+			}
+			s.processarEventoComoHost(sala, eventoReq) // <-- CHAMADA CORRIGIDA
+
+		} else if servidorSombra == s.MeuEndereco {
+			// Se é a Sombra, encaminha para o Host via API REST
+			s.encaminharJogadaParaHost(sala, clienteID, cartaID, false)
+		}
+
+	// Em func (s *Servidor) handleComandoPartida
+	case "CHAT":
+		var dadosCliente protocolo.DadosEnviarChat
+		if err := json.Unmarshal(mensagem.Dados, &dadosCliente); err != nil {
+			log.Printf("[CHAT_ERRO] Erro ao decodificar dados do chat: %v", err)
+			return
+		}
+
+		// CORREÇÃO: Aplicar lógica Host/Shadow
+		sala.Mutex.Lock()
+		servidorHost := sala.ServidorHost
+		servidorSombra := sala.ServidorSombra
+		sala.Mutex.Unlock()
+
+		s.mutexClientes.RLock()
+		cliente := s.Clientes[dadosCliente.ClienteID]
+		s.mutexClientes.RUnlock()
+		if cliente == nil {
+			return
+		}
+
+		if servidorHost == s.MeuEndereco {
+			// Eu sou o Host, eu faço o broadcast
+			log.Printf("[HOST-CHAT] Recebido chat de %s. Fazendo broadcast.", cliente.Nome)
+			s.retransmitirChat(sala, cliente, dadosCliente.Texto)
+		} else if servidorSombra == s.MeuEndereco {
+			// Eu sou o Shadow, encaminho para o Host
+			log.Printf("[SHADOW-CHAT] Recebido chat de %s. Encaminhando para Host %s.", cliente.Nome, servidorHost)
+			dadosEvento := map[string]interface{}{
+				"texto": dadosCliente.Texto,
+			}
+			go s.encaminharEventoParaHost(sala, dadosCliente.ClienteID, "CHAT", dadosEvento)
+		}
+
+	case "TROCAR_CARTAS", "TROCAR_CARTAS_OFERTA", "TROCA_CONTRAPROPOSTA", "TROCA_ACEITAR", "TROCA_RECUSAR":
+		var req protocolo.TrocarCartasReq
+		if err := json.Unmarshal(mensagem.Dados, &req); err != nil {
+			log.Printf("[TROCA_ERRO] Erro ao decodificar requisição de troca: %v", err)
+			return
+		}
+		s.processarTrocaCartas(sala, mensagem.Comando, &req)
+
+	case "CANCELAR_PARTIDA":
+		var dados map[string]string
+		json.Unmarshal(mensagem.Dados, &dados)
+		clienteID := dados["cliente_id"]
+
+		if servidorHost == s.MeuEndereco {
+			s.sairDaSala(sala, clienteID)
+		} else if servidorSombra == s.MeuEndereco {
+			// O Host decide o destino da sala; a Sombra só repassa o pedido
+			go s.encaminharComandoParaOrigem(servidorHost, salaID, mensagem)
+		}
+
+	case "REVANCHE":
+		var dados map[string]string
+		json.Unmarshal(mensagem.Dados, &dados)
+		clienteID := dados["cliente_id"]
+
+		if servidorHost == s.MeuEndereco {
+			s.pedirRevanche(sala, clienteID)
+		} else if servidorSombra == s.MeuEndereco {
+			go s.encaminharComandoParaOrigem(servidorHost, salaID, mensagem)
+		}
+
+	case "EXPORTAR_REPLAY":
+		var dados map[string]string
+		json.Unmarshal(mensagem.Dados, &dados)
+		// Host e Sombra têm o EventLog completo, então quem recebeu o pedido responde
+		s.enviarReplayParaCliente(sala, dados["cliente_id"])
+	}
+}
+
+func (s *Servidor) publicarParaCliente(clienteID string, msg protocolo.Mensagem) {
+	// Jogadores que retomaram a sessão por outro servidor recebem as mensagens por ele
+	s.mutexSessoes.RLock()
+	gateway := s.gatewaysClientes[clienteID]
+	s.mutexSessoes.RUnlock()
+	if gateway != "" {
+		go s.notificarJogadorRemoto(gateway, clienteID, msg)
+		return
+	}
+
+	payload, _ := json.Marshal(msg)
+	topico := fmt.Sprintf("clientes/%s/eventos", clienteID)
+	log.Printf("[PUBLICAR_CLIENTE] Enviando para %s no tópico %s: %s", clienteID, topico, string(payload))
+	s.MQTTClient.Publish(topico, 0, false, payload)
+}
+
+func (s *Servidor) publicarEventoPartida(salaID string, msg protocolo.Mensagem) {
+	payload, _ := json.Marshal(msg)
+	topico := fmt.Sprintf("partidas/%s/eventos", salaID)
+	s.MQTTClient.Publish(topico, 0, false, payload)
+
+	// Repete o evento nos brokers dos servidores que atendem sessões retomadas desta sala
+	s.mutexSessoes.RLock()
+	gateways := make([]string, 0, len(s.gatewaysSalas[salaID]))
+	for gateway := range s.gatewaysSalas[salaID] {
+		gateways = append(gateways, gateway)
+	}
+	s.mutexSessoes.RUnlock()
+	for _, gateway := range gateways {
+		go s.publicarEventoEmGateway(gateway, salaID, msg)
+	}
+}
+
+// ==================== MATCHMAKING E LÓGICA DE JOGO ====================
+
+// ratingDe devolve o rating do jogador (ranking.RATING_INICIAL se ele não tem conta)
+func (s *Servidor) ratingDe(clienteID string) int {
+	rating, _ := s.Contas.Rating(clienteID)
+	return rating
+}
+
+// removerDaLista remove o elemento i da fila preservando a ordem de chegada
+func removerDaLista(fila []*tipos.Cliente, i int) []*tipos.Cliente {
+	return append(fila[:i:i], fila[i+1:]...)
+}
+
+// entrarFila coloca o cliente na fila local e na fila do cluster. Quem forma os
+// pares é o líder (coordenarFilaGlobal); a fila local guarda quem este servidor ainda
+// pode entregar a uma partida.
+func (s *Servidor) entrarFila(cliente *tipos.Cliente) {
+	rating := s.ratingDe(cliente.ID)
+
+	s.mutexFila.Lock()
+	cliente.NaFilaDesde = time.Now()
+	s.FilaDeEspera = append(s.FilaDeEspera, cliente)
+	s.mutexFila.Unlock()
+
+	log.Printf("Cliente %s (%s, rating %d) entrou na fila de espera.", cliente.Nome, cliente.ID, rating)
+	s.publicarParaCliente(cliente.ID, protocolo.Mensagem{
+		Comando: "AGUARDANDO_OPONENTE",
+		Dados:   seguranca.MustJSON(map[string]string{"mensagem": fmt.Sprintf("Procurando oponente em todos os servidores (seu rating: %d)...", rating)}),
+	})
+
+	go s.enviarEntradaFila(s.entradaDaFila(cliente))
+}
+
+// retirarDaFila tira um cliente da fila local e o devolve, ou nil se ele não está nela.
+// Só quem consegue retirar o jogador pode colocá-lo numa partida.
+func (s *Servidor) retirarDaFila(clienteID string) *tipos.Cliente {
+	s.mutexFila.Lock()
+	defer s.mutexFila.Unlock()
+	for i, c := range s.FilaDeEspera {
+		if c.ID == clienteID {
+			s.FilaDeEspera = removerDaLista(s.FilaDeEspera, i)
+			return c
+		}
+	}
+	return nil
+}
+
+// devolverAFila recoloca um cliente retirado da fila, mantendo o seu tempo de espera
+func (s *Servidor) devolverAFila(cliente *tipos.Cliente) {
+	s.mutexFila.Lock()
+	s.FilaDeEspera = append(s.FilaDeEspera, cliente)
+	s.mutexFila.Unlock()
+	go s.enviarEntradaFila(s.entradaDaFila(cliente))
+}
+
+// entradaDaFila monta a entrada da fila do cluster para um cliente deste servidor
+func (s *Servidor) entradaDaFila(cliente *tipos.Cliente) matchmaking.Entrada {
+	return matchmaking.Entrada{
+		ClienteID: cliente.ID,
+		Nome:      cliente.Nome,
+		Servidor:  s.MeuEndereco,
+		Rating:    s.ratingDe(cliente.ID),
+		Desde:     cliente.NaFilaDesde,
+	}
+}
+
+// enviarEntradaFila coloca um jogador na fila do cluster, no líder
+func (s *Servidor) enviarEntradaFila(entrada matchmaking.Entrada) {
+	lider := s.ClusterManager.GetLider()
+	if lider == "" {
+		return // A próxima sincronização entrega a entrada ao líder
+	}
+	if lider == s.MeuEndereco {
+		s.EntrarFilaGlobal(entrada)
+		return
+	}
+	body, _ := json.Marshal(entrada)
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/matchmaking/fila/entrar", lider), body)
+	if err != nil {
+		log.Printf("[FILA_GLOBAL:%s] Erro ao enviar %s para a fila do líder %s: %v", s.ServerID, entrada.ClienteID, lider, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// enviarSaidaFila tira um jogador da fila do cluster, no líder. Se a chamada se perder,
+// a próxima sincronização corrige a fila.
+func (s *Servidor) enviarSaidaFila(clienteID string) {
+	lider := s.ClusterManager.GetLider()
+	if lider == "" {
+		return
+	}
+	if lider == s.MeuEndereco {
+		s.SairFilaGlobal(clienteID)
+		return
+	}
+	body, _ := json.Marshal(map[string]string{"cliente_id": clienteID})
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/matchmaking/fila/sair", lider), body)
+	if err != nil {
+		log.Printf("[FILA_GLOBAL:%s] Erro ao tirar %s da fila do líder %s: %v", s.ServerID, clienteID, lider, err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// sincronizarFilaComLider reenvia periodicamente a fila local ao líder. Assim um líder
+// novo reconstrói a fila do cluster e entradas perdidas são corrigidas. A resposta traz
+// a situação de cada jogador, repassada a eles como STATUS_FILA.
+func (s *Servidor) sincronizarFilaComLider() {
+	ticker := time.NewTicker(FILA_SINCRONIA_INTERVALO)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		lider := s.ClusterManager.GetLider()
+		if lider == "" {
+			continue
+		}
+
+		s.mutexFila.Lock()
+		fila := make([]*tipos.Cliente, len(s.FilaDeEspera))
+		copy(fila, s.FilaDeEspera)
+		s.mutexFila.Unlock()
+		entradas := make([]matchmaking.Entrada, 0, len(fila))
+		for _, c := range fila {
+			entradas = append(entradas, s.entradaDaFila(c))
+		}
+
+		if lider == s.MeuEndereco {
+			s.notificarStatusFila(s.SincronizarFilaGlobal(s.MeuEndereco, entradas))
+			continue
+		}
+		body, _ := json.Marshal(map[string]interface{}{
+			"servidor": s.MeuEndereco,
+			"entradas": entradas,
+		})
+		resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/matchmaking/fila/sincronizar", lider), body)
+		if err != nil {
+			log.Printf("[FILA_GLOBAL:%s] Erro ao sincronizar a fila com o líder %s: %v", s.ServerID, lider, err)
+			continue
+		}
+		var resposta struct {
+			Status map[string]matchmaking.Status `json:"status"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&resposta); err != nil {
+			log.Printf("[FILA_GLOBAL:%s] Resposta de sincronização inválida do líder %s: %v", s.ServerID, lider, err)
+		}
+		resp.Body.Close()
+		s.notificarStatusFila(resposta.Status)
+	}
+}
+
+// notificarStatusFila envia STATUS_FILA a cada jogador que ainda está na fila local
+func (s *Servidor) notificarStatusFila(status map[string]matchmaking.Status) {
+	s.mutexFila.Lock()
+	fila := make([]*tipos.Cliente, len(s.FilaDeEspera))
+	copy(fila, s.FilaDeEspera)
+	s.mutexFila.Unlock()
+
+	for _, c := range fila {
+		st, ok := status[c.ID]
+		if !ok {
+			continue // Ainda não chegou ao líder; a próxima sincronização informa
+		}
+		esperando := time.Since(c.NaFilaDesde)
+		s.publicarParaCliente(c.ID, protocolo.Mensagem{
+			Comando: "STATUS_FILA",
+			Dados: seguranca.MustJSON(protocolo.DadosStatusFila{
+				Posicao:                st.Posicao,
+				Total:                  st.Total,
+				EsperandoSegundos:      int(esperando.Seconds()),
+				EsperaEstimadaSegundos: int(st.EsperaEstimada.Seconds()),
+				ServidoresConsultados:  st.Servidores,
+				JanelaRating:           ranking.Janela(esperando),
+			}),
+		})
+	}
+}
+
+// EntrarFilaGlobal adiciona um jogador à fila do cluster (só no líder). O rating vem
+// das contas replicadas, não do servidor que enviou a entrada.
+func (s *Servidor) EntrarFilaGlobal(entrada matchmaking.Entrada) {
+	entrada.Rating = s.ratingDe(entrada.ClienteID)
+	s.FilaGlobal.Entrar(entrada)
+	log.Printf("[FILA_GLOBAL:%s] %s (%d) entrou na fila do cluster via %s", s.ServerID, entrada.Nome, entrada.Rating, entrada.Servidor)
+}
+
+// SairFilaGlobal tira um jogador da fila do cluster (só no líder)
+func (s *Servidor) SairFilaGlobal(clienteID string) bool {
+	return s.FilaGlobal.Sair(clienteID)
+}
+
+// SincronizarFilaGlobal substitui na fila do cluster as entradas de um servidor e
+// devolve a situação de cada jogador dele (só no líder)
+func (s *Servidor) SincronizarFilaGlobal(servidor string, entradas []matchmaking.Entrada) map[string]matchmaking.Status {
+	for i := range entradas {
+		entradas[i].Rating = s.ratingDe(entradas[i].ClienteID)
+	}
+	s.FilaGlobal.Sincronizar(servidor, entradas)
+	return s.FilaGlobal.StatusDoServidor(servidor)
+}
+
+func (s *Servidor) GetFilaGlobal() []matchmaking.Entrada {
+	return s.FilaGlobal.Entradas()
+}
+
+// coordenarFilaGlobal é o laço do líder: descarta entradas de servidores que pararam
+// de sincronizar e forma os pares. Cada par sai da fila no mesmo passo em que é
+// formado, então um jogador nunca é pareado duas vezes.
+func (s *Servidor) coordenarFilaGlobal() {
+	ticker := time.NewTicker(FILA_GLOBAL_INTERVALO)
+	defer ticker.Stop()
+
+	eraLider := false
+	for range ticker.C {
+		if !s.ClusterManager.SouLider() {
+			if eraLider {
+				// Outro líder assume a fila a partir das sincronizações dos servidores
+				s.FilaGlobal.Limpar()
+				eraLider = false
+			}
+			continue
+		}
+		eraLider = true
+
+		for _, e := range s.FilaGlobal.Expirar(FILA_GLOBAL_EXPIRACAO) {
+			log.Printf("[FILA_GLOBAL:%s] %s saiu da fila: %s parou de sincronizar", s.ServerID, e.Nome, e.Servidor)
+		}
+		for _, par := range s.FilaGlobal.Parear() {
+			log.Printf("[FILA_GLOBAL:%s] Par %s: %s (%d, %s) x %s (%d, %s)", s.ServerID, par.ID, par.A.Nome, par.A.Rating, par.A.Servidor, par.B.Nome, par.B.Rating, par.B.Servidor)
+			go s.despacharPareamento(par)
+		}
+	}
+}
+
+// despacharPareamento coordena o handshake em duas fases de um par. Primeiro os
+// servidores de A e de B reservam os seus jogadores (preparar); se os dois
+// reservaram, o servidor de A cria a sala como Host e o de B entra como Sombra
+// (confirmar). Qualquer falha desfaz as reservas (abortar) e os jogadores voltam
+// para a fila.
+func (s *Servidor) despacharPareamento(par matchmaking.Pareamento) {
+	preparados := make([]matchmaking.Entrada, 0, 2)
+	for _, jogador := range []matchmaking.Entrada{par.A, par.B} {
+		_, err := s.enviarConfirmacao(jogador.Servidor, matchmaking.Confirmacao{
+			Fase:       matchmaking.FASE_PREPARAR,
+			Pareamento: par,
+			ClienteID:  jogador.ClienteID,
+		})
+		if err != nil {
+			log.Printf("[PAREAMENTO:%s] Par %s: %s não foi reservado em %s: %v", s.ServerID, par.ID, jogador.Nome, jogador.Servidor, err)
+			s.abortarPareamento(par, preparados)
+			return
+		}
+		preparados = append(preparados, jogador)
+	}
+
+	salaID, err := s.enviarConfirmacaoComRepeticao(par.A.Servidor, matchmaking.Confirmacao{
+		Fase:       matchmaking.FASE_CONFIRMAR,
+		Pareamento: par,
+		Papel:      matchmaking.PAPEL_HOST,
+	})
+	if err != nil {
+		// O abortar também cancela a sala, se o Host a criou e só a resposta se perdeu
+		log.Printf("[PAREAMENTO:%s] Par %s: Host %s não criou a sala: %v", s.ServerID, par.ID, par.A.Servidor, err)
+		s.abortarPareamento(par, preparados)
+		return
+	}
+	if par.B.Servidor == par.A.Servidor {
+		log.Printf("[PAREAMENTO:%s] Par %s confirmado: sala %s em %s", s.ServerID, par.ID, salaID, par.A.Servidor)
+		return
+	}
+
+	_, err = s.enviarConfirmacaoComRepeticao(par.B.Servidor, matchmaking.Confirmacao{
+		Fase:       matchmaking.FASE_CONFIRMAR,
+		Pareamento: par,
+		Papel:      matchmaking.PAPEL_SOMBRA,
+		SalaID:     salaID,
+	})
+	if err != nil {
+		// A sala já existe no Host: ela é cancelada e A volta para a fila
+		log.Printf("[PAREAMENTO:%s] Par %s: Sombra %s não entrou na sala %s: %v", s.ServerID, par.ID, par.B.Servidor, salaID, err)
+		s.abortarPareamento(par, []matchmaking.Entrada{par.B})
+		if par.A.Servidor == s.MeuEndereco {
+			s.EncerrarLobby(salaID, MOTIVO_LOBBY_CANCELADO, []string{par.A.ClienteID})
+		} else {
+			s.encerrarLobbyRemoto(par.A.Servidor, salaID, MOTIVO_LOBBY_CANCELADO, []string{par.A.ClienteID})
+		}
+		return
+	}
+	log.Printf("[PAREAMENTO:%s] Par %s confirmado: sala %s (Host %s, Sombra %s)", s.ServerID, par.ID, salaID, par.A.Servidor, par.B.Servidor)
+}
+
+// abortarPareamento desfaz as reservas já feitas para um par
+func (s *Servidor) abortarPareamento(par matchmaking.Pareamento, preparados []matchmaking.Entrada) {
+	for _, jogador := range preparados {
+		_, err := s.enviarConfirmacao(jogador.Servidor, matchmaking.Confirmacao{
+			Fase:       matchmaking.FASE_ABORTAR,
+			Pareamento: par,
+			ClienteID:  jogador.ClienteID,
+		})
+		if err != nil {
+			// A reserva expira sozinha em PAREAMENTO_RESERVA_PRAZO
+			log.Printf("[PAREAMENTO:%s] Par %s: erro ao liberar %s em %s: %v", s.ServerID, par.ID, jogador.Nome, jogador.Servidor, err)
+		}
+	}
+}
+
+// enviarConfirmacao envia uma fase do handshake a um servidor e devolve o ID da sala
+// (na confirmação do Host)
+func (s *Servidor) enviarConfirmacao(servidor string, msg matchmaking.Confirmacao) (string, error) {
+	if servidor == s.MeuEndereco {
+		return s.ConfirmarPartida(msg)
+	}
+	body, _ := json.Marshal(msg)
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/matchmaking/confirmar_partida", servidor), body)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		SalaID string `json:"sala_id"`
+		Erro   string `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", resp.StatusCode, res.Erro)
+	}
+	return res.SalaID, nil
+}
+
+// enviarConfirmacaoComRepeticao reenvia a confirmação quando ela falha. Repetir é
+// seguro: o servidor devolve a sala que já criou para o par.
+func (s *Servidor) enviarConfirmacaoComRepeticao(servidor string, msg matchmaking.Confirmacao) (string, error) {
+	var err error
+	for tentativa := 1; tentativa <= PAREAMENTO_TENTATIVAS; tentativa++ {
+		var salaID string
+		if salaID, err = s.enviarConfirmacao(servidor, msg); err == nil {
+			return salaID, nil
+		}
+		log.Printf("[PAREAMENTO:%s] Par %s: confirmação em %s falhou (tentativa %d/%d): %v", s.ServerID, msg.Pareamento.ID, servidor, tentativa, PAREAMENTO_TENTATIVAS, err)
+	}
+	return "", err
+}
+
+// salaPareamento é a sala criada neste servidor pela confirmação de um par
+type salaPareamento struct {
+	salaID   string
+	criadaEm time.Time
+}
+
+// reservaPareamento é um jogador retirado da fila local à espera da confirmação do par
+type reservaPareamento struct {
+	cliente *tipos.Cliente
+	prazo   *time.Timer // Devolve o jogador à fila se a confirmação não chegar
+}
+
+// ConfirmarPartida executa neste servidor uma fase do handshake de um par. A
+// confirmação é idempotente por par: repetida, devolve a sala já criada; e o
+// abortar cancela a sala se ela chegou a ser criada aqui.
+func (s *Servidor) ConfirmarPartida(msg matchmaking.Confirmacao) (string, error) {
+	par := msg.Pareamento
+	switch msg.Fase {
+	case matchmaking.FASE_PREPARAR:
+		return "", s.reservarJogador(par.ID, msg.ClienteID)
+
+	case matchmaking.FASE_ABORTAR:
+		if cliente := s.tomarReserva(par.ID, msg.ClienteID); cliente != nil {
+			log.Printf("[PAREAMENTO:%s] Par %s abortado: %s volta para a fila", s.ServerID, par.ID, cliente.Nome)
+			s.devolverAFila(cliente)
+		}
+		s.cancelarSalaDoPareamento(par.ID)
+		return "", nil
+
+	case matchmaking.FASE_CONFIRMAR:
+		s.mutexPareamentos.Lock()
+		defer s.mutexPareamentos.Unlock()
+		if criada, existe := s.salasPareamento[par.ID]; existe {
+			log.Printf("[PAREAMENTO:%s] Par %s já confirmado aqui: sala %s", s.ServerID, par.ID, criada.salaID)
+			return criada.salaID, nil
+		}
+
+		if msg.Papel == matchmaking.PAPEL_SOMBRA {
+			jogador := s.tomarReserva(par.ID, par.B.ClienteID)
+			if jogador == nil {
+				return "", fmt.Errorf("%s não está reservado em %s", par.B.Nome, s.MeuEndereco)
+			}
+			// Sem a sala aqui o par não pode seguir: o erro faz o coordenador abortá-lo
+			if err := s.criarSalaComoSombra(jogador, msg.SalaID, par.A.ClienteID, par.A.Nome, par.A.Servidor); err != nil {
+				return "", err
+			}
+			s.lembrarSalaDoPareamento(par.ID, msg.SalaID)
+			return msg.SalaID, nil
+		}
+
+		jogador := s.tomarReserva(par.ID, par.A.ClienteID)
+		if jogador == nil {
+			return "", fmt.Errorf("%s não está reservado em %s", par.A.Nome, s.MeuEndereco)
+		}
+		oponente := &tipos.Cliente{ID: par.B.ClienteID, Nome: par.B.Nome}
+		sombraAddr := par.B.Servidor
+		if par.B.Servidor == s.MeuEndereco {
+			if oponente = s.tomarReserva(par.ID, par.B.ClienteID); oponente == nil {
+				s.devolverAFila(jogador)
+				return "", fmt.Errorf("%s não está reservado em %s", par.B.Nome, s.MeuEndereco)
+			}
+			sombraAddr = ""
+		}
+		salaID := s.criarSala(jogador, oponente, sombraAddr)
+		if salaID == "" {
+			s.devolverAFila(jogador)
+			if sombraAddr == "" {
+				s.devolverAFila(oponente)
+			}
+			return "", fmt.Errorf("falha ao criar a sala")
+		}
+		s.lembrarSalaDoPareamento(par.ID, salaID)
+		return salaID, nil
+	}
+	return "", fmt.Errorf("fase desconhecida: %s", msg.Fase)
+}
+
+// lembrarSalaDoPareamento guarda a sala criada para o par e esquece as antigas.
+// Assume mutexPareamentos ativo.
+func (s *Servidor) lembrarSalaDoPareamento(pareamentoID, salaID string) {
+	for id, criada := range s.salasPareamento {
+		if time.Since(criada.criadaEm) > PAREAMENTO_SALA_MEMORIA {
+			delete(s.salasPareamento, id)
+		}
+	}
+	s.salasPareamento[pareamentoID] = salaPareamento{salaID: salaID, criadaEm: time.Now()}
+}
+
+// cancelarSalaDoPareamento encerra a sala criada aqui para um par abortado depois
+// da confirmação (a resposta do confirmar se perdeu). Os jogadores deste servidor
+// voltam para a fila.
+func (s *Servidor) cancelarSalaDoPareamento(pareamentoID string) {
+	s.mutexPareamentos.Lock()
+	criada, existe := s.salasPareamento[pareamentoID]
+	delete(s.salasPareamento, pareamentoID)
+	s.mutexPareamentos.Unlock()
+	if !existe {
+		return
+	}
+
+	s.mutexSalas.RLock()
+	sala := s.Salas[criada.salaID]
+	s.mutexSalas.RUnlock()
+	if sala == nil {
+		return
+	}
+	sala.Mutex.Lock()
+	if sala.Estado != "AGUARDANDO_COMPRA" {
+		sala.Mutex.Unlock()
+		return
+	}
+	reenfileirar := make([]string, 0, len(sala.Jogadores))
+	for _, j := range sala.Jogadores {
+		reenfileirar = append(reenfileirar, j.ID)
+	}
+	sala.Mutex.Unlock()
+
+	log.Printf("[PAREAMENTO:%s] Par %s abortado depois da confirmação: sala %s cancelada", s.ServerID, pareamentoID, criada.salaID)
+	s.EncerrarLobby(criada.salaID, MOTIVO_LOBBY_CANCELADO, reenfileirar)
+}
+
+// reservarJogador retira o jogador da fila local para um par. Falha se ele já não
+// está na fila (saiu ou foi para outra partida).
+func (s *Servidor) reservarJogador(pareamentoID, clienteID string) error {
+	cliente := s.retirarDaFila(clienteID)
+	if cliente == nil {
+		return fmt.Errorf("%s não está na fila de %s", clienteID, s.MeuEndereco)
+	}
+	chave := pareamentoID + "/" + clienteID
+	reserva := &reservaPareamento{cliente: cliente}
+	reserva.prazo = time.AfterFunc(PAREAMENTO_RESERVA_PRAZO, func() {
+		if c := s.tomarReserva(pareamentoID, clienteID); c != nil {
+			log.Printf("[PAREAMENTO:%s] Par %s não confirmado a tempo: %s volta para a fila", s.ServerID, pareamentoID, c.Nome)
+			s.devolverAFila(c)
+		}
+	})
+
+	s.mutexFila.Lock()
+	s.reservasPareamento[chave] = reserva
+	s.mutexFila.Unlock()
+	return nil
+}
+
+// tomarReserva remove a reserva e devolve o jogador, ou nil se ela não existe mais
+func (s *Servidor) tomarReserva(pareamentoID, clienteID string) *tipos.Cliente {
+	chave := pareamentoID + "/" + clienteID
+	s.mutexFila.Lock()
+	reserva := s.reservasPareamento[chave]
+	delete(s.reservasPareamento, chave)
+	s.mutexFila.Unlock()
+	if reserva == nil {
+		return nil
+	}
+	reserva.prazo.Stop()
+	return reserva.cliente
+}
+
+// cancelarReservasDe desfaz as reservas do jogador (ele saiu da fila antes de o par ser
+// confirmado). Devolve false se ele não tinha reserva.
+func (s *Servidor) cancelarReservasDe(clienteID string) bool {
+	s.mutexFila.Lock()
+	defer s.mutexFila.Unlock()
+	cancelou := false
+	for chave, reserva := range s.reservasPareamento {
+		if reserva.cliente.ID == clienteID {
+			reserva.prazo.Stop()
+			delete(s.reservasPareamento, chave)
+			cancelou = true
+		}
+	}
+	return cancelou
+}
+
+// Em: servidor/main.go
+// ADICIONAR esta nova função
+// Em: servidor/main.go
+// SUBSTITUA a função 'criarSalaComoSombra' (Etapa 7) por esta:
+
+// criarSalaComoSombra cria a cópia da sala neste servidor, a Sombra da partida do
+// jogador local. Falha, sem criar a sala, se o jogador já não está conectado aqui.
+func (s *Servidor) criarSalaComoSombra(jogadorLocal *tipos.Cliente, salaID string, oponenteID string, oponenteNome string, hostAddr string) error {
+	// Cria objeto para oponente remoto (o Host)
+	oponenteRemoto := &tipos.Cliente{
+		ID:   oponenteID,
+		Nome: oponenteNome,
+	}
+
+	// Busca info completa do jogador local (que ESTÁ no mapa)
+	s.mutexClientes.RLock()
+	clienteLocalCompleto, ok := s.Clientes[jogadorLocal.ID]
+	s.mutexClientes.RUnlock()
+	if !ok || clienteLocalCompleto == nil {
+		log.Printf("[CRIAR_SALA_SOMBRA_ERRO] Cliente local %s não encontrado no mapa principal.", jogadorLocal.ID)
+		return fmt.Errorf("%s não está conectado a %s", jogadorLocal.Nome, s.MeuEndereco)
+	}
+
+	clienteLocalCompleto.Mutex.Lock()
+	nomeJ1 := clienteLocalCompleto.Nome
+	clienteLocalCompleto.Mutex.Unlock()
+
+	nomeJ2 := oponenteRemoto.Nome // Nome do oponente remoto (Host)
+
+	log.Printf("[CRIAR_SALA_SOMBRA:%s] Criando sala %s (Host: %s) para %s vs %s", s.ServerID, salaID, hostAddr, nomeJ1, nomeJ2)
+
+	novaSala := &tipos.Sala{
+		ID:             salaID,
+		Jogadores:      []*tipos.Cliente{clienteLocalCompleto, oponenteRemoto}, // Usa o local (completo) e o remoto (DTO)
+		Estado:         "AGUARDANDO_COMPRA",
+		CartasNaMesa:   make(map[string]Carta),
+		PontosRodada:   make(map[string]int),
+		PontosPartida:  make(map[string]int),
+		NumeroRodada:   1,
+		Prontos:        make(map[string]bool),
+		ServidorHost:   hostAddr,      // Aponta para o Host
+		ServidorSombra: s.MeuEndereco, // Eu sou a Sombra
+		PrazoProntos:   time.Now().Add(LOBBY_PRAZO_PRONTOS),
+	}
+
+	s.mutexSalas.Lock()
+	s.Salas[salaID] = novaSala
+	s.mutexSalas.Unlock()
+
+	// Associa a sala ao jogador LOCAL
+	clienteLocalCompleto.Mutex.Lock()
+	clienteLocalCompleto.Sala = novaSala
+	clienteLocalCompleto.Mutex.Unlock()
+
+	// Associa a sala ao jogador REMOTO (DTO)
+	oponenteRemoto.Mutex.Lock()
+	oponenteRemoto.Sala = novaSala
+	oponenteRemoto.Mutex.Unlock()
+
+	log.Printf("Sala %s criada como SOMBRA. Host: %s", salaID, hostAddr)
+
+	// Notifica jogador local (o Sombra notifica seu jogador)
+	msg := protocolo.Mensagem{
+		Comando: "PARTIDA_ENCONTRADA",
+		Dados:   seguranca.MustJSON(protocolo.DadosPartidaEncontrada{SalaID: salaID, OponenteID: oponenteID, OponenteNome: oponenteNome, SegundosParaComprar: int(LOBBY_PRAZO_PRONTOS / time.Second)}),
+	}
+	s.publicarParaCliente(jogadorLocal.ID, msg)
+	return nil
+}
+
+// Em: servidor/main.go
+// SUBSTITUA a função 'criarSala' (Etapa 1) por esta:
+
+func (s *Servidor) criarSala(j1 *tipos.Cliente, j2 *tipos.Cliente, sombraAddr string) string {
+	salaID := uuid.New().String()
+
+	// --- LÓGICA DE BUSCA CORRIGIDA ---
+	// j1 é o jogador local (oponente) que ESTÁ no mapa.
+	// j2 é o jogador remoto (solicitante) que NÃO ESTÁ no mapa.
+
+	s.mutexClientes.RLock()
+	// Busca o struct completo do jogador local
+	cliente1Completo, ok1 := s.Clientes[j1.ID]
+	s.mutexClientes.RUnlock()
+
+	if !ok1 {
+		log.Printf("[CRIAR_SALA_ERRO:%s] Falha ao buscar informações completas do JOGADOR LOCAL %s (%s) no mapa principal.", s.ServerID, j1.Nome, j1.ID)
+		return "" // Aborta
 	}
 
 	// Usa o struct DTO (Data Transfer Object) do jogador remoto diretamente.
@@ -1008,6 +2619,7 @@ func (s *Servidor) criarSala(j1 *tipos.Cliente, j2 *tipos.Cliente, sombraAddr st
 		Prontos:        make(map[string]bool),
 		ServidorHost:   s.MeuEndereco,
 		ServidorSombra: sombraAddr, // Salva o endereço da Sombra
+		PrazoProntos:   time.Now().Add(LOBBY_PRAZO_PRONTOS),
 	}
 
 	s.mutexSalas.Lock()
@@ -1030,7 +2642,7 @@ func (s *Servidor) criarSala(j1 *tipos.Cliente, j2 *tipos.Cliente, sombraAddr st
 	// Notifica jogadores (o sistema MQTT/API fará o roteamento)
 	msg1 := protocolo.Mensagem{
 		Comando: "PARTIDA_ENCONTRADA",
-		Dados:   seguranca.MustJSON(protocolo.DadosPartidaEncontrada{SalaID: salaID, OponenteID: idJ2, OponenteNome: nomeJ2}),
+		Dados:   seguranca.MustJSON(protocolo.DadosPartidaEncontrada{SalaID: salaID, OponenteID: idJ2, OponenteNome: nomeJ2, SegundosParaComprar: int(LOBBY_PRAZO_PRONTOS / time.Second)}),
 	}
 
 	s.publicarParaCliente(j1.ID, msg1) // Notifica o jogador local
@@ -1040,7 +2652,7 @@ func (s *Servidor) criarSala(j1 *tipos.Cliente, j2 *tipos.Cliente, sombraAddr st
 	if sombraAddr == "" {
 		msg2 := protocolo.Mensagem{
 			Comando: "PARTIDA_ENCONTRADA",
-			Dados:   seguranca.MustJSON(protocolo.DadosPartidaEncontrada{SalaID: salaID, OponenteID: idJ1, OponenteNome: nomeJ1}),
+			Dados:   seguranca.MustJSON(protocolo.DadosPartidaEncontrada{SalaID: salaID, OponenteID: idJ1, OponenteNome: nomeJ1, SegundosParaComprar: int(LOBBY_PRAZO_PRONTOS / time.Second)}),
 		}
 		s.publicarParaCliente(j2.ID, msg2)
 		log.Printf("[CRIAR_SALA:NOTIFICACAO] Enviando PARTIDA_ENCONTRADA para JOGADOR LOCAL %s (ID: %s)", nomeJ2, idJ2)
@@ -1069,6 +2681,7 @@ func (s *Servidor) CriarSalaCrossServer(matchID string, players []tipos.Player,
 		Prontos:        make(map[string]bool),
 		ServidorHost:   s.MeuEndereco,
 		ServidorSombra: "", // Será definido quando Shadow se conectar
+		PrazoProntos:   time.Now().Add(LOBBY_PRAZO_PRONTOS),
 	}
 
 	// Adiciona jogadores à sala
@@ -1092,7 +2705,25 @@ func (s *Servidor) ProcessarEventoComoHost(sala *tipos.Sala, evento *tipos.GameE
 	return s.processarEventoComoHost(sala, evento)
 }
 
-func (s *Servidor) ReplicarEstadoComoShadow(matchID string, eventSeq int64, state tipos.EstadoPartida) bool {
+// ConferirEpocaEvento diz se um evento encaminhado pela Sombra ainda vale: este
+// servidor é o Host da sala e o evento não foi gerado numa época anterior à atual.
+// Devolve também a época e o Host atuais, informados na recusa.
+func (s *Servidor) ConferirEpocaEvento(matchID string, epoca int64) (bool, int64, string) {
+	s.mutexSalas.RLock()
+	sala, ok := s.Salas[matchID]
+	s.mutexSalas.RUnlock()
+	if !ok {
+		return false, 0, ""
+	}
+	sala.Mutex.Lock()
+	defer sala.Mutex.Unlock()
+	return sala.ServidorHost == s.MeuEndereco && epoca >= sala.Epoca, sala.Epoca, sala.ServidorHost
+}
+
+// ReplicarEstadoComoShadow aplica o estado enviado pelo Host. Um estado de época
+// anterior vem de um Host que já foi substituído: é recusado, e a época e o Host
+// atuais são devolvidos para que ele se rebaixe.
+func (s *Servidor) ReplicarEstadoComoShadow(remetente, matchID string, eventSeq int64, state tipos.EstadoPartida) (bool, int64, string) {
 	s.mutexSalas.Lock()
 	sala, ok := s.Salas[matchID]
 	s.mutexSalas.Unlock()
@@ -1113,10 +2744,20 @@ func (s *Servidor) ReplicarEstadoComoShadow(matchID string, eventSeq int64, stat
 	sala.Mutex.Lock()
 	defer sala.Mutex.Unlock()
 
+	if state.Epoca < sala.Epoca {
+		log.Printf("[FAILOVER] Estado da sala %s recusado: época %d de %s, atual %d (Host: %s)", matchID, state.Epoca, remetente, sala.Epoca, sala.ServidorHost)
+		// Quem é readmitido é o Host que este servidor substituiu ao subir a época,
+		// não o remetente informado no pedido
+		if sala.ServidorHost == s.MeuEndereco && sala.HostAnterior != "" {
+			go s.readmitirAntigoHost(sala, sala.HostAnterior)
+		}
+		return false, sala.Epoca, sala.ServidorHost
+	}
+
 	// Valida eventSeq
 	if eventSeq <= sala.EventSeq {
 		log.Printf("[REPLICAR_ESTADO] EventSeq %d é menor ou igual ao atual %d", eventSeq, sala.EventSeq)
-		return false
+		return false, sala.Epoca, sala.ServidorHost
 	}
 
 	// Atualiza estado
@@ -1127,9 +2768,29 @@ func (s *Servidor) ReplicarEstadoComoShadow(matchID string, eventSeq int64, stat
 	sala.NumeroRodada = state.NumeroRodada
 	sala.Prontos = state.Prontos
 	sala.EventSeq = eventSeq
+	sala.EventLog = state.EventLog
+	sala.TurnoDe = state.TurnoDe
+	sala.PrazoTurno = state.PrazoTurno
+	sala.Epoca = state.Epoca
+	ultimoEstado := state
+	sala.UltimoEstadoHost = &ultimoEstado
+
+	// O estado do Host continua sendo a autoridade; o replay só detecta divergência
+	if state.Hash != "" && len(sala.Jogadores) > 0 {
+		reconstruida, err := game.Reconstruir(matchID, sala.Jogadores, state.EventLog)
+		if err != nil {
+			log.Printf("[DIVERGENCIA:%s] Não foi possível refazer o log recebido: %v", matchID, err)
+		} else if hash := game.HashSala(reconstruida); hash != state.Hash {
+			log.Printf("[DIVERGENCIA:%s] Replay do log (eventSeq %d) gerou hash %s, Host informou %s", matchID, eventSeq, hash, state.Hash)
+		}
+	}
+
+	if sala.ServidorSombra == s.MeuEndereco && state.Estado == "JOGANDO" {
+		go s.iniciarMonitorHost(matchID)
+	}
 
 	log.Printf("[REPLICAR_ESTADO] Estado da sala %s sincronizado (eventSeq: %d)", matchID, eventSeq)
-	return true
+	return true, sala.Epoca, sala.ServidorHost
 }
 
 // CORREÇÃO: Funções auxiliares para a API (GetMeuEndereco já existe)
@@ -1139,6 +2800,7 @@ func (s *Servidor) encaminharEventoParaHost(sala *tipos.Sala, clienteID, eventTy
 	sala.Mutex.Lock()
 	host := sala.ServidorHost
 	eventSeq := int64(0)
+	epoca := sala.Epoca
 	sala.Mutex.Unlock()
 
 	log.Printf("[SHADOW] Encaminhando evento %s de %s para o Host %s (eventSeq será definido pelo Host)", eventType, clienteID, host)
@@ -1149,6 +2811,7 @@ func (s *Servidor) encaminharEventoParaHost(sala *tipos.Sala, clienteID, eventTy
 		EventType: eventType,
 		PlayerID:  clienteID,
 		Data:      data,
+		Epoca:     epoca,
 	}
 
 	// Criar evento e assinar
@@ -1181,6 +2844,12 @@ func (s *Servidor) encaminharEventoParaHost(sala *tipos.Sala, clienteID, eventTy
 			log.Printf("[SHADOW] Evento %s processado pelo Host com sucesso (tentativa %d/%d)", eventType, attempt, maxRetries)
 			return
 		}
+		if resp.StatusCode == http.StatusConflict {
+			// Repetir não adianta: o evento foi gerado numa época vencida
+			log.Printf("[FAILOVER] Evento %s de %s recusado por %s: época %d vencida", eventType, clienteID, host, epoca)
+			s.notificarErroPartida(clienteID, "Ação recusada: a partida passou para outro servidor. Tente de novo.", sala.ID)
+			return
+		}
 
 		log.Printf("[SHADOW] Host retornou status %d ao processar evento %s (tentativa %d/%d)", resp.StatusCode, eventType, attempt, maxRetries)
 		if attempt < maxRetries {
@@ -1200,12 +2869,18 @@ func (s *Servidor) processarCompraPacote(clienteID string, sala *tipos.Sala) {
 	cartas := make([]Carta, 0) // Inicializa como slice vazio, não nil
 
 	if souLider {
-		cartas = s.Store.FormarPacote(PACOTE_SIZE)
-		log.Printf("[COMPRAR_DEBUG] Líder retirou %d cartas do estoque", len(cartas))
+		pacote, err := s.FormarPacote(clienteID, sala.ID)
+		if err != nil {
+			log.Printf("[ESTOQUE_REPLICA] Compra de %s recusada: %v", clienteID, err)
+			s.notificarErro(clienteID, fmt.Sprintf("Não foi possível comprar o pacote: %v", err))
+			return
+		}
+		cartas = pacote
 	} else {
 		// Faz requisição HTTP para o líder
 		dados := map[string]interface{}{
 			"cliente_id": clienteID,
+			"sala_id":    sala.ID,
 		}
 		jsonData, _ := json.Marshal(dados)
 		url := fmt.Sprintf("http://%s/estoque/comprar_pacote", lider)
@@ -1219,14 +2894,26 @@ func (s *Servidor) processarCompraPacote(clienteID string, sala *tipos.Sala) {
 		req.Header.Set("Content-Type", "application/json")
 		req.Header.Set("Authorization", "Bearer "+seguranca.GenerateJWT(s.ServerID))
 
-		client := &http.Client{Timeout: 15 * time.Second}
+		// O líder pode levar o commit da compra e o do cancelamento para responder
+		client := &http.Client{Timeout: COMPRA_PACOTE_TIMEOUT}
 		resp, err := client.Do(req)
 		if err != nil {
 			log.Printf("Erro ao requisitar pacote do líder: %v", err)
+			s.notificarErro(clienteID, "O líder não respondeu à compra. Se ela foi confirmada, as cartas aparecem no seu inventário.")
 			return
 		}
 		defer resp.Body.Close()
 
+		if resp.StatusCode != http.StatusOK {
+			var falha struct {
+				Erro string `json:"error"`
+			}
+			json.NewDecoder(resp.Body).Decode(&falha)
+			log.Printf("Líder recusou a compra de %s: %s", clienteID, falha.Erro)
+			s.notificarErro(clienteID, fmt.Sprintf("Não foi possível comprar o pacote: %s", falha.Erro))
+			return
+		}
+
 		var resultado struct {
 			Pacote []Carta `json:"pacote"`
 		}
@@ -1238,14 +2925,15 @@ func (s *Servidor) processarCompraPacote(clienteID string, sala *tipos.Sala) {
 		cartas = resultado.Pacote
 	}
 
-	// Adiciona cartas ao inventário do cliente
-	s.mutexClientes.RLock()
-	cliente := s.Clientes[clienteID]
-	s.mutexClientes.RUnlock()
-
-	cliente.Mutex.Lock()
-	cliente.Inventario = append(cliente.Inventario, cartas...)
-	cliente.Mutex.Unlock()
+	// A compra já está na conta; o inventário em memória recebe as cartas aqui ou ao
+	// aplicar a entrada, o que vier primeiro
+	cliente := s.getClienteLocal(clienteID)
+	if cliente == nil {
+		return
+	}
+	for _, c := range cartas {
+		s.adicionarCartaAoCliente(clienteID, c)
+	}
 
 	// Notifica cliente
 	_, total := s.Store.GetStatusEstoque()
@@ -1274,11 +2962,16 @@ func (s *Servidor) processarCompraPacote(clienteID string, sala *tipos.Sala) {
 
 	// CORREÇÃO DEADLOCK: Lógica diferenciada por tipo de partida
 	sala.Mutex.Lock()
-	sala.Prontos[cliente.Nome] = true
-
 	// Captura informações para decisão
 	isHost := sala.ServidorHost == s.MeuEndereco
 	isShadow := sala.ServidorSombra == s.MeuEndereco
+
+	// Só o Host registra eventos no log; a Sombra recebe o PLAYER_READY pela replicação
+	if isHost {
+		if _, _, err := s.registrarEvento(sala, partida.EVENTO_JOGADOR_PRONTO, cliente.ID, nil); err != nil {
+			log.Printf("[HOST] Falha ao registrar PLAYER_READY de %s: %v", cliente.Nome, err)
+		}
+	}
 	sombraAddr = sala.ServidorSombra
 	hostAddr = sala.ServidorHost
 	sala.Mutex.Unlock()
@@ -1321,13 +3014,15 @@ func (s *Servidor) iniciarPartidaInterna(sala *tipos.Sala) bool {
 	}
 
 	log.Printf("[INICIAR_PARTIDA_DEBUG:%s] Estado atual: %s, mudando para JOGANDO", s.ServerID, sala.Estado)
-	sala.Estado = "JOGANDO"
 
 	// CORREÇÃO: Registrar o TurnoDe ANTES de copiar jogadores, para evitar race condition
+	// O sorteio vai para o log (MATCH_STARTED) para que o replay chegue ao mesmo turno
 	jogadorInicial := sala.Jogadores[rand.Intn(len(sala.Jogadores))]
-	turnoDeID := jogadorInicial.ID
-
-	sala.TurnoDe = turnoDeID
+	dados := partida.DadosPartidaIniciada{TurnoDe: jogadorInicial.ID}
+	if _, _, err := s.registrarEvento(sala, partida.EVENTO_PARTIDA_INICIADA, jogadorInicial.ID, dados); err != nil {
+		log.Printf("[INICIAR_PARTIDA:%s] Falha ao registrar MATCH_STARTED na sala %s: %v", s.ServerID, sala.ID, err)
+		return false
+	}
 
 	return true
 }
@@ -1342,6 +3037,7 @@ func (s *Servidor) notificarInicioPartida(sala *tipos.Sala) {
 	turnoDeID := sala.TurnoDe
 	jogadoresCopy := make([]*tipos.Cliente, len(sala.Jogadores))
 	copy(jogadoresCopy, sala.Jogadores)
+	prazoTurno, segundosRestantes := contagemRegressiva(sala.PrazoTurno)
 	sala.Mutex.Unlock()
 
 	// Coleta contagem de cartas FORA do lock da sala para evitar contenção
@@ -1375,10 +3071,12 @@ func (s *Servidor) notificarInicioPartida(sala *tipos.Sala) {
 	msg := protocolo.Mensagem{
 		Comando: "ATUALIZACAO_JOGO",
 		Dados: seguranca.MustJSON(protocolo.DadosAtualizacaoJogo{
-			MensagemDoTurno: fmt.Sprintf("Partida iniciada! É a vez de %s.", jogadorInicialNome),
-			NumeroRodada:    sala.NumeroRodada,
-			ContagemCartas:  contagemCartas,
-			TurnoDe:         turnoDeID,
+			MensagemDoTurno:   fmt.Sprintf("Partida iniciada! É a vez de %s.", jogadorInicialNome),
+			NumeroRodada:      sala.NumeroRodada,
+			ContagemCartas:    contagemCartas,
+			TurnoDe:           turnoDeID,
+			PrazoTurno:        prazoTurno,
+			SegundosRestantes: segundosRestantes,
 		}),
 	}
 
@@ -1390,6 +3088,8 @@ func (s *Servidor) notificarInicioPartida(sala *tipos.Sala) {
 		s.publicarEventoPartida(sala.ID, msg)
 		// Notifica jogadores remotos (do Shadow) via HTTP
 		go s.notificarJogadoresRemotosDaPartida(sala.ID, sombraAddr, jogadoresCopy, msg)
+		// Envia o estado inicial para a Sombra poder assumir a partida em caso de falha
+		go s.enviarEstadoInicialParaSombra(sala, sombraAddr)
 	} else {
 		// Partida local - apenas publica no MQTT
 		s.publicarEventoPartida(sala.ID, msg)
@@ -1453,18 +3153,19 @@ func (s *Servidor) verificarEIniciarPartidaSeProntos(sala *tipos.Sala) {
 	}
 }
 
-// encaminharJogadaParaHost encaminha uma jogada da Sombra para o Host via API REST
-func (s *Servidor) encaminharJogadaParaHost(sala *tipos.Sala, clienteID, cartaID string) {
+// encaminharJogadaParaHost encaminha uma jogada da Sombra para o Host via API REST.
+// `automatica` marca a jogada feita por este servidor quando o prazo do turno esgotou.
+func (s *Servidor) encaminharJogadaParaHost(sala *tipos.Sala, clienteID, cartaID string, automatica bool) {
 	sala.Mutex.Lock()
 	host := sala.ServidorHost
 	// CORREÇÃO: Não incrementar o eventSeq aqui. O Host é a autoridade sobre o eventSeq.
 	eventSeq := int64(0) // Será definido pelo Host
+	epoca := sala.Epoca
 	sala.Mutex.Unlock()
 
 	log.Printf("[SHADOW] Encaminhando jogada de %s para o Host %s (eventSeq será definido pelo Host)", clienteID, host)
 
 	// CORREÇÃO: Buscar e validar a carta no inventário local do Shadow
-	// IMPORTANTE: NÃO remove a carta ainda - apenas obtém os dados
 	s.mutexClientes.RLock()
 	cliente := s.Clientes[clienteID]
 	s.mutexClientes.RUnlock()
@@ -1474,124 +3175,666 @@ func (s *Servidor) encaminharJogadaParaHost(sala *tipos.Sala, clienteID, cartaID
 		return
 	}
 
-	cliente.Mutex.Lock()
-	var carta Carta
-	cartaIndex := -1
-	for i, c := range cliente.Inventario {
-		if c.ID == cartaID {
-			carta = c
-			cartaIndex = i
-			break
+	// Remove a carta do inventário local ANTES de enviar ao Host, conferindo a reserva
+	// de troca sob o mesmo lock. O consumo só é registrado depois que o Host aceitar;
+	// se ele recusar, a carta volta para a mão.
+	carta, err := tirarCartaDaMao(s.ReservasTroca, cliente, cartaID)
+	if err != nil {
+		log.Printf("[SHADOW] Jogada de %s não encaminhada: %v", clienteID, err)
+		s.notificarErroPartida(clienteID, fmt.Sprintf("Jogada recusada: %v.", err), sala.ID)
+		return
+	}
+
+	// Usa o novo endpoint /game/event
+	req := tipos.GameEventRequest{
+		MatchID:   sala.ID,
+		EventSeq:  eventSeq,
+		EventType: "CARD_PLAYED",
+		PlayerID:  clienteID,
+		Data: map[string]interface{}{
+			"carta_id":       cartaID,
+			"carta_nome":     carta.Nome,
+			"carta_naipe":    carta.Naipe,
+			"carta_valor":    carta.Valor,
+			"carta_raridade": carta.Raridade,
+		},
+		Token:      seguranca.GenerateJWT(s.ServerID),
+		Automatica: automatica,
+		Epoca:      epoca,
+	}
+
+	// Gera assinatura
+	event := tipos.GameEvent{
+		EventSeq:  req.EventSeq,
+		MatchID:   req.MatchID,
+		EventType: req.EventType,
+		PlayerID:  req.PlayerID,
+	}
+	seguranca.SignEvent(&event)
+	req.Signature = event.Signature
+
+	jsonData, _ := json.Marshal(req)
+	url := fmt.Sprintf("http://%s/game/event", host)
+
+	// Adiciona timeout para detectar falha do Host
+	httpClient := &http.Client{
+		Timeout: 15 * time.Second,
+	}
+
+	// Adiciona header de autenticação
+	httpReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+req.Token)
+
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		log.Printf("[FAILOVER] Host %s inacessível: %v. Iniciando promoção da Sombra...", host, err)
+		s.promoverSombraAHost(sala)
+
+		// Como novo Host, este servidor tira a carta da mão e registra o consumo
+		devolverCartaAMao(cliente, carta)
+		s.processarEventoComoHost(sala, &req)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusConflict:
+		// O Host está numa época mais nova (ou já não é o Host): a jogada não vale
+		devolverCartaAMao(cliente, carta)
+		log.Printf("[FAILOVER] Jogada de %s recusada por %s: época %d vencida", clienteID, host, epoca)
+		s.notificarErroPartida(clienteID, "Jogada recusada: a partida passou para outro servidor. A carta voltou para a sua mão; jogue de novo.", sala.ID)
+		return
+	default:
+		devolverCartaAMao(cliente, carta)
+		log.Printf("[SHADOW] Host retornou status %d ao processar jogada", resp.StatusCode)
+		s.notificarErroPartida(clienteID, "Jogada recusada pelo servidor da partida.", sala.ID)
+		return
+	}
+
+	cliente.Mutex.Lock()
+	nomeCliente := cliente.Nome
+	cliente.Mutex.Unlock()
+	go s.salvarTransferencia([]string{clienteID}, []razao.Movimento{{
+		ID: idMovimentoPartida(sala.ID, epoca, carta.ID, razao.TIPO_CONSUMIDA), Tipo: razao.TIPO_CONSUMIDA, Carta: carta,
+		De: clienteID, DeNome: nomeCliente, Referencia: sala.ID,
+	}})
+	log.Printf("[SHADOW] Jogada processada pelo Host com sucesso")
+}
+
+// promoverSombraAHost promove a Sombra a Host quando o Host original falha
+func (s *Servidor) promoverSombraAHost(sala *tipos.Sala) {
+	sala.Mutex.Lock()
+	if sala.ServidorHost == s.MeuEndereco {
+		sala.Mutex.Unlock()
+		return // Já sou o host, não fazer nada
+	}
+
+	antigoHost := sala.ServidorHost
+	sala.ServidorHost = s.MeuEndereco
+	sala.ServidorSombra = "" // Eu sou o novo Host
+	s.reconstruirEstadoDoHost(sala)
+	// Nova época: se o Host antigo ainda estiver vivo, o próximo estado que ele mandar
+	// é recusado e ele se rebaixa, em vez de as duas cópias seguirem divergindo
+	sala.Epoca++
+	sala.HostAnterior = antigoHost
+
+	// O prazo herdado pode ter corrido enquanto o Host estava fora; o jogador da vez
+	// não perde o turno por causa da falha
+	if sala.Estado == "JOGANDO" {
+		if minimo := time.Now().Add(TURNO_PRAZO_MINIMO_FAILOVER); sala.PrazoTurno.Before(minimo) {
+			sala.PrazoTurno = minimo
+		}
+	}
+
+	dados := protocolo.DadosFailoverPartida{
+		SalaID:       sala.ID,
+		NovoHost:     s.MeuEndereco,
+		AntigoHost:   antigoHost,
+		Mensagem:     "O servidor da partida falhou. A partida continuará em um servidor reserva.",
+		NumeroRodada: sala.NumeroRodada,
+		TurnoDe:      sala.TurnoDe,
+		EventSeq:     sala.EventSeq,
+	}
+	epoca := sala.Epoca
+	sala.Mutex.Unlock()
+
+	log.Printf("[FAILOVER] Sombra promovida a Host para a sala %s. Antigo Host: %s (eventSeq: %d, época: %d)", sala.ID, antigoHost, dados.EventSeq, epoca)
+
+	// Notifica os jogadores da promoção
+	s.publicarEventoPartida(sala.ID, protocolo.Mensagem{
+		Comando: "FAILOVER_PARTIDA",
+		Dados:   seguranca.MustJSON(dados),
+	})
+
+	// Restabelece o par Host/Sombra para sobreviver a uma segunda falha. Se a suspeita
+	// foi falsa, o Host antigo ainda atende o jogador dele e volta como Sombra.
+	go func() {
+		s.readmitirAntigoHost(sala, antigoHost)
+		s.elegerNovaSombra(sala, antigoHost)
+	}()
+}
+
+// readmitirAntigoHost manda o estado atual ao Host anterior da sala, que passa a ser a
+// Sombra (ver AssumirComoSombra). Usado logo após a promoção e quando o Host antigo
+// volta a replicar numa época vencida: o jogador dele continua conectado lá.
+func (s *Servidor) readmitirAntigoHost(sala *tipos.Sala, antigoHost string) {
+	sala.Mutex.Lock()
+	if sala.ServidorHost != s.MeuEndereco || sala.ServidorSombra == antigoHost || sala.Estado == "FINALIZADO" {
+		sala.Mutex.Unlock()
+		return
+	}
+	estado := s.criarEstadoDaSala(sala)
+	sala.Mutex.Unlock()
+
+	if !s.transferirParaSombra(antigoHost, estado) {
+		return
+	}
+	sala.Mutex.Lock()
+	anterior := sala.ServidorSombra
+	sala.ServidorSombra = antigoHost
+	sala.Mutex.Unlock()
+	log.Printf("[FAILOVER] Host anterior %s readmitido como Sombra da sala %s (época %d, Sombra anterior: %q)", antigoHost, sala.ID, estado.Epoca, anterior)
+}
+
+// elegerNovaSombra escolhe outro servidor ativo para ser a Sombra da sala e transfere
+// o EstadoPartida completo (com EventLog). Tenta novamente enquanto a partida não
+// terminar e nenhum candidato aceitar.
+func (s *Servidor) elegerNovaSombra(sala *tipos.Sala, antigoHost string) {
+	ticker := time.NewTicker(SOMBRA_NOVA_INTERVALO)
+	defer ticker.Stop()
+	for {
+		sala.Mutex.Lock()
+		if sala.ServidorHost != s.MeuEndereco || sala.ServidorSombra != "" || sala.Estado == "FINALIZADO" {
+			sala.Mutex.Unlock()
+			return
+		}
+		estado := s.criarEstadoDaSala(sala)
+		sala.Mutex.Unlock()
+
+		detector := s.ClusterManager.GetDetector()
+		for _, candidato := range s.ClusterManager.GetServidoresAtivos(s.MeuEndereco) {
+			if candidato == antigoHost || detector.Suspeito(candidato) {
+				continue
+			}
+			if !s.transferirParaSombra(candidato, estado) {
+				continue
+			}
+
+			sala.Mutex.Lock()
+			sala.ServidorSombra = candidato
+			sala.Mutex.Unlock()
+			log.Printf("[FAILOVER] %s é a nova Sombra da sala %s (eventSeq: %d)", candidato, sala.ID, estado.EventSeq)
+			return
+		}
+
+		log.Printf("[FAILOVER] Nenhum servidor disponível para ser Sombra da sala %s. Tentando novamente em %v.", sala.ID, SOMBRA_NOVA_INTERVALO)
+		<-ticker.C
+	}
+}
+
+// transferirParaSombra envia o estado da sala ao candidato via /partida/assumir_sombra.
+func (s *Servidor) transferirParaSombra(candidato string, estado *tipos.EstadoPartida) bool {
+	req := tipos.AssumirSombraRequest{Host: s.MeuEndereco, Estado: *estado}
+	url := fmt.Sprintf("http://%s/partida/assumir_sombra", candidato)
+	resp, err := s.enviarRequestComToken("POST", url, seguranca.MustJSON(req))
+	if err != nil {
+		log.Printf("[FAILOVER] Falha ao transferir a sala %s para %s: %v", estado.SalaID, candidato, err)
+		return false
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("[FAILOVER] %s recusou ser Sombra da sala %s (status %d)", candidato, estado.SalaID, resp.StatusCode)
+		return false
+	}
+	return true
+}
+
+// AssumirComoSombra é chamado pela API quando um Host escolhe este servidor como nova
+// Sombra: cria (ou atualiza) a sala a partir do estado recebido e passa a monitorar o Host.
+func (s *Servidor) AssumirComoSombra(host string, estado tipos.EstadoPartida) bool {
+	s.mutexSalas.Lock()
+	sala, existe := s.Salas[estado.SalaID]
+	if !existe {
+		sala = &tipos.Sala{
+			ID:            estado.SalaID,
+			CartasNaMesa:  make(map[string]Carta),
+			PontosRodada:  make(map[string]int),
+			PontosPartida: make(map[string]int),
+			Prontos:       make(map[string]bool),
+		}
+		s.Salas[estado.SalaID] = sala
+	}
+	s.mutexSalas.Unlock()
+
+	sala.Mutex.Lock()
+	if estado.Epoca < sala.Epoca {
+		sala.Mutex.Unlock()
+		log.Printf("[FAILOVER] %s pediu a Sombra da sala %s numa época vencida (%d < %d)", host, estado.SalaID, estado.Epoca, sala.Epoca)
+		return false
+	}
+	if estado.Epoca > sala.Epoca {
+		// Outro servidor assumiu a sala numa época nova: o estado dele substitui o local,
+		// mesmo que este servidor (Host antigo) tenha registrado eventos depois da troca
+		sala.EventSeq = 0
+		sala.Epoca = estado.Epoca
+		sala.HostAnterior = ""
+	}
+	var descartadas []tipos.GameEvent
+	if estado.EventSeq >= sala.EventSeq {
+		descartadas = jogadasDescartadas(sala.EventLog, estado.EventLog)
+	}
+	epoca := sala.Epoca
+	if len(sala.Jogadores) == 0 {
+		for _, j := range estado.Jogadores {
+			sala.Jogadores = append(sala.Jogadores, &tipos.Cliente{ID: j.ID, Nome: j.Nome})
+		}
+	}
+	sala.ServidorHost = host
+	sala.ServidorSombra = s.MeuEndereco
+	ultimoEstado := estado
+	sala.UltimoEstadoHost = &ultimoEstado
+	s.reconstruirEstadoDoHost(sala)
+	sala.Mutex.Unlock()
+	s.devolverJogadasDescartadas(estado.SalaID, epoca, descartadas)
+
+	log.Printf("[FAILOVER] Assumindo como Sombra da sala %s (Host: %s, eventSeq: %d)", estado.SalaID, host, estado.EventSeq)
+	if estado.Estado != "FINALIZADO" {
+		s.iniciarMonitorHost(estado.SalaID)
+	}
+	return true
+}
+
+// jogadasDescartadas devolve as jogadas do log local que não estão no log do Host que
+// o substitui: as que este servidor aceitou como Host depois de ter sido trocado numa
+// época nova.
+func jogadasDescartadas(local, novo []tipos.GameEvent) []tipos.GameEvent {
+	assinaturas := make(map[int64]string, len(novo))
+	for _, ev := range novo {
+		assinaturas[ev.EventSeq] = ev.Signature
+	}
+	descartadas := make([]tipos.GameEvent, 0)
+	for _, ev := range local {
+		if ev.EventType != partida.EVENTO_CARTA_JOGADA {
+			continue
+		}
+		if assinatura, existe := assinaturas[ev.EventSeq]; !existe || assinatura != ev.Signature {
+			descartadas = append(descartadas, ev)
+		}
+	}
+	return descartadas
+}
+
+// devolverJogadasDescartadas põe de volta na mão dos jogadores deste servidor as cartas
+// das jogadas descartadas, registra a devolução no livro-razão e avisa cada jogador
+// que a jogada não valeu.
+func (s *Servidor) devolverJogadasDescartadas(salaID string, epoca int64, descartadas []tipos.GameEvent) {
+	for _, ev := range descartadas {
+		jogador := s.getClienteLocal(ev.PlayerID)
+		if jogador == nil {
+			continue // A carta de um jogador remoto sai da mão no servidor dele
+		}
+		var dados partida.DadosCartaJogada
+		bruto, _ := json.Marshal(ev.Data)
+		if json.Unmarshal(bruto, &dados) != nil || dados.Carta.ID == "" {
+			continue
+		}
+		devolverCartaAMao(jogador, dados.Carta)
+		jogador.Mutex.Lock()
+		nome := jogador.Nome
+		jogador.Mutex.Unlock()
+		go s.salvarTransferencia([]string{jogador.ID}, []razao.Movimento{{
+			ID: idMovimentoPartida(salaID, epoca, dados.Carta.ID, razao.TIPO_DEVOLVIDA), Tipo: razao.TIPO_DEVOLVIDA, Carta: dados.Carta,
+			Para: jogador.ID, ParaNome: nome, Referencia: salaID,
+		}})
+		log.Printf("[FAILOVER] Jogada de %s com %s (eventSeq %d) descartada na sala %s: época vencida. Carta devolvida.", nome, dados.Carta.Nome, ev.EventSeq, salaID)
+		s.notificarErroPartida(jogador.ID, fmt.Sprintf("Sua jogada com %s foi descartada: a partida passou para outro servidor. A carta voltou para a sua mão.", dados.Carta.Nome), salaID)
+	}
+}
+
+// idMovimentoPartida é o ID do movimento de uma carta numa partida. A época entra no
+// ID para que uma carta devolvida por um failover possa ser consumida de novo.
+func idMovimentoPartida(salaID string, epoca int64, cartaID, tipo string) string {
+	return fmt.Sprintf("%s/%s/%s/%d", salaID, cartaID, tipo, epoca)
+}
+
+// reconstruirEstadoDoHost aplica na sala o último EstadoPartida recebido do Host.
+// Inventários de jogadores locais não são sobrescritos: este servidor é a fonte deles.
+// Assume o lock da sala ativo.
+func (s *Servidor) reconstruirEstadoDoHost(sala *tipos.Sala) {
+	estado := sala.UltimoEstadoHost
+	if estado == nil {
+		log.Printf("[FAILOVER] Nenhum estado do Host recebido para a sala %s. Mantendo estado local.", sala.ID)
+		return
+	}
+	if estado.EventSeq < sala.EventSeq {
+		log.Printf("[FAILOVER] Estado do Host (eventSeq %d) mais antigo que o local (%d). Mantendo estado local.", estado.EventSeq, sala.EventSeq)
+		return
+	}
+
+	// O estado é refeito a partir do log; a cópia dos campos fica só para logs inválidos
+	if reconstruida, err := game.Reconstruir(sala.ID, sala.Jogadores, estado.EventLog); err == nil && reconstruida.EventSeq == estado.EventSeq {
+		game.CopiarEstado(sala, reconstruida)
+	} else {
+		log.Printf("[FAILOVER] Replay do log da sala %s falhou (%v). Usando os campos do estado do Host.", sala.ID, err)
+		sala.Estado = estado.Estado
+		sala.NumeroRodada = estado.NumeroRodada
+		sala.EventSeq = estado.EventSeq
+		sala.EventLog = estado.EventLog
+		sala.TurnoDe = estado.TurnoDe
+		if estado.CartasNaMesa != nil {
+			sala.CartasNaMesa = estado.CartasNaMesa
+		}
+		if estado.PontosRodada != nil {
+			sala.PontosRodada = estado.PontosRodada
+		}
+		if estado.PontosPartida != nil {
+			sala.PontosPartida = estado.PontosPartida
+		}
+		if estado.Prontos != nil {
+			sala.Prontos = estado.Prontos
+		}
+	}
+
+	sala.PrazoTurno = estado.PrazoTurno
+	if estado.Serie != nil {
+		sala.Serie = estado.Serie
+	}
+
+	for _, jogadorEstado := range estado.Jogadores {
+		if s.getClienteLocal(jogadorEstado.ID) != nil {
+			continue
+		}
+		for _, j := range sala.Jogadores {
+			if j.ID == jogadorEstado.ID {
+				j.Inventario = jogadorEstado.Inventario
+			}
+		}
+	}
+	log.Printf("[FAILOVER] Sala %s reconstruída a partir do estado do Host (rodada %d, eventSeq %d)", sala.ID, sala.NumeroRodada, sala.EventSeq)
+}
+
+// enviarEstadoInicialParaSombra envia à Sombra o estado da partida recém-iniciada via
+// /partida/iniciar_remoto. Apenas os inventários dos jogadores deste servidor vão
+// junto, para não sobrescrever os dos jogadores da Sombra.
+func (s *Servidor) enviarEstadoInicialParaSombra(sala *tipos.Sala, sombraAddr string) {
+	sala.Mutex.Lock()
+	estado := s.criarEstadoDaSala(sala)
+	sala.Mutex.Unlock()
+
+	jogadoresLocais := make([]tipos.JogadorEstado, 0, len(estado.Jogadores))
+	for _, j := range estado.Jogadores {
+		if s.getClienteLocal(j.ID) != nil {
+			jogadoresLocais = append(jogadoresLocais, j)
+		}
+	}
+	estado.Jogadores = jogadoresLocais
+
+	url := fmt.Sprintf("http://%s/partida/iniciar_remoto", sombraAddr)
+	resp, err := s.enviarRequestComToken("POST", url, seguranca.MustJSON(estado))
+	if err != nil {
+		log.Printf("[SYNC_SOMBRA] Falha ao enviar estado inicial da sala %s para %s: %v", sala.ID, sombraAddr, err)
+		return
+	}
+	resp.Body.Close()
+	log.Printf("[SYNC_SOMBRA] Estado inicial da sala %s enviado para a Sombra %s (status %d)", sala.ID, sombraAddr, resp.StatusCode)
+}
+
+// iniciarMonitorHost inicia (uma única vez por sala) o monitoramento do Host pela Sombra.
+func (s *Servidor) iniciarMonitorHost(salaID string) {
+	s.mutexSalas.Lock()
+	if s.salasMonitoradas[salaID] {
+		s.mutexSalas.Unlock()
+		return
+	}
+	s.salasMonitoradas[salaID] = true
+	s.mutexSalas.Unlock()
+
+	log.Printf("[FAILOVER] Monitorando o Host da sala %s", salaID)
+	go s.monitorarHostDaSala(salaID)
+}
+
+// monitorarHostDaSala verifica periodicamente se o Host ainda atende a sala e promove
+// esta Sombra quando o detector de falhas suspeita do Host ou ele deixa de responder.
+func (s *Servidor) monitorarHostDaSala(salaID string) {
+	defer func() {
+		s.mutexSalas.Lock()
+		delete(s.salasMonitoradas, salaID)
+		s.mutexSalas.Unlock()
+	}()
+
+	falhas := 0
+	ticker := time.NewTicker(HOST_MONITOR_INTERVALO)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutexSalas.RLock()
+		sala := s.Salas[salaID]
+		s.mutexSalas.RUnlock()
+		if sala == nil {
+			return
+		}
+
+		sala.Mutex.Lock()
+		host := sala.ServidorHost
+		souSombra := sala.ServidorSombra == s.MeuEndereco
+		finalizada := sala.Estado == "FINALIZADO"
+		sala.Mutex.Unlock()
+		if !souSombra || host == s.MeuEndereco || finalizada {
+			return
+		}
+
+		if s.ClusterManager.GetDetector().Suspeito(host) {
+			log.Printf("[FAILOVER] Detector suspeita do Host %s da sala %s. Assumindo a partida.", host, salaID)
+			s.promoverSombraAHost(sala)
+			return
+		}
+		atende, sombraDoHost := s.hostAtendeSala(host, salaID)
+		if atende && sombraDoHost != "" && sombraDoHost != s.MeuEndereco {
+			// O Host readmitiu outro servidor como Sombra (ex.: o Host anterior da sala)
+			log.Printf("[FAILOVER] %s agora é a Sombra da sala %s. Deixando de monitorar o Host.", sombraDoHost, salaID)
+			sala.Mutex.Lock()
+			if sala.ServidorSombra == s.MeuEndereco {
+				sala.ServidorSombra = sombraDoHost
+			}
+			sala.Mutex.Unlock()
+			return
+		}
+		if atende {
+			falhas = 0
+			continue
+		}
+		falhas++
+		log.Printf("[FAILOVER] Host %s não respondeu pela sala %s (%d/%d)", host, salaID, falhas, HOST_FALHAS_MAXIMAS)
+		if falhas >= HOST_FALHAS_MAXIMAS {
+			s.promoverSombraAHost(sala)
+			return
+		}
+	}
+}
+
+// hostAtendeSala consulta /partida/status no Host e devolve também a Sombra que ele
+// registra para a sala. Um 404 também conta como falha: o Host reiniciou e perdeu a sala.
+func (s *Servidor) hostAtendeSala(host, salaID string) (bool, string) {
+	url := fmt.Sprintf("http://%s/partida/status/%s", host, salaID)
+	resp, err := s.enviarRequestComTokenPrazo("GET", url, nil, HOST_STATUS_TIMEOUT)
+	if err != nil {
+		return false, ""
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, ""
+	}
+	var status struct {
+		Sombra string `json:"sombra"`
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	return true, status.Sombra
+}
+
+// GetStatusSala resume o estado de uma sala hospedada neste servidor.
+func (s *Servidor) GetStatusSala(salaID string) (string, int64, string, bool) {
+	s.mutexSalas.RLock()
+	sala, ok := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+	if !ok {
+		return "", 0, "", false
+	}
+	sala.Mutex.Lock()
+	defer sala.Mutex.Unlock()
+	return sala.Estado, sala.EventSeq, sala.ServidorSombra, true
+}
+
+// GetReplaySala exporta o log de uma partida em JSON Lines (ver game.ExportarReplay).
+// Devolve também o estado da sala, para que quem chama recuse partidas não finalizadas.
+func (s *Servidor) GetReplaySala(salaID string) ([]byte, string, bool) {
+	s.mutexSalas.RLock()
+	sala, ok := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+	if !ok {
+		// Salas coletadas continuam disponíveis no histórico
+		if conteudo, arquivada := s.Historico.Replay(salaID); arquivada {
+			return conteudo, "FINALIZADO", true
 		}
+		return nil, "", false
 	}
 
-	if cartaIndex == -1 {
-		cliente.Mutex.Unlock()
-		log.Printf("[SHADOW] Carta %s não encontrada no inventário de %s", cartaID, clienteID)
-		return
+	sala.Mutex.Lock()
+	defer sala.Mutex.Unlock()
+	if sala.Estado != "FINALIZADO" {
+		return nil, sala.Estado, true
 	}
-	// Remove a carta do inventário local ANTES de enviar ao Host
-	cliente.Inventario = append(cliente.Inventario[:cartaIndex], cliente.Inventario[cartaIndex+1:]...)
-	cliente.Mutex.Unlock()
 
-	// Usa o novo endpoint /game/event
-	req := tipos.GameEventRequest{
-		MatchID:   sala.ID,
-		EventSeq:  eventSeq,
-		EventType: "CARD_PLAYED",
-		PlayerID:  clienteID,
-		Data: map[string]interface{}{
-			"carta_id":       cartaID,
-			"carta_nome":     carta.Nome,
-			"carta_naipe":    carta.Naipe,
-			"carta_valor":    carta.Valor,
-			"carta_raridade": carta.Raridade,
-		},
-		Token: seguranca.GenerateJWT(s.ServerID),
+	var buf bytes.Buffer
+	if err := game.ExportarReplay(&buf, sala); err != nil {
+		log.Printf("[REPLAY:%s] Erro ao exportar replay: %v", salaID, err)
+		return nil, sala.Estado, true
 	}
+	return buf.Bytes(), sala.Estado, true
+}
 
-	// Gera assinatura
-	event := tipos.GameEvent{
-		EventSeq:  req.EventSeq,
-		MatchID:   req.MatchID,
-		EventType: req.EventType,
-		PlayerID:  req.PlayerID,
+// enviarReplayParaCliente envia ao jogador o replay da partida pelo tópico privado dele
+func (s *Servidor) enviarReplayParaCliente(sala *tipos.Sala, clienteID string) {
+	sala.Mutex.Lock()
+	participou := false
+	for _, j := range sala.Jogadores {
+		if j.ID == clienteID {
+			participou = true
+			break
+		}
 	}
-	seguranca.SignEvent(&event)
-	req.Signature = event.Signature
-
-	jsonData, _ := json.Marshal(req)
-	url := fmt.Sprintf("http://%s/game/event", host)
-
-	// Adiciona timeout para detectar falha do Host
-	httpClient := &http.Client{
-		Timeout: 15 * time.Second,
+	sala.Mutex.Unlock()
+	if !participou {
+		log.Printf("[REPLAY:%s] Cliente %s não participou da partida. Ignorando pedido.", sala.ID, clienteID)
+		return
 	}
 
-	// Adiciona header de autenticação
-	httpReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+req.Token)
-
-	resp, err := httpClient.Do(httpReq)
-	if err != nil {
-		log.Printf("[FAILOVER] Host %s inacessível: %v. Iniciando promoção da Sombra...", host, err)
-		s.promoverSombraAHost(sala)
-
-		// CORREÇÃO: Processa o evento 'req' que já foi criado nesta função (na linha 1182)
-		s.processarEventoComoHost(sala, &req)
-
+	conteudo, estado, _ := s.GetReplaySala(sala.ID)
+	if estado != "FINALIZADO" {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "O replay só fica disponível quando a partida termina."})})
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("[SHADOW] Host retornou status %d ao processar jogada", resp.StatusCode)
+	if conteudo == nil {
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "ERRO", Dados: seguranca.MustJSON(protocolo.DadosErro{Mensagem: "Não foi possível exportar o replay."})})
 		return
 	}
 
-	log.Printf("[SHADOW] Jogada processada pelo Host com sucesso")
+	log.Printf("[REPLAY:%s] Enviando replay (%d bytes) para %s", sala.ID, len(conteudo), clienteID)
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{
+		Comando: "REPLAY_PARTIDA",
+		Dados:   seguranca.MustJSON(protocolo.DadosReplayPartida{SalaID: sala.ID, Conteudo: string(conteudo)}),
+	})
+}
 
-	// CORREÇÃO: Remove a carta do inventário APENAS após confirmação do Host
-	cliente.Mutex.Lock()
-	// Remove a carta que foi jogada
-	cartaIndex = -1
-	for i, c := range cliente.Inventario {
-		if c.ID == cartaID {
-			cartaIndex = i
+// enviarReplayArquivado envia a um participante o replay de uma partida que já saiu da memória
+func (s *Servidor) enviarReplayArquivado(salaID, clienteID string) {
+	resumo, _ := s.Historico.Resumo(salaID)
+	participou := false
+	for _, j := range resumo.Jogadores {
+		if j.ID == clienteID {
+			participou = true
 			break
 		}
 	}
-	if cartaIndex != -1 {
-		cliente.Inventario = append(cliente.Inventario[:cartaIndex], cliente.Inventario[cartaIndex+1:]...)
-		log.Printf("[SHADOW] Carta %s removida do inventário de %s", cartaID, clienteID)
+	conteudo, ok := s.Historico.Replay(salaID)
+	if !participou || !ok {
+		log.Printf("[REPLAY:%s] Pedido de %s ignorado (participou: %v, arquivo: %v)", salaID, clienteID, participou, ok)
+		return
 	}
-	cliente.Mutex.Unlock()
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{
+		Comando: "REPLAY_PARTIDA",
+		Dados:   seguranca.MustJSON(protocolo.DadosReplayPartida{SalaID: salaID, Conteudo: string(conteudo)}),
+	})
 }
 
-// promoverSombraAHost promove a Sombra a Host quando o Host original falha
-func (s *Servidor) promoverSombraAHost(sala *tipos.Sala) {
-	sala.Mutex.Lock()
-	defer sala.Mutex.Unlock()
+// GetHistoricoJogador lista as partidas do jogador arquivadas neste servidor
+func (s *Servidor) GetHistoricoJogador(clienteID string) []historico.Resumo {
+	return s.Historico.PartidasDoJogador(clienteID)
+}
 
-	if sala.ServidorHost == s.MeuEndereco {
-		return // Já sou o host, não fazer nada
-	}
+// coletarSalasFinalizadas arquiva no histórico as salas finalizadas há mais de
+// SALA_RETENCAO_FINALIZADA (tempo para pedidos de replay e mensagens atrasadas) e as
+// remove da memória. A primeira passagem só marca quando a sala foi vista finalizada,
+// o que vale igual para Host e Sombra.
+func (s *Servidor) coletarSalasFinalizadas() {
+	ticker := time.NewTicker(SALA_GC_INTERVALO)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutexSalas.RLock()
+		salas := make([]*tipos.Sala, 0, len(s.Salas))
+		for _, sala := range s.Salas {
+			salas = append(salas, sala)
+		}
+		s.mutexSalas.RUnlock()
 
-	antigoHost := sala.ServidorHost
-	sala.ServidorHost = s.MeuEndereco
-	sala.ServidorSombra = "" // Eu sou o novo Host
+		agora := time.Now()
+		for _, sala := range salas {
+			sala.Mutex.Lock()
+			if sala.Estado != "FINALIZADO" {
+				sala.Mutex.Unlock()
+				continue
+			}
+			if sala.FinalizadaEm.IsZero() {
+				sala.FinalizadaEm = agora
+			}
+			if agora.Sub(sala.FinalizadaEm) < SALA_RETENCAO_FINALIZADA {
+				sala.Mutex.Unlock()
+				continue
+			}
+			err := s.Historico.Arquivar(sala)
+			salaID := sala.ID
+			sala.Mutex.Unlock()
 
-	log.Printf("[FAILOVER] Sombra promovida a Host para a sala %s. Antigo Host: %s", sala.ID, antigoHost)
+			if err != nil {
+				log.Printf("[GC_SALAS:%s] Erro ao arquivar a sala %s (nova tentativa no próximo ciclo): %v", s.ServerID, salaID, err)
+				continue
+			}
+			s.removerSala(salaID)
+			log.Printf("[GC_SALAS:%s] Sala %s arquivada e removida da memória", s.ServerID, salaID)
+		}
+	}
+}
 
-	// Notifica jogadores da promoção
-	msg := protocolo.Mensagem{
-		Comando: "ATUALIZACAO_JOGO",
-		Dados: seguranca.MustJSON(protocolo.DadosAtualizacaoJogo{
-			MensagemDoTurno: "O servidor da partida falhou. A partida continuará em um servidor reserva.",
-		}),
+// promoverSalasDoHostSuspeito é chamado pelo detector de falhas do cluster quando um
+// servidor passa a ser suspeito: assume as partidas em andamento em que este servidor
+// é a Sombra daquele Host.
+func (s *Servidor) promoverSalasDoHostSuspeito(endereco string, phi float64) {
+	s.mutexSalas.RLock()
+	salas := make([]*tipos.Sala, 0)
+	for _, sala := range s.Salas {
+		sala.Mutex.Lock()
+		if sala.ServidorHost == endereco && sala.ServidorSombra == s.MeuEndereco && sala.Estado != "FINALIZADO" {
+			salas = append(salas, sala)
+		}
+		sala.Mutex.Unlock()
+	}
+	s.mutexSalas.RUnlock()
+
+	for _, sala := range salas {
+		log.Printf("[FAILOVER] Host %s suspeito (phi %.2f). Promovendo Sombra da sala %s.", endereco, phi, sala.ID)
+		s.promoverSombraAHost(sala)
 	}
-	s.publicarEventoPartida(sala.ID, msg)
 }
 
 // (No arquivo servidor/main.go)
@@ -1668,10 +3911,6 @@ func (s *Servidor) processarEventoComoHost(sala *tipos.Sala, evento *tipos.GameE
 		}
 	}
 
-	// O Host define o eventSeq oficial
-	sala.EventSeq++
-	currentEventSeq := sala.EventSeq
-
 	// Encontra o cliente
 	var jogador *tipos.Cliente
 	var nomeJogador string
@@ -1687,25 +3926,17 @@ func (s *Servidor) processarEventoComoHost(sala *tipos.Sala, evento *tipos.GameE
 		return nil
 	}
 
-	// Registra o evento no log (agora genérico)
-	logEvent := tipos.GameEvent{
-		EventSeq:  currentEventSeq, // Usa o eventSeq oficial do Host
-		MatchID:   sala.ID,
-		Timestamp: time.Now(),
-		EventType: evento.EventType,
-		PlayerID:  evento.PlayerID,
-		Data:      evento.Data,
-	}
-	seguranca.SignEvent(&logEvent)
-	sala.EventLog = append(sala.EventLog, logEvent)
+	// Monta os dados do evento que vai para o log. O estado só muda ao aplicar o
+	// evento pelo redutor (game.Aplicar), para que o log baste para reconstruí-lo.
+	tipoEvento := evento.EventType
+	dadosEvento := evento.Data
+	var cartaRetirada *tipos.Cliente // Jogador local de quem a carta jogada saiu
 
-	// --- LÓGICA DE CADA EVENTO ---
 	switch evento.EventType {
 
-	case "PLAYER_READY":
-		sala.Prontos[nomeJogador] = true
-		log.Printf("[HOST] Jogador %s (%s) está PRONTO (evento recebido). Prontos: %d/%d", nomeJogador, evento.PlayerID, len(sala.Prontos), len(sala.Jogadores))
-		// CORREÇÃO: A verificação NÃO acontece aqui para evitar deadlock.
+	case partida.EVENTO_JOGADOR_PRONTO:
+		log.Printf("[HOST] Jogador %s (%s) está PRONTO (evento recebido).", nomeJogador, evento.PlayerID)
+		// CORREÇÃO: A verificação de início NÃO acontece aqui para evitar deadlock.
 		// Será feita após liberar o lock.
 
 	case "CHAT":
@@ -1727,6 +3958,9 @@ func (s *Servidor) processarEventoComoHost(sala *tipos.Sala, evento *tipos.GameE
 		// (A função broadcastChat deve ser atualizada para publicar no MQTT da partida)
 		go s.retransmitirChat(sala, jogador, texto)
 
+	case partida.EVENTO_DESISTENCIA:
+		log.Printf("[HOST] Jogador %s (%s) perdeu por desistência.", nomeJogador, evento.PlayerID)
+
 	case "JOGAR_CARTA", "CARD_PLAYED": // Aceita ambos os tipos por compatibilidade
 		// CORREÇÃO: Primeiro, faça a asserção de tipo do 'Data' para um map
 		dadosDoEvento, ok := evento.Data.(map[string]interface{})
@@ -1750,30 +3984,24 @@ func (s *Servidor) processarEventoComoHost(sala *tipos.Sala, evento *tipos.GameE
 		// CORREÇÃO: Verificar se é jogador local ou remoto
 		// Se o jogador está no mapa local de clientes, é local. Caso contrário, é remoto (Shadow).
 		s.mutexClientes.RLock()
-		_, jogadorLocal := s.Clientes[evento.PlayerID]
+		local, jogadorLocal := s.Clientes[evento.PlayerID]
 		s.mutexClientes.RUnlock()
 
 		var carta Carta
 
-		// CORREÇÃO: Apenas tenta remover do inventário local se o jogador for local
+		// Jogador local: a carta sai da mão junto com a conferência da reserva de troca.
+		// Se o redutor recusar a jogada (abaixo), ela volta, para que uma jogada
+		// inválida não custe a carta.
 		if jogadorLocal {
-			jogador.Mutex.Lock()
-			cartaIndex := -1
-			for i, c := range jogador.Inventario {
-				if c.ID == cartaID {
-					carta = c
-					cartaIndex = i
-					break
-				}
-			}
-			if cartaIndex == -1 {
-				jogador.Mutex.Unlock()
-				log.Printf("[HOST] Carta %s não encontrada no inventário de %s (jogador local)", cartaID, nomeJogador)
+			var err error
+			carta, err = tirarCartaDaMao(s.ReservasTroca, local, cartaID)
+			if err != nil {
+				log.Printf("[HOST] Jogada de %s recusada (jogador local): %v", nomeJogador, err)
+				s.notificarErroPartida(evento.PlayerID, fmt.Sprintf("Jogada recusada: %v.", err), sala.ID)
 				return nil
 			}
-			jogador.Inventario = append(jogador.Inventario[:cartaIndex], jogador.Inventario[cartaIndex+1:]...)
-			jogador.Mutex.Unlock()
-			log.Printf("[HOST] Jogador local %s jogou carta %s (Poder: %d) - eventSeq: %d", nomeJogador, carta.Nome, carta.Valor, currentEventSeq)
+			cartaRetirada = local
+			log.Printf("[HOST] Jogador local %s jogou carta %s (Poder: %d)", nomeJogador, carta.Nome, carta.Valor)
 		} else {
 			// Jogador remoto - apenas obtém os dados da carta do evento
 			// O Shadow já validou e removeu a carta do inventário do jogador remoto
@@ -1789,27 +4017,61 @@ func (s *Servidor) processarEventoComoHost(sala *tipos.Sala, evento *tipos.GameE
 				Valor:    int(cartaValor),
 				Raridade: cartaRaridade,
 			}
-			log.Printf("[HOST] Jogador remoto %s jogou carta %s (Poder: %d) - eventSeq: %d", nomeJogador, carta.Nome, carta.Valor, currentEventSeq)
+			log.Printf("[HOST] Jogador remoto %s jogou carta %s (Poder: %d)", nomeJogador, carta.Nome, carta.Valor)
 		}
 
-		sala.CartasNaMesa[nomeJogador] = carta
+		// Uma jogada do próprio jogador zera a contagem de prazos esgotados. A marca de
+		// jogada automática só é posta por um servidor, nunca lida dos dados do cliente.
+		automatica := evento.Automatica
+		if !automatica {
+			delete(sala.TurnosExpirados, evento.PlayerID)
+		}
 
-		if len(sala.CartasNaMesa) == len(sala.Jogadores) {
-			vencedorJogada = s.resolverJogada(sala)
-		} else {
-			for _, j := range sala.Jogadores {
-				if j.ID != evento.PlayerID {
-					log.Printf("[TURNO:%s] Jogador %s jogou. Próximo a jogar: %s (%s)", sala.ID, evento.PlayerID, j.Nome, j.ID)
-					s.mudarTurnoAtomicamente(sala, j.ID)
-					break
-				}
-			}
+		// O fim da partida depende dos inventários, que não estão no log: o Host
+		// decide aqui e registra a decisão no próprio evento.
+		fechaMesa := len(sala.CartasNaMesa)+1 == len(sala.Jogadores)
+		tipoEvento = partida.EVENTO_CARTA_JOGADA
+		dadosEvento = partida.DadosCartaJogada{
+			Carta:          carta,
+			EncerraPartida: fechaMesa && s.jogadoresSemCartas(sala, evento.PlayerID, cartaID),
+			Automatica:     automatica,
+		}
+	} // Fim do switch
+
+	// O Host define o eventSeq oficial e aplica o evento
+	logEvent, vencedor, err := s.registrarEvento(sala, tipoEvento, evento.PlayerID, dadosEvento)
+	if err != nil {
+		log.Printf("[EVENTO_HOST:%s] Evento %s rejeitado pelo redutor: %v", sala.ID, tipoEvento, err)
+		if jogada, ok := dadosEvento.(partida.DadosCartaJogada); ok && cartaRetirada != nil {
+			devolverCartaAMao(cartaRetirada, jogada.Carta)
+		}
+		s.notificarErroPartida(evento.PlayerID, "Jogada inválida.", sala.ID)
+		return nil
+	}
+	vencedorJogada = vencedor
+	currentEventSeq := logEvent.EventSeq
+
+	if tipoEvento == partida.EVENTO_CARTA_JOGADA {
+		if jogada, ok := dadosEvento.(partida.DadosCartaJogada); ok && cartaRetirada != nil {
+			s.registrarConsumoLocal(sala, cartaRetirada, jogada.Carta)
+		}
+		if vencedorJogada == "" {
+			log.Printf("[TURNO:%s] Jogador %s jogou. Próximo a jogar: %s", sala.ID, evento.PlayerID, sala.TurnoDe)
 			// CORREÇÃO: Chama em goroutine para não bloquear o lock da sala
 			// A função notificarAguardandoOponente já não requer lock ativo
 			go s.notificarAguardandoOponente(sala) // Notifica que a jogada foi feita, mas espera o outro
+		} else {
+			log.Printf("[TURNO:%s] Vencedor da jogada: %s. Próximo turno: %s (eventSeq: %d)", sala.ID, vencedorJogada, sala.TurnoDe, currentEventSeq)
+			if sala.Estado == "FINALIZADO" {
+				log.Printf("[FINALIZACAO:%s] Ambos os jogadores ficaram sem cartas. Finalizando partida.", sala.ID)
+				s.finalizarPartida(sala)
+			}
 		}
-
-	} // Fim do switch
+	}
+	if tipoEvento == partida.EVENTO_DESISTENCIA {
+		log.Printf("[FINALIZACAO:%s] Partida encerrada por desistência de %s (%s).", sala.ID, nomeJogador, sala.MotivoFim)
+		s.finalizarPartida(sala)
+	}
 
 	// --- REPLICAÇÃO ---
 	estado := &tipos.EstadoPartida{
@@ -1824,167 +4086,536 @@ func (s *Servidor) processarEventoComoHost(sala *tipos.Sala, evento *tipos.GameE
 		EventLog:       sala.EventLog,
 		TurnoDe:        sala.TurnoDe,
 		VencedorJogada: vencedorJogada, // Adiciona o vencedor ao estado retornado
+		Hash:           game.HashSala(sala),
+		PrazoTurno:     sala.PrazoTurno,
+		Serie:          sala.Serie,
+		Epoca:          sala.Epoca,
 	}
 
 	if sala.ServidorSombra != "" && sala.ServidorSombra != s.MeuEndereco {
 		go s.replicarEstadoParaShadow(sala.ServidorSombra, estado)
 	}
 
-	// (A lógica de notificação que estava aqui foi movida para dentro do case "CARD_PLAYED"
-	// ou é tratada pela replicação/broadcast)
-
 	return estado
 }
 
+// tirarCartaDaMao tira a carta do inventário do jogador para jogá-la. Falha se ela
+// não está no inventário ou está reservada para uma troca; a reserva é conferida sob
+// o lock do jogador, o mesmo que reservarCartaParaTroca usa, então uma carta não
+// pode ser reservada entre a conferência e a retirada.
+func tirarCartaDaMao(reservas *troca.Reservas, jogador *tipos.Cliente, cartaID string) (Carta, error) {
+	jogador.Mutex.Lock()
+	defer jogador.Mutex.Unlock()
+	if reservas.Reservada(jogador.ID, cartaID) {
+		return Carta{}, fmt.Errorf("a carta está reservada para uma troca em andamento")
+	}
+	for i, c := range jogador.Inventario {
+		if c.ID == cartaID {
+			jogador.Inventario = append(jogador.Inventario[:i:i], jogador.Inventario[i+1:]...)
+			return c, nil
+		}
+	}
+	return Carta{}, fmt.Errorf("a carta não está no seu inventário")
+}
+
+// devolverCartaAMao põe de volta a carta de uma jogada recusada pelo redutor
+func devolverCartaAMao(jogador *tipos.Cliente, carta Carta) {
+	jogador.Mutex.Lock()
+	defer jogador.Mutex.Unlock()
+	if !temCarta(jogador.Inventario, carta.ID) {
+		jogador.Inventario = append(jogador.Inventario, carta)
+	}
+}
+
+// registrarConsumoLocal registra no livro-razão a carta de uma jogada já aceita pelo
+// redutor, tirada da mão do jogador deste servidor por tirarCartaDaMao (a de um
+// jogador remoto é registrada pela Sombra). Assume o lock da sala ativo.
+func (s *Servidor) registrarConsumoLocal(sala *tipos.Sala, jogador *tipos.Cliente, carta Carta) {
+	jogador.Mutex.Lock()
+	nome := jogador.Nome
+	jogador.Mutex.Unlock()
+	go s.salvarTransferencia([]string{jogador.ID}, []razao.Movimento{{
+		ID: idMovimentoPartida(sala.ID, sala.Epoca, carta.ID, razao.TIPO_CONSUMIDA), Tipo: razao.TIPO_CONSUMIDA, Carta: carta,
+		De: jogador.ID, DeNome: nome, Referencia: sala.ID,
+	}})
+}
+
 // replicarEstadoParaShadow replica o estado para o servidor Shadow usando o endpoint /game/replicate
 func (s *Servidor) replicarEstadoParaShadow(shadowAddr string, estado *tipos.EstadoPartida) {
 	req := tipos.GameReplicateRequest{
 		MatchID:  estado.SalaID,
 		EventSeq: estado.EventSeq,
 		State:    *estado,
+		Host:     s.MeuEndereco,
 		Token:    seguranca.GenerateJWT(s.ServerID),
 	}
 
-	// Gera assinatura
-	data := fmt.Sprintf("%s:%d", req.MatchID, req.EventSeq)
-	req.Signature = seguranca.GenerateHMAC(data, JWT_SECRET)
+	// Gera assinatura
+	data := fmt.Sprintf("%s:%d", req.MatchID, req.EventSeq)
+	req.Signature = seguranca.GenerateHMAC(data, JWT_SECRET)
+
+	jsonData, _ := json.Marshal(req)
+	url := fmt.Sprintf("http://%s/game/replicate", shadowAddr)
+
+	httpClient := &http.Client{Timeout: 15 * time.Second}
+
+	httpReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Authorization", "Bearer "+req.Token)
+
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		log.Printf("[HOST] Erro ao replicar estado para Shadow %s: %v", shadowAddr, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		log.Printf("[HOST] Estado replicado com sucesso para Shadow %s (eventSeq: %d)", shadowAddr, estado.EventSeq)
+		return
+	}
+	log.Printf("[HOST] Shadow %s retornou status %d ao receber replicação", shadowAddr, resp.StatusCode)
+	if resp.StatusCode == http.StatusConflict {
+		var recusa struct {
+			Epoca int64  `json:"epoca"`
+			Host  string `json:"host"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&recusa) == nil && recusa.Epoca > estado.Epoca && recusa.Host != "" {
+			s.rebaixarComoHost(estado.SalaID, recusa.Host, recusa.Epoca)
+		}
+	}
+}
+
+// rebaixarComoHost deixa de atender a sala como Host quando a Sombra assumiu numa
+// época mais nova (este servidor foi dado como falho) e adota essa época, para que
+// as jogadas encaminhadas daqui em diante não sejam recusadas pelo novo Host. Os
+// eventos registrados aqui depois da troca são descartados: o novo Host manda o
+// estado dele em seguida (readmitirAntigoHost) e, em AssumirComoSombra, as jogadas
+// descartadas voltam para a mão dos jogadores com um aviso.
+func (s *Servidor) rebaixarComoHost(salaID, novoHost string, epoca int64) {
+	s.mutexSalas.RLock()
+	sala := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+	if sala == nil {
+		return
+	}
+	sala.Mutex.Lock()
+	if sala.ServidorHost != s.MeuEndereco || sala.Epoca >= epoca {
+		sala.Mutex.Unlock()
+		return
+	}
+	sala.ServidorHost = novoHost
+	sala.ServidorSombra = s.MeuEndereco
+	sala.HostAnterior = ""
+	sala.Epoca = epoca
+	// O log local passa a valer menos que qualquer estado do novo Host, que o substitui ao chegar
+	sala.EventSeq = 0
+	sala.Mutex.Unlock()
+	log.Printf("[FAILOVER] %s assumiu a sala %s na época %d. Deixando de atuar como Host.", novoHost, salaID, epoca)
+}
+
+// registrarEvento cria o próximo evento do log da sala, aplica-o pelo redutor
+// game.Aplicar e, se for válido, adiciona-o ao EventLog. Assume o lock da sala ativo.
+func (s *Servidor) registrarEvento(sala *tipos.Sala, tipo, playerID string, dados interface{}) (tipos.GameEvent, string, error) {
+	ev := tipos.GameEvent{
+		EventSeq:  sala.EventSeq + 1,
+		MatchID:   sala.ID,
+		Timestamp: time.Now(),
+		EventType: tipo,
+		PlayerID:  playerID,
+		Data:      dados,
+	}
+	seguranca.SignEvent(&ev)
+
+	vencedorJogada, err := game.Aplicar(sala, ev)
+	if err != nil {
+		return ev, "", err
+	}
+	sala.EventLog = append(sala.EventLog, ev)
+
+	// O prazo do turno é relógio do Host e não faz parte do log; chat não muda o turno
+	if tipo != partida.EVENTO_CHAT {
+		if sala.Estado == "JOGANDO" {
+			sala.PrazoTurno = time.Now().Add(s.duracaoTurno)
+		} else {
+			sala.PrazoTurno = time.Time{}
+		}
+	}
+	return ev, vencedorJogada, nil
+}
+
+// jogadoresSemCartas diz se nenhum jogador da sala tem mais cartas depois da jogada
+// de `cartaID` por `jogadorID`. A carta de um jogador local já saiu da mão
+// (tirarCartaDaMao); a cópia que o Host tem do inventário de um jogador remoto ainda
+// pode trazê-la, e por isso ela não é contada.
+func (s *Servidor) jogadoresSemCartas(sala *tipos.Sala, jogadorID, cartaID string) bool {
+	for _, j := range sala.Jogadores {
+		// Busca jogadores do mapa global para contagem atualizada
+		s.mutexClientes.RLock()
+		jGlobal := s.Clientes[j.ID]
+		s.mutexClientes.RUnlock()
+		if jGlobal == nil {
+			jGlobal = j
+		}
+
+		jGlobal.Mutex.Lock()
+		cartas := len(jGlobal.Inventario)
+		if j.ID == jogadorID {
+			for _, c := range jGlobal.Inventario {
+				if c.ID == cartaID {
+					cartas--
+					break
+				}
+			}
+		}
+		jGlobal.Mutex.Unlock()
+
+		log.Printf("[VERIFICACAO_CARTAS:%s] %s tem %d cartas", sala.ID, j.Nome, cartas)
+		// Em partidas cross-server, o inventário do jogador remoto pode estar vazio no Host,
+		// então só finaliza se AMBOS tiverem 0 cartas
+		if cartas > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ==================== LOBBY ====================
+
+// sairDaSala trata o pedido de um jogador para deixar a sala. No lobby, a sala é
+// cancelada e o outro jogador volta para a fila; com a partida em andamento, quem
+// sai perde por abandono. Só o Host chama.
+func (s *Servidor) sairDaSala(sala *tipos.Sala, clienteID string) {
+	sala.Mutex.Lock()
+	estado := sala.Estado
+	sala.Mutex.Unlock()
+
+	switch estado {
+	case "AGUARDANDO_COMPRA":
+		s.cancelarLobby(sala, clienteID, MOTIVO_LOBBY_CANCELADO)
+	case "JOGANDO":
+		s.processarEventoComoHost(sala, &tipos.GameEventRequest{
+			MatchID:   sala.ID,
+			EventType: partida.EVENTO_DESISTENCIA,
+			PlayerID:  clienteID,
+			Data:      map[string]interface{}{"motivo": partida.MOTIVO_ABANDONO},
+		})
+	default:
+		s.notificarErroPartida(clienteID, "A partida já terminou.", sala.ID)
+	}
+}
+
+// cancelarLobby encerra uma sala que não chegou a começar. `saiu` é o jogador que
+// cancelou (vazio quando o prazo de compra esgotou). Voltam para a fila o outro
+// jogador, no cancelamento, ou quem já tinha comprado, no prazo esgotado; numa sala
+// privada ninguém volta para a fila pública.
+func (s *Servidor) cancelarLobby(sala *tipos.Sala, saiu, motivo string) {
+	sala.Mutex.Lock()
+	if sala.Estado != "AGUARDANDO_COMPRA" {
+		sala.Mutex.Unlock()
+		return
+	}
+	sala.Estado = "CANCELADA" // Impede que uma compra atrasada inicie a partida
+	reenfileirar := make([]string, 0, len(sala.Jogadores))
+	for _, j := range sala.Jogadores {
+		if j.ID == saiu {
+			continue
+		}
+		if !sala.Privada && (saiu != "" || sala.Prontos[j.Nome]) {
+			reenfileirar = append(reenfileirar, j.ID)
+		}
+	}
+	salaID := sala.ID
+	outroServidor := sala.ServidorSombra
+	if outroServidor == s.MeuEndereco {
+		outroServidor = sala.ServidorHost
+	}
+	sala.Mutex.Unlock()
+
+	log.Printf("[LOBBY:%s] Sala %s cancelada (%s). Voltam para a fila: %v", s.ServerID, salaID, motivo, reenfileirar)
+
+	if outroServidor != "" && outroServidor != s.MeuEndereco {
+		go s.encerrarLobbyRemoto(outroServidor, salaID, motivo, reenfileirar)
+	}
+	s.EncerrarLobby(salaID, motivo, reenfileirar)
+}
+
+// EncerrarLobby avisa os jogadores deste servidor que a sala foi cancelada, devolve à
+// fila os que estão em `reenfileirar` e remove a sala. Chamado pelo Host e, via API,
+// pelo outro servidor da partida.
+func (s *Servidor) EncerrarLobby(salaID, motivo string, reenfileirar []string) {
+	s.mutexSalas.RLock()
+	sala := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+	if sala == nil {
+		return
+	}
 
-	jsonData, _ := json.Marshal(req)
-	url := fmt.Sprintf("http://%s/game/replicate", shadowAddr)
+	sala.Mutex.Lock()
+	sala.Estado = "CANCELADA"
+	jogadores := make([]*tipos.Cliente, len(sala.Jogadores))
+	copy(jogadores, sala.Jogadores)
+	sala.Mutex.Unlock()
 
-	httpClient := &http.Client{Timeout: 15 * time.Second}
+	s.removerSala(salaID)
 
-	httpReq, _ := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+req.Token)
+	voltaParaFila := make(map[string]bool, len(reenfileirar))
+	for _, id := range reenfileirar {
+		voltaParaFila[id] = true
+	}
+	for _, j := range jogadores {
+		cliente := s.getClienteLocal(j.ID)
+		if cliente == nil {
+			continue
+		}
+		s.publicarParaCliente(cliente.ID, protocolo.Mensagem{
+			Comando: "PARTIDA_CANCELADA",
+			Dados: seguranca.MustJSON(protocolo.DadosPartidaCancelada{
+				SalaID:        salaID,
+				Motivo:        motivo,
+				Reenfileirado: voltaParaFila[cliente.ID],
+			}),
+		})
+		if voltaParaFila[cliente.ID] {
+			go s.entrarFila(cliente)
+		}
+	}
+}
 
-	resp, err := httpClient.Do(httpReq)
+// encerrarLobbyRemoto pede ao outro servidor da partida que encerre a sua cópia da sala
+func (s *Servidor) encerrarLobbyRemoto(servidor, salaID, motivo string, reenfileirar []string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"sala_id":      salaID,
+		"motivo":       motivo,
+		"reenfileirar": reenfileirar,
+	})
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/partida/encerrar_lobby", servidor), body)
 	if err != nil {
-		log.Printf("[HOST] Erro ao replicar estado para Shadow %s: %v", shadowAddr, err)
+		log.Printf("[LOBBY] Erro ao encerrar a sala %s em %s: %v", salaID, servidor, err)
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusOK {
-		log.Printf("[HOST] Estado replicado com sucesso para Shadow %s (eventSeq: %d)", shadowAddr, estado.EventSeq)
-	} else {
-		log.Printf("[HOST] Shadow %s retornou status %d ao receber replicação", shadowAddr, resp.StatusCode)
-	}
+	resp.Body.Close()
 }
 
-// resolverJogada resolve uma jogada quando ambos os jogadores jogaram
-func (s *Servidor) resolverJogada(sala *tipos.Sala) string {
-	// IMPORTANTE: Esta função assume que o `sala.Mutex` JÁ ESTÁ BLOQUEADO pela função que a chamou (ex: processarJogadaComoHost)
-	log.Printf("[JOGADA_RESOLVER:%s] Resolvendo jogada...", sala.ID)
+// removerSala apaga a sala e tudo o que aponta para ela neste servidor
+func (s *Servidor) removerSala(salaID string) {
+	s.mutexSalas.Lock()
+	sala := s.Salas[salaID]
+	delete(s.Salas, salaID)
+	delete(s.salasMonitoradas, salaID)
+	s.mutexSalas.Unlock()
+
+	s.mutexComandos.Lock()
+	delete(s.ComandosPartida, salaID)
+	s.mutexComandos.Unlock()
 
-	// Garante que a operação seja atômica na sala
-	// sala.Mutex.Lock() <--- REMOVIDO PARA EVITAR DEADLOCK
-	// defer sala.Mutex.Unlock() <--- REMOVIDO
+	s.mutexSessoes.Lock()
+	delete(s.gatewaysSalas, salaID)
+	delete(s.salasViaGateway, salaID)
+	s.mutexSessoes.Unlock()
 
-	if len(sala.CartasNaMesa) != 2 {
-		log.Printf("[JOGO_ERRO:%s] Tentativa de resolver jogada com %d cartas na mesa.", sala.ID, len(sala.CartasNaMesa))
-		return ""
+	if sala == nil {
+		return
 	}
+	sala.Mutex.Lock()
+	jogadores := make([]*tipos.Cliente, len(sala.Jogadores))
+	copy(jogadores, sala.Jogadores)
+	sala.Mutex.Unlock()
+	for _, j := range jogadores {
+		cliente := s.getClienteLocal(j.ID)
+		if cliente == nil {
+			cliente = j
+		}
+		cliente.Mutex.Lock()
+		if cliente.Sala == sala {
+			cliente.Sala = nil
+		}
+		cliente.Mutex.Unlock()
+	}
+}
 
-	j1 := sala.Jogadores[0]
-	j2 := sala.Jogadores[1]
-
-	c1 := sala.CartasNaMesa[j1.Nome]
-	c2 := sala.CartasNaMesa[j2.Nome]
+// contagemRegressiva converte o prazo do turno para o formato de ATUALIZACAO_JOGO
+// (Unix em milissegundos e segundos restantes). Prazo zero fica de fora da mensagem.
+func contagemRegressiva(prazo time.Time) (int64, int) {
+	if prazo.IsZero() {
+		return 0, 0
+	}
+	restante := time.Until(prazo)
+	if restante < 0 {
+		restante = 0
+	}
+	return prazo.UnixMilli(), int((restante + time.Second - 1) / time.Second)
+}
 
-	vencedorJogada := "EMPATE"
-	var vencedor *tipos.Cliente
+// monitorarPrazos confere periodicamente os prazos das salas deste servidor: o do
+// turno nas partidas em andamento e o de compra nos lobbies
+func (s *Servidor) monitorarPrazos() {
+	ticker := time.NewTicker(TURNO_VERIFICACAO_INTERVALO)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mutexSalas.RLock()
+		salas := make([]*tipos.Sala, 0, len(s.Salas))
+		for _, sala := range s.Salas {
+			salas = append(salas, sala)
+		}
+		s.mutexSalas.RUnlock()
 
-	resultado := compararCartas(c1, c2)
-	if resultado > 0 {
-		vencedorJogada = j1.Nome
-		vencedor = j1
-	} else if resultado < 0 {
-		vencedorJogada = j2.Nome
-		vencedor = j2
+		agora := time.Now()
+		for _, sala := range salas {
+			sala.Mutex.Lock()
+			souHost := sala.ServidorHost == s.MeuEndereco
+			expirou := souHost && sala.Estado == "JOGANDO" &&
+				!sala.PrazoTurno.IsZero() && agora.After(sala.PrazoTurno)
+			// A Sombra só encerra o lobby se o Host não o fez dentro da tolerância
+			prazoLobby := sala.PrazoProntos
+			if !souHost && !prazoLobby.IsZero() {
+				prazoLobby = prazoLobby.Add(LOBBY_TOLERANCIA_SOMBRA)
+			}
+			lobbyVencido := sala.Estado == "AGUARDANDO_COMPRA" && !prazoLobby.IsZero() && agora.After(prazoLobby)
+			sala.Mutex.Unlock()
+			if expirou {
+				s.expirarTurno(sala)
+			}
+			if lobbyVencido {
+				s.cancelarLobby(sala, "", MOTIVO_LOBBY_PRAZO)
+			}
+		}
 	}
+}
 
-	if vencedor != nil {
-		sala.PontosRodada[vencedor.Nome]++
+// expirarTurno age quando o jogador da vez deixa o prazo esgotar. Se o Host guarda o
+// inventário dele, joga a carta mais fraca em seu lugar; depois de
+// TURNOS_EXPIRADOS_MAXIMOS prazos seguidos (ou sem inventário no Host), o jogador
+// perde por W.O. Os dois caminhos passam por processarEventoComoHost, então vão
+// para o log e são replicados para a Sombra como qualquer jogada.
+func (s *Servidor) expirarTurno(sala *tipos.Sala) {
+	sala.Mutex.Lock()
+	jogadorID := sala.TurnoDe
+	if sala.TurnosExpirados == nil {
+		sala.TurnosExpirados = make(map[string]int)
 	}
+	sala.TurnosExpirados[jogadorID]++
+	expiracoes := sala.TurnosExpirados[jogadorID]
+	sala.PrazoTurno = time.Time{} // Não dispara de novo enquanto o evento é processado
+	salaID := sala.ID
+	sala.Mutex.Unlock()
 
-	log.Printf("Resultado da jogada: %s venceu", vencedorJogada)
-
-	// Limpa a mesa
-	sala.CartasNaMesa = make(map[string]Carta)
+	var carta Carta
+	if expiracoes < TURNOS_EXPIRADOS_MAXIMOS {
+		var jogadorLocal bool
+		carta, jogadorLocal = s.cartaMaisFraca(jogadorID)
+		// O inventário de um jogador de outro servidor está lá: quem escolhe e tira a
+		// carta é o servidor dele, que encaminha a jogada ao Host como qualquer outra
+		if !jogadorLocal && s.pedirJogadaAutomatica(sala, jogadorID) {
+			log.Printf("[TURNO:%s] Prazo esgotado para %s (%d/%d). Jogada automática pedida ao servidor do jogador.", salaID, jogadorID, expiracoes, TURNOS_EXPIRADOS_MAXIMOS)
+			sala.Mutex.Lock()
+			if sala.Estado == "JOGANDO" && sala.PrazoTurno.IsZero() {
+				sala.PrazoTurno = time.Now().Add(s.duracaoTurno) // Se a jogada não chegar, o próximo prazo encerra por W.O.
+			}
+			sala.Mutex.Unlock()
+			return
+		}
+	}
 
-	// CORREÇÃO: Define o próximo turno baseado no vencedor da jogada
-	if vencedor != nil {
-		log.Printf("[TURNO:%s] Vencedor da jogada: %s. Próximo turno: %s", sala.ID, vencedorJogada, vencedor.Nome)
-		s.mudarTurnoAtomicamente(sala, vencedor.ID)
+	evento := &tipos.GameEventRequest{MatchID: salaID, PlayerID: jogadorID}
+	if carta.ID != "" {
+		log.Printf("[TURNO:%s] Prazo esgotado para %s (%d/%d). Jogando %s automaticamente.", salaID, jogadorID, expiracoes, TURNOS_EXPIRADOS_MAXIMOS, carta.Nome)
+		evento.EventType = partida.EVENTO_CARTA_JOGADA
+		evento.Data = map[string]interface{}{"carta_id": carta.ID}
+		evento.Automatica = true
 	} else {
-		// Em caso de empate, mantém o mesmo jogador
-		log.Printf("[TURNO:%s] Empate na jogada. Mantendo turno atual: %s", sala.ID, sala.TurnoDe)
-		// Notificação será feita pela função chamadora após liberar o lock
+		log.Printf("[TURNO:%s] Prazo esgotado para %s (%d/%d). Encerrando a partida por W.O.", salaID, jogadorID, expiracoes, TURNOS_EXPIRADOS_MAXIMOS)
+		evento.EventType = partida.EVENTO_DESISTENCIA
+		evento.Data = map[string]interface{}{"motivo": partida.MOTIVO_TEMPO_ESGOTADO}
 	}
 
-	// CORREÇÃO: NOTA - notificarResultadoJogada será chamada APÓS liberar o lock da sala
-	// pelo processarEventoComoHost, para evitar que a goroutine inicie com o lock ativo
-
-	// CORREÇÃO: Verifica se acabaram as cartas DEPOIS de limpar a mesa
-	// Busca jogadores do mapa global para contagem atualizada
-	s.mutexClientes.RLock()
-	j1Global := s.Clientes[j1.ID]
-	j2Global := s.Clientes[j2.ID]
-	s.mutexClientes.RUnlock()
+	if s.processarEventoComoHost(sala, evento) == nil {
+		// O evento não foi aplicado: devolve um prazo para tentar de novo
+		sala.Mutex.Lock()
+		if sala.Estado == "JOGANDO" && sala.PrazoTurno.IsZero() {
+			sala.PrazoTurno = time.Now().Add(s.duracaoTurno)
+		}
+		sala.Mutex.Unlock()
+		return
+	}
 
-	var j1Cartas, j2Cartas int
-	if j1Global != nil {
-		j1Global.Mutex.Lock()
-		j1Cartas = len(j1Global.Inventario)
-		j1Global.Mutex.Unlock()
-	} else {
-		j1.Mutex.Lock()
-		j1Cartas = len(j1.Inventario)
-		j1.Mutex.Unlock()
+	if carta.ID != "" {
+		s.publicarParaCliente(jogadorID, protocolo.Mensagem{
+			Comando: "JOGADA_AUTOMATICA",
+			Dados:   seguranca.MustJSON(protocolo.DadosJogadaAutomatica{SalaID: salaID, Carta: carta}),
+		})
 	}
+}
 
-	if j2Global != nil {
-		j2Global.Mutex.Lock()
-		j2Cartas = len(j2Global.Inventario)
-		j2Global.Mutex.Unlock()
-	} else {
-		j2.Mutex.Lock()
-		j2Cartas = len(j2.Inventario)
-		j2.Mutex.Unlock()
+// cartaMaisFraca devolve a carta de menor valor de um jogador deste servidor, sem
+// as reservadas para uma troca. O segundo valor é false se o jogador não é daqui.
+func (s *Servidor) cartaMaisFraca(clienteID string) (Carta, bool) {
+	jogador := s.getClienteLocal(clienteID)
+	if jogador == nil {
+		return Carta{}, false
 	}
+	jogador.Mutex.Lock()
+	inventario := make([]Carta, len(jogador.Inventario))
+	copy(inventario, jogador.Inventario)
+	jogador.Mutex.Unlock()
 
-	log.Printf("[VERIFICACAO_CARTAS:%s] Após jogada: %s tem %d cartas, %s tem %d cartas", sala.ID, j1.Nome, j1Cartas, j2.Nome, j2Cartas)
+	var carta Carta
+	for _, c := range inventario {
+		if s.cartaReservadaParaTroca(clienteID, c.ID) {
+			continue
+		}
+		if carta.ID == "" || partida.CompararCartas(c, carta) < 0 {
+			carta = c
+		}
+	}
+	return carta, true
+}
 
-	// CORREÇÃO: Só finalizar se AMBOS tiverem 0 cartas (ou se for realmente um caso de fim de jogo)
-	// Em partidas cross-server, o inventário do jogador remoto pode estar vazio no Host
-	// então não devemos finalizar baseado apenas em um jogador com 0 cartas
-	if j1Cartas == 0 && j2Cartas == 0 {
-		// Ambos sem cartas - fim definitivo
-		log.Printf("[FINALIZACAO:%s] Ambos os jogadores ficaram sem cartas. Finalizando partida.", sala.ID)
-		s.finalizarPartida(sala)
-	} else if j1Cartas == 0 || j2Cartas == 0 {
-		// Apenas um sem cartas - isso não deveria acontecer normalmente, mas vamos continuar
-		log.Printf("[AVISO:%s] Um jogador tem 0 cartas (cross-server?). Continuando partida por segurança.", sala.ID)
-		sala.NumeroRodada++
-	} else {
-		// Ambos com cartas - continuar
-		log.Printf("[CONTINUA_JOGO:%s] Ambos os jogadores ainda têm cartas (%d e %d). Continuando a partida.", sala.ID, j1Cartas, j2Cartas)
-		sala.NumeroRodada++
+// pedirJogadaAutomatica pede ao servidor do jogador (a Sombra) que jogue a carta mais
+// fraca dele. Devolve false se o servidor não respondeu ou o jogador não tem carta.
+func (s *Servidor) pedirJogadaAutomatica(sala *tipos.Sala, clienteID string) bool {
+	sala.Mutex.Lock()
+	outroServidor := sala.ServidorSombra
+	salaID := sala.ID
+	sala.Mutex.Unlock()
+	if outroServidor == "" || outroServidor == s.MeuEndereco {
+		return false
 	}
 
-	return vencedorJogada
+	body, _ := json.Marshal(map[string]string{"sala_id": salaID, "cliente_id": clienteID})
+	resp, err := s.enviarRequestComTokenPrazo("POST", fmt.Sprintf("http://%s/partida/jogada_automatica", outroServidor), body, HOST_STATUS_TIMEOUT)
+	if err != nil {
+		log.Printf("[TURNO:%s] %s não respondeu ao pedido de jogada automática de %s: %v", salaID, outroServidor, clienteID, err)
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
 }
 
-// compararCartas compara duas cartas e retorna o resultado
-func compararCartas(c1, c2 Carta) int {
-	if c1.Valor != c2.Valor {
-		return c1.Valor - c2.Valor
+// JogarAutomaticamente é chamado pelo Host quando o prazo de um jogador deste
+// servidor esgotou: escolhe a carta mais fraca e a encaminha ao Host como jogada
+// automática. Devolve false se o jogador não está aqui ou não tem carta.
+func (s *Servidor) JogarAutomaticamente(salaID, clienteID string) bool {
+	s.mutexSalas.RLock()
+	sala := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+	if sala == nil {
+		return false
+	}
+	carta, _ := s.cartaMaisFraca(clienteID)
+	if carta.ID == "" {
+		return false
 	}
 
-	// Desempate por naipe
-	naipes := map[string]int{"♠": 4, "♥": 3, "♦": 2, "♣": 1}
-	return naipes[c1.Naipe] - naipes[c2.Naipe]
+	log.Printf("[TURNO:%s] Prazo de %s esgotado no Host. Jogando %s automaticamente.", salaID, clienteID, carta.Nome)
+	go func() {
+		s.encaminharJogadaParaHost(sala, clienteID, carta.ID, true)
+		s.publicarParaCliente(clienteID, protocolo.Mensagem{
+			Comando: "JOGADA_AUTOMATICA",
+			Dados:   seguranca.MustJSON(protocolo.DadosJogadaAutomatica{SalaID: salaID, Carta: carta}),
+		})
+	}()
+	return true
 }
 
 // notificarAguardandoOponente notifica que está aguardando o oponente jogar
@@ -2011,6 +4642,7 @@ func (s *Servidor) notificarAguardandoOponente(sala *tipos.Sala) {
 	copy(jogadoresCopy, sala.Jogadores)
 	sombraAddr := sala.ServidorSombra
 	hostAddr := sala.ServidorHost
+	prazoTurno, segundosRestantes := contagemRegressiva(sala.PrazoTurno)
 	sala.Mutex.Unlock()
 
 	// Agora encontra o nome do jogador e conta cartas FORA do lock da sala
@@ -2039,11 +4671,13 @@ func (s *Servidor) notificarAguardandoOponente(sala *tipos.Sala) {
 	msg := protocolo.Mensagem{
 		Comando: "ATUALIZACAO_JOGO",
 		Dados: seguranca.MustJSON(protocolo.DadosAtualizacaoJogo{
-			MensagemDoTurno: fmt.Sprintf("Aguardando jogada de %s...", proximoJogadorNome),
-			NumeroRodada:    numeroRodada,
-			ContagemCartas:  contagemCartas,
-			UltimaJogada:    cartasNaMesa,
-			TurnoDe:         turnoDe,
+			MensagemDoTurno:   fmt.Sprintf("Aguardando jogada de %s...", proximoJogadorNome),
+			NumeroRodada:      numeroRodada,
+			ContagemCartas:    contagemCartas,
+			UltimaJogada:      cartasNaMesa,
+			TurnoDe:           turnoDe,
+			PrazoTurno:        prazoTurno,
+			SegundosRestantes: segundosRestantes,
 		}),
 	}
 
@@ -2090,6 +4724,7 @@ func (s *Servidor) notificarResultadoJogada(sala *tipos.Sala, vencedorJogada str
 	copy(jogadoresCopy, sala.Jogadores)
 	sombraAddr := sala.ServidorSombra
 	hostAddr := sala.ServidorHost
+	prazoTurno, segundosRestantes := contagemRegressiva(sala.PrazoTurno)
 	sala.Mutex.Unlock()
 
 	// Encontra o nome do próximo jogador e cria contagem de cartas FORA do lock da sala
@@ -2109,81 +4744,388 @@ func (s *Servidor) notificarResultadoJogada(sala *tipos.Sala, vencedorJogada str
 		jogadorAtualizado := s.Clientes[j.ID]
 		s.mutexClientes.RUnlock()
 
-		if jogadorAtualizado != nil {
-			jogadorAtualizado.Mutex.Lock()
-			contagemCartas[j.Nome] = len(jogadorAtualizado.Inventario)
-			jogadorAtualizado.Mutex.Unlock()
+		if jogadorAtualizado != nil {
+			jogadorAtualizado.Mutex.Lock()
+			contagemCartas[j.Nome] = len(jogadorAtualizado.Inventario)
+			jogadorAtualizado.Mutex.Unlock()
+		}
+	}
+
+	// Cria a mensagem base
+	msg := protocolo.Mensagem{
+		Comando: "ATUALIZACAO_JOGO",
+		Dados: seguranca.MustJSON(protocolo.DadosAtualizacaoJogo{
+			MensagemDoTurno:   fmt.Sprintf("Vencedor da jogada: %s. Próximo a jogar: %s", vencedorJogada, proximoJogadorNome),
+			NumeroRodada:      numeroRodada,
+			ContagemCartas:    contagemCartas,
+			UltimaJogada:      cartasNaMesa,
+			VencedorJogada:    vencedorJogada,
+			SalaID:            salaID,
+			TurnoDe:           turnoDe,
+			PrazoTurno:        prazoTurno,
+			SegundosRestantes: segundosRestantes,
+		}),
+	}
+
+	// CORREÇÃO CRUCIAL: Em partidas cross-server, publica MQTT local E notifica jogadores remotos via HTTP
+	if hostAddr == s.MeuEndereco && sombraAddr != "" {
+		// Este servidor é o Host, partida é cross-server
+		log.Printf("[NOTIFICACAO_CROSS] Publicando no MQTT local e notificando Shadow via HTTP")
+		// Publica no MQTT local (vai chegar apenas aos clientes conectados a este servidor)
+		s.publicarEventoPartida(salaID, msg)
+		// Notifica jogadores remotos (do Shadow) via HTTP
+		go s.notificarJogadoresRemotosDaPartida(salaID, sombraAddr, jogadoresCopy, msg)
+	} else {
+		// Partida local - apenas publica no MQTT
+		s.publicarEventoPartida(salaID, msg)
+	}
+}
+
+// finalizarPartida finaliza uma partida e determina o vencedor
+func (s *Servidor) finalizarPartida(sala *tipos.Sala) {
+	// CORREÇÃO: Esta função assume que o lock da sala JÁ ESTÁ ATIVO
+	// Quando chamada de dentro de processarEventoComoHost, depois que o evento que
+	// encerra a partida já colocou a sala em FINALIZADO
+
+	vencedorFinal := game.Vencedor(sala)
+	dados := protocolo.DadosFimDeJogo{VencedorNome: vencedorFinal, SalaID: sala.ID, Motivo: sala.MotivoFim}
+	if dados.Motivo == "" {
+		dados.Motivo = partida.MOTIVO_CARTAS_ESGOTADAS
+	}
+	for _, j := range sala.Jogadores {
+		if j.ID == sala.Desistente {
+			dados.DesistenteNome = j.Nome
+		}
+	}
+	if sala.Serie != nil {
+		dados.Serie = placarDaSerie(sala)
+	}
+	if resultado, ok := s.resultadoDaSala(sala, vencedorFinal); ok {
+		// Os novos ratings são calculados aqui só para exibição; o valor oficial é o
+		// aplicado pelo log replicado, na mesma ordem em todos os servidores
+		ratingA, _ := s.Contas.Rating(resultado.JogadorA)
+		ratingB, _ := s.Contas.Rating(resultado.JogadorB)
+		novoA, novoB := ranking.Atualizar(ratingA, ratingB, resultado.PontosA)
+		dados.Ratings = map[string]int{sala.Jogadores[0].Nome: novoA, sala.Jogadores[1].Nome: novoB}
+		premioA, premioB := contas.Premios(resultado.PontosA)
+		dados.Moedas = map[string]int{sala.Jogadores[0].Nome: premioA, sala.Jogadores[1].Nome: premioB}
+		go s.registrarResultado(resultado)
+	}
+
+	log.Printf("Partida %s finalizada. Vencedor: %s (motivo: %s)", sala.ID, vencedorFinal, dados.Motivo)
+
+	msg := protocolo.Mensagem{
+		Comando: "FIM_DE_JOGO",
+		Dados:   seguranca.MustJSON(dados),
+	}
+
+	// CORREÇÃO: Não adquire lock - assume que já está ativo
+	jogadores := make([]*tipos.Cliente, len(sala.Jogadores))
+	copy(jogadores, sala.Jogadores)
+	sombraAddr := sala.ServidorSombra
+
+	for _, jogador := range jogadores {
+		if s.getClienteLocal(jogador.ID) != nil {
+			s.publicarParaCliente(jogador.ID, msg)
+		} else {
+			if sombraAddr != "" {
+				go s.notificarJogadorRemoto(sombraAddr, jogador.ID, msg)
+			}
+		}
+	}
+}
+
+// resultadoDaSala monta o resultado para o rating. Partidas com jogadores sem conta
+// não contam. Assume o lock da sala ativo.
+func (s *Servidor) resultadoDaSala(sala *tipos.Sala, vencedor string) (resultadoPartida, bool) {
+	if len(sala.Jogadores) != 2 {
+		return resultadoPartida{}, false
+	}
+	a, b := sala.Jogadores[0], sala.Jogadores[1]
+	if _, ok := s.Contas.Rating(a.ID); !ok {
+		return resultadoPartida{}, false
+	}
+	if _, ok := s.Contas.Rating(b.ID); !ok {
+		return resultadoPartida{}, false
+	}
+	resultado := resultadoPartida{SalaID: sala.ID, JogadorA: a.ID, JogadorB: b.ID, PontosA: 0.5}
+	switch vencedor {
+	case a.Nome:
+		resultado.PontosA = 1
+	case b.Nome:
+		resultado.PontosA = 0
+	}
+	return resultado, true
+}
+
+// placarDaSerie devolve o placar da série de revanches contando a partida já
+// finalizada (empates não pontuam). Assume o lock da sala ativo.
+func placarDaSerie(sala *tipos.Sala) map[string]int {
+	placar := make(map[string]int, len(sala.Jogadores))
+	for _, j := range sala.Jogadores {
+		placar[j.Nome] = sala.Serie[j.Nome]
+	}
+	if sala.Estado == "FINALIZADO" {
+		if vencedor := game.Vencedor(sala); vencedor != "EMPATE" {
+			placar[vencedor]++
+		}
+	}
+	return placar
+}
+
+// pedirRevanche registra que o jogador quer jogar de novo. Quando todos aceitam, o
+// Host abre uma nova sala com os mesmos jogadores, o mesmo par Host/Sombra e o
+// placar da série, e a Sombra abre a sua cópia.
+func (s *Servidor) pedirRevanche(sala *tipos.Sala, clienteID string) {
+	sala.Mutex.Lock()
+	if sala.Estado != "FINALIZADO" {
+		sala.Mutex.Unlock()
+		s.notificarErroPartida(clienteID, "A revanche só pode ser pedida depois do fim da partida.", sala.ID)
+		return
+	}
+	if sala.Revanche != "" {
+		sala.Mutex.Unlock()
+		return
+	}
+
+	var solicitante *tipos.Cliente
+	saiu := ""
+	for _, j := range sala.Jogadores {
+		if j.ID == clienteID {
+			solicitante = j
+		}
+		// Quem já voltou para a fila não joga a revanche
+		if local := s.getClienteLocal(j.ID); local != nil {
+			local.Mutex.Lock()
+			if local.Sala != sala {
+				saiu = j.Nome
+			}
+			local.Mutex.Unlock()
+		}
+	}
+	if solicitante == nil {
+		sala.Mutex.Unlock()
+		return
+	}
+	if saiu != "" {
+		sala.Mutex.Unlock()
+		s.notificarErroPartida(clienteID, fmt.Sprintf("Não há revanche: %s já saiu da sala.", saiu), sala.ID)
+		return
+	}
+
+	if sala.PedidosRevanche == nil {
+		sala.PedidosRevanche = make(map[string]bool)
+	}
+	sala.PedidosRevanche[clienteID] = true
+	jogadores := make([]*tipos.Cliente, len(sala.Jogadores))
+	copy(jogadores, sala.Jogadores)
+	sombraAddr := sala.ServidorSombra
+
+	if len(sala.PedidosRevanche) < len(sala.Jogadores) {
+		sala.Mutex.Unlock()
+		log.Printf("[REVANCHE:%s] %s pediu revanche na sala %s", s.ServerID, solicitante.Nome, sala.ID)
+		msg := protocolo.Mensagem{
+			Comando: "REVANCHE_PEDIDA",
+			Dados:   seguranca.MustJSON(protocolo.DadosRevanchePedida{SalaID: sala.ID, Nome: solicitante.Nome}),
+		}
+		for _, j := range jogadores {
+			if j.ID == clienteID {
+				continue
+			}
+			if s.getClienteLocal(j.ID) != nil {
+				s.publicarParaCliente(j.ID, msg)
+			} else if sombraAddr != "" {
+				go s.notificarJogadorRemoto(sombraAddr, j.ID, msg)
+			}
+		}
+		return
+	}
+
+	novaSala := &tipos.Sala{
+		ID:             uuid.New().String(),
+		Estado:         "AGUARDANDO_COMPRA",
+		CartasNaMesa:   make(map[string]Carta),
+		PontosRodada:   make(map[string]int),
+		PontosPartida:  make(map[string]int),
+		NumeroRodada:   1,
+		Prontos:        make(map[string]bool),
+		ServidorHost:   s.MeuEndereco,
+		ServidorSombra: sombraAddr,
+		PrazoProntos:   time.Now().Add(LOBBY_PRAZO_PRONTOS),
+		Serie:          placarDaSerie(sala),
+	}
+	sala.Revanche = novaSala.ID
+	salaAnterior := sala.ID
+	sala.Mutex.Unlock()
+
+	for _, j := range jogadores {
+		if local := s.getClienteLocal(j.ID); local != nil {
+			j = local
+		}
+		novaSala.Jogadores = append(novaSala.Jogadores, j)
+	}
+	s.abrirSalaRevanche(salaAnterior, novaSala)
+
+	if sombraAddr != "" && sombraAddr != s.MeuEndereco {
+		if err := s.criarRevancheRemota(sombraAddr, salaAnterior, novaSala.ID, novaSala.Serie); err != nil {
+			log.Printf("[REVANCHE:%s] Sombra %s não abriu a revanche da sala %s: %v", s.ServerID, sombraAddr, salaAnterior, err)
+			// Desfaz a revanche: os jogadores voltam para a sala anterior, que aceita
+			// novos pedidos (sem isso ela ignoraria qualquer /revanche seguinte)
+			for _, j := range novaSala.Jogadores {
+				j.Mutex.Lock()
+				if j.Sala == novaSala {
+					j.Sala = sala
+				}
+				j.Mutex.Unlock()
+			}
+			s.removerSala(novaSala.ID)
+			sala.Mutex.Lock()
+			if sala.Revanche == novaSala.ID {
+				sala.Revanche = ""
+				sala.PedidosRevanche = nil
+			}
+			sala.Mutex.Unlock()
+			for _, j := range jogadores {
+				if s.getClienteLocal(j.ID) != nil {
+					s.notificarErroPartida(j.ID, "Não foi possível iniciar a revanche: o oponente já saiu da sala.", salaAnterior)
+				}
+			}
+			return
+		}
+	}
+
+	log.Printf("[REVANCHE:%s] Sala %s aberta como revanche de %s (Sombra: %s, série: %v)", s.ServerID, novaSala.ID, salaAnterior, sombraAddr, novaSala.Serie)
+	s.notificarRevanche(novaSala, salaAnterior)
+}
+
+// CriarRevancheComoSombra abre na Sombra a cópia da sala de revanche criada pelo
+// Host. Devolve false se o jogador deste servidor já saiu da sala anterior.
+func (s *Servidor) CriarRevancheComoSombra(salaAnterior, salaID string, serie map[string]int) bool {
+	s.mutexSalas.RLock()
+	anterior := s.Salas[salaAnterior]
+	s.mutexSalas.RUnlock()
+	if anterior == nil {
+		return false
+	}
+
+	anterior.Mutex.Lock()
+	jogadores := make([]*tipos.Cliente, 0, len(anterior.Jogadores))
+	for _, j := range anterior.Jogadores {
+		if local := s.getClienteLocal(j.ID); local != nil {
+			local.Mutex.Lock()
+			saiu := local.Sala != anterior
+			local.Mutex.Unlock()
+			if saiu {
+				anterior.Mutex.Unlock()
+				return false
+			}
+			j = local
 		}
+		jogadores = append(jogadores, j)
 	}
+	anterior.Revanche = salaID
+	hostAddr := anterior.ServidorHost
+	anterior.Mutex.Unlock()
 
-	// Cria a mensagem base
-	msg := protocolo.Mensagem{
-		Comando: "ATUALIZACAO_JOGO",
-		Dados: seguranca.MustJSON(protocolo.DadosAtualizacaoJogo{
-			MensagemDoTurno: fmt.Sprintf("Vencedor da jogada: %s. Próximo a jogar: %s", vencedorJogada, proximoJogadorNome),
-			NumeroRodada:    numeroRodada,
-			ContagemCartas:  contagemCartas,
-			UltimaJogada:    cartasNaMesa,
-			VencedorJogada:  vencedorJogada,
-			SalaID:          salaID,
-			TurnoDe:         turnoDe,
-		}),
+	novaSala := &tipos.Sala{
+		ID:             salaID,
+		Jogadores:      jogadores,
+		Estado:         "AGUARDANDO_COMPRA",
+		CartasNaMesa:   make(map[string]Carta),
+		PontosRodada:   make(map[string]int),
+		PontosPartida:  make(map[string]int),
+		NumeroRodada:   1,
+		Prontos:        make(map[string]bool),
+		ServidorHost:   hostAddr,
+		ServidorSombra: s.MeuEndereco,
+		PrazoProntos:   time.Now().Add(LOBBY_PRAZO_PRONTOS),
+		Serie:          serie,
 	}
+	s.abrirSalaRevanche(salaAnterior, novaSala)
 
-	// CORREÇÃO CRUCIAL: Em partidas cross-server, publica MQTT local E notifica jogadores remotos via HTTP
-	if hostAddr == s.MeuEndereco && sombraAddr != "" {
-		// Este servidor é o Host, partida é cross-server
-		log.Printf("[NOTIFICACAO_CROSS] Publicando no MQTT local e notificando Shadow via HTTP")
-		// Publica no MQTT local (vai chegar apenas aos clientes conectados a este servidor)
-		s.publicarEventoPartida(salaID, msg)
-		// Notifica jogadores remotos (do Shadow) via HTTP
-		go s.notificarJogadoresRemotosDaPartida(salaID, sombraAddr, jogadoresCopy, msg)
-	} else {
-		// Partida local - apenas publica no MQTT
-		s.publicarEventoPartida(salaID, msg)
-	}
+	log.Printf("[REVANCHE:%s] Sala %s aberta como SOMBRA da revanche de %s (Host: %s)", s.ServerID, salaID, salaAnterior, hostAddr)
+	s.notificarRevanche(novaSala, salaAnterior)
+	return true
 }
 
-// finalizarPartida finaliza uma partida e determina o vencedor
-func (s *Servidor) finalizarPartida(sala *tipos.Sala) {
-	// CORREÇÃO: Esta função assume que o lock da sala JÁ ESTÁ ATIVO
-	// Quando chamada de dentro de resolverJogada (que está dentro de processarEventoComoHost com lock ativo)
-
-	sala.Estado = "FINALIZADO"
+// abrirSalaRevanche registra a sala de revanche e move os jogadores para ela. Os
+// servidores que atendiam sessões retomadas da sala anterior continuam atendendo.
+func (s *Servidor) abrirSalaRevanche(salaAnterior string, novaSala *tipos.Sala) {
+	s.mutexSalas.Lock()
+	s.Salas[novaSala.ID] = novaSala
+	s.mutexSalas.Unlock()
 
-	vencedorFinal := "EMPATE"
-	maxPontos := -1
+	for _, j := range novaSala.Jogadores {
+		j.Mutex.Lock()
+		j.Sala = novaSala
+		j.Mutex.Unlock()
+	}
 
-	for nome, pontos := range sala.PontosRodada {
-		if pontos > maxPontos {
-			maxPontos = pontos
-			vencedorFinal = nome
-		} else if pontos == maxPontos {
-			vencedorFinal = "EMPATE"
+	s.mutexSessoes.Lock()
+	if gateways := s.gatewaysSalas[salaAnterior]; len(gateways) > 0 {
+		s.gatewaysSalas[novaSala.ID] = make(map[string]bool, len(gateways))
+		for gateway := range gateways {
+			s.gatewaysSalas[novaSala.ID][gateway] = true
 		}
 	}
+	s.mutexSessoes.Unlock()
+}
 
-	log.Printf("Partida %s finalizada. Vencedor: %s", sala.ID, vencedorFinal)
-
-	msg := protocolo.Mensagem{
-		Comando: "FIM_DE_JOGO",
-		Dados:   seguranca.MustJSON(protocolo.DadosFimDeJogo{VencedorNome: vencedorFinal, SalaID: sala.ID}),
+// notificarRevanche envia PARTIDA_ENCONTRADA aos jogadores deste servidor
+func (s *Servidor) notificarRevanche(sala *tipos.Sala, salaAnterior string) {
+	for _, j := range sala.Jogadores {
+		if s.getClienteLocal(j.ID) == nil {
+			continue
+		}
+		for _, oponente := range sala.Jogadores {
+			if oponente.ID == j.ID {
+				continue
+			}
+			s.publicarParaCliente(j.ID, protocolo.Mensagem{
+				Comando: "PARTIDA_ENCONTRADA",
+				Dados: seguranca.MustJSON(protocolo.DadosPartidaEncontrada{
+					SalaID:              sala.ID,
+					OponenteID:          oponente.ID,
+					OponenteNome:        oponente.Nome,
+					SegundosParaComprar: int(LOBBY_PRAZO_PRONTOS / time.Second),
+					SalaAnterior:        salaAnterior,
+					Serie:               sala.Serie,
+				}),
+			})
+		}
 	}
+}
 
-	// CORREÇÃO: Não adquire lock - assume que já está ativo
-	jogadores := make([]*tipos.Cliente, len(sala.Jogadores))
-	copy(jogadores, sala.Jogadores)
-	sombraAddr := sala.ServidorSombra
+// criarRevancheRemota pede à Sombra que abra a sua cópia da sala de revanche
+func (s *Servidor) criarRevancheRemota(sombraAddr, salaAnterior, salaID string, serie map[string]int) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"sala_anterior": salaAnterior,
+		"sala_id":       salaID,
+		"serie":         serie,
+	})
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/partida/criar_revanche", sombraAddr), body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
 
-	for _, jogador := range jogadores {
-		if s.getClienteLocal(jogador.ID) != nil {
-			s.publicarParaCliente(jogador.ID, msg)
-		} else {
-			if sombraAddr != "" {
-				go s.notificarJogadorRemoto(sombraAddr, jogador.ID, msg)
-			}
-		}
+// herdarOrigemDaRevanche faz um servidor que atende a sessão retomada de um jogador
+// encaminhar também os comandos da revanche para o servidor de origem.
+func (s *Servidor) herdarOrigemDaRevanche(msg protocolo.Mensagem) {
+	var dados protocolo.DadosPartidaEncontrada
+	if err := json.Unmarshal(msg.Dados, &dados); err != nil || dados.SalaAnterior == "" {
+		return
 	}
+	s.mutexSessoes.Lock()
+	if origem := s.salasViaGateway[dados.SalaAnterior]; origem != "" {
+		s.salasViaGateway[dados.SalaID] = origem
+	}
+	s.mutexSessoes.Unlock()
 }
 
 // sincronizarEstadoComSombra envia o estado atualizado da partida para a Sombra
@@ -2268,461 +5210,1052 @@ func (s *Servidor) broadcastChat(sala *tipos.Sala, texto, remetenteNome string)
 	s.publicarEventoPartida(sala.ID, msgChat)
 }
 
-// ==================== LÓGICA DE TROCA DE CARTAS ====================
+// ==================== LÓGICA DE TROCA DE CARTAS ====================
+
+func (s *Servidor) ProcessarTrocaDireta(sala *tipos.Sala, comando string, req *protocolo.TrocarCartasReq) {
+	s.processarTrocaCartas(sala, comando, req)
+}
+
+// AplicarTrocaLocal remove a carta desejada do cliente local e adiciona a carta oferecida
+func (s *Servidor) BuscarCartaEmCliente(clienteID, cartaID string) tipos.Carta {
+	s.mutexClientes.RLock()
+	cliente := s.Clientes[clienteID]
+	s.mutexClientes.RUnlock()
+
+	if cliente == nil {
+		return tipos.Carta{}
+	}
+
+	cliente.Mutex.Lock()
+	var cartaEncontrada tipos.Carta
+	for _, c := range cliente.Inventario {
+		if c.ID == cartaID {
+			cartaEncontrada = c
+			break
+		}
+	}
+	cliente.Mutex.Unlock()
+
+	return cartaEncontrada
+}
+
+func (s *Servidor) AplicarTrocaLocal(clienteID string, idCartaDesejada string, cartaOferecida tipos.Carta) (bool, tipos.Carta, []tipos.Carta) {
+	log.Printf("[APLICAR_TROCA_LOCAL] Cliente: %s, removendo carta ID: %s, adicionando: %s", clienteID, idCartaDesejada, cartaOferecida.Nome)
+
+	s.mutexClientes.RLock()
+	cliente := s.Clientes[clienteID]
+	s.mutexClientes.RUnlock()
+	if cliente == nil {
+		log.Printf("[APLICAR_TROCA_LOCAL] Cliente %s não encontrado", clienteID)
+		return false, tipos.Carta{}, nil
+	}
+	cliente.Mutex.Lock()
+	defer cliente.Mutex.Unlock()
+
+	log.Printf("[APLICAR_TROCA_LOCAL] Inventário do cliente tem %d cartas", len(cliente.Inventario))
+
+	idx := -1
+	var cartaRemovida tipos.Carta
+	for i, c := range cliente.Inventario {
+		if c.ID == idCartaDesejada {
+			idx = i
+			cartaRemovida = c
+			log.Printf("[APLICAR_TROCA_LOCAL] Carta encontrada no índice %d: %s", i, c.Nome)
+			break
+		}
+	}
+	if idx == -1 {
+		log.Printf("[APLICAR_TROCA_LOCAL] Carta %s não encontrada no inventário", idCartaDesejada)
+		log.Printf("[APLICAR_TROCA_LOCAL] Inventário atual: %v", cliente.Inventario)
+		return false, tipos.Carta{}, nil
+	}
+	// Remove a carta do inventário
+	inv := make([]tipos.Carta, 0, len(cliente.Inventario))
+	inv = append(inv, cliente.Inventario[:idx]...)
+	inv = append(inv, cliente.Inventario[idx+1:]...)
+	// Adiciona a nova carta
+	inv = append(inv, cartaOferecida)
+	cliente.Inventario = inv
+	go s.salvarInventario(clienteID)
+	snapshot := make([]tipos.Carta, len(inv))
+	copy(snapshot, inv)
+	log.Printf("[APLICAR_TROCA_LOCAL] Inventário atualizado para %d cartas. Cartas atuais: %v", len(inv), inv)
+	return true, cartaRemovida, snapshot
+}
+
+// processarTrocaCartas trata os comandos de troca. O Host guarda a proposta pendente
+// da sala e só executa a troca quando o outro jogador a aceita; a Sombra encaminha.
+func (s *Servidor) processarTrocaCartas(sala *tipos.Sala, comando string, req *protocolo.TrocarCartasReq) {
+	// NECESSÁRIO: Apenas o Host coordena a troca
+	if sala.ServidorHost != s.MeuEndereco {
+		log.Printf("[TROCA] Shadow (servidor %s) encaminhando %s para o Host %s", s.MeuEndereco, comando, sala.ServidorHost)
+		s.encaminharTrocaParaHost(sala.ServidorHost, sala.ID, comando, req)
+		return
+	}
+
+	switch comando {
+	case "TROCAR_CARTAS", "TROCAR_CARTAS_OFERTA":
+		s.proporTroca(sala, req, false)
+	case "TROCA_CONTRAPROPOSTA":
+		s.proporTroca(sala, req, true)
+	case "TROCA_ACEITAR":
+		s.aceitarTroca(sala, req)
+	case "TROCA_RECUSAR":
+		s.recusarTroca(sala, req)
+	}
+}
+
+// proporTroca registra uma proposta (ou contraproposta) depois de conferir que cada
+// jogador tem a carta que entraria na troca. Cada sala tem no máximo uma proposta
+// pendente; a contraproposta a substitui e inverte quem precisa responder.
+func (s *Servidor) proporTroca(sala *tipos.Sala, req *protocolo.TrocarCartasReq, contraproposta bool) {
+	ofertante := s.getClienteDaSala(sala, req.IDJogadorOferta)
+	desejado := s.getClienteDaSala(sala, req.IDJogadorDesejado)
+	if ofertante == nil || desejado == nil || ofertante.ID == desejado.ID {
+		s.notificarErroTroca(sala, req.IDJogadorOferta, "Um dos jogadores não foi encontrado.")
+		return
+	}
+	req.NomeJogadorOferta, req.NomeJogadorDesejado = ofertante.Nome, desejado.Nome
+
+	sala.Mutex.Lock()
+	atual := sala.OfertaTroca
+	sala.Mutex.Unlock()
+	if contraproposta {
+		if atual == nil || atual.Req.OfertaID != req.OfertaID {
+			s.notificarErroTroca(sala, req.IDJogadorOferta, "Essa proposta de troca não está mais pendente.")
+			return
+		}
+		if atual.Req.IDJogadorDesejado != req.IDJogadorOferta {
+			s.notificarErroTroca(sala, req.IDJogadorOferta, "Só quem recebeu a proposta pode fazer uma contraproposta.")
+			return
+		}
+	} else if atual != nil {
+		s.notificarErroTroca(sala, req.IDJogadorOferta, "Já existe uma proposta de troca pendente. Use /recusar para cancelá-la.")
+		return
+	}
+
+	cartaOferecida := s.buscarCartaDoJogador(sala, req.IDJogadorOferta, req.IDCartaOferecida)
+	if cartaOferecida.ID == "" {
+		s.notificarErroTroca(sala, req.IDJogadorOferta, "Você não possui esta carta.")
+		return
+	}
+	cartaDesejada := s.buscarCartaDoJogador(sala, req.IDJogadorDesejado, req.IDCartaDesejada)
+	if cartaDesejada.ID == "" {
+		s.notificarErroTroca(sala, req.IDJogadorOferta, fmt.Sprintf("%s não possui esta carta.", req.NomeJogadorDesejado))
+		return
+	}
+
+	nova := &tipos.OfertaTroca{
+		Req:            *req,
+		CartaOferecida: cartaOferecida,
+		CartaDesejada:  cartaDesejada,
+		ExpiraEm:       time.Now().Add(TROCA_OFERTA_PRAZO),
+	}
+	nova.Req.OfertaID = uuid.New().String()
+	nova.Req.ClienteID = ""
+
+	sala.Mutex.Lock()
+	if sala.OfertaTroca != atual {
+		// A proposta mudou enquanto as cartas eram conferidas
+		sala.Mutex.Unlock()
+		s.notificarErroTroca(sala, req.IDJogadorOferta, "A proposta de troca mudou. Tente novamente.")
+		return
+	}
+	sala.OfertaTroca = nova
+	sala.Mutex.Unlock()
+	time.AfterFunc(TROCA_OFERTA_PRAZO, func() { s.expirarOfertaTroca(sala, nova.Req.OfertaID) })
+
+	log.Printf("[TROCA:%s] Sala %s: %s propõe %s por %s de %s (proposta %s)", s.ServerID, sala.ID, req.NomeJogadorOferta, cartaOferecida.Nome, cartaDesejada.Nome, req.NomeJogadorDesejado, nova.Req.OfertaID)
+	msg := protocolo.Mensagem{
+		Comando: "TROCA_PROPOSTA",
+		Dados: seguranca.MustJSON(protocolo.DadosOfertaTroca{
+			Oferta:           nova.Req,
+			CartaOferecida:   cartaOferecida,
+			CartaDesejada:    cartaDesejada,
+			ExpiraEmSegundos: int(TROCA_OFERTA_PRAZO / time.Second),
+			Contraproposta:   contraproposta,
+		}),
+	}
+	s.notificarJogadorDaSala(sala, nova.Req.IDJogadorOferta, msg)
+	s.notificarJogadorDaSala(sala, nova.Req.IDJogadorDesejado, msg)
+}
+
+// aceitarTroca executa a proposta pendente, se quem aceita é o jogador que a recebeu
+func (s *Servidor) aceitarTroca(sala *tipos.Sala, req *protocolo.TrocarCartasReq) {
+	sala.Mutex.Lock()
+	oferta := sala.OfertaTroca
+	if oferta == nil || oferta.Req.OfertaID != req.OfertaID {
+		sala.Mutex.Unlock()
+		s.notificarErroTroca(sala, req.ClienteID, "Essa proposta de troca não está mais pendente.")
+		return
+	}
+	if oferta.Req.IDJogadorDesejado != req.ClienteID {
+		sala.Mutex.Unlock()
+		s.notificarErroTroca(sala, req.ClienteID, fmt.Sprintf("Só %s pode aceitar esta proposta.", oferta.Req.NomeJogadorDesejado))
+		return
+	}
+	sala.OfertaTroca = nil
+	sala.Mutex.Unlock()
+
+	log.Printf("[TROCA:%s] Sala %s: %s aceitou a proposta %s", s.ServerID, sala.ID, oferta.Req.NomeJogadorDesejado, oferta.Req.OfertaID)
+	s.executarTroca(sala, oferta)
+}
+
+// recusarTroca descarta a proposta pendente: recusada por quem a recebeu ou
+// cancelada por quem a fez
+func (s *Servidor) recusarTroca(sala *tipos.Sala, req *protocolo.TrocarCartasReq) {
+	sala.Mutex.Lock()
+	oferta := sala.OfertaTroca
+	if oferta == nil || oferta.Req.OfertaID != req.OfertaID ||
+		(req.ClienteID != oferta.Req.IDJogadorOferta && req.ClienteID != oferta.Req.IDJogadorDesejado) {
+		sala.Mutex.Unlock()
+		s.notificarErroTroca(sala, req.ClienteID, "Essa proposta de troca não está mais pendente.")
+		return
+	}
+	sala.OfertaTroca = nil
+	sala.Mutex.Unlock()
+
+	if req.ClienteID == oferta.Req.IDJogadorDesejado {
+		s.encerrarOfertaTroca(sala, &oferta.Req, "recusada", fmt.Sprintf("%s recusou a proposta de troca.", oferta.Req.NomeJogadorDesejado))
+	} else {
+		s.encerrarOfertaTroca(sala, &oferta.Req, "cancelada", fmt.Sprintf("%s cancelou a proposta de troca.", oferta.Req.NomeJogadorOferta))
+	}
+}
+
+// expirarOfertaTroca descarta a proposta que ficou sem resposta por TROCA_OFERTA_PRAZO
+func (s *Servidor) expirarOfertaTroca(sala *tipos.Sala, ofertaID string) {
+	sala.Mutex.Lock()
+	oferta := sala.OfertaTroca
+	if oferta == nil || oferta.Req.OfertaID != ofertaID {
+		sala.Mutex.Unlock()
+		return // Já foi respondida ou substituída por uma contraproposta
+	}
+	sala.OfertaTroca = nil
+	sala.Mutex.Unlock()
+	s.encerrarOfertaTroca(sala, &oferta.Req, "expirada", "A proposta de troca expirou sem resposta.")
+}
+
+// encerrarOfertaTroca avisa os dois jogadores que a proposta não vai ser executada
+func (s *Servidor) encerrarOfertaTroca(sala *tipos.Sala, req *protocolo.TrocarCartasReq, motivo, texto string) {
+	log.Printf("[TROCA:%s] Sala %s: proposta %s encerrada (%s)", s.ServerID, sala.ID, req.OfertaID, motivo)
+	msg := protocolo.Mensagem{
+		Comando: "TROCA_ENCERRADA",
+		Dados:   seguranca.MustJSON(protocolo.TrocarCartasResp{Sucesso: false, Mensagem: texto, OfertaID: req.OfertaID, Motivo: motivo}),
+	}
+	s.notificarJogadorDaSala(sala, req.IDJogadorOferta, msg)
+	s.notificarJogadorDaSala(sala, req.IDJogadorDesejado, msg)
+}
+
+// notificarJogadorDaSala entrega uma mensagem a um jogador da sala, pelo broker deste
+// servidor ou pelo outro servidor da partida
+func (s *Servidor) notificarJogadorDaSala(sala *tipos.Sala, clienteID string, msg protocolo.Mensagem) {
+	if s.getClienteLocal(clienteID) != nil {
+		s.publicarParaCliente(clienteID, msg)
+		return
+	}
+	sala.Mutex.Lock()
+	outroServidor := sala.ServidorSombra
+	if outroServidor == s.MeuEndereco {
+		outroServidor = sala.ServidorHost
+	}
+	sala.Mutex.Unlock()
+	if outroServidor != "" {
+		go s.notificarJogadorRemoto(outroServidor, clienteID, msg)
+	}
+}
+
+func (s *Servidor) notificarErroTroca(sala *tipos.Sala, clienteID, texto string) {
+	s.notificarJogadorDaSala(sala, clienteID, protocolo.Mensagem{
+		Comando: "ERRO",
+		Dados:   seguranca.MustJSON(protocolo.DadosErro{Mensagem: texto}),
+	})
+}
+
+// buscarCartaDoJogador procura a carta no inventário do jogador: no mapa de clientes,
+// no servidor remoto dele ou, em último caso, na cópia da sala
+func (s *Servidor) buscarCartaDoJogador(sala *tipos.Sala, clienteID, cartaID string) tipos.Carta {
+	if s.getClienteLocal(clienteID) != nil {
+		return s.BuscarCartaEmCliente(clienteID, cartaID)
+	}
+
+	sala.Mutex.Lock()
+	outroServidor := sala.ServidorSombra
+	if outroServidor == s.MeuEndereco {
+		outroServidor = sala.ServidorHost
+	}
+	sala.Mutex.Unlock()
+	if outroServidor != "" {
+		body, _ := json.Marshal(map[string]interface{}{
+			"cliente_id": clienteID,
+			"carta_id":   cartaID,
+		})
+		resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/partida/buscar_carta", outroServidor), body)
+		if err != nil {
+			log.Printf("[TROCA] Erro ao buscar a carta %s de %s em %s: %v", cartaID, clienteID, outroServidor, err)
+		} else {
+			defer resp.Body.Close()
+			var result struct {
+				Encontrada bool        `json:"encontrada"`
+				Carta      tipos.Carta `json:"carta"`
+			}
+			if resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&result) == nil && result.Encontrada {
+				return result.Carta
+			}
+		}
+	}
+
+	if jogador := s.getClienteDaSala(sala, clienteID); jogador != nil {
+		if carta, idx := s.findCartaNoInventario(jogador, cartaID); idx != -1 {
+			return carta
+		}
+	}
+	return tipos.Carta{}
+}
+
+// trocarCartasLocais executa a troca quando os dois jogadores estão neste servidor:
+// os dois inventários mudam sob os dois locks, ou nenhum muda
+func (s *Servidor) trocarCartasLocais(sala *tipos.Sala, req *protocolo.TrocarCartasReq, ofertante, desejado *tipos.Cliente) {
+	primeiro, segundo := ofertante, desejado
+	if segundo.ID < primeiro.ID {
+		primeiro, segundo = segundo, primeiro
+	}
+	primeiro.Mutex.Lock()
+	segundo.Mutex.Lock()
+
+	idxOferta, idxDesejada := -1, -1
+	for i, c := range ofertante.Inventario {
+		if c.ID == req.IDCartaOferecida {
+			idxOferta = i
+			break
+		}
+	}
+	for i, c := range desejado.Inventario {
+		if c.ID == req.IDCartaDesejada {
+			idxDesejada = i
+			break
+		}
+	}
+	if idxOferta == -1 || idxDesejada == -1 {
+		segundo.Mutex.Unlock()
+		primeiro.Mutex.Unlock()
+		s.encerrarOfertaTroca(sala, req, "falhou", "A troca falhou: uma das cartas não está mais no inventário.")
+		return
+	}
+
+	cartaOferta := ofertante.Inventario[idxOferta]
+	cartaDesejada := desejado.Inventario[idxDesejada]
+	invOferta := append(append(make([]tipos.Carta, 0, len(ofertante.Inventario)), ofertante.Inventario[:idxOferta]...), ofertante.Inventario[idxOferta+1:]...)
+	invDesejado := append(append(make([]tipos.Carta, 0, len(desejado.Inventario)), desejado.Inventario[:idxDesejada]...), desejado.Inventario[idxDesejada+1:]...)
+	ofertante.Inventario = append(invOferta, cartaDesejada)
+	desejado.Inventario = append(invDesejado, cartaOferta)
+	snapshotOferta := append([]tipos.Carta(nil), ofertante.Inventario...)
+	snapshotDesejado := append([]tipos.Carta(nil), desejado.Inventario...)
 
-func (s *Servidor) ProcessarTrocaDireta(sala *tipos.Sala, req *protocolo.TrocarCartasReq) {
-	s.processarTrocaCartas(sala, req)
-}
+	segundo.Mutex.Unlock()
+	primeiro.Mutex.Unlock()
 
-// AplicarTrocaLocal remove a carta desejada do cliente local e adiciona a carta oferecida
-func (s *Servidor) BuscarCartaEmCliente(clienteID, cartaID string) tipos.Carta {
-	s.mutexClientes.RLock()
-	cliente := s.Clientes[clienteID]
-	s.mutexClientes.RUnlock()
+	go s.salvarTransferencia([]string{ofertante.ID, desejado.ID}, []razao.Movimento{
+		{ID: req.OfertaID + "/" + cartaOferta.ID + "/" + razao.TIPO_TROCA, Tipo: razao.TIPO_TROCA, Carta: cartaOferta, De: ofertante.ID, DeNome: req.NomeJogadorOferta, Para: desejado.ID, ParaNome: req.NomeJogadorDesejado, Referencia: req.OfertaID},
+		{ID: req.OfertaID + "/" + cartaDesejada.ID + "/" + razao.TIPO_TROCA, Tipo: razao.TIPO_TROCA, Carta: cartaDesejada, De: desejado.ID, DeNome: req.NomeJogadorDesejado, Para: ofertante.ID, ParaNome: req.NomeJogadorOferta, Referencia: req.OfertaID},
+	})
+	s.notificarSucessoTrocaComInventario(ofertante.ID, cartaOferta.Nome, cartaDesejada.Nome, snapshotOferta)
+	s.notificarSucessoTrocaComInventario(desejado.ID, cartaDesejada.Nome, cartaOferta.Nome, snapshotDesejado)
+	log.Printf("[TROCA:%s] Sala %s: %s trocou %s por %s com %s", s.ServerID, sala.ID, req.NomeJogadorOferta, cartaOferta.Nome, cartaDesejada.Nome, req.NomeJogadorDesejado)
+}
 
-	if cliente == nil {
-		return tipos.Carta{}
+// executarTroca executa uma proposta aceita. Chamado apenas no Host. Com um dos
+// jogadores no outro servidor da partida, a troca vira uma transação do coordenador
+// (reserva as duas cartas, confirma nos dois servidores).
+func (s *Servidor) executarTroca(sala *tipos.Sala, oferta *tipos.OfertaTroca) {
+	req := &oferta.Req
+	ofertanteLocal := s.getClienteLocal(req.IDJogadorOferta)
+	desejadoLocal := s.getClienteLocal(req.IDJogadorDesejado)
+	if ofertanteLocal != nil && desejadoLocal != nil {
+		s.trocarCartasLocais(sala, req, ofertanteLocal, desejadoLocal)
+		return
 	}
 
-	cliente.Mutex.Lock()
-	var cartaEncontrada tipos.Carta
-	for _, c := range cliente.Inventario {
-		if c.ID == cartaID {
-			cartaEncontrada = c
-			break
+	sala.Mutex.Lock()
+	outroServidor := sala.ServidorSombra
+	if outroServidor == s.MeuEndereco {
+		outroServidor = sala.ServidorHost
+	}
+	sala.Mutex.Unlock()
+	servidorDe := func(local *tipos.Cliente) string {
+		if local != nil {
+			return s.MeuEndereco
 		}
+		return outroServidor
+	}
+
+	t := &troca.Transacao{
+		ID:          req.OfertaID,
+		SalaID:      sala.ID,
+		Coordenador: s.MeuEndereco,
+		Lados: [2]troca.Lado{
+			{
+				Servidor:   servidorDe(ofertanteLocal),
+				ClienteID:  req.IDJogadorOferta,
+				Nome:       req.NomeJogadorOferta,
+				CartaSai:   oferta.CartaOferecida,
+				CartaEntra: oferta.CartaDesejada,
+			},
+			{
+				Servidor:   servidorDe(desejadoLocal),
+				ClienteID:  req.IDJogadorDesejado,
+				Nome:       req.NomeJogadorDesejado,
+				CartaSai:   oferta.CartaDesejada,
+				CartaEntra: oferta.CartaOferecida,
+			},
+		},
 	}
-	cliente.Mutex.Unlock()
-
-	return cartaEncontrada
+	log.Printf("[TROCA:%s] Sala %s: iniciando a transação %s entre %s e %s", s.ServerID, sala.ID, t.ID, outroServidor, s.MeuEndereco)
+	go func() {
+		// Quem recebe as cartas é avisado pelo servidor de cada jogador, na confirmação
+		if err := s.Trocas.Executar(t); err != nil {
+			s.encerrarOfertaTroca(sala, req, "falhou", fmt.Sprintf("A troca falhou: %v", err))
+		}
+	}()
 }
 
-func (s *Servidor) AplicarTrocaLocal(clienteID string, idCartaDesejada string, cartaOferecida tipos.Carta) (bool, tipos.Carta, []tipos.Carta) {
-	log.Printf("[APLICAR_TROCA_LOCAL] Cliente: %s, removendo carta ID: %s, adicionando: %s", clienteID, idCartaDesejada, cartaOferecida.Nome)
+// ParticiparTroca executa neste servidor uma fase de uma transação de troca para um
+// jogador local. As fases podem ser repetidas pelo coordenador sem efeito duplicado.
+func (s *Servidor) ParticiparTroca(p troca.Pedido) error {
+	lado := p.Lado
+	switch p.Fase {
+	case troca.FASE_PREPARAR:
+		return s.reservarCartaParaTroca(p)
+
+	case troca.FASE_ABORTAR:
+		if s.ReservasTroca.Liberar(p.TrocaID, lado.ClienteID) {
+			log.Printf("[TROCA_TX:%s] Troca %s abortada: %s liberada para %s", s.ServerID, p.TrocaID, lado.CartaSai.Nome, lado.Nome)
+		}
+		return nil
 
-	s.mutexClientes.RLock()
-	cliente := s.Clientes[clienteID]
-	s.mutexClientes.RUnlock()
+	case troca.FASE_CONFIRMAR:
+		return s.confirmarLadoDaTroca(p)
+	}
+	return fmt.Errorf("%w: fase desconhecida: %s", troca.ErrRecusado, p.Fase)
+}
+
+// reservarCartaParaTroca separa a carta que o jogador local vai entregar. Falha se ela
+// não está no inventário ou já está reservada para outra troca e, numa troca fora de
+// partida (sem SalaID), se o jogador entrou em uma partida. A reserva é gravada e só
+// sai com a decisão do coordenador. O inventário é conferido e a carta reservada sob
+// o lock do jogador, o mesmo em que uma jogada confere a reserva e tira a carta da
+// mão (tirarCartaDaMao), para que a carta não seja jogada e reservada ao mesmo tempo.
+func (s *Servidor) reservarCartaParaTroca(p troca.Pedido) error {
+	lado := p.Lado
+	if _, existe := s.ReservasTroca.Buscar(p.TrocaID, lado.ClienteID); existe {
+		return nil
+	}
+	cliente := s.getClienteLocal(lado.ClienteID)
 	if cliente == nil {
-		log.Printf("[APLICAR_TROCA_LOCAL] Cliente %s não encontrado", clienteID)
-		return false, tipos.Carta{}, nil
+		return fmt.Errorf("%w: %s não está conectado a %s", troca.ErrRecusado, lado.Nome, s.MeuEndereco)
+	}
+	if _, emPartida := salaDoCliente(cliente); emPartida && p.SalaID == "" {
+		return fmt.Errorf("%w: %s entrou em uma partida", troca.ErrRecusado, lado.Nome)
 	}
 	cliente.Mutex.Lock()
 	defer cliente.Mutex.Unlock()
+	if !temCarta(cliente.Inventario, lado.CartaSai.ID) {
+		return fmt.Errorf("%w: %s não possui %s", troca.ErrRecusado, lado.Nome, lado.CartaSai.Nome)
+	}
+	return s.ReservasTroca.Reservar(troca.Reserva{
+		TrocaID:     p.TrocaID,
+		ClienteID:   lado.ClienteID,
+		CartaID:     lado.CartaSai.ID,
+		CartaNome:   lado.CartaSai.Nome,
+		Coordenador: p.Coordenador,
+		CriadaEm:    time.Now(),
+	})
+}
 
-	log.Printf("[APLICAR_TROCA_LOCAL] Inventário do cliente tem %d cartas", len(cliente.Inventario))
-
-	idx := -1
-	var cartaRemovida tipos.Carta
-	for i, c := range cliente.Inventario {
-		if c.ID == idCartaDesejada {
-			idx = i
-			cartaRemovida = c
-			log.Printf("[APLICAR_TROCA_LOCAL] Carta encontrada no índice %d: %s", i, c.Nome)
-			break
+// confirmarLadoDaTroca troca a carta reservada pela recebida. Quem votou "sim" não
+// recusa a confirmação: a carta que sai é tirada se ainda estiver no inventário e a
+// que entra é colocada se ainda não estiver, então repetir não muda nada. Se o
+// jogador não está conectado aqui (ex.: o servidor reiniciou), a troca é aplicada
+// à conta salva no log replicado. A reserva só é apagada depois disso.
+func (s *Servidor) confirmarLadoDaTroca(p troca.Pedido) error {
+	lado := p.Lado
+	if _, existe := s.ReservasTroca.Buscar(p.TrocaID, lado.ClienteID); !existe {
+		return nil // Confirmação repetida: a troca já foi aplicada
+	}
+	// Cada lado registra a carta que entrega, na mesma entrada do seu inventário
+	movimentos := []razao.Movimento{{
+		ID: p.TrocaID + "/" + lado.CartaSai.ID + "/" + razao.TIPO_TROCA, Tipo: razao.TIPO_TROCA, Carta: lado.CartaSai,
+		De: lado.ClienteID, DeNome: lado.Nome, Para: p.Contraparte, ParaNome: p.ContraparteNome, Referencia: p.TrocaID,
+	}}
+
+	if cliente := s.getClienteLocal(lado.ClienteID); cliente != nil {
+		cliente.Mutex.Lock()
+		cliente.Inventario = trocarCartaNoInventario(cliente.Inventario, lado.CartaSai.ID, lado.CartaEntra)
+		inventario := make([]tipos.Carta, len(cliente.Inventario))
+		copy(inventario, cliente.Inventario)
+		cliente.Mutex.Unlock()
+		if err := s.salvarTransferencia([]string{lado.ClienteID}, movimentos); err != nil {
+			return fmt.Errorf("inventário de %s não comprometido: %v", lado.Nome, err)
+		}
+		s.notificarSucessoTrocaComInventario(lado.ClienteID, lado.CartaSai.Nome, lado.CartaEntra.Nome, inventario)
+	} else {
+		conta := s.Contas.BuscarPorID(lado.ClienteID)
+		if conta == nil {
+			return fmt.Errorf("conta de %s não encontrada", lado.Nome)
+		}
+		s.mutexInventarios.Lock()
+		err := s.proporTransferencia(transferenciaCartas{
+			Inventarios: []inventarioConta{{ID: conta.ID, Inventario: trocarCartaNoInventario(conta.Inventario, lado.CartaSai.ID, lado.CartaEntra)}},
+			Movimentos:  movimentos,
+		})
+		s.mutexInventarios.Unlock()
+		if err != nil {
+			return fmt.Errorf("inventário de %s não comprometido: %v", lado.Nome, err)
 		}
 	}
-	if idx == -1 {
-		log.Printf("[APLICAR_TROCA_LOCAL] Carta %s não encontrada no inventário", idCartaDesejada)
-		log.Printf("[APLICAR_TROCA_LOCAL] Inventário atual: %v", cliente.Inventario)
-		return false, tipos.Carta{}, nil
-	}
-	// Remove a carta do inventário
-	inv := make([]tipos.Carta, 0, len(cliente.Inventario))
-	inv = append(inv, cliente.Inventario[:idx]...)
-	inv = append(inv, cliente.Inventario[idx+1:]...)
-	// Adiciona a nova carta
-	inv = append(inv, cartaOferecida)
-	cliente.Inventario = inv
-	snapshot := make([]tipos.Carta, len(inv))
-	copy(snapshot, inv)
-	log.Printf("[APLICAR_TROCA_LOCAL] Inventário atualizado para %d cartas. Cartas atuais: %v", len(inv), inv)
-	return true, cartaRemovida, snapshot
-}
 
-func (s *Servidor) processarTrocaCartas(sala *tipos.Sala, req *protocolo.TrocarCartasReq) {
-	log.Printf("[TROCA] === INÍCIO PROCESSAMENTO TROCA FORÇADA ===")
-	log.Printf("[TROCA] Sala: %s", sala.ID)
-	log.Printf("[TROCA] Ofertante: %s (%s) -> carta: %s", req.NomeJogadorOferta, req.IDJogadorOferta, req.IDCartaOferecida)
-	log.Printf("[TROCA] Desejado: %s (%s) -> carta: %s", req.NomeJogadorDesejado, req.IDJogadorDesejado, req.IDCartaDesejada)
+	s.ReservasTroca.Liberar(p.TrocaID, lado.ClienteID)
+	log.Printf("[TROCA_TX:%s] Troca %s confirmada: %s deu %s e recebeu %s", s.ServerID, p.TrocaID, lado.Nome, lado.CartaSai.Nome, lado.CartaEntra.Nome)
+	return nil
+}
 
-	// NECESSÁRIO: Apenas o Host coordena a troca
-	if sala.ServidorHost != s.MeuEndereco {
-		log.Printf("[TROCA] Shadow (servidor %s) encaminhando troca para o Host %s", s.MeuEndereco, sala.ServidorHost)
-		s.encaminharTrocaParaHost(sala.ServidorHost, sala.ID, req)
-		return
+// temCarta diz se a carta está no inventário
+func temCarta(inventario []tipos.Carta, cartaID string) bool {
+	for _, c := range inventario {
+		if c.ID == cartaID {
+			return true
+		}
 	}
+	return false
+}
 
-	// Processa a troca no Host
-	log.Printf("[TROCA] Processando troca no Host")
+// trocarCartaNoInventario devolve o inventário sem a carta `saiID` e com `entra`
+func trocarCartaNoInventario(inventario []tipos.Carta, saiID string, entra tipos.Carta) []tipos.Carta {
+	novo := make([]tipos.Carta, 0, len(inventario)+1)
+	temEntra := false
+	for _, c := range inventario {
+		if c.ID == saiID {
+			continue
+		}
+		if c.ID == entra.ID {
+			temEntra = true
+		}
+		novo = append(novo, c)
+	}
+	if !temEntra {
+		novo = append(novo, entra)
+	}
+	return novo
+}
 
-	// Busca jogadores
-	s.mutexClientes.RLock()
-	jogadorOferta := s.Clientes[req.IDJogadorOferta]
-	jogadorDesejado := s.Clientes[req.IDJogadorDesejado]
-	s.mutexClientes.RUnlock()
+// cartaReservadaParaTroca diz se a carta do jogador local está presa a uma troca em andamento
+func (s *Servidor) cartaReservadaParaTroca(clienteID, cartaID string) bool {
+	return s.ReservasTroca.Reservada(clienteID, cartaID)
+}
 
-	// Busca na sala se não encontrou no mapa global
-	if jogadorOferta == nil {
-		sala.Mutex.Lock()
-		for _, j := range sala.Jogadores {
-			if j.ID == req.IDJogadorOferta {
-				jogadorOferta = j
-				log.Printf("[TROCA] Jogador ofertante %s encontrado na cópia da sala", j.Nome)
-				break
+// vigiarReservasTroca consulta o coordenador das reservas que estão há mais de
+// TROCA_RESERVA_PRAZO sem decisão. A reserva só é liberada se a troca foi abortada
+// ou se o coordenador não a conhece (ele grava a troca antes de pedir reservas);
+// sem resposta, ela continua presa. Na mesma passagem, apaga do diário as trocas
+// coordenadas aqui que terminaram há mais de TROCA_DIARIO_RETENCAO.
+func (s *Servidor) vigiarReservasTroca() {
+	ticker := time.NewTicker(TROCA_RESERVA_PRAZO)
+	defer ticker.Stop()
+	for range ticker.C {
+		if n := s.Trocas.Coletar(TROCA_DIARIO_RETENCAO); n > 0 {
+			log.Printf("[TROCA_TX:%s] %d trocas terminadas apagadas do diário", s.ServerID, n)
+		}
+		for _, reserva := range s.ReservasTroca.Antigas(TROCA_RESERVA_PRAZO) {
+			t, encontrada, err := s.consultarTroca(reserva.Coordenador, reserva.TrocaID)
+			if err != nil {
+				log.Printf("[TROCA_TX:%s] Reserva de %s para a troca %s mantida: coordenador %s não respondeu (%v)", s.ServerID, reserva.CartaNome, reserva.TrocaID, reserva.Coordenador, err)
+				continue
+			}
+			if encontrada && t.Estado != troca.ESTADO_ABORTANDO && t.Estado != troca.ESTADO_ABORTADA {
+				continue
+			}
+			if s.ReservasTroca.Liberar(reserva.TrocaID, reserva.ClienteID) {
+				log.Printf("[TROCA_TX:%s] Reserva de %s para a troca %s liberada: a troca foi abortada", s.ServerID, reserva.CartaNome, reserva.TrocaID)
 			}
 		}
-		sala.Mutex.Unlock()
 	}
+}
 
-	if jogadorDesejado == nil {
-		sala.Mutex.Lock()
-		for _, j := range sala.Jogadores {
-			if j.ID == req.IDJogadorDesejado {
-				jogadorDesejado = j
-				log.Printf("[TROCA] Jogador desejado %s encontrado na cópia da sala", j.Nome)
-				break
-			}
+// consultarTroca busca a transação no servidor que a coordena
+func (s *Servidor) consultarTroca(coordenador, trocaID string) (troca.Transacao, bool, error) {
+	if coordenador == s.MeuEndereco {
+		t, ok := s.Trocas.Buscar(trocaID)
+		return t, ok, nil
+	}
+	resp, err := s.enviarRequestComToken("GET", fmt.Sprintf("http://%s/troca/transacao/%s", coordenador, trocaID), nil)
+	if err != nil {
+		return troca.Transacao{}, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var t troca.Transacao
+		if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+			return troca.Transacao{}, false, err
 		}
-		sala.Mutex.Unlock()
+		return t, true, nil
+	case http.StatusNotFound:
+		return troca.Transacao{}, false, nil
+	default:
+		return troca.Transacao{}, false, fmt.Errorf("status %d", resp.StatusCode)
 	}
+}
 
-	if jogadorOferta == nil || jogadorDesejado == nil {
-		s.notificarErro(req.IDJogadorOferta, "Um dos jogadores não foi encontrado.")
-		return
+// enviarPedidoTroca é o transporte do coordenador de trocas: chama ParticiparTroca
+// direto quando o jogador é deste servidor
+func (s *Servidor) enviarPedidoTroca(servidor string, p troca.Pedido) error {
+	if servidor == s.MeuEndereco {
+		return s.ParticiparTroca(p)
+	}
+	body, _ := json.Marshal(p)
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/troca/participar", servidor), body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var res struct {
+		Erro string `json:"error"`
 	}
+	json.NewDecoder(resp.Body).Decode(&res)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusConflict:
+		return fmt.Errorf("%w: %s", troca.ErrRecusado, res.Erro)
+	default:
+		return fmt.Errorf("status %d: %s", resp.StatusCode, res.Erro)
+	}
+}
 
-	// Busca carta do ofertante
-	var cartaOferta tipos.Carta
-	idxOferta := -1
+// atualizarCopiaDaTroca aplica um lado confirmado à cópia do jogador remoto na sala.
+// O estado que o Host replica para a Sombra sai dessas cópias; sem isso, a próxima
+// sincronização desfaria a troca no servidor do jogador.
+func (s *Servidor) atualizarCopiaDaTroca(salaID, clienteID string, sai, entra tipos.Carta) {
+	if s.getClienteLocal(clienteID) != nil {
+		return // O inventário real já foi alterado por confirmarLadoDaTroca
+	}
+	s.mutexSalas.RLock()
+	sala := s.Salas[salaID]
+	s.mutexSalas.RUnlock()
+	if sala == nil {
+		return
+	}
+	jogador := s.getClienteDaSala(sala, clienteID)
+	if jogador == nil {
+		return
+	}
+	jogador.Mutex.Lock()
+	defer jogador.Mutex.Unlock()
+	for i, c := range jogador.Inventario {
+		if c.ID == sai.ID {
+			jogador.Inventario[i] = entra
+			return
+		}
+	}
+}
 
-	// Tenta no mapa real primeiro
-	s.mutexClientes.RLock()
-	jogadorReal := s.Clientes[req.IDJogadorOferta]
-	s.mutexClientes.RUnlock()
+// GetTransacaoTroca devolve uma transação coordenada por este servidor
+func (s *Servidor) GetTransacaoTroca(trocaID string) (troca.Transacao, bool) {
+	return s.Trocas.Buscar(trocaID)
+}
 
-	if jogadorReal != nil {
-		// Cliente local
-		jogadorReal.Mutex.Lock()
-		for i, c := range jogadorReal.Inventario {
-			if c.ID == req.IDCartaOferecida {
-				cartaOferta = c
-				idxOferta = i
-				break
-			}
-		}
-		jogadorReal.Mutex.Unlock()
-		log.Printf("[TROCA] Carta ofertante %s encontrada no inventário real (idx: %d)", cartaOferta.Nome, idxOferta)
-	} else {
-		// Cliente remoto - busca no servidor dele via HTTP
-		log.Printf("[TROCA] Jogador ofertante %s está remoto. Buscando carta via HTTP...", req.NomeJogadorOferta)
-
-		// Determina servidor do jogador ofertante
-		var servidorJogadorOferta string
-		if sala.ServidorHost == s.MeuEndereco {
-			// Sou Host, jogador remoto está na Sombra
-			servidorJogadorOferta = sala.ServidorSombra
-		} else {
-			// Sou Shadow, jogador remoto está no Host
-			servidorJogadorOferta = sala.ServidorHost
-		}
+// ResolverTroca aplica a decisão do operador (retomar ou abortar) a uma troca
+// suspensa coordenada por este servidor
+func (s *Servidor) ResolverTroca(trocaID, decisao string) error {
+	return s.Trocas.Resolver(trocaID, decisao)
+}
 
-		log.Printf("[TROCA] Buscando no servidor %s a carta %s do jogador %s", servidorJogadorOferta, req.IDCartaOferecida, req.IDJogadorOferta)
+// ==================== TROCAS FORA DE PARTIDA ====================
 
-		// Busca a carta no servidor remoto
-		payload := map[string]interface{}{
-			"cliente_id": req.IDJogadorOferta,
-			"carta_id":   req.IDCartaOferecida,
-		}
-		body, _ := json.Marshal(payload)
+// handleClienteTroca recebe os comandos de troca fora de partida (clientes/{id}/troca).
+// Uma proposta nova é coordenada pelo servidor de quem a faz; as respostas vão para o
+// coordenador da proposta.
+func (s *Servidor) handleClienteTroca(client mqtt.Client, msg mqtt.Message) {
+	partes := strings.Split(msg.Topic(), "/")
+	if len(partes) != 3 {
+		log.Printf("[TROCA_LOBBY_ERRO:%s] Tópico de troca inválido: %s", s.ServerID, msg.Topic())
+		return
+	}
+	clienteID := partes[1]
+	var mensagem protocolo.Mensagem
+	var req protocolo.TrocarCartasReq
+	if err := json.Unmarshal(msg.Payload(), &mensagem); err != nil || json.Unmarshal(mensagem.Dados, &req) != nil {
+		log.Printf("[TROCA_LOBBY_ERRO:%s] Comando de troca inválido de %s", s.ServerID, clienteID)
+		return
+	}
+	if !s.comandoAutenticado(clienteID, mensagem.TokenSessao, mensagem.Comando) {
+		return
+	}
+	if s.clienteLogado(clienteID) == nil {
+		s.notificarErro(clienteID, "Faça login antes de trocar cartas.")
+		return
+	}
+	req.ClienteID = clienteID // Quem envia é sempre o dono do tópico
 
-		url := fmt.Sprintf("http://%s/partida/buscar_carta", servidorJogadorOferta)
-		resp, err := s.enviarRequestComToken("POST", url, body)
-		if err != nil {
-			log.Printf("[TROCA] Erro ao buscar carta do ofertante no remoto: %v", err)
-		} else if resp != nil {
-			defer resp.Body.Close()
-			if resp.StatusCode == 200 {
-				var result struct {
-					Encontrada bool        `json:"encontrada"`
-					Carta      tipos.Carta `json:"carta"`
-				}
-				if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Encontrada {
-					cartaOferta = result.Carta
-					idxOferta = 99 // Placeholder para indicar que foi encontrada remotamente
-					log.Printf("[TROCA] Carta ofertante %s encontrada no servidor remoto", cartaOferta.Nome)
-				}
-			}
+	coordenador := s.MeuEndereco
+	if mensagem.Comando != "TROCAR_CARTAS_OFERTA" {
+		oferta, ok := s.OfertasTroca.Buscar(req.OfertaID)
+		if !ok {
+			s.notificarErro(clienteID, "Essa proposta de troca não está mais pendente.")
+			return
 		}
+		coordenador = oferta.Coordenador
+	}
 
-		// Se ainda não encontrou, tenta na cópia da sala como fallback
-		if cartaOferta.ID == "" {
-			sala.Mutex.Lock()
-			for _, j := range sala.Jogadores {
-				if j.ID == req.IDJogadorOferta {
-					for i, c := range j.Inventario {
-						if c.ID == req.IDCartaOferecida {
-							cartaOferta = c
-							idxOferta = i
-							log.Printf("[TROCA] Carta ofertante %s encontrada na cópia da sala (fallback)", cartaOferta.Nome)
-							break
-						}
-					}
-					break
-				}
-			}
-			sala.Mutex.Unlock()
-		}
+	var err error
+	if coordenador == s.MeuEndereco {
+		err = s.ProcessarTrocaForaDePartida(mensagem.Comando, req)
+	} else {
+		err = s.encaminharTrocaForaDePartida(coordenador, mensagem.Comando, req)
+	}
+	if err != nil {
+		log.Printf("[TROCA_LOBBY:%s] %s de %s recusado: %v", s.ServerID, mensagem.Comando, clienteID, err)
+		s.notificarErro(clienteID, fmt.Sprintf("Não foi possível concluir o comando de troca: %v", err))
 	}
+}
 
-	if cartaOferta.ID == "" {
-		s.notificarErro(req.IDJogadorOferta, "Você não possui esta carta.")
+// handleClienteBuscarJogador procura um jogador pelo nome no cluster e devolve as
+// cartas dele (JOGADOR_ENCONTRADO), para o cliente escolher o que pedir numa troca
+func (s *Servidor) handleClienteBuscarJogador(client mqtt.Client, msg mqtt.Message) {
+	var dados map[string]string
+	if err := json.Unmarshal(msg.Payload(), &dados); err != nil {
+		log.Printf("[TROCA_LOBBY_ERRO:%s] Erro ao decodificar JSON: %v", s.ServerID, err)
+		return
+	}
+	clienteID, nome := dados["cliente_id"], strings.TrimSpace(dados["nome"])
+	if !s.comandoAutenticado(clienteID, dados["token_sessao"], "BUSCAR_JOGADOR") || s.clienteLogado(clienteID) == nil {
+		return
+	}
+	jogador, ok := s.localizarJogador(nome)
+	if !ok {
+		s.notificarErro(clienteID, fmt.Sprintf("%s não está conectado a nenhum servidor.", nome))
 		return
 	}
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "JOGADOR_ENCONTRADO", Dados: seguranca.MustJSON(jogador)})
+}
 
-	// Busca carta desejada
-	var cartaDesejada tipos.Carta
+// BuscarJogadorLocal procura pelo nome um jogador logado neste servidor
+func (s *Servidor) BuscarJogadorLocal(nome string) (protocolo.DadosJogador, bool) {
+	var encontrado *tipos.Cliente
 	s.mutexClientes.RLock()
-	jogadorDesejadoLocal := s.Clientes[req.IDJogadorDesejado]
+	for _, cliente := range s.Clientes {
+		cliente.Mutex.Lock()
+		igual := cliente.Nome != "" && strings.EqualFold(cliente.Nome, nome)
+		cliente.Mutex.Unlock()
+		if igual {
+			encontrado = cliente
+			break
+		}
+	}
 	s.mutexClientes.RUnlock()
+	if encontrado == nil {
+		return protocolo.DadosJogador{}, false
+	}
+
+	_, emPartida := salaDoCliente(encontrado)
+	encontrado.Mutex.Lock()
+	defer encontrado.Mutex.Unlock()
+	return protocolo.DadosJogador{
+		ClienteID:  encontrado.ID,
+		Nome:       encontrado.Nome,
+		Servidor:   s.MeuEndereco,
+		EmPartida:  emPartida,
+		Inventario: append([]tipos.Carta(nil), encontrado.Inventario...),
+	}, true
+}
 
-	if jogadorDesejadoLocal != nil {
-		// Jogador local - busca no inventário real
-		jogadorDesejadoLocal.Mutex.Lock()
-		for _, c := range jogadorDesejadoLocal.Inventario {
-			if c.ID == req.IDCartaDesejada {
-				cartaDesejada = c
-				break
-			}
+// localizarJogador procura o jogador neste servidor e depois nos outros servidores ativos
+func (s *Servidor) localizarJogador(nome string) (protocolo.DadosJogador, bool) {
+	if jogador, ok := s.BuscarJogadorLocal(nome); ok {
+		return jogador, true
+	}
+	for _, servidor := range s.ClusterManager.GetServidoresAtivos(s.MeuEndereco) {
+		resp, err := s.enviarRequestComToken("GET", fmt.Sprintf("http://%s/troca/jogador/%s", servidor, url.PathEscape(nome)), nil)
+		if err != nil {
+			continue
 		}
-		jogadorDesejadoLocal.Mutex.Unlock()
-		log.Printf("[TROCA] Carta desejada %s encontrada no inventário real", cartaDesejada.Nome)
-	} else {
-		// Jogador está em outro servidor - busca no servidor remoto via HTTP
-		log.Printf("[TROCA] Jogador desejado %s está remoto. Buscando carta via HTTP no servidor dele...", req.NomeJogadorDesejado)
-
-		// Determina servidor do jogador desejado
-		var servidorJogadorDesejado string
-		if sala.ServidorHost == s.MeuEndereco {
-			// Sou Host, jogador remoto está na Sombra
-			servidorJogadorDesejado = sala.ServidorSombra
-		} else {
-			// Sou Shadow, jogador remoto está no Host
-			servidorJogadorDesejado = sala.ServidorHost
+		var jogador protocolo.DadosJogador
+		ok := resp.StatusCode == http.StatusOK && json.NewDecoder(resp.Body).Decode(&jogador) == nil
+		resp.Body.Close()
+		if ok {
+			return jogador, true
 		}
+	}
+	return protocolo.DadosJogador{}, false
+}
 
-		log.Printf("[TROCA] Buscando no servidor %s a carta %s do jogador %s", servidorJogadorDesejado, req.IDCartaDesejada, req.IDJogadorDesejado)
+// ProcessarTrocaForaDePartida executa um comando de troca fora de partida no servidor
+// que coordena a proposta. O erro é mostrado a quem enviou o comando.
+func (s *Servidor) ProcessarTrocaForaDePartida(comando string, req protocolo.TrocarCartasReq) error {
+	switch comando {
+	case "TROCAR_CARTAS_OFERTA":
+		return s.proporTrocaForaDePartida(req, false)
+	case "TROCA_CONTRAPROPOSTA":
+		return s.proporTrocaForaDePartida(req, true)
+	case "TROCA_ACEITAR":
+		return s.aceitarTrocaForaDePartida(req)
+	case "TROCA_RECUSAR":
+		return s.recusarTrocaForaDePartida(req)
+	}
+	return fmt.Errorf("comando desconhecido: %s", comando)
+}
 
-		// Busca a carta no servidor remoto
-		payload := map[string]interface{}{
-			"cliente_id": req.IDJogadorDesejado,
-			"carta_id":   req.IDCartaDesejada,
+// proporTrocaForaDePartida registra uma proposta (ou contraproposta) entre dois
+// jogadores que não estão em partida, depois de conferir as cartas de cada um
+func (s *Servidor) proporTrocaForaDePartida(req protocolo.TrocarCartasReq, contraproposta bool) error {
+	var nomeOfertante, nomeDesejado string
+	var atual troca.Oferta
+	if contraproposta {
+		var ok bool
+		atual, ok = s.OfertasTroca.Buscar(req.OfertaID)
+		if !ok || atual.Coordenador != s.MeuEndereco {
+			return fmt.Errorf("a proposta não está mais pendente")
 		}
-		body, _ := json.Marshal(payload)
-
-		url := fmt.Sprintf("http://%s/partida/buscar_carta", servidorJogadorDesejado)
-		resp, err := s.enviarRequestComToken("POST", url, body)
-		if err != nil {
-			log.Printf("[TROCA] Erro ao buscar carta no remoto: %v", err)
-		} else if resp != nil {
-			defer resp.Body.Close()
-			if resp.StatusCode == 200 {
-				var result struct {
-					Encontrada bool        `json:"encontrada"`
-					Carta      tipos.Carta `json:"carta"`
-				}
-				if json.NewDecoder(resp.Body).Decode(&result) == nil && result.Encontrada {
-					cartaDesejada = result.Carta
-					log.Printf("[TROCA] Carta desejada %s encontrada no servidor remoto", cartaDesejada.Nome)
-				}
-			}
+		if atual.Req.IDJogadorDesejado != req.ClienteID {
+			return fmt.Errorf("só quem recebeu a proposta pode fazer uma contraproposta")
 		}
-
-		// Se ainda não encontrou, tenta na cópia da sala como fallback
-		if cartaDesejada.ID == "" {
-			sala.Mutex.Lock()
-			for _, j := range sala.Jogadores {
-				if j.ID == req.IDJogadorDesejado {
-					log.Printf("[TROCA] Fallback: buscando carta %s no inventário de %s na cópia. Total: %d", req.IDCartaDesejada, j.Nome, len(j.Inventario))
-					for _, c := range j.Inventario {
-						if c.ID == req.IDCartaDesejada {
-							cartaDesejada = c
-							log.Printf("[TROCA] Carta desejada %s encontrada na cópia da sala", cartaDesejada.Nome)
-							break
-						}
-					}
-					break
-				}
-			}
-			sala.Mutex.Unlock()
+		nomeOfertante, nomeDesejado = atual.Req.NomeJogadorDesejado, atual.Req.NomeJogadorOferta
+	} else {
+		cliente := s.clienteLogado(req.ClienteID)
+		if cliente == nil {
+			return fmt.Errorf("você não está conectado")
 		}
+		if len(s.OfertasTroca.FeitasPor(req.ClienteID, s.MeuEndereco)) > 0 {
+			return fmt.Errorf("você já tem uma proposta pendente (use /recusar para cancelá-la)")
+		}
+		cliente.Mutex.Lock()
+		nomeOfertante = cliente.Nome
+		cliente.Mutex.Unlock()
+		nomeDesejado = req.NomeJogadorDesejado
 	}
 
-	if cartaDesejada.ID == "" {
-		s.notificarErro(req.IDJogadorOferta, fmt.Sprintf("%s não possui esta carta.", req.NomeJogadorDesejado))
-		return
-	}
-
-	// EXECUTA A TROCA - Remove carta do ofertante e adiciona carta desejada
-	var novoInventario []tipos.Carta
-
-	if jogadorReal != nil && idxOferta != 99 {
-		// Atualiza inventário real do jogador local
-		jogadorReal.Mutex.Lock()
-		inventario := jogadorReal.Inventario
-		inventario = append(inventario[:idxOferta], inventario[idxOferta+1:]...)
-		inventario = append(inventario, cartaDesejada)
-		jogadorReal.Inventario = inventario
-		novoInventario = make([]tipos.Carta, len(inventario))
-		copy(novoInventario, inventario)
-		jogadorReal.Mutex.Unlock()
-		log.Printf("[TROCA] Inventário real do ofertante atualizado: %d cartas", len(inventario))
-	} else if idxOferta == 99 {
-		// Carta foi encontrada em servidor remoto - precisa aplicar remoto
-		log.Printf("[TROCA] Carta do ofertante veio do servidor remoto. Aplicando troca remota...")
-
-		// Determina servidor do jogador ofertante
-		var servidorJogadorOferta string
-		if sala.ServidorHost == s.MeuEndereco {
-			servidorJogadorOferta = sala.ServidorSombra
-		} else {
-			servidorJogadorOferta = sala.ServidorHost
+	ofertante, ok := s.localizarJogador(nomeOfertante)
+	if !ok || ofertante.ClienteID != req.ClienteID {
+		return fmt.Errorf("você não está conectado")
+	}
+	desejado, ok := s.localizarJogador(nomeDesejado)
+	if !ok {
+		return fmt.Errorf("%s não está conectado a nenhum servidor", nomeDesejado)
+	}
+	if desejado.ClienteID == ofertante.ClienteID {
+		return fmt.Errorf("não é possível trocar com você mesmo")
+	}
+	for _, jogador := range []protocolo.DadosJogador{ofertante, desejado} {
+		if jogador.EmPartida {
+			return fmt.Errorf("%s está em uma partida (dentro dela, use /trocar)", jogador.Nome)
 		}
-
-		// Aplica troca no servidor remoto do ofertante
-		// Remove carta oferecida e adiciona carta desejada
-		payload := map[string]interface{}{
-			"cliente_id":        req.IDJogadorOferta,
-			"carta_desejada_id": req.IDCartaOferecida, // Carta que será REMOVIDA
-			"carta_oferecida":   cartaDesejada,        // Carta que será ADICIONADA
+	}
+	cartaOferecida, ok := cartaDaLista(ofertante.Inventario, req.IDCartaOferecida)
+	if !ok {
+		return fmt.Errorf("você não possui esta carta")
+	}
+	cartaDesejada, ok := cartaDaLista(desejado.Inventario, req.IDCartaDesejada)
+	if !ok {
+		return fmt.Errorf("%s não possui esta carta", desejado.Nome)
+	}
+
+	nova := troca.Oferta{
+		Req: protocolo.TrocarCartasReq{
+			IDJogadorOferta:     ofertante.ClienteID,
+			NomeJogadorOferta:   ofertante.Nome,
+			IDJogadorDesejado:   desejado.ClienteID,
+			NomeJogadorDesejado: desejado.Nome,
+			IDCartaOferecida:    cartaOferecida.ID,
+			IDCartaDesejada:     cartaDesejada.ID,
+			OfertaID:            uuid.New().String(),
+		},
+		CartaOferecida:   cartaOferecida,
+		CartaDesejada:    cartaDesejada,
+		ServidorOferta:   ofertante.Servidor,
+		ServidorDesejado: desejado.Servidor,
+		Coordenador:      s.MeuEndereco,
+		ExpiraEm:         time.Now().Add(TROCA_OFERTA_PRAZO),
+	}
+	if contraproposta {
+		if _, ok := s.OfertasTroca.Tomar(atual.Req.OfertaID); !ok {
+			return fmt.Errorf("a proposta não está mais pendente")
 		}
-		log.Printf("[TROCA] Aplicando troca remota: removendo %s e adicionando %s", req.IDCartaOferecida, cartaDesejada.Nome)
-		body, _ := json.Marshal(payload)
+	}
+	s.OfertasTroca.Registrar(nova)
+	time.AfterFunc(TROCA_OFERTA_PRAZO, func() { s.expirarOfertaForaDePartida(nova.Req.OfertaID) })
 
-		url := fmt.Sprintf("http://%s/partida/aplicar_troca_local", servidorJogadorOferta)
-		log.Printf("[TROCA] Chamando %s", url)
-		resp, err := s.enviarRequestComToken("POST", url, body)
-		if err != nil {
-			log.Printf("[TROCA] Erro ao aplicar troca no ofertante remoto: %v", err)
-		} else if resp != nil {
-			defer resp.Body.Close()
-			if resp.StatusCode == 200 {
-				var result struct {
-					Status     string        `json:"status"`
-					Inventario []tipos.Carta `json:"inventario"`
-				}
-				decoder := json.NewDecoder(resp.Body)
-				if err := decoder.Decode(&result); err == nil {
-					novoInventario = result.Inventario
-					log.Printf("[TROCA] Inventário atualizado recebido do ofertante remoto: %d cartas", len(novoInventario))
-					log.Printf("[TROCA] Primeira carta: %+v", result.Inventario[0])
-				} else {
-					log.Printf("[TROCA] Erro ao decodificar resposta: %v", err)
-					// Lê o body para debug
-					bodyBytes, _ := io.ReadAll(resp.Body)
-					log.Printf("[TROCA] Resposta raw: %s", string(bodyBytes))
-				}
-			} else {
-				log.Printf("[TROCA] Status code: %d", resp.StatusCode)
-			}
-			log.Printf("[TROCA] Troca aplicada no ofertante remoto com sucesso")
+	log.Printf("[TROCA_LOBBY:%s] %s (%s) propõe %s por %s de %s (%s), proposta %s",
+		s.ServerID, ofertante.Nome, ofertante.Servidor, cartaOferecida.Nome, cartaDesejada.Nome, desejado.Nome, desejado.Servidor, nova.Req.OfertaID)
+	msg := protocolo.Mensagem{
+		Comando: "TROCA_PROPOSTA",
+		Dados: seguranca.MustJSON(protocolo.DadosOfertaTroca{
+			Oferta:           nova.Req,
+			CartaOferecida:   cartaOferecida,
+			CartaDesejada:    cartaDesejada,
+			ExpiraEmSegundos: int(TROCA_OFERTA_PRAZO / time.Second),
+			Contraproposta:   contraproposta,
+			ForaDePartida:    true,
+		}),
+	}
+	s.avisarJogadorDaOferta(nova, nova.Req.IDJogadorOferta, msg, false)
+	s.avisarJogadorDaOferta(nova, nova.Req.IDJogadorDesejado, msg, false)
+	return nil
+}
+
+// aceitarTrocaForaDePartida executa a proposta como uma transação do coordenador de
+// trocas, mesmo com os dois jogadores neste servidor
+func (s *Servidor) aceitarTrocaForaDePartida(req protocolo.TrocarCartasReq) error {
+	oferta, ok := s.OfertasTroca.Buscar(req.OfertaID)
+	if !ok || oferta.Coordenador != s.MeuEndereco {
+		return fmt.Errorf("a proposta não está mais pendente")
+	}
+	if oferta.Req.IDJogadorDesejado != req.ClienteID {
+		return fmt.Errorf("só %s pode aceitar esta proposta", oferta.Req.NomeJogadorDesejado)
+	}
+	if _, ok := s.OfertasTroca.Tomar(req.OfertaID); !ok {
+		return fmt.Errorf("a proposta não está mais pendente")
+	}
+
+	log.Printf("[TROCA_LOBBY:%s] %s aceitou a proposta %s", s.ServerID, oferta.Req.NomeJogadorDesejado, oferta.Req.OfertaID)
+	t := &troca.Transacao{
+		ID:          oferta.Req.OfertaID,
+		Coordenador: s.MeuEndereco,
+		Lados: [2]troca.Lado{
+			{
+				Servidor:   oferta.ServidorOferta,
+				ClienteID:  oferta.Req.IDJogadorOferta,
+				Nome:       oferta.Req.NomeJogadorOferta,
+				CartaSai:   oferta.CartaOferecida,
+				CartaEntra: oferta.CartaDesejada,
+			},
+			{
+				Servidor:   oferta.ServidorDesejado,
+				ClienteID:  oferta.Req.IDJogadorDesejado,
+				Nome:       oferta.Req.NomeJogadorDesejado,
+				CartaSai:   oferta.CartaDesejada,
+				CartaEntra: oferta.CartaOferecida,
+			},
+		},
+	}
+	go func() {
+		if err := s.Trocas.Executar(t); err != nil {
+			s.encerrarOfertaForaDePartida(oferta, "falhou", fmt.Sprintf("A troca falhou: %v", err))
 		}
+	}()
+	return nil
+}
+
+// recusarTrocaForaDePartida descarta a proposta: recusada por quem a recebeu ou
+// cancelada por quem a fez
+func (s *Servidor) recusarTrocaForaDePartida(req protocolo.TrocarCartasReq) error {
+	oferta, ok := s.OfertasTroca.Buscar(req.OfertaID)
+	if !ok || oferta.Coordenador != s.MeuEndereco ||
+		(req.ClienteID != oferta.Req.IDJogadorOferta && req.ClienteID != oferta.Req.IDJogadorDesejado) {
+		return fmt.Errorf("a proposta não está mais pendente")
 	}
+	if _, ok := s.OfertasTroca.Tomar(req.OfertaID); !ok {
+		return fmt.Errorf("a proposta não está mais pendente")
+	}
+	if req.ClienteID == oferta.Req.IDJogadorDesejado {
+		s.encerrarOfertaForaDePartida(oferta, "recusada", fmt.Sprintf("%s recusou a proposta de troca.", oferta.Req.NomeJogadorDesejado))
+	} else {
+		s.encerrarOfertaForaDePartida(oferta, "cancelada", fmt.Sprintf("%s cancelou a proposta de troca.", oferta.Req.NomeJogadorOferta))
+	}
+	return nil
+}
 
-	// Se jogador desejado está local, executa a troca reversa
-	if jogadorDesejadoLocal != nil {
-		// Remove carta desejada e adiciona carta oferecida
-		jogadorDesejadoLocal.Mutex.Lock()
-		inventario := jogadorDesejadoLocal.Inventario
-		idxDesejado := -1
-		for i, c := range inventario {
-			if c.ID == req.IDCartaDesejada {
-				idxDesejado = i
-				break
-			}
-		}
-		if idxDesejado != -1 {
-			inventario = append(inventario[:idxDesejado], inventario[idxDesejado+1:]...)
-			inventario = append(inventario, cartaOferta)
-			jogadorDesejadoLocal.Inventario = inventario
-		}
-		inventarioDesejado := make([]tipos.Carta, len(inventario))
-		copy(inventarioDesejado, inventario)
-		jogadorDesejadoLocal.Mutex.Unlock()
-		log.Printf("[TROCA] Inventário real do desejado atualizado: %d cartas", len(inventario))
+// expirarOfertaForaDePartida descarta a proposta que ficou sem resposta por TROCA_OFERTA_PRAZO
+func (s *Servidor) expirarOfertaForaDePartida(ofertaID string) {
+	if oferta, ok := s.OfertasTroca.Tomar(ofertaID); ok {
+		s.encerrarOfertaForaDePartida(oferta, "expirada", "A proposta de troca expirou sem resposta.")
+	}
+}
 
-		// Notifica ambos
-		s.notificarSucessoTrocaComInventario(req.IDJogadorOferta, cartaOferta.Nome, cartaDesejada.Nome, novoInventario)
-		s.notificarSucessoTrocaComInventario(req.IDJogadorDesejado, cartaDesejada.Nome, cartaOferta.Nome, inventarioDesejado)
-	} else {
-		// Jogador desejado é remoto - solicita ao servidor dele aplicar a troca
-		log.Printf("[TROCA] Jogador desejado é remoto. Enviando para aplicar troca...")
-		payload := map[string]interface{}{
-			"cliente_id":        req.IDJogadorDesejado,
-			"carta_desejada_id": req.IDCartaDesejada,
-			"carta_oferecida":   cartaOferta,
-		}
-		body, _ := json.Marshal(payload)
-
-		// Determina servidor destino - lógica corrigida:
-		// Se sou Host, jogador remoto está na Sombra
-		// Se sou Shadow, jogador remoto está no Host
-		servidorDestino := sala.ServidorSombra
-		if s.MeuEndereco == sala.ServidorHost {
-			// Sou Host, remoto está na Sombra
-			servidorDestino = sala.ServidorSombra
-		} else {
-			// Sou Shadow, remoto está no Host
-			servidorDestino = sala.ServidorHost
-		}
+// encerrarOfertaForaDePartida avisa os dois jogadores que a proposta não vai ser executada
+func (s *Servidor) encerrarOfertaForaDePartida(oferta troca.Oferta, motivo, texto string) {
+	log.Printf("[TROCA_LOBBY:%s] Proposta %s encerrada (%s)", s.ServerID, oferta.Req.OfertaID, motivo)
+	msg := protocolo.Mensagem{
+		Comando: "TROCA_ENCERRADA",
+		Dados: seguranca.MustJSON(protocolo.TrocarCartasResp{
+			Mensagem: texto,
+			OfertaID: oferta.Req.OfertaID,
+			Motivo:   motivo,
+		}),
+	}
+	s.avisarJogadorDaOferta(oferta, oferta.Req.IDJogadorOferta, msg, true)
+	s.avisarJogadorDaOferta(oferta, oferta.Req.IDJogadorDesejado, msg, true)
+}
 
-		url := fmt.Sprintf("http://%s/partida/aplicar_troca_local", servidorDestino)
-		log.Printf("[TROCA] Enviando para %s", url)
-		resp, err := s.enviarRequestComToken("POST", url, body)
+// avisarJogadorDaOferta envia a mensagem ao jogador no servidor dele. Um servidor
+// remoto também guarda (ou apaga) a sua cópia da oferta, usada para encaminhar as
+// respostas do jogador ao coordenador.
+func (s *Servidor) avisarJogadorDaOferta(oferta troca.Oferta, clienteID string, msg protocolo.Mensagem, encerrada bool) {
+	servidor := oferta.ServidorOferta
+	if clienteID == oferta.Req.IDJogadorDesejado {
+		servidor = oferta.ServidorDesejado
+	}
+	if servidor == s.MeuEndereco {
+		s.publicarParaCliente(clienteID, msg)
+		return
+	}
+	aviso := troca.Aviso{ClienteID: clienteID, Mensagem: msg, Oferta: oferta, Encerrada: encerrada}
+	go func() {
+		resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/troca/oferta/avisar", servidor), seguranca.MustJSON(aviso))
 		if err != nil {
-			log.Printf("[TROCA] Falha ao aplicar troca no remoto %s: %v", servidorDestino, err)
-		} else if resp != nil {
-			defer resp.Body.Close()
-			log.Printf("[TROCA] Troca aplicada com sucesso no remoto")
+			log.Printf("[TROCA_LOBBY:%s] Erro ao avisar %s em %s: %v", s.ServerID, clienteID, servidor, err)
+			return
 		}
+		resp.Body.Close()
+	}()
+}
 
-		// Notifica ambos os jogadores (a notificação para o desejado já foi enviada pelo aplicador remoto)
-		log.Printf("[TROCA] Notificando ofertante com inventário de %d cartas", len(novoInventario))
-		s.notificarSucessoTrocaComInventario(req.IDJogadorOferta, cartaOferta.Nome, cartaDesejada.Nome, novoInventario)
+// AvisarOfertaTroca entrega ao jogador local uma mensagem do coordenador da oferta
+func (s *Servidor) AvisarOfertaTroca(aviso troca.Aviso) {
+	if aviso.Encerrada {
+		s.OfertasTroca.Tomar(aviso.Oferta.Req.OfertaID)
+	} else {
+		s.OfertasTroca.Registrar(aviso.Oferta)
 	}
+	s.publicarParaCliente(aviso.ClienteID, aviso.Mensagem)
+}
 
-	// Atualiza a cópia da sala
-	sala.Mutex.Lock()
-	for i := range sala.Jogadores {
-		if sala.Jogadores[i].ID == req.IDJogadorOferta {
-			sala.Jogadores[i].Inventario = novoInventario
-			log.Printf("[TROCA] Cópia da sala atualizada para %s", req.NomeJogadorOferta)
-			break
+// encaminharTrocaForaDePartida repassa o comando do jogador local ao servidor que
+// coordena a proposta e devolve a recusa dele, se houver
+func (s *Servidor) encaminharTrocaForaDePartida(coordenador, comando string, req protocolo.TrocarCartasReq) error {
+	body, _ := json.Marshal(map[string]interface{}{
+		"comando": comando,
+		"req":     req,
+	})
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/troca/oferta/comando", coordenador), body)
+	if err != nil {
+		return fmt.Errorf("o servidor da proposta não respondeu")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var res struct {
+			Erro string `json:"error"`
 		}
+		json.NewDecoder(resp.Body).Decode(&res)
+		return fmt.Errorf("%s", res.Erro)
 	}
-	sala.Mutex.Unlock()
+	return nil
+}
 
-	// Se o ofertante é local, também atualiza o inventário real
-	s.mutexClientes.RLock()
-	clienteOferta := s.Clientes[req.IDJogadorOferta]
-	s.mutexClientes.RUnlock()
-	if clienteOferta != nil {
-		clienteOferta.Mutex.Lock()
-		clienteOferta.Inventario = novoInventario
-		clienteOferta.Mutex.Unlock()
-		log.Printf("[TROCA] Inventário real do ofertante local atualizado para %d cartas", len(novoInventario))
+func cartaDaLista(cartas []tipos.Carta, cartaID string) (tipos.Carta, bool) {
+	for _, c := range cartas {
+		if c.ID == cartaID {
+			return c, true
+		}
 	}
-
-	log.Printf("[TROCA] === FIM PROCESSAMENTO TROCA === %s trocou %s por %s com %s", req.NomeJogadorOferta, cartaOferta.Nome, cartaDesejada.Nome, req.NomeJogadorDesejado)
+	return tipos.Carta{}, false
 }
 
 // encaminharTrocaParaHost envia uma requisição de troca de cartas do Shadow para o Host via HTTP
-func (s *Servidor) encaminharTrocaParaHost(hostAddr, salaID string, req *protocolo.TrocarCartasReq) {
-	log.Printf("[TROCA_SHADOW] Encaminhando requisição de troca para o Host %s na sala %s", hostAddr, salaID)
+func (s *Servidor) encaminharTrocaParaHost(hostAddr, salaID, tipoComando string, req *protocolo.TrocarCartasReq) {
+	log.Printf("[TROCA_SHADOW] Encaminhando %s para o Host %s na sala %s", tipoComando, hostAddr, salaID)
 
 	// Cria a mensagem de comando para encaminhar
 	comando := protocolo.Mensagem{
-		Comando: "TROCAR_CARTAS",
+		Comando: tipoComando,
 		Dados:   seguranca.MustJSON(req),
 	}
 
@@ -2870,6 +6403,7 @@ func (s *Servidor) criarEstadoDaSala(sala *tipos.Sala) *tipos.EstadoPartida {
 		copy(invCopy, j.Inventario)
 		jogadoresEstado = append(jogadoresEstado, tipos.JogadorEstado{
 			ID:         j.ID,
+			Nome:       j.Nome,
 			Inventario: invCopy,
 		})
 		j.Mutex.Unlock()
@@ -2888,6 +6422,10 @@ func (s *Servidor) criarEstadoDaSala(sala *tipos.Sala) *tipos.EstadoPartida {
 		EventSeq:      sala.EventSeq,
 		EventLog:      sala.EventLog,
 		Jogadores:     jogadoresEstado,
+		Hash:          game.HashSala(sala),
+		PrazoTurno:    sala.PrazoTurno,
+		Serie:         sala.Serie,
+		Epoca:         sala.Epoca,
 	}
 }
 
@@ -2902,30 +6440,432 @@ func (s *Servidor) notificarErroPartida(clienteID, mensagem, salaID string) {
 	s.publicarParaCliente(clienteID, msg)
 }
 
-// ==================== UTILITÁRIOS ====================
+// ==================== MERCADO DE CARTAS ====================
 
-func mustJSON(v interface{}) []byte {
-	b, _ := json.Marshal(v)
-	return b
+// handleClienteMercado recebe os comandos do mercado (clientes/{id}/mercado). As
+// consultas usam a cópia local do mercado; anúncios, compras e cancelamentos vão ao líder.
+func (s *Servidor) handleClienteMercado(client mqtt.Client, msg mqtt.Message) {
+	partes := strings.Split(msg.Topic(), "/")
+	if len(partes) != 3 {
+		log.Printf("[MERCADO_ERRO:%s] Tópico do mercado inválido: %s", s.ServerID, msg.Topic())
+		return
+	}
+	clienteID := partes[1]
+	var mensagem protocolo.Mensagem
+	var req protocolo.MercadoReq
+	if err := json.Unmarshal(msg.Payload(), &mensagem); err != nil || json.Unmarshal(mensagem.Dados, &req) != nil {
+		log.Printf("[MERCADO_ERRO:%s] Comando do mercado inválido de %s", s.ServerID, clienteID)
+		return
+	}
+	if !s.comandoAutenticado(clienteID, mensagem.TokenSessao, mensagem.Comando) {
+		return
+	}
+	cliente := s.clienteLogado(clienteID)
+	if cliente == nil {
+		s.notificarErro(clienteID, "Faça login antes de usar o mercado.")
+		return
+	}
+
+	switch mensagem.Comando {
+	case "MERCADO_LISTAR":
+		filtro := mercado.Filtro{Raridade: req.Raridade, Nome: req.Nome, ValorMin: req.ValorMin, ValorMax: req.ValorMax}
+		s.responderMercado(clienteID, "MERCADO_ANUNCIOS", s.Mercado.Listar(filtro))
+		return
+	case "MERCADO_SALDO":
+		s.responderMercado(clienteID, "SALDO", s.Mercado.DoVendedor(clienteID))
+		return
+	}
+
+	// As operações mexem no inventário, que durante uma partida é copiado para a sala
+	if _, emPartida := salaDoCliente(cliente); emPartida {
+		s.notificarErro(clienteID, "Termine a partida antes de negociar no mercado.")
+		return
+	}
+	cliente.Mutex.Lock()
+	nome := cliente.Nome
+	cliente.Mutex.Unlock()
+
+	var err error
+	switch mensagem.Comando {
+	case "MERCADO_ANUNCIAR":
+		err = s.anunciarCarta(cliente, req.CartaID, req.Preco)
+	case "MERCADO_COMPRAR":
+		err = s.operarMercado(mercado.Operacao{Tipo: mercado.OPERACAO_COMPRAR, ClienteID: clienteID, Nome: nome, AnuncioID: req.AnuncioID})
+	case "MERCADO_CANCELAR":
+		err = s.operarMercado(mercado.Operacao{Tipo: mercado.OPERACAO_CANCELAR, ClienteID: clienteID, Nome: nome, AnuncioID: req.AnuncioID})
+	default:
+		log.Printf("[MERCADO_ERRO:%s] Comando desconhecido de %s: %s", s.ServerID, clienteID, mensagem.Comando)
+		return
+	}
+	if err != nil {
+		log.Printf("[MERCADO:%s] %s de %s recusado: %v", s.ServerID, mensagem.Comando, clienteID, err)
+		s.notificarErro(clienteID, fmt.Sprintf("Mercado: %v", err))
+	}
 }
 
-// CORREÇÃO: Função auxiliar para mudança atômica de turno
-func (s *Servidor) mudarTurnoAtomicamente(sala *tipos.Sala, novoJogadorID string) {
-	// Encontra o nome do novo jogador
-	var novoJogadorNome string
-	for _, j := range sala.Jogadores {
-		if j.ID == novoJogadorID {
-			novoJogadorNome = j.Nome
-			break
+func (s *Servidor) responderMercado(clienteID, comando string, anuncios []mercado.Anuncio) {
+	moedas, _ := s.Contas.Moedas(clienteID)
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{
+		Comando: comando,
+		Dados:   seguranca.MustJSON(protocolo.DadosMercado{Anuncios: anuncios, Moedas: moedas}),
+	})
+}
+
+// anunciarCarta tira a carta do inventário do jogador (ela fica presa no anúncio) e
+// pede ao líder para publicá-la. Se o líder recusar, a carta volta ao inventário.
+func (s *Servidor) anunciarCarta(cliente *tipos.Cliente, cartaID string, preco int) error {
+	carta, err := tirarCartaDaMao(s.ReservasTroca, cliente, cartaID)
+	if err != nil {
+		return err
+	}
+	cliente.Mutex.Lock()
+	nome := cliente.Nome
+	cliente.Mutex.Unlock()
+
+	anuncio := mercado.Anuncio{
+		ID:           uuid.New().String(),
+		VendedorID:   cliente.ID,
+		VendedorNome: nome,
+		Carta:        carta,
+		Preco:        preco,
+		CriadoEm:     time.Now(),
+	}
+	if err := s.operarMercado(mercado.Operacao{Tipo: mercado.OPERACAO_ANUNCIAR, ClienteID: cliente.ID, Nome: nome, Anuncio: anuncio}); err != nil {
+		s.adicionarCartaAoCliente(cliente.ID, carta)
+		return err
+	}
+	go s.salvarInventario(cliente.ID)
+	return nil
+}
+
+// operarMercado leva a operação ao líder: direto, se este servidor é o líder, ou
+// por /mercado/operar
+func (s *Servidor) operarMercado(op mercado.Operacao) error {
+	if s.ClusterManager.SouLider() {
+		return s.OperarMercado(op)
+	}
+	lider := s.ClusterManager.GetLider()
+	if lider == "" {
+		return fmt.Errorf("nenhum líder disponível no momento")
+	}
+	body, _ := json.Marshal(op)
+	resp, err := s.enviarRequestComToken("POST", fmt.Sprintf("http://%s/mercado/operar", lider), body)
+	if err != nil {
+		return fmt.Errorf("o líder não respondeu")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var res struct {
+			Erro string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&res)
+		return fmt.Errorf("%s", res.Erro)
+	}
+	return nil
+}
+
+// OperarMercado valida a operação e a compromete no log. Só no líder: validação e
+// proposta acontecem sob mutexMercado (o líder aplica a entrada antes de Propor
+// voltar), então um anúncio é vendido uma vez só e nenhum saldo fica negativo.
+func (s *Servidor) OperarMercado(op mercado.Operacao) error {
+	s.mutexMercado.Lock()
+	defer s.mutexMercado.Unlock()
+
+	var tipo string
+	var dados interface{}
+	switch op.Tipo {
+	case mercado.OPERACAO_ANUNCIAR:
+		if op.Anuncio.VendedorID != op.ClienteID || op.Anuncio.Carta.ID == "" {
+			return fmt.Errorf("anúncio inválido")
+		}
+		if err := s.Mercado.ValidarAnuncio(op.Anuncio); err != nil {
+			return err
+		}
+		tipo, dados = ENTRADA_MERCADO_ANUNCIO, op.Anuncio
+	case mercado.OPERACAO_COMPRAR:
+		anuncio, err := s.Mercado.ValidarCompra(op.AnuncioID, op.ClienteID)
+		if err != nil {
+			return err
+		}
+		if saldo, _ := s.Contas.Moedas(op.ClienteID); saldo < anuncio.Preco {
+			return fmt.Errorf("%w: %s custa %d moedas e você tem %d", contas.ErrSaldoInsuficiente, anuncio.Carta.Nome, anuncio.Preco, saldo)
+		}
+		tipo, dados = ENTRADA_MERCADO_VENDA, mercado.Venda{AnuncioID: anuncio.ID, CompradorID: op.ClienteID, CompradorNome: op.Nome, Em: time.Now()}
+	case mercado.OPERACAO_CANCELAR:
+		if _, err := s.Mercado.ValidarCancelamento(op.AnuncioID, op.ClienteID); err != nil {
+			return err
+		}
+		tipo, dados = ENTRADA_MERCADO_CANCELAMENTO, mercado.Cancelamento{AnuncioID: op.AnuncioID, Em: time.Now()}
+	default:
+		return fmt.Errorf("operação desconhecida: %s", op.Tipo)
+	}
+
+	if _, err := s.ClusterManager.Propor(tipo, dados); err != nil {
+		return fmt.Errorf("operação não confirmada pelo cluster: %v", err)
+	}
+	log.Printf("[MERCADO:%s] %s de %s comprometido", s.ServerID, op.Tipo, op.Nome)
+	return nil
+}
+
+// ListarMercado devolve os anúncios ativos que passam no filtro
+func (s *Servidor) ListarMercado(filtro mercado.Filtro) []mercado.Anuncio {
+	return s.Mercado.Listar(filtro)
+}
+
+// aplicarAnuncioMercado põe a carta à venda. A carta sai da conta do vendedor e, se
+// ele está neste servidor, também do inventário em memória (caso o servidor dele a
+// tenha devolvido por não ter recebido a resposta do líder a tempo).
+func (s *Servidor) aplicarAnuncioMercado(entrada tipos.EntradaLog) {
+	var anuncio mercado.Anuncio
+	if err := json.Unmarshal(entrada.Dados, &anuncio); err != nil {
+		log.Printf("[MERCADO] Entrada %d de anúncio inválida: %v", entrada.Indice, err)
+		return
+	}
+	if !s.Mercado.Adicionar(anuncio) {
+		return
+	}
+	if err := s.Contas.RemoverCarta(anuncio.VendedorID, anuncio.Carta.ID); err != nil {
+		log.Printf("[MERCADO] Anúncio da entrada %d: %v", entrada.Indice, err)
+	}
+	s.registrarNoRazao(entrada, razao.Movimento{
+		ID: anuncio.ID + "/" + razao.TIPO_ANUNCIADA, Tipo: razao.TIPO_ANUNCIADA, Carta: anuncio.Carta,
+		De: anuncio.VendedorID, DeNome: anuncio.VendedorNome, Referencia: anuncio.ID, Em: anuncio.CriadoEm,
+	})
+	if s.getClienteLocal(anuncio.VendedorID) != nil {
+		if s.removerCartaDoCliente(anuncio.VendedorID, anuncio.Carta.ID) {
+			go s.salvarInventario(anuncio.VendedorID)
+		}
+		s.notificarResultadoMercado(anuncio.VendedorID, "anunciada", anuncio)
+	}
+}
+
+// aplicarVendaMercado transfere as moedas e a carta de um anúncio vendido
+func (s *Servidor) aplicarVendaMercado(entrada tipos.EntradaLog) {
+	var venda mercado.Venda
+	if err := json.Unmarshal(entrada.Dados, &venda); err != nil {
+		log.Printf("[MERCADO] Entrada %d de venda inválida: %v", entrada.Indice, err)
+		return
+	}
+	anuncio, ok := s.Mercado.Remover(venda.AnuncioID)
+	if !ok {
+		return
+	}
+	variacoes := map[string]int{venda.CompradorID: -anuncio.Preco, anuncio.VendedorID: anuncio.Preco}
+	if err := s.Contas.AplicarMovimento("venda/"+anuncio.ID, variacoes); err != nil {
+		// O líder confere o saldo antes de propor; se ainda assim faltar, o anúncio continua à venda
+		log.Printf("[MERCADO] Venda da entrada %d descartada: %v", entrada.Indice, err)
+		s.Mercado.Adicionar(anuncio)
+		return
+	}
+	if err := s.Contas.AdicionarCarta(venda.CompradorID, anuncio.Carta); err != nil {
+		log.Printf("[MERCADO] Venda da entrada %d: %v", entrada.Indice, err)
+	}
+	s.registrarNoRazao(entrada, razao.Movimento{
+		ID: anuncio.ID + "/" + razao.TIPO_VENDIDA, Tipo: razao.TIPO_VENDIDA, Carta: anuncio.Carta,
+		Para: venda.CompradorID, ParaNome: venda.CompradorNome, Referencia: anuncio.ID, Em: venda.Em,
+	})
+	log.Printf("[MERCADO:%s] %s comprou %s de %s por %d moedas", s.ServerID, venda.CompradorNome, anuncio.Carta.Nome, anuncio.VendedorNome, anuncio.Preco)
+
+	if s.getClienteLocal(venda.CompradorID) != nil {
+		s.adicionarCartaAoCliente(venda.CompradorID, anuncio.Carta)
+		go s.salvarInventario(venda.CompradorID)
+		s.notificarResultadoMercado(venda.CompradorID, "comprada", anuncio)
+	}
+	if s.getClienteLocal(anuncio.VendedorID) != nil {
+		s.notificarResultadoMercado(anuncio.VendedorID, "vendida", anuncio)
+	}
+}
+
+// aplicarCancelamentoMercado devolve a carta do anúncio ao vendedor
+func (s *Servidor) aplicarCancelamentoMercado(entrada tipos.EntradaLog) {
+	var cancelamento mercado.Cancelamento
+	if err := json.Unmarshal(entrada.Dados, &cancelamento); err != nil {
+		log.Printf("[MERCADO] Entrada %d de cancelamento inválida: %v", entrada.Indice, err)
+		return
+	}
+	anuncio, ok := s.Mercado.Remover(cancelamento.AnuncioID)
+	if !ok {
+		return
+	}
+	if err := s.Contas.AdicionarCarta(anuncio.VendedorID, anuncio.Carta); err != nil {
+		log.Printf("[MERCADO] Cancelamento da entrada %d: %v", entrada.Indice, err)
+	}
+	s.registrarNoRazao(entrada, razao.Movimento{
+		ID: anuncio.ID + "/" + razao.TIPO_RETIRADA, Tipo: razao.TIPO_RETIRADA, Carta: anuncio.Carta,
+		Para: anuncio.VendedorID, ParaNome: anuncio.VendedorNome, Referencia: anuncio.ID, Em: cancelamento.Em,
+	})
+	if s.getClienteLocal(anuncio.VendedorID) != nil {
+		s.adicionarCartaAoCliente(anuncio.VendedorID, anuncio.Carta)
+		go s.salvarInventario(anuncio.VendedorID)
+		s.notificarResultadoMercado(anuncio.VendedorID, "cancelada", anuncio)
+	}
+}
+
+// adicionarCartaAoCliente coloca a carta no inventário em memória, se ainda não estiver lá
+func (s *Servidor) adicionarCartaAoCliente(clienteID string, carta tipos.Carta) {
+	cliente := s.getClienteLocal(clienteID)
+	if cliente == nil {
+		return
+	}
+	cliente.Mutex.Lock()
+	defer cliente.Mutex.Unlock()
+	if _, tem := cartaDaLista(cliente.Inventario, carta.ID); !tem {
+		cliente.Inventario = append(cliente.Inventario, carta)
+	}
+}
+
+// removerCartaDoCliente tira a carta do inventário em memória. Devolve false se ela não estava lá.
+func (s *Servidor) removerCartaDoCliente(clienteID, cartaID string) bool {
+	cliente := s.getClienteLocal(clienteID)
+	if cliente == nil {
+		return false
+	}
+	cliente.Mutex.Lock()
+	defer cliente.Mutex.Unlock()
+	for i, c := range cliente.Inventario {
+		if c.ID == cartaID {
+			cliente.Inventario = append(cliente.Inventario[:i:i], cliente.Inventario[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Servidor) notificarResultadoMercado(clienteID, operacao string, anuncio mercado.Anuncio) {
+	dados := protocolo.DadosResultadoMercado{Operacao: operacao, Anuncio: anuncio}
+	dados.Moedas, _ = s.Contas.Moedas(clienteID)
+	if cliente := s.getClienteLocal(clienteID); cliente != nil && operacao != "vendida" {
+		cliente.Mutex.Lock()
+		dados.Inventario = append(make([]tipos.Carta, 0, len(cliente.Inventario)), cliente.Inventario...)
+		cliente.Mutex.Unlock()
+	}
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "MERCADO_RESULTADO", Dados: seguranca.MustJSON(dados)})
+}
+
+// ==================== LIVRO-RAZÃO DAS CARTAS ====================
+
+// transferenciaCartas é o dado da entrada ENTRADA_CONTA_TRANSFERENCIA: os inventários
+// que uma transferência de cartas mudou e os movimentos que a registram no
+// livro-razão, comprometidos juntos
+type transferenciaCartas struct {
+	Inventarios []inventarioConta `json:"inventarios"`
+	Movimentos  []razao.Movimento `json:"movimentos"`
+}
+
+// salvarTransferencia grava numa entrada só os inventários em memória dos jogadores
+// deste servidor e os movimentos da transferência, então o livro-razão nunca fica
+// sem a transferência nem a transferência sem o livro. Os movimentos têm IDs fixos
+// (referência + carta + tipo): gravar de novo não os duplica.
+func (s *Servidor) salvarTransferencia(clienteIDs []string, movimentos []razao.Movimento) error {
+	s.mutexInventarios.Lock()
+	defer s.mutexInventarios.Unlock()
+
+	dados := transferenciaCartas{Movimentos: movimentos}
+	for _, id := range clienteIDs {
+		cliente := s.getClienteLocal(id)
+		if cliente == nil {
+			continue
+		}
+		cliente.Mutex.Lock()
+		dados.Inventarios = append(dados.Inventarios, inventarioConta{ID: cliente.ID, Inventario: append([]tipos.Carta(nil), cliente.Inventario...)})
+		cliente.Mutex.Unlock()
+	}
+	return s.proporTransferencia(dados)
+}
+
+// proporTransferencia carimba os movimentos com este servidor e a hora e propõe a
+// entrada. Assume mutexInventarios ativo.
+func (s *Servidor) proporTransferencia(dados transferenciaCartas) error {
+	agora := time.Now()
+	for i := range dados.Movimentos {
+		dados.Movimentos[i].Servidor = s.ServerID
+		dados.Movimentos[i].Em = agora
+	}
+	if _, err := s.ClusterManager.Propor(ENTRADA_CONTA_TRANSFERENCIA, dados); err != nil {
+		log.Printf("[RAZAO:%s] Transferência (%d movimentos) não confirmada pela maioria: %v", s.ServerID, len(dados.Movimentos), err)
+		return err
+	}
+	return nil
+}
+
+// aplicarTransferenciaCartas aplica os inventários e acrescenta os movimentos ao
+// livro-razão de uma transferência comprometida no log
+func (s *Servidor) aplicarTransferenciaCartas(entrada tipos.EntradaLog) {
+	var dados transferenciaCartas
+	if err := json.Unmarshal(entrada.Dados, &dados); err != nil {
+		log.Printf("[RAZAO] Entrada %d de transferência inválida: %v", entrada.Indice, err)
+		return
+	}
+	for _, inventario := range dados.Inventarios {
+		if err := s.Contas.AplicarInventario(inventario.ID, inventario.Inventario); err != nil {
+			log.Printf("[CONTAS] Inventário da entrada %d descartado: %v", entrada.Indice, err)
 		}
 	}
+	for _, m := range dados.Movimentos {
+		s.registrarNoRazao(entrada, m)
+	}
+}
+
+// registrarNoRazao acrescenta um movimento derivado da entrada do log. Quem aplica
+// entradas que já estão no log (como as do mercado) usa IDs fixos, então todos os
+// servidores registram o mesmo movimento uma vez só.
+func (s *Servidor) registrarNoRazao(entrada tipos.EntradaLog, m razao.Movimento) {
+	m.Indice = entrada.Indice
+	if _, err := s.Razao.Registrar(m); err != nil {
+		log.Printf("[RAZAO] Movimento da entrada %d não gravado: %v", entrada.Indice, err)
+	}
+}
+
+// handleClienteRazao responde (RAZAO_HISTORICO) com a história de uma carta ou, sem
+// carta_id, com os movimentos do próprio jogador
+func (s *Servidor) handleClienteRazao(client mqtt.Client, msg mqtt.Message) {
+	partes := strings.Split(msg.Topic(), "/")
+	if len(partes) != 3 {
+		return
+	}
+	clienteID := partes[1]
+	var dados map[string]string
+	if err := json.Unmarshal(msg.Payload(), &dados); err != nil {
+		log.Printf("[RAZAO_ERRO:%s] Erro ao decodificar JSON: %v", s.ServerID, err)
+		return
+	}
+	if !s.comandoAutenticado(clienteID, dados["token_sessao"], "RAZAO") || s.clienteLogado(clienteID) == nil {
+		return
+	}
+
+	resposta := protocolo.DadosRazao{CartaID: strings.TrimSpace(dados["carta_id"])}
+	if resposta.CartaID != "" {
+		resposta.Movimentos = s.Razao.DaCarta(resposta.CartaID)
+	} else {
+		resposta.Movimentos = s.Razao.DoJogador(clienteID)
+	}
+	if len(resposta.Movimentos) > RAZAO_LIMITE_CLIENTE {
+		resposta.Movimentos = resposta.Movimentos[len(resposta.Movimentos)-RAZAO_LIMITE_CLIENTE:]
+	}
+	s.publicarParaCliente(clienteID, protocolo.Mensagem{Comando: "RAZAO_HISTORICO", Dados: seguranca.MustJSON(resposta)})
+}
 
-	// Atualiza o turno
-	sala.TurnoDe = novoJogadorID
-	log.Printf("[TURNO_ATOMICO:%s] Turno alterado para: %s (%s)", sala.ID, novoJogadorNome, novoJogadorID)
+// HistoricoCarta devolve todos os movimentos de uma carta
+func (s *Servidor) HistoricoCarta(cartaID string) []razao.Movimento {
+	return s.Razao.DaCarta(cartaID)
+}
+
+// MovimentosDoJogador devolve todos os movimentos em que o jogador entregou ou recebeu uma carta
+func (s *Servidor) MovimentosDoJogador(clienteID string) []razao.Movimento {
+	return s.Razao.DoJogador(clienteID)
+}
+
+// AuditarCartas devolve os movimentos inconsistentes do livro-razão e as cartas
+// salvas em mais de uma conta
+func (s *Servidor) AuditarCartas() ([]razao.Inconsistencia, map[string][]string) {
+	return s.Razao.Auditar(), s.Contas.CartasEmMaisDeUmaConta()
+}
+
+// ==================== UTILITÁRIOS ====================
 
-	// CORREÇÃO: Notificação deve ser feita FORA do lock da sala para evitar deadlock
-	// A notificação será feita pela função chamadora após liberar o lock
+func mustJSON(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
 }
 
 // A estrutura Servidor agora implementa implicitamente a api.ServidorInterface
@@ -2977,7 +6917,7 @@ func (s *Servidor) EncaminharParaLider(c *gin.Context) {
 	}
 
 	proxyReq.Header = c.Request.Header
-	client := &http.Client{Timeout: 15 * time.Second}
+	client := &http.Client{Timeout: COMPRA_PACOTE_TIMEOUT} // A rota mais lenta é a compra de pacote
 	resp, err := client.Do(proxyReq)
 	if err != nil {
 		c.JSON(http.StatusBadGateway, gin.H{"error": "Falha ao encaminhar requisição para o líder"})
@@ -2988,8 +6928,140 @@ func (s *Servidor) EncaminharParaLider(c *gin.Context) {
 	c.DataFromReader(resp.StatusCode, resp.ContentLength, resp.Header.Get("Content-Type"), resp.Body, nil)
 }
 
-func (s *Servidor) FormarPacote() ([]tipos.Carta, error) {
-	return s.Store.FormarPacote(PACOTE_SIZE), nil
+// ==================== COMPRA DE PACOTES ====================
+
+// compraPacote é o dado das entradas ENTRADA_PACOTE_COMPRA e ENTRADA_PACOTE_CANCELAMENTO
+type compraPacote struct {
+	ID        string        `json:"id"`
+	ClienteID string        `json:"cliente_id"`
+	Nome      string        `json:"nome"`
+	SalaID    string        `json:"sala_id,omitempty"`
+	Preco     int           `json:"preco"`
+	Cartas    []tipos.Carta `json:"cartas"`
+	Retiradas []string      `json:"retiradas"` // Cartas que saem do estoque (as outras foram geradas com o estoque vazio)
+	Em        time.Time     `json:"em"`
+}
+
+// FormarPacote vende um pacote ao jogador. Só no líder, e sem lock durante a
+// proposta: duas compras simultâneas podem sortear a mesma carta ou contar com a
+// mesma moeda, e aplicarCompraPacote cancela a que for comprometida depois (cartas
+// fora do estoque ou débito recusado). Débito, retirada, cunhagem e entrega são uma
+// entrada só do log. Se o commit não for confirmado, o líder propõe o cancelamento:
+// depois dele, a compra valeu inteira ou não aconteceu, e nada fica para estornar.
+func (s *Servidor) FormarPacote(clienteID, salaID string) ([]tipos.Carta, error) {
+	conta := s.Contas.BuscarPorID(clienteID)
+	if conta == nil {
+		return nil, fmt.Errorf("conta %s não encontrada", clienteID)
+	}
+	if conta.Moedas < PACOTE_PRECO {
+		return nil, fmt.Errorf("%w: o pacote custa %d moedas e você tem %d", contas.ErrSaldoInsuficiente, PACOTE_PRECO, conta.Moedas)
+	}
+	cartas, retiradas := s.Store.EscolherPacote(PACOTE_SIZE)
+	if len(cartas) == 0 {
+		return nil, fmt.Errorf("não há cartas para formar um pacote")
+	}
+	compra := compraPacote{
+		ID:        uuid.New().String(),
+		ClienteID: clienteID,
+		Nome:      conta.Nome,
+		SalaID:    salaID,
+		Preco:     PACOTE_PRECO,
+		Cartas:    cartas,
+		Retiradas: retiradas,
+		Em:        time.Now(),
+	}
+
+	indice, err := s.ClusterManager.Propor(ENTRADA_PACOTE_COMPRA, compra)
+	if err != nil {
+		log.Printf("[ESTOQUE_REPLICA] Compra %s de %s sem commit confirmado (%v); propondo o cancelamento", compra.ID, clienteID, err)
+		if _, errCancelamento := s.ClusterManager.Propor(ENTRADA_PACOTE_CANCELAMENTO, compra); errCancelamento != nil {
+			return nil, fmt.Errorf("compra não confirmada pelo cluster: %v", err)
+		}
+		// Se este servidor deixou de ser o líder, o cancelamento é aplicado aqui depois
+		limite := time.Now().Add(CONTA_ESPERA_APLICACAO)
+		for !s.Contas.MovimentoAplicado(clienteID, compra.ID+SUFIXO_COMPRA_CANCELADA) && time.Now().Before(limite) {
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	if !s.Contas.MovimentoAplicado(clienteID, compra.ID) {
+		if err != nil {
+			return nil, fmt.Errorf("compra não confirmada pelo cluster: %v", err)
+		}
+		if s.Contas.MovimentoAplicado(clienteID, compra.ID+SUFIXO_COMPRA_CANCELADA) {
+			return nil, fmt.Errorf("as cartas sorteadas já não estão no estoque; tente de novo")
+		}
+		return nil, fmt.Errorf("%w: o débito do pacote foi recusado", contas.ErrSaldoInsuficiente)
+	}
+	log.Printf("[ESTOQUE_REPLICA] Compra %s de %s comprometida (índice %d, %d cartas do estoque)", compra.ID, clienteID, indice, len(retiradas))
+	return cartas, nil
+}
+
+// aplicarCompraPacote aplica uma compra comprometida, em todos os servidores: debita
+// o jogador, tira as cartas do estoque, registra a cunhagem e a entrega no
+// livro-razão e põe as cartas na conta (e no inventário em memória, no servidor da
+// sessão). Uma compra cancelada antes, ou cujo débito não passa, não muda nada.
+// Se alguma carta a retirar já saiu do estoque (outra compra comprometida antes a
+// levou, sorteada de um estoque desatualizado), a compra é marcada como cancelada:
+// sem débito, sem cunhagem e sem entrega. Reaplicada, só refaz a retirada do
+// estoque e o livro-razão, que ignoram repetições.
+func (s *Servidor) aplicarCompraPacote(entrada tipos.EntradaLog) {
+	var compra compraPacote
+	if err := json.Unmarshal(entrada.Dados, &compra); err != nil {
+		log.Printf("[ESTOQUE_REPLICA] Entrada %d de compra de pacote inválida: %v", entrada.Indice, err)
+		return
+	}
+	if s.Contas.MovimentoAplicado(compra.ClienteID, compra.ID+SUFIXO_COMPRA_CANCELADA) {
+		return
+	}
+	jaAplicada := s.Contas.MovimentoAplicado(compra.ClienteID, compra.ID)
+	if !jaAplicada && !s.Store.EmEstoque(compra.Retiradas) {
+		log.Printf("[ESTOQUE_REPLICA] Compra da entrada %d cancelada: cartas do pacote já retiradas do estoque", entrada.Indice)
+		if err := s.Contas.AplicarMovimento(compra.ID+SUFIXO_COMPRA_CANCELADA, map[string]int{compra.ClienteID: 0}); err != nil {
+			log.Printf("[ESTOQUE_REPLICA] Cancelamento da entrada %d não registrado: %v", entrada.Indice, err)
+		}
+		return
+	}
+	if !jaAplicada {
+		if err := s.Contas.AplicarMovimento(compra.ID, map[string]int{compra.ClienteID: -compra.Preco}); err != nil {
+			log.Printf("[ESTOQUE_REPLICA] Compra da entrada %d descartada: %v", entrada.Indice, err)
+			return
+		}
+	}
+
+	s.Store.RemoverCartas(compra.Retiradas)
+	for _, c := range compra.Cartas {
+		s.registrarNoRazao(entrada, razao.Movimento{
+			ID: compra.ID + "/" + c.ID + "/" + razao.TIPO_CUNHADA, Tipo: razao.TIPO_CUNHADA, Carta: c,
+			Referencia: compra.ID, Em: compra.Em,
+		})
+		s.registrarNoRazao(entrada, razao.Movimento{
+			ID: compra.ID + "/" + c.ID + "/" + razao.TIPO_PACOTE, Tipo: razao.TIPO_PACOTE, Carta: c,
+			Para: compra.ClienteID, ParaNome: compra.Nome, Referencia: compra.SalaID, Em: compra.Em,
+		})
+	}
+	if jaAplicada {
+		return
+	}
+	for _, c := range compra.Cartas {
+		if err := s.Contas.AdicionarCarta(compra.ClienteID, c); err != nil {
+			log.Printf("[ESTOQUE_REPLICA] Compra da entrada %d: %v", entrada.Indice, err)
+		}
+		s.adicionarCartaAoCliente(compra.ClienteID, c)
+	}
+}
+
+// aplicarCancelamentoPacote marca a compra como cancelada na conta. Vindo depois da
+// compra no log, não desfaz nada (ela já foi aplicada e entregue); antes, impede
+// que uma compra atrasada seja aplicada.
+func (s *Servidor) aplicarCancelamentoPacote(entrada tipos.EntradaLog) {
+	var compra compraPacote
+	if err := json.Unmarshal(entrada.Dados, &compra); err != nil {
+		log.Printf("[ESTOQUE_REPLICA] Entrada %d de cancelamento de pacote inválida: %v", entrada.Indice, err)
+		return
+	}
+	if err := s.Contas.AplicarMovimento(compra.ID+SUFIXO_COMPRA_CANCELADA, map[string]int{compra.ClienteID: 0}); err != nil {
+		log.Printf("[ESTOQUE_REPLICA] Cancelamento da entrada %d descartado: %v", entrada.Indice, err)
+	}
 }
 
 // PublicarChatRemoto é chamado pela API quando o Shadow recebe um chat do Host
@@ -3225,6 +7297,12 @@ func (s *Servidor) forcarSincronizacaoEstado(salaID string) {
 
 // enviarRequestComToken é um helper para enviar requisições HTTP autenticadas para outros servidores
 func (s *Servidor) enviarRequestComToken(method, url string, body []byte) (*http.Response, error) {
+	return s.enviarRequestComTokenPrazo(method, url, body, 15*time.Second)
+}
+
+// enviarRequestComTokenPrazo é enviarRequestComToken com um timeout próprio (ex.: as
+// sondas da Sombra, que não podem esperar 15s por um Host caído)
+func (s *Servidor) enviarRequestComTokenPrazo(method, url string, body []byte, timeout time.Duration) (*http.Response, error) {
 	token := seguranca.GenerateJWT(s.MeuEndereco)
 
 	req, err := http.NewRequest(method, url, bytes.NewBuffer(body))
@@ -3235,7 +7313,7 @@ func (s *Servidor) enviarRequestComToken(method, url string, body []byte) (*http
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+token)
 
-	httpClient := &http.Client{Timeout: 15 * time.Second}
+	httpClient := &http.Client{Timeout: timeout}
 	resp, err := httpClient.Do(req)
 	if err != nil {
 		log.Printf("[AUTH_DEBUG] Erro ao executar request: %v", err)
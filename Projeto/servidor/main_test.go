@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"jogodistribuido/protocolo"
+	"jogodistribuido/servidor/contas"
+	"jogodistribuido/servidor/razao"
+	"jogodistribuido/servidor/seguranca"
+	"jogodistribuido/servidor/store"
+	"jogodistribuido/servidor/tipos"
+)
+
+func TestAplicarCompraPacoteComRetiradasRepetidas(t *testing.T) {
+	repo, _ := contas.NovoRepositorio("")
+	livro, _ := razao.NovoLivro("")
+	s := &Servidor{
+		Store:    store.NewStoreComSemente(1),
+		Contas:   repo,
+		Razao:    livro,
+		Clientes: make(map[string]*tipos.Cliente),
+	}
+	for _, id := range []string{"a", "b"} {
+		if err := repo.AplicarCriacao(contas.Conta{ID: id, Nome: id, Moedas: 100, Carteira: true}); err != nil {
+			t.Fatalf("criar conta %s: %v", id, err)
+		}
+	}
+
+	// As duas compras foram sorteadas do mesmo estoque e levam as mesmas cartas
+	cartas, retiradas := s.Store.EscolherPacote(PACOTE_SIZE)
+	if len(retiradas) == 0 {
+		t.Fatal("o pacote sorteado não tirou nenhuma carta do estoque")
+	}
+	_, totalAntes := s.Store.GetStatusEstoque()
+	compras := []compraPacote{
+		{ID: "compra-a", ClienteID: "a", Nome: "a", Preco: PACOTE_PRECO, Cartas: cartas, Retiradas: retiradas, Em: time.Now()},
+		{ID: "compra-b", ClienteID: "b", Nome: "b", Preco: PACOTE_PRECO, Cartas: cartas, Retiradas: retiradas, Em: time.Now()},
+	}
+	for i, compra := range compras {
+		dados, _ := json.Marshal(compra)
+		s.aplicarCompraPacote(tipos.EntradaLog{Indice: int64(i + 1), Tipo: ENTRADA_PACOTE_COMPRA, Dados: dados})
+	}
+
+	casos := []struct {
+		conta     string
+		moedas    int
+		cartas    int
+		cancelada bool
+		movimento string
+	}{
+		{conta: "a", moedas: 100 - PACOTE_PRECO, cartas: len(cartas), movimento: "compra-a"},
+		{conta: "b", moedas: 100, cartas: 0, cancelada: true, movimento: "compra-b"},
+	}
+	for _, c := range casos {
+		moedas, _ := repo.Moedas(c.conta)
+		if moedas != c.moedas {
+			t.Errorf("conta %s: %d moedas, esperado %d", c.conta, moedas, c.moedas)
+		}
+		if n := len(repo.BuscarPorID(c.conta).Inventario); n != c.cartas {
+			t.Errorf("conta %s: %d cartas, esperado %d", c.conta, n, c.cartas)
+		}
+		if got := repo.MovimentoAplicado(c.conta, c.movimento+SUFIXO_COMPRA_CANCELADA); got != c.cancelada {
+			t.Errorf("conta %s: cancelada = %v, esperado %v", c.conta, got, c.cancelada)
+		}
+	}
+
+	if _, total := s.Store.GetStatusEstoque(); total != totalAntes-len(retiradas) {
+		t.Errorf("estoque com %d cartas, esperado %d", total, totalAntes-len(retiradas))
+	}
+	for _, c := range cartas {
+		if n := len(livro.DaCarta(c.ID)); n != 2 {
+			t.Errorf("carta %s com %d movimentos no livro-razão, esperado 2 (cunhagem e pacote de uma compra só)", c.ID, n)
+		}
+	}
+}
+
+func TestComandoDePartidaExigeTokenDaConta(t *testing.T) {
+	token := seguranca.GerarTokenSessao("a", "servidor1:8080")
+	comando := func(dados interface{}, token string) protocolo.Mensagem {
+		return protocolo.Mensagem{Comando: "TESTE", Dados: seguranca.MustJSON(dados), TokenSessao: token}
+	}
+
+	casos := []struct {
+		nome     string
+		mensagem protocolo.Mensagem
+		aceito   bool
+	}{
+		{nome: "token da conta do comando", mensagem: comando(map[string]string{"cliente_id": "a"}, token), aceito: true},
+		{nome: "proposta de troca do dono do token", mensagem: comando(protocolo.TrocarCartasReq{IDJogadorOferta: "a", IDJogadorDesejado: "b"}, token), aceito: true},
+		{nome: "sem token", mensagem: comando(map[string]string{"cliente_id": "a"}, ""), aceito: false},
+		{nome: "token de outra conta", mensagem: comando(map[string]string{"cliente_id": "b"}, token), aceito: false},
+		{nome: "proposta em nome de outra conta", mensagem: comando(protocolo.TrocarCartasReq{IDJogadorOferta: "b", ClienteID: "a"}, token), aceito: false},
+		{nome: "comando sem conta", mensagem: comando(map[string]string{"carta_id": "c1"}, token), aceito: false},
+		{nome: "token adulterado", mensagem: comando(map[string]string{"cliente_id": "a"}, token+"x"), aceito: false},
+	}
+	for _, c := range casos {
+		if got := sessaoConfere(autorDoComando(c.mensagem), c.mensagem.TokenSessao); got != c.aceito {
+			t.Errorf("%s: aceito = %v, esperado %v", c.nome, got, c.aceito)
+		}
+	}
+}
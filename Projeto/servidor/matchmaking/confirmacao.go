@@ -0,0 +1,23 @@
+package matchmaking
+
+// Fases do handshake de /matchmaking/confirmar_partida. O líder é o coordenador: pede
+// a cada servidor que reserve o seu jogador (preparar) e só cria a sala quando os dois
+// reservaram (confirmar). Se algum falha, as reservas são desfeitas (abortar) e os
+// jogadores voltam para a fila.
+const (
+	FASE_PREPARAR  = "preparar"
+	FASE_CONFIRMAR = "confirmar"
+	FASE_ABORTAR   = "abortar"
+
+	PAPEL_HOST   = "host"   // Servidor de A: cria a sala
+	PAPEL_SOMBRA = "sombra" // Servidor de B: cria a cópia da sala criada pelo Host
+)
+
+// Confirmacao é o corpo de /matchmaking/confirmar_partida.
+type Confirmacao struct {
+	Fase       string     `json:"fase"`
+	Pareamento Pareamento `json:"pareamento"`
+	ClienteID  string     `json:"cliente_id,omitempty"` // Jogador reservado (preparar/abortar)
+	Papel      string     `json:"papel,omitempty"`      // Papel do servidor (confirmar)
+	SalaID     string     `json:"sala_id,omitempty"`    // Sala criada pelo Host (confirmar da Sombra)
+}
@@ -0,0 +1,136 @@
+package matchmaking
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	CONVITE_CODIGO_TAMANHO = 6
+	alfabetoConvite        = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789" // Sem 0/O e 1/I, que se confundem ao digitar
+)
+
+// Convite é uma sala privada esperando o segundo jogador. Só o servidor do criador
+// (`Servidor`) aceita o código; ele será o Host da partida.
+type Convite struct {
+	Codigo    string    `json:"codigo"`
+	ClienteID string    `json:"cliente_id"`
+	Nome      string    `json:"nome"`
+	Servidor  string    `json:"servidor"`
+	ExpiraEm  time.Time `json:"expira_em"`
+}
+
+// Convites guarda os convites ativos do cluster. Cada servidor tem a sua cópia,
+// montada a partir do log replicado.
+type Convites struct {
+	mutex    sync.Mutex
+	convites map[string]Convite // Código -> Convite
+}
+
+func NovosConvites() *Convites {
+	return &Convites{convites: make(map[string]Convite)}
+}
+
+// NovoCodigo gera um código curto que não está em uso
+func (c *Convites) NovoCodigo() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for {
+		codigo := make([]byte, CONVITE_CODIGO_TAMANHO)
+		for i := range codigo {
+			codigo[i] = alfabetoConvite[rand.Intn(len(alfabetoConvite))]
+		}
+		if _, existe := c.convites[string(codigo)]; !existe {
+			return string(codigo)
+		}
+	}
+}
+
+// NormalizarCodigo aceita o código digitado em minúsculas ou com espaços
+func NormalizarCodigo(codigo string) string {
+	return strings.ToUpper(strings.TrimSpace(codigo))
+}
+
+// Registrar adiciona o convite e descarta os expirados. Repetir o registro não tem efeito.
+func (c *Convites) Registrar(convite Convite) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	agora := time.Now()
+	for codigo, existente := range c.convites {
+		if agora.After(existente.ExpiraEm) {
+			delete(c.convites, codigo)
+		}
+	}
+	if agora.Before(convite.ExpiraEm) {
+		c.convites[convite.Codigo] = convite
+	}
+}
+
+// Buscar devolve o convite ativo com o código
+func (c *Convites) Buscar(codigo string) (Convite, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	convite, ok := c.convites[codigo]
+	if !ok || time.Now().After(convite.ExpiraEm) {
+		return Convite{}, false
+	}
+	return convite, true
+}
+
+// Tomar remove e devolve o convite ativo com o código. No servidor do criador, é o
+// que garante que o código só é usado uma vez.
+func (c *Convites) Tomar(codigo string) (Convite, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	convite, ok := c.convites[codigo]
+	delete(c.convites, codigo)
+	if !ok || time.Now().After(convite.ExpiraEm) {
+		return Convite{}, false
+	}
+	return convite, true
+}
+
+// Remover apaga o convite, expirado ou não. Devolve false se ele não existia.
+func (c *Convites) Remover(codigo string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, existe := c.convites[codigo]
+	delete(c.convites, codigo)
+	return existe
+}
+
+// DoCliente devolve os códigos ativos criados pelo jogador
+func (c *Convites) DoCliente(clienteID string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	codigos := make([]string, 0)
+	for codigo, convite := range c.convites {
+		if convite.ClienteID == clienteID {
+			codigos = append(codigos, codigo)
+		}
+	}
+	return codigos
+}
+
+// Exportar devolve os convites para o snapshot do log replicado
+func (c *Convites) Exportar() (json.RawMessage, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return json.Marshal(c.convites)
+}
+
+// Importar substitui os convites pelos de um snapshot do log replicado
+func (c *Convites) Importar(dados json.RawMessage) error {
+	convites := make(map[string]Convite)
+	if err := json.Unmarshal(dados, &convites); err != nil {
+		return fmt.Errorf("convites do snapshot inválidos: %v", err)
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.convites = convites
+	return nil
+}
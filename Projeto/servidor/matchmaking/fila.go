@@ -0,0 +1,216 @@
+package matchmaking
+
+import (
+	"jogodistribuido/servidor/ranking"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Entrada é um jogador esperando na fila global. `Servidor` é o servidor que atende
+// o jogador; `Desde` é quando ele entrou na fila (vem do servidor do jogador, então
+// sobrevive à troca de líder).
+type Entrada struct {
+	ClienteID    string    `json:"cliente_id"`
+	Nome         string    `json:"nome"`
+	Servidor     string    `json:"servidor"`
+	Rating       int       `json:"rating"`
+	Desde        time.Time `json:"desde"`
+	AtualizadaEm time.Time `json:"-"` // Última vez que o servidor do jogador confirmou a entrada
+}
+
+// Pareamento é uma partida decidida pelo líder. O servidor de A será o Host; o de B,
+// a Sombra (ou o mesmo servidor, se os dois estão nele).
+type Pareamento struct {
+	ID string  `json:"id"`
+	A  Entrada `json:"a"`
+	B  Entrada `json:"b"`
+}
+
+// Fila é a fila de matchmaking do cluster, mantida em memória pelo líder. Cada
+// jogador aparece no máximo uma vez, e Parear tira os dois jogadores da fila no mesmo
+// passo em que forma o par, então ninguém é pareado duas vezes.
+type Fila struct {
+	mutex        sync.Mutex
+	entradas     map[string]*Entrada  // ClienteID -> Entrada
+	sincronizada map[string]time.Time // Servidor -> última entrada ou sincronização recebida
+	esperaMedia  time.Duration        // Média móvel da espera de quem foi pareado
+}
+
+// Status é a situação de um jogador na fila do cluster.
+type Status struct {
+	Posicao        int           `json:"posicao"`         // 1 = quem espera há mais tempo
+	Total          int           `json:"total"`           // Jogadores na fila do cluster
+	EsperaEstimada time.Duration `json:"espera_estimada"` // Espera média dos últimos pareados (0 = sem histórico)
+	Servidores     int           `json:"servidores"`      // Servidores cujas filas estão sendo consideradas
+}
+
+func NovaFila() *Fila {
+	return &Fila{
+		entradas:     make(map[string]*Entrada),
+		sincronizada: make(map[string]time.Time),
+	}
+}
+
+// Entrar adiciona o jogador à fila ou renova a entrada dele.
+func (f *Fila) Entrar(e Entrada) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	e.AtualizadaEm = time.Now()
+	f.entradas[e.ClienteID] = &e
+	f.sincronizada[e.Servidor] = e.AtualizadaEm
+}
+
+// Sair tira o jogador da fila. Devolve false se ele não estava nela.
+func (f *Fila) Sair(clienteID string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, existe := f.entradas[clienteID]
+	delete(f.entradas, clienteID)
+	return existe
+}
+
+// Sincronizar substitui as entradas de um servidor pela lista que ele enviou. É assim
+// que um líder novo reconstrói a fila e que saídas perdidas são corrigidas.
+func (f *Fila) Sincronizar(servidor string, entradas []Entrada) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for id, e := range f.entradas {
+		if e.Servidor == servidor {
+			delete(f.entradas, id)
+		}
+	}
+	agora := time.Now()
+	f.sincronizada[servidor] = agora
+	for _, e := range entradas {
+		e.Servidor = servidor
+		e.AtualizadaEm = agora
+		copia := e
+		f.entradas[e.ClienteID] = &copia
+	}
+}
+
+// Expirar remove as entradas que o servidor do jogador não confirma há mais de `limite`
+// (servidor fora do ar).
+func (f *Fila) Expirar(limite time.Duration) []Entrada {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	expiradas := make([]Entrada, 0)
+	for id, e := range f.entradas {
+		if time.Since(e.AtualizadaEm) > limite {
+			expiradas = append(expiradas, *e)
+			delete(f.entradas, id)
+		}
+	}
+	for servidor, em := range f.sincronizada {
+		if time.Since(em) > limite {
+			delete(f.sincronizada, servidor)
+		}
+	}
+	return expiradas
+}
+
+// Limpar esvazia a fila (o servidor deixou de ser líder).
+func (f *Fila) Limpar() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.entradas = make(map[string]*Entrada)
+	f.sincronizada = make(map[string]time.Time)
+}
+
+// Entradas devolve uma cópia da fila, de quem espera há mais tempo para quem chegou agora.
+func (f *Fila) Entradas() []Entrada {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.ordenadas()
+}
+
+// StatusDoServidor devolve a situação na fila de cada jogador de um servidor.
+func (f *Fila) StatusDoServidor(servidor string) map[string]Status {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fila := f.ordenadas()
+	status := make(map[string]Status)
+	for i, e := range fila {
+		if e.Servidor == servidor {
+			status[e.ClienteID] = Status{
+				Posicao:        i + 1,
+				Total:          len(fila),
+				EsperaEstimada: f.esperaMedia,
+				Servidores:     len(f.sincronizada),
+			}
+		}
+	}
+	return status
+}
+
+// Parear forma todos os pares possíveis e os tira da fila. Quem espera há mais tempo
+// escolhe primeiro o oponente de rating mais próximo dentro da janela
+// (ranking.Compativeis); no empate, prefere um jogador do mesmo servidor.
+func (f *Fila) Parear() []Pareamento {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	agora := time.Now()
+	pareados := make(map[string]bool)
+	pares := make([]Pareamento, 0)
+	fila := f.ordenadas()
+	for i, a := range fila {
+		if pareados[a.ClienteID] {
+			continue
+		}
+		escolhido, menorDiferenca := -1, 0
+		for k := i + 1; k < len(fila); k++ {
+			b := fila[k]
+			if pareados[b.ClienteID] || !ranking.Compativeis(a.Rating, b.Rating, agora.Sub(a.Desde), agora.Sub(b.Desde)) {
+				continue
+			}
+			diferenca := a.Rating - b.Rating
+			if diferenca < 0 {
+				diferenca = -diferenca
+			}
+			if escolhido == -1 || diferenca < menorDiferenca ||
+				(diferenca == menorDiferenca && b.Servidor == a.Servidor && fila[escolhido].Servidor != a.Servidor) {
+				escolhido, menorDiferenca = k, diferenca
+			}
+		}
+		if escolhido == -1 {
+			continue
+		}
+		b := fila[escolhido]
+		pareados[a.ClienteID], pareados[b.ClienteID] = true, true
+		delete(f.entradas, a.ClienteID)
+		delete(f.entradas, b.ClienteID)
+		pares = append(pares, Pareamento{ID: uuid.New().String(), A: a, B: b})
+		for _, e := range []Entrada{a, b} {
+			f.registrarEspera(agora.Sub(e.Desde))
+		}
+	}
+	return pares
+}
+
+// ordenadas devolve as entradas por ordem de chegada. Assume o lock ativo.
+func (f *Fila) ordenadas() []Entrada {
+	lista := make([]Entrada, 0, len(f.entradas))
+	for _, e := range f.entradas {
+		lista = append(lista, *e)
+	}
+	sort.Slice(lista, func(i, k int) bool {
+		if lista[i].Desde.Equal(lista[k].Desde) {
+			return lista[i].ClienteID < lista[k].ClienteID
+		}
+		return lista[i].Desde.Before(lista[k].Desde)
+	})
+	return lista
+}
+
+// registrarEspera atualiza a média móvel da espera. Assume o lock ativo.
+func (f *Fila) registrarEspera(espera time.Duration) {
+	if f.esperaMedia == 0 {
+		f.esperaMedia = espera
+		return
+	}
+	f.esperaMedia = (7*f.esperaMedia + 3*espera) / 10
+}
@@ -0,0 +1,182 @@
+package matchmaking
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"jogodistribuido/servidor/ranking"
+)
+
+// entrada monta um jogador que entrou na fila há `espera`
+func entrada(id, servidor string, rating int, espera time.Duration) Entrada {
+	return Entrada{ClienteID: id, Nome: id, Servidor: servidor, Rating: rating, Desde: time.Now().Add(-espera)}
+}
+
+// idsDosPares descreve cada par como "A-B", na ordem em que foram formados
+func idsDosPares(pares []Pareamento) []string {
+	ids := make([]string, len(pares))
+	for i, p := range pares {
+		ids[i] = p.A.ClienteID + "-" + p.B.ClienteID
+	}
+	return ids
+}
+
+func idsNaFila(f *Fila) []string {
+	ids := make([]string, 0)
+	for _, e := range f.Entradas() {
+		ids = append(ids, e.ClienteID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestParear(t *testing.T) {
+	casos := []struct {
+		nome     string
+		entradas []Entrada
+		pares    []string // "A-B", com A = quem espera há mais tempo
+		restam   []string
+	}{
+		{
+			nome:     "fila vazia",
+			entradas: nil,
+			pares:    []string{}, restam: []string{},
+		},
+		{
+			nome:     "jogador sozinho fica na fila",
+			entradas: []Entrada{entrada("a", "s1", 1500, time.Second)},
+			pares:    []string{}, restam: []string{"a"},
+		},
+		{
+			nome: "ratings fora da janela não formam par",
+			entradas: []Entrada{
+				entrada("a", "s1", 1500, time.Second),
+				entrada("b", "s2", 1500+ranking.JANELA_INICIAL+1, 0),
+			},
+			pares: []string{}, restam: []string{"a", "b"},
+		},
+		{
+			nome: "a espera alarga a janela",
+			entradas: []Entrada{
+				entrada("a", "s1", 1500, 2*ranking.JANELA_INTERVALO),
+				entrada("b", "s2", 1500+ranking.JANELA_INICIAL+1, 0),
+			},
+			pares: []string{"a-b"}, restam: []string{},
+		},
+		{
+			nome: "quem espera mais escolhe o rating mais próximo",
+			entradas: []Entrada{
+				entrada("a", "s1", 1500, 3*time.Second),
+				entrada("b", "s2", 1580, 2*time.Second),
+				entrada("c", "s2", 1510, time.Second),
+			},
+			pares: []string{"a-c"}, restam: []string{"b"},
+		},
+		{
+			nome: "no empate de rating prefere o mesmo servidor",
+			entradas: []Entrada{
+				entrada("a", "s1", 1500, 3*time.Second),
+				entrada("b", "s2", 1520, 2*time.Second),
+				entrada("c", "s1", 1480, time.Second),
+			},
+			pares: []string{"a-c"}, restam: []string{"b"},
+		},
+		{
+			nome: "forma todos os pares possíveis",
+			entradas: []Entrada{
+				entrada("a", "s1", 1500, 4*time.Second),
+				entrada("b", "s2", 2000, 3*time.Second),
+				entrada("c", "s3", 1550, 2*time.Second),
+				entrada("d", "s1", 2050, time.Second),
+			},
+			pares: []string{"a-c", "b-d"}, restam: []string{},
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			f := NovaFila()
+			for _, e := range c.entradas {
+				f.Entrar(e)
+			}
+			pares := f.Parear()
+			if got := idsDosPares(pares); strings.Join(got, ",") != strings.Join(c.pares, ",") {
+				t.Errorf("pares %v, esperado %v", got, c.pares)
+			}
+			if got := idsNaFila(f); strings.Join(got, ",") != strings.Join(c.restam, ",") {
+				t.Errorf("restaram %v, esperado %v", got, c.restam)
+			}
+			// Um segundo passo não pareia de novo quem já saiu da fila
+			for _, p := range f.Parear() {
+				for _, anterior := range pares {
+					if p.A.ClienteID == anterior.A.ClienteID || p.A.ClienteID == anterior.B.ClienteID {
+						t.Errorf("%s pareado duas vezes", p.A.ClienteID)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSincronizar(t *testing.T) {
+	casos := []struct {
+		nome     string
+		servidor string
+		entradas []Entrada
+		restam   []string
+	}{
+		{
+			nome:     "lista vazia remove as entradas do servidor",
+			servidor: "s1",
+			entradas: nil,
+			restam:   []string{"c"},
+		},
+		{
+			nome:     "saída perdida é corrigida",
+			servidor: "s1",
+			entradas: []Entrada{entrada("a", "s1", 1500, time.Second)},
+			restam:   []string{"a", "c"},
+		},
+		{
+			nome:     "jogador novo entra na fila",
+			servidor: "s2",
+			entradas: []Entrada{entrada("c", "s2", 1500, time.Second), entrada("d", "s2", 1500, 0)},
+			restam:   []string{"a", "b", "c", "d"},
+		},
+		{
+			nome:     "entrada vale para o servidor que sincronizou",
+			servidor: "s2",
+			entradas: []Entrada{entrada("c", "s2", 1500, time.Second), entrada("e", "s9", 1500, 0)},
+			restam:   []string{"a", "b", "c", "e"},
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			f := NovaFila()
+			f.Entrar(entrada("a", "s1", 1500, 3*time.Second))
+			f.Entrar(entrada("b", "s1", 1500, 2*time.Second))
+			f.Entrar(entrada("c", "s2", 1500, time.Second))
+
+			f.Sincronizar(c.servidor, c.entradas)
+			if got := idsNaFila(f); strings.Join(got, ",") != strings.Join(c.restam, ",") {
+				t.Errorf("fila com %v, esperado %v", got, c.restam)
+			}
+			for _, e := range f.Entradas() {
+				for _, enviada := range c.entradas {
+					if e.ClienteID == enviada.ClienteID && e.Servidor != c.servidor {
+						t.Errorf("%s ficou no servidor %s, esperado %s", e.ClienteID, e.Servidor, c.servidor)
+					}
+				}
+			}
+			// O servidor sincronizado passa a contar no status da fila
+			for id, st := range f.StatusDoServidor(c.servidor) {
+				if st.Servidores < 1 {
+					t.Errorf("%s: %d servidores no status, esperado ao menos 1", id, st.Servidores)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,223 @@
+package mercado
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"jogodistribuido/protocolo"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PRECO_MINIMO         = 1
+	PRECO_MAXIMO         = 10000
+	ANUNCIOS_POR_JOGADOR = 10
+)
+
+// Operações enviadas ao líder em /mercado/operar
+const (
+	OPERACAO_ANUNCIAR = "anunciar"
+	OPERACAO_COMPRAR  = "comprar"
+	OPERACAO_CANCELAR = "cancelar"
+)
+
+var (
+	ErrAnuncioInexistente = errors.New("o anúncio não está mais à venda")
+	ErrCartaJaAnunciada   = errors.New("esta carta já está anunciada")
+	ErrAnuncioProprio     = errors.New("você não pode comprar o próprio anúncio")
+	ErrNaoEVendedor       = errors.New("só quem anunciou pode cancelar o anúncio")
+)
+
+type Anuncio = protocolo.AnuncioMercado
+
+// Filtro seleciona anúncios em Listar. Campos vazios/zero não filtram.
+type Filtro struct {
+	Raridade string
+	Nome     string // Trecho do nome, sem diferenciar maiúsculas
+	ValorMin int
+	ValorMax int
+}
+
+// Operacao é o corpo de /mercado/operar: o servidor do jogador pede ao líder para
+// anunciar, comprar ou cancelar
+type Operacao struct {
+	Tipo      string  `json:"tipo"`
+	ClienteID string  `json:"cliente_id"`
+	Nome      string  `json:"nome"`
+	Anuncio   Anuncio `json:"anuncio"`              // OPERACAO_ANUNCIAR
+	AnuncioID string  `json:"anuncio_id,omitempty"` // OPERACAO_COMPRAR / OPERACAO_CANCELAR
+}
+
+// Venda é a entrada do log que transfere a carta e as moedas de um anúncio
+type Venda struct {
+	AnuncioID     string    `json:"anuncio_id"`
+	CompradorID   string    `json:"comprador_id"`
+	CompradorNome string    `json:"comprador_nome"`
+	Em            time.Time `json:"em"`
+}
+
+// Cancelamento é a entrada do log que devolve a carta de um anúncio ao vendedor
+type Cancelamento struct {
+	AnuncioID string    `json:"anuncio_id"`
+	Em        time.Time `json:"em"`
+}
+
+// Mercado guarda os anúncios ativos do cluster. Só muda pelo log replicado, então é
+// o mesmo em todos os servidores; as validações rodam no líder antes de propor.
+type Mercado struct {
+	mutex    sync.RWMutex
+	anuncios map[string]Anuncio // ID -> Anuncio
+}
+
+func NovoMercado() *Mercado {
+	return &Mercado{anuncios: make(map[string]Anuncio)}
+}
+
+// ValidarAnuncio confere o preço, o limite de anúncios do vendedor e se a carta já
+// está à venda
+func (m *Mercado) ValidarAnuncio(a Anuncio) error {
+	if a.Preco < PRECO_MINIMO || a.Preco > PRECO_MAXIMO {
+		return fmt.Errorf("o preço deve ficar entre %d e %d moedas", PRECO_MINIMO, PRECO_MAXIMO)
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	doVendedor := 0
+	for _, existente := range m.anuncios {
+		if existente.Carta.ID == a.Carta.ID {
+			return ErrCartaJaAnunciada
+		}
+		if existente.VendedorID == a.VendedorID {
+			doVendedor++
+		}
+	}
+	if doVendedor >= ANUNCIOS_POR_JOGADOR {
+		return fmt.Errorf("limite de %d anúncios ativos atingido", ANUNCIOS_POR_JOGADOR)
+	}
+	return nil
+}
+
+// ValidarCompra devolve o anúncio se ele existe e não é do próprio comprador. O
+// saldo é conferido por quem chama.
+func (m *Mercado) ValidarCompra(anuncioID, compradorID string) (Anuncio, error) {
+	a, ok := m.Buscar(anuncioID)
+	if !ok {
+		return Anuncio{}, ErrAnuncioInexistente
+	}
+	if a.VendedorID == compradorID {
+		return Anuncio{}, ErrAnuncioProprio
+	}
+	return a, nil
+}
+
+// ValidarCancelamento devolve o anúncio se ele existe e é de `clienteID`
+func (m *Mercado) ValidarCancelamento(anuncioID, clienteID string) (Anuncio, error) {
+	a, ok := m.Buscar(anuncioID)
+	if !ok {
+		return Anuncio{}, ErrAnuncioInexistente
+	}
+	if a.VendedorID != clienteID {
+		return Anuncio{}, ErrNaoEVendedor
+	}
+	return a, nil
+}
+
+// Adicionar registra um anúncio comprometido no log. Devolve false se ele (ou a
+// carta) já estava no mercado, como quando o log é reaplicado.
+func (m *Mercado) Adicionar(a Anuncio) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for _, existente := range m.anuncios {
+		if existente.ID == a.ID || existente.Carta.ID == a.Carta.ID {
+			return false
+		}
+	}
+	m.anuncios[a.ID] = a
+	return true
+}
+
+// Remover tira o anúncio do mercado e o devolve. Só quem o removeu recebe ok, o que
+// garante que uma venda ou cancelamento é aplicado uma vez só.
+func (m *Mercado) Remover(id string) (Anuncio, bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	a, ok := m.anuncios[id]
+	delete(m.anuncios, id)
+	return a, ok
+}
+
+func (m *Mercado) Buscar(id string) (Anuncio, bool) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	a, ok := m.anuncios[id]
+	return a, ok
+}
+
+// Listar devolve os anúncios que passam no filtro, do mais barato ao mais caro
+func (m *Mercado) Listar(f Filtro) []Anuncio {
+	nome := strings.ToLower(strings.TrimSpace(f.Nome))
+	m.mutex.RLock()
+	lista := make([]Anuncio, 0)
+	for _, a := range m.anuncios {
+		if f.Raridade != "" && !strings.EqualFold(a.Carta.Raridade, f.Raridade) {
+			continue
+		}
+		if nome != "" && !strings.Contains(strings.ToLower(a.Carta.Nome), nome) {
+			continue
+		}
+		if f.ValorMin > 0 && a.Carta.Valor < f.ValorMin {
+			continue
+		}
+		if f.ValorMax > 0 && a.Carta.Valor > f.ValorMax {
+			continue
+		}
+		lista = append(lista, a)
+	}
+	m.mutex.RUnlock()
+	ordenar(lista)
+	return lista
+}
+
+// DoVendedor devolve os anúncios ativos do jogador
+func (m *Mercado) DoVendedor(clienteID string) []Anuncio {
+	m.mutex.RLock()
+	lista := make([]Anuncio, 0)
+	for _, a := range m.anuncios {
+		if a.VendedorID == clienteID {
+			lista = append(lista, a)
+		}
+	}
+	m.mutex.RUnlock()
+	ordenar(lista)
+	return lista
+}
+
+// Exportar devolve os anúncios para o snapshot do log replicado
+func (m *Mercado) Exportar() (json.RawMessage, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return json.Marshal(m.anuncios)
+}
+
+// Importar substitui os anúncios pelos de um snapshot do log replicado
+func (m *Mercado) Importar(dados json.RawMessage) error {
+	anuncios := make(map[string]Anuncio)
+	if err := json.Unmarshal(dados, &anuncios); err != nil {
+		return fmt.Errorf("anúncios do snapshot inválidos: %v", err)
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.anuncios = anuncios
+	return nil
+}
+
+func ordenar(lista []Anuncio) {
+	sort.Slice(lista, func(i, j int) bool {
+		if lista[i].Preco != lista[j].Preco {
+			return lista[i].Preco < lista[j].Preco
+		}
+		return lista[i].CriadoEm.Before(lista[j].CriadoEm)
+	})
+}
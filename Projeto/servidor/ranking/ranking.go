@@ -0,0 +1,46 @@
+package ranking
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	RATING_INICIAL   = 1500             // Rating de uma conta nova
+	FATOR_K          = 32               // Variação máxima do rating em uma partida (Elo)
+	JANELA_INICIAL   = 100              // Diferença de rating aceita assim que o jogador entra na fila
+	JANELA_PASSO     = 50               // Quanto a janela cresce a cada JANELA_INTERVALO de espera
+	JANELA_INTERVALO = 10 * time.Second // Intervalo de espera entre dois alargamentos da janela
+	JANELA_MAXIMA    = 800              // Maior diferença de rating aceita no pareamento
+)
+
+// Esperado devolve a pontuação esperada de A contra B (de 0 a 1).
+func Esperado(ratingA, ratingB int) float64 {
+	return 1 / (1 + math.Pow(10, float64(ratingB-ratingA)/400))
+}
+
+// Atualizar devolve os novos ratings de A e B depois de uma partida. pontosA é 1 se
+// A venceu, 0.5 no empate e 0 se B venceu. O que um ganha o outro perde.
+func Atualizar(ratingA, ratingB int, pontosA float64) (int, int) {
+	delta := int(math.Round(FATOR_K * (pontosA - Esperado(ratingA, ratingB))))
+	return ratingA + delta, ratingB - delta
+}
+
+// Janela devolve a diferença de rating aceita para quem está na fila há `espera`.
+func Janela(espera time.Duration) int {
+	janela := JANELA_INICIAL + JANELA_PASSO*int(espera/JANELA_INTERVALO)
+	if janela > JANELA_MAXIMA {
+		return JANELA_MAXIMA
+	}
+	return janela
+}
+
+// Compativeis diz se dois jogadores podem ser pareados: a diferença de rating tem de
+// caber na janela de quem espera há mais tempo.
+func Compativeis(ratingA, ratingB int, esperaA, esperaB time.Duration) bool {
+	diferenca := ratingA - ratingB
+	if diferenca < 0 {
+		diferenca = -diferenca
+	}
+	return diferenca <= Janela(max(esperaA, esperaB))
+}
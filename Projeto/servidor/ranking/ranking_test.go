@@ -0,0 +1,69 @@
+package ranking
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJanela(t *testing.T) {
+	casos := []struct {
+		espera time.Duration
+		janela int
+	}{
+		{espera: 0, janela: JANELA_INICIAL},
+		{espera: JANELA_INTERVALO - time.Millisecond, janela: JANELA_INICIAL},
+		{espera: JANELA_INTERVALO, janela: JANELA_INICIAL + JANELA_PASSO},
+		{espera: 3*JANELA_INTERVALO + time.Second, janela: JANELA_INICIAL + 3*JANELA_PASSO},
+		{espera: time.Hour, janela: JANELA_MAXIMA},
+	}
+	for _, c := range casos {
+		if got := Janela(c.espera); got != c.janela {
+			t.Errorf("Janela(%v) = %d, esperado %d", c.espera, got, c.janela)
+		}
+	}
+}
+
+func TestCompativeis(t *testing.T) {
+	casos := []struct {
+		nome             string
+		ratingA, ratingB int
+		esperaA, esperaB time.Duration
+		compativeis      bool
+	}{
+		{nome: "mesmo rating", ratingA: 1500, ratingB: 1500, compativeis: true},
+		{nome: "diferença na janela inicial", ratingA: 1500, ratingB: 1600, compativeis: true},
+		{nome: "diferença fora da janela inicial", ratingA: 1500, ratingB: 1601, compativeis: false},
+		{nome: "vale a janela de quem espera mais", ratingA: 1700, ratingB: 1500, esperaB: 2 * JANELA_INTERVALO, compativeis: true},
+		{nome: "nem a janela máxima alcança", ratingA: 2400, ratingB: 1500, esperaA: time.Hour, compativeis: false},
+	}
+	for _, c := range casos {
+		if got := Compativeis(c.ratingA, c.ratingB, c.esperaA, c.esperaB); got != c.compativeis {
+			t.Errorf("%s: Compativeis = %v, esperado %v", c.nome, got, c.compativeis)
+		}
+	}
+}
+
+func TestAtualizar(t *testing.T) {
+	casos := []struct {
+		nome             string
+		ratingA, ratingB int
+		pontosA          float64
+		novoA, novoB     int
+	}{
+		{nome: "vitória entre iguais", ratingA: 1500, ratingB: 1500, pontosA: 1, novoA: 1516, novoB: 1484},
+		{nome: "derrota entre iguais", ratingA: 1500, ratingB: 1500, pontosA: 0, novoA: 1484, novoB: 1516},
+		{nome: "empate entre iguais", ratingA: 1500, ratingB: 1500, pontosA: 0.5, novoA: 1500, novoB: 1500},
+		{nome: "favorito vence e ganha pouco", ratingA: 1900, ratingB: 1500, pontosA: 1, novoA: 1903, novoB: 1497},
+		{nome: "zebra vence e ganha muito", ratingA: 1500, ratingB: 1900, pontosA: 1, novoA: 1529, novoB: 1871},
+		{nome: "empate puxa o favorito para baixo", ratingA: 1900, ratingB: 1500, pontosA: 0.5, novoA: 1887, novoB: 1513},
+	}
+	for _, c := range casos {
+		a, b := Atualizar(c.ratingA, c.ratingB, c.pontosA)
+		if a != c.novoA || b != c.novoB {
+			t.Errorf("%s: Atualizar = (%d, %d), esperado (%d, %d)", c.nome, a, b, c.novoA, c.novoB)
+		}
+		if a+b != c.ratingA+c.ratingB {
+			t.Errorf("%s: soma dos ratings mudou de %d para %d", c.nome, c.ratingA+c.ratingB, a+b)
+		}
+	}
+}
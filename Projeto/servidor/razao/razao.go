@@ -0,0 +1,239 @@
+package razao
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"jogodistribuido/protocolo"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const ARQUIVO_RAZAO = "razao.jsonl"
+
+// Tipos de movimento
+const (
+	TIPO_CUNHADA   = "cunhada"   // Saiu do estoque num pacote
+	TIPO_PACOTE    = "pacote"    // Entrou no inventário de quem comprou o pacote
+	TIPO_TROCA     = "troca"     // Passou de um jogador para outro numa troca
+	TIPO_CONSUMIDA = "consumida" // Jogada numa partida; sai de circulação
+	TIPO_ANUNCIADA = "anunciada" // Saiu do inventário para um anúncio do mercado
+	TIPO_VENDIDA   = "vendida"   // Saiu do mercado para o inventário do comprador
+	TIPO_RETIRADA  = "retirada"  // Anúncio cancelado; voltou para o vendedor
+	TIPO_DEVOLVIDA = "devolvida" // Jogada descartada num failover; a carta consumida voltou ao jogador
+)
+
+type Movimento = protocolo.MovimentoCarta
+
+// Inconsistencia é um movimento que não bate com o dono que o livro atribui à carta
+// naquele momento (ex.: carta cunhada duas vezes, ou trocada por quem não a tinha)
+type Inconsistencia struct {
+	CartaID      string    `json:"carta_id"`
+	Motivo       string    `json:"motivo"`
+	DonoEsperado string    `json:"dono_esperado,omitempty"`
+	Movimento    Movimento `json:"movimento"`
+}
+
+// Livro é o livro-razão das cartas: só recebe movimentos novos, na ordem do log
+// replicado, então é o mesmo em todos os servidores. Com `diretorio` vazio fica só
+// em memória (e é refeito a partir do log); com diretório, cada movimento é
+// acrescentado a ARQUIVO_RAZAO.
+type Livro struct {
+	mutex      sync.RWMutex
+	movimentos []Movimento
+	ids        map[string]bool  // IDs já registrados (o log pode ser reaplicado)
+	porCarta   map[string][]int // cartaID -> posições em movimentos
+	porJogador map[string][]int // clienteID -> posições em movimentos
+	arquivo    *os.File
+}
+
+// NovoLivro abre o livro-razão e carrega os movimentos já gravados.
+func NovoLivro(diretorio string) (*Livro, error) {
+	l := &Livro{
+		movimentos: make([]Movimento, 0),
+		ids:        make(map[string]bool),
+		porCarta:   make(map[string][]int),
+		porJogador: make(map[string][]int),
+	}
+	if diretorio == "" {
+		return l, nil
+	}
+
+	if err := os.MkdirAll(diretorio, 0o755); err != nil {
+		return nil, fmt.Errorf("erro ao criar diretório do livro-razão: %v", err)
+	}
+	caminho := filepath.Join(diretorio, ARQUIVO_RAZAO)
+	fimValido, err := l.carregar(caminho)
+	if err != nil {
+		return nil, err
+	}
+
+	arquivo, err := os.OpenFile(caminho, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao abrir livro-razão: %v", err)
+	}
+	// Descarta a cauda incompleta: sem isso o próximo movimento seria emendado na
+	// linha quebrada e perdido na carga seguinte
+	if err := arquivo.Truncate(fimValido); err != nil {
+		arquivo.Close()
+		return nil, fmt.Errorf("erro ao truncar livro-razão: %v", err)
+	}
+	l.arquivo = arquivo
+	log.Printf("[RAZAO] %d movimentos carregados de %s", len(l.movimentos), caminho)
+	return l, nil
+}
+
+// carregar indexa os movimentos gravados e devolve o tamanho da parte válida do
+// arquivo (tudo até a última linha completa e legível).
+func (l *Livro) carregar(caminho string) (int64, error) {
+	f, err := os.Open(caminho)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("erro ao ler livro-razão: %v", err)
+	}
+	defer f.Close()
+
+	var fimValido int64
+	leitor := bufio.NewReader(f)
+	for {
+		linha, err := leitor.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				return 0, fmt.Errorf("erro ao ler livro-razão: %v", err)
+			}
+			if len(linha) > 0 {
+				// Linha sem '\n' só pode ser a última (queda durante a escrita)
+				log.Printf("[RAZAO] Movimento incompleto no fim do livro descartado (%d bytes)", len(linha))
+			}
+			break
+		}
+		var m Movimento
+		if err := json.Unmarshal(linha, &m); err != nil {
+			log.Printf("[RAZAO] Movimento inválido no livro; descartando o restante: %v", err)
+			break
+		}
+		fimValido += int64(len(linha))
+		l.indexar(m)
+	}
+	return fimValido, nil
+}
+
+// Registrar acrescenta um movimento comprometido no log. Devolve false se o ID já
+// estava no livro.
+func (l *Livro) Registrar(m Movimento) (bool, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.ids[m.ID] {
+		return false, nil
+	}
+	if l.arquivo != nil {
+		linha, err := json.Marshal(m)
+		if err != nil {
+			return false, err
+		}
+		if _, err := l.arquivo.Write(append(linha, '\n')); err != nil {
+			return false, fmt.Errorf("erro ao gravar movimento %s: %v", m.ID, err)
+		}
+	}
+	l.indexar(m)
+	return true, nil
+}
+
+// Exportar devolve os movimentos para o snapshot do log replicado
+func (l *Livro) Exportar() (json.RawMessage, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return json.Marshal(l.movimentos)
+}
+
+// Importar acrescenta os movimentos de um snapshot do log replicado que ainda não
+// estão no livro. O livro só cresce, então não há o que desfazer.
+func (l *Livro) Importar(dados json.RawMessage) error {
+	var movimentos []Movimento
+	if err := json.Unmarshal(dados, &movimentos); err != nil {
+		return fmt.Errorf("movimentos do snapshot inválidos: %v", err)
+	}
+	for _, m := range movimentos {
+		if _, err := l.Registrar(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DaCarta devolve a história de uma carta, do movimento mais antigo ao mais recente
+func (l *Livro) DaCarta(cartaID string) []Movimento {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.copiar(l.porCarta[cartaID])
+}
+
+// DoJogador devolve os movimentos em que o jogador entregou ou recebeu uma carta
+func (l *Livro) DoJogador(clienteID string) []Movimento {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	return l.copiar(l.porJogador[clienteID])
+}
+
+// Auditar refaz o dono de cada carta movimento a movimento e devolve os que não
+// batem: uma carta cunhada de novo, que sai de quem não a tinha ou que volta a
+// circular depois de consumida sem ter sido devolvida. Cartas que já existiam antes
+// do livro não têm cunhagem; o dono delas começa pelo primeiro movimento.
+func (l *Livro) Auditar() []Inconsistencia {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	inconsistencias := make([]Inconsistencia, 0)
+	for cartaID, posicoes := range l.porCarta {
+		dono, cunhada, consumida := "", false, false
+		if primeiro := l.movimentos[posicoes[0]]; primeiro.Tipo != TIPO_CUNHADA {
+			dono = primeiro.De // Carta anterior ao livro: o primeiro movimento diz de quem era
+		}
+		for _, p := range posicoes {
+			m := l.movimentos[p]
+			switch {
+			case consumida && m.Tipo != TIPO_DEVOLVIDA:
+				inconsistencias = append(inconsistencias, Inconsistencia{CartaID: cartaID, Motivo: "movimento depois de consumida", Movimento: m})
+			case m.Tipo == TIPO_CUNHADA && cunhada:
+				inconsistencias = append(inconsistencias, Inconsistencia{CartaID: cartaID, Motivo: "cunhada mais de uma vez", DonoEsperado: dono, Movimento: m})
+			case m.Tipo != TIPO_CUNHADA && m.De != dono:
+				inconsistencias = append(inconsistencias, Inconsistencia{CartaID: cartaID, Motivo: "origem diferente do dono registrado", DonoEsperado: dono, Movimento: m})
+			}
+			cunhada = cunhada || m.Tipo == TIPO_CUNHADA
+			consumida = (consumida || m.Tipo == TIPO_CONSUMIDA) && m.Tipo != TIPO_DEVOLVIDA
+			dono = m.Para
+		}
+	}
+	return inconsistencias
+}
+
+// indexar guarda o movimento em memória. Assume o lock ativo (ou o livro ainda não publicado).
+func (l *Livro) indexar(m Movimento) {
+	if l.ids[m.ID] {
+		return
+	}
+	posicao := len(l.movimentos)
+	l.movimentos = append(l.movimentos, m)
+	l.ids[m.ID] = true
+	l.porCarta[m.Carta.ID] = append(l.porCarta[m.Carta.ID], posicao)
+	if m.De != "" {
+		l.porJogador[m.De] = append(l.porJogador[m.De], posicao)
+	}
+	if m.Para != "" && m.Para != m.De {
+		l.porJogador[m.Para] = append(l.porJogador[m.Para], posicao)
+	}
+}
+
+func (l *Livro) copiar(posicoes []int) []Movimento {
+	lista := make([]Movimento, 0, len(posicoes))
+	for _, p := range posicoes {
+		lista = append(lista, l.movimentos[p])
+	}
+	return lista
+}
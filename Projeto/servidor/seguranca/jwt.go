@@ -36,42 +36,87 @@ func GenerateJWT(serverID string) string {
 
 // ValidateJWT valida um token JWT
 func ValidateJWT(token string) (string, error) {
+	payload, err := lerClaims(token)
+	if err != nil {
+		return "", err
+	}
+
+	serverID, ok := payload["server_id"].(string)
+	if !ok {
+		return "", fmt.Errorf("claim 'server_id' ausente ou com formato inválido")
+	}
+
+	return serverID, nil
+}
+
+// GerarTokenSessao gera o token de sessão entregue ao jogador no LOGIN_OK. Ele
+// identifica a conta e o servidor que guarda a sessão (o "servidor de origem"), e
+// pode ser validado por qualquer servidor do cluster.
+func GerarTokenSessao(clienteID, servidor string) string {
+	return assinarClaims(map[string]interface{}{
+		"cliente_id": clienteID,
+		"servidor":   servidor,
+		"exp":        time.Now().Add(JWT_EXPIRATION).Unix(),
+		"iat":        time.Now().Unix(),
+	})
+}
+
+// ValidarTokenSessao valida um token de GerarTokenSessao e devolve a conta e o servidor de origem
+func ValidarTokenSessao(token string) (string, string, error) {
+	payload, err := lerClaims(token)
+	if err != nil {
+		return "", "", err
+	}
+	clienteID, ok := payload["cliente_id"].(string)
+	if !ok || clienteID == "" {
+		return "", "", fmt.Errorf("claim 'cliente_id' ausente ou com formato inválido")
+	}
+	servidor, _ := payload["servidor"].(string)
+	return clienteID, servidor, nil
+}
+
+// assinarClaims monta um JWT HS256 com as claims informadas
+func assinarClaims(payload map[string]interface{}) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payloadJSON, _ := json.Marshal(payload)
+	payloadB64 := base64.RawURLEncoding.EncodeToString(payloadJSON)
+
+	message := header + "." + payloadB64
+	return message + "." + GenerateHMAC(message, JWT_SECRET)
+}
+
+// lerClaims confere a assinatura e a expiração de um JWT e devolve as claims
+func lerClaims(token string) (map[string]interface{}, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
-		return "", fmt.Errorf("token inválido (formato incorreto, %d partes)", len(parts))
+		return nil, fmt.Errorf("token inválido (formato incorreto, %d partes)", len(parts))
 	}
 
 	message := parts[0] + "." + parts[1]
 	expectedSig := GenerateHMAC(message, JWT_SECRET)
 
 	if parts[2] != expectedSig {
-		return "", fmt.Errorf("assinatura inválida")
+		return nil, fmt.Errorf("assinatura inválida")
 	}
 
 	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
 	if err != nil {
-		return "", fmt.Errorf("payload inválido (erro base64)")
+		return nil, fmt.Errorf("payload inválido (erro base64)")
 	}
 
 	var payload map[string]interface{}
 	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
-		return "", fmt.Errorf("payload JSON inválido")
+		return nil, fmt.Errorf("payload JSON inválido")
 	}
 
 	exp, ok := payload["exp"].(float64)
 	if !ok {
-		return "", fmt.Errorf("claim 'exp' ausente ou com formato inválido")
+		return nil, fmt.Errorf("claim 'exp' ausente ou com formato inválido")
 	}
 	if time.Now().Unix() > int64(exp) {
-		return "", fmt.Errorf("token expirado (exp: %d, now: %d)", int64(exp), time.Now().Unix())
-	}
-
-	serverID, ok := payload["server_id"].(string)
-	if !ok {
-		return "", fmt.Errorf("claim 'server_id' ausente ou com formato inválido")
+		return nil, fmt.Errorf("token expirado (exp: %d, now: %d)", int64(exp), time.Now().Unix())
 	}
-
-	return serverID, nil
+	return payload, nil
 }
 
 // GenerateHMAC gera uma assinatura HMAC-SHA256
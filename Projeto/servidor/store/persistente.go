@@ -0,0 +1,378 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"jogodistribuido/servidor/tipos"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	ARQUIVO_WAL        = "estoque.wal"
+	ARQUIVO_SNAPSHOT   = "estoque.snapshot.json"
+	SNAPSHOT_INTERVALO = 100 // Número de retiradas entre snapshots
+)
+
+// registroWAL é uma linha do log append-only de retiradas do estoque.
+type registroWAL struct {
+	Seq       int64     `json:"seq"`
+	Operacao  string    `json:"operacao"` // "RETIRADA"
+	IDs       []string  `json:"ids"`      // IDs removidos do estoque
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// snapshotEstoque é o estado completo do estoque até (e incluindo) Seq.
+type snapshotEstoque struct {
+	Seq     int64                    `json:"seq"`
+	Semente int64                    `json:"semente"`
+	Estoque map[string][]tipos.Carta `json:"estoque"`
+}
+
+// StorePersistente é um StoreInterface durável: cada retirada é gravada (com fsync)
+// em um WAL antes de ser devolvida, e snapshots periódicos compactam o log.
+// Ao reiniciar, o estoque é recarregado do último snapshot mais o WAL, de modo que
+// cartas já entregues nunca voltam ao estoque.
+type StorePersistente struct {
+	mutex       sync.RWMutex
+	Estoque     map[string][]tipos.Carta
+	diretorio   string
+	semente     int64
+	seq         int64 // Último registro aplicado
+	seqSnapshot int64 // Seq coberto pelo último snapshot
+	wal         *os.File
+}
+
+// NewStorePersistente abre (ou cria) o estoque durável em `diretorio`. Se não houver
+// snapshot, o estoque inicial é gerado a partir de `semente`, o que torna a carga
+// determinística.
+func NewStorePersistente(diretorio string, semente int64) (*StorePersistente, error) {
+	if err := os.MkdirAll(diretorio, 0o755); err != nil {
+		return nil, fmt.Errorf("erro ao criar diretório do estoque: %v", err)
+	}
+
+	s := &StorePersistente{
+		diretorio: diretorio,
+		semente:   semente,
+	}
+
+	fimValido, err := s.carregar()
+	if err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(filepath.Join(diretorio, ARQUIVO_WAL), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao abrir WAL do estoque: %v", err)
+	}
+	// Descarta a cauda incompleta: sem isso o próximo registro seria emendado na
+	// linha quebrada e ignorado na carga seguinte
+	if err := wal.Truncate(fimValido); err != nil {
+		wal.Close()
+		return nil, fmt.Errorf("erro ao truncar WAL do estoque: %v", err)
+	}
+	s.wal = wal
+
+	_, total := contarEstoque(s.Estoque)
+	log.Printf("[ESTOQUE_PERSISTENTE] Estoque carregado de %s (seq: %d, total: %d cartas)", diretorio, s.seq, total)
+	return s, nil
+}
+
+// carregar lê o snapshot (ou gera o estoque inicial) e reaplica o WAL. Devolve o
+// tamanho do WAL até o último registro completo.
+func (s *StorePersistente) carregar() (int64, error) {
+	caminhoSnapshot := filepath.Join(s.diretorio, ARQUIVO_SNAPSHOT)
+	dados, err := os.ReadFile(caminhoSnapshot)
+	switch {
+	case err == nil:
+		var snap snapshotEstoque
+		if err := json.Unmarshal(dados, &snap); err != nil {
+			return 0, fmt.Errorf("snapshot do estoque corrompido: %v", err)
+		}
+		s.Estoque = snap.Estoque
+		s.seq = snap.Seq
+		s.seqSnapshot = snap.Seq
+		if snap.Semente != s.semente {
+			log.Printf("[ESTOQUE_PERSISTENTE] Snapshot gerado com semente %d (configurada: %d). Mantendo o snapshot.", snap.Semente, s.semente)
+			s.semente = snap.Semente
+		}
+	case os.IsNotExist(err):
+		s.Estoque = gerarEstoque(rand.New(rand.NewSource(s.semente)))
+		log.Printf("[ESTOQUE_PERSISTENTE] Nenhum snapshot encontrado. Estoque gerado com semente %d.", s.semente)
+	default:
+		return 0, fmt.Errorf("erro ao ler snapshot do estoque: %v", err)
+	}
+
+	f, err := os.Open(filepath.Join(s.diretorio, ARQUIVO_WAL))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("erro ao ler WAL do estoque: %v", err)
+	}
+	defer f.Close()
+
+	aplicados := 0
+	var fimValido int64
+	leitor := bufio.NewReader(f)
+	for {
+		linha, err := leitor.ReadBytes('\n')
+		if err != nil {
+			if err != io.EOF {
+				return 0, fmt.Errorf("erro ao ler WAL do estoque: %v", err)
+			}
+			if len(linha) > 0 {
+				// Linha sem '\n' só pode ser a última (queda durante a escrita)
+				log.Printf("[ESTOQUE_PERSISTENTE] Registro incompleto no fim do WAL descartado (%d bytes)", len(linha))
+			}
+			break
+		}
+		var reg registroWAL
+		if err := json.Unmarshal(linha, &reg); err != nil {
+			log.Printf("[ESTOQUE_PERSISTENTE] Registro inválido no WAL; descartando o restante: %v", err)
+			break
+		}
+		fimValido += int64(len(linha))
+		if reg.Seq <= s.seq {
+			continue // Já coberto pelo snapshot
+		}
+		removerIDs(s.Estoque, reg.IDs)
+		s.seq = reg.Seq
+		aplicados++
+	}
+	if aplicados > 0 {
+		log.Printf("[ESTOQUE_PERSISTENTE] %d retiradas reaplicadas a partir do WAL", aplicados)
+	}
+	return fimValido, nil
+}
+
+func (s *StorePersistente) FormarPacote(tamanho int) []tipos.Carta {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	cartas, retiradas := retirarPacote(s.Estoque, tamanho)
+	if err := s.registrar(retiradas); err != nil {
+		// Sem registro durável a retirada não pode ser entregue: devolve as cartas
+		log.Printf("[ESTOQUE_PERSISTENTE_ERRO] Falha ao gravar retirada no WAL: %v", err)
+		devolverCartas(s.Estoque, cartas, retiradas)
+		return []tipos.Carta{}
+	}
+	s.compactarSeNecessario()
+	return cartas
+}
+
+// EscolherPacote sorteia um pacote sem retirá-lo; a retirada é gravada no WAL quando
+// chega por RemoverCartas.
+func (s *StorePersistente) EscolherPacote(tamanho int) ([]tipos.Carta, []string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return escolherPacote(s.Estoque, tamanho)
+}
+
+// RemoverCartas registra a retirada no WAL e só então tira as cartas do estoque, para
+// que a memória nunca tenha uma retirada que o disco não tem. IDs que já não estão no
+// estoque são ignorados, o que torna a operação idempotente.
+func (s *StorePersistente) RemoverCartas(ids []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	presentes := idsPresentes(s.Estoque, ids)
+	if len(presentes) == 0 {
+		return
+	}
+	if err := s.registrar(presentes); err != nil {
+		log.Printf("[ESTOQUE_PERSISTENTE_ERRO] Falha ao gravar remoção replicada no WAL; cartas mantidas no estoque: %v", err)
+		return
+	}
+	removerIDs(s.Estoque, presentes)
+	s.compactarSeNecessario()
+}
+
+// EmEstoque diz se todas as cartas informadas ainda estão no estoque.
+func (s *StorePersistente) EmEstoque(ids []string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return todasPresentes(s.Estoque, ids)
+}
+
+func (s *StorePersistente) GetStatusEstoque() (map[string]int, int) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return contarEstoque(s.Estoque)
+}
+
+// Exportar devolve o estoque para o snapshot do log replicado
+func (s *StorePersistente) Exportar() (json.RawMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return json.Marshal(s.Estoque)
+}
+
+// Importar substitui o estoque pelo de um snapshot do log replicado e grava um
+// snapshot local, para que o WAL anterior não seja reaplicado sobre ele.
+func (s *StorePersistente) Importar(dados json.RawMessage) error {
+	var estoque map[string][]tipos.Carta
+	if err := json.Unmarshal(dados, &estoque); err != nil {
+		return fmt.Errorf("estoque do snapshot inválido: %v", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Estoque = estoque
+	return s.gravarSnapshot()
+}
+
+// registrar grava a retirada no WAL e força o fsync. Assume o lock ativo.
+func (s *StorePersistente) registrar(ids []string) error {
+	reg := registroWAL{
+		Seq:       s.seq + 1,
+		Operacao:  "RETIRADA",
+		IDs:       ids,
+		Timestamp: time.Now(),
+	}
+	linha, err := json.Marshal(reg)
+	if err != nil {
+		return err
+	}
+	if _, err := s.wal.Write(append(linha, '\n')); err != nil {
+		return err
+	}
+	if err := s.wal.Sync(); err != nil {
+		return err
+	}
+	s.seq = reg.Seq
+	return nil
+}
+
+// compactarSeNecessario grava um snapshot a cada SNAPSHOT_INTERVALO registros. Chamado
+// depois de a retirada registrada chegar ao estoque em memória, que é o que o
+// snapshot grava. Assume o lock ativo.
+func (s *StorePersistente) compactarSeNecessario() {
+	if s.seq-s.seqSnapshot < SNAPSHOT_INTERVALO {
+		return
+	}
+	if err := s.gravarSnapshot(); err != nil {
+		// O WAL continua válido; o snapshot será tentado novamente na próxima retirada
+		log.Printf("[ESTOQUE_PERSISTENTE_ERRO] Falha ao gravar snapshot: %v", err)
+	}
+}
+
+// gravarSnapshot escreve o estado atual de forma atômica (arquivo temporário + rename)
+// e, em seguida, trunca o WAL. Assume o lock ativo.
+func (s *StorePersistente) gravarSnapshot() error {
+	snap := snapshotEstoque{Seq: s.seq, Semente: s.semente, Estoque: s.Estoque}
+	dados, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	caminho := filepath.Join(s.diretorio, ARQUIVO_SNAPSHOT)
+	tmp := caminho + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(dados); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	if err := os.Rename(tmp, caminho); err != nil {
+		return err
+	}
+	// Sem o fsync do diretório o rename pode se perder numa queda, e o WAL truncado
+	// abaixo deixaria de ter as retiradas que o snapshot antigo não tem
+	if err := sincronizarDiretorio(s.diretorio); err != nil {
+		return err
+	}
+	s.seqSnapshot = s.seq
+
+	// Registros com seq <= snapshot são ignorados na carga, então truncar é seguro
+	// mesmo que o processo caia logo depois do rename.
+	if err := s.wal.Truncate(0); err != nil {
+		return err
+	}
+	log.Printf("[ESTOQUE_PERSISTENTE] Snapshot gravado (seq: %d)", s.seq)
+	return nil
+}
+
+// Fechar grava um snapshot final e fecha o WAL.
+func (s *StorePersistente) Fechar() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.gravarSnapshot(); err != nil {
+		return err
+	}
+	return s.wal.Close()
+}
+
+// idsPresentes filtra os IDs que ainda estão no estoque.
+// sincronizarDiretorio faz o fsync do diretório, tornando duráveis as criações e
+// renomeações de arquivos nele.
+func sincronizarDiretorio(diretorio string) error {
+	dir, err := os.Open(diretorio)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func idsPresentes(estoque map[string][]tipos.Carta, ids []string) []string {
+	procurados := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		procurados[id] = true
+	}
+	presentes := make([]string, 0, len(ids))
+	for _, cartas := range estoque {
+		for _, c := range cartas {
+			if procurados[c.ID] {
+				presentes = append(presentes, c.ID)
+			}
+		}
+	}
+	return presentes
+}
+
+// todasPresentes diz se cada um dos IDs (sem contar repetições) está no estoque.
+func todasPresentes(estoque map[string][]tipos.Carta, ids []string) bool {
+	procurados := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		procurados[id] = true
+	}
+	for _, cartas := range estoque {
+		for _, c := range cartas {
+			delete(procurados, c.ID)
+		}
+	}
+	return len(procurados) == 0
+}
+
+// removerIDs retira do estoque as cartas com os IDs informados.
+func removerIDs(estoque map[string][]tipos.Carta, ids []string) {
+	if len(ids) == 0 {
+		return
+	}
+	remover := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		remover[id] = true
+	}
+	for raridade, cartas := range estoque {
+		restantes := cartas[:0]
+		for _, c := range cartas {
+			if !remover[c.ID] {
+				restantes = append(restantes, c)
+			}
+		}
+		estoque[raridade] = restantes
+	}
+}
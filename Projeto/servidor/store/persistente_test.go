@@ -0,0 +1,142 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// abrirPersistente abre o estoque em `dir` e o fecha no fim do teste sem gravar
+// snapshot, como numa queda
+func abrirPersistente(t *testing.T, dir string) *StorePersistente {
+	t.Helper()
+	s, err := NewStorePersistente(dir, 7)
+	if err != nil {
+		t.Fatalf("abrir estoque: %v", err)
+	}
+	t.Cleanup(func() { s.wal.Close() })
+	return s
+}
+
+func TestStorePersistenteRecarregaWAL(t *testing.T) {
+	dir := t.TempDir()
+	s := abrirPersistente(t, dir)
+	_, inicial := s.GetStatusEstoque()
+
+	_, retiradas := s.EscolherPacote(3)
+	s.RemoverCartas(retiradas)
+	s.RemoverCartas(retiradas) // Repetida: nada a remover, nada gravado
+	pacote := s.FormarPacote(2)
+	s.wal.Close()
+
+	reaberto := abrirPersistente(t, dir)
+	if _, total := reaberto.GetStatusEstoque(); total != inicial-len(retiradas)-len(pacote) {
+		t.Errorf("estoque recarregado com %d cartas, esperado %d", total, inicial-len(retiradas)-len(pacote))
+	}
+	if reaberto.seq != 2 {
+		t.Errorf("seq %d depois de recarregar, esperado 2", reaberto.seq)
+	}
+	if reaberto.EmEstoque(retiradas) {
+		t.Error("cartas retiradas voltaram ao estoque")
+	}
+}
+
+func TestStorePersistenteCaudaDoWAL(t *testing.T) {
+	casos := []struct {
+		nome   string
+		cauda  string
+		valido bool // A cauda é um registro completo e deve ser aplicada
+	}{
+		{nome: "registro completo", cauda: `{"seq":2,"operacao":"RETIRADA","ids":["x"]}` + "\n", valido: true},
+		{nome: "registro sem quebra de linha", cauda: `{"seq":2,"operacao":"RETIRADA","ids":["x"]`},
+		{nome: "linha inválida", cauda: "lixo\n" + `{"seq":3,"operacao":"RETIRADA","ids":["y"]}` + "\n"},
+	}
+	for _, c := range casos {
+		t.Run(c.nome, func(t *testing.T) {
+			dir := t.TempDir()
+			s := abrirPersistente(t, dir)
+			_, retiradas := s.EscolherPacote(1)
+			s.RemoverCartas(retiradas)
+			s.wal.Close()
+
+			caminho := filepath.Join(dir, ARQUIVO_WAL)
+			info, err := os.Stat(caminho)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tamanhoValido := info.Size()
+			f, err := os.OpenFile(caminho, os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.WriteString(c.cauda)
+			f.Close()
+
+			reaberto := abrirPersistente(t, dir)
+			esperadoSeq, esperadoTamanho := int64(1), tamanhoValido
+			if c.valido {
+				esperadoSeq, esperadoTamanho = 2, tamanhoValido+int64(len(c.cauda))
+			}
+			if reaberto.seq != esperadoSeq {
+				t.Errorf("seq %d, esperado %d", reaberto.seq, esperadoSeq)
+			}
+			if info, _ := os.Stat(caminho); info.Size() != esperadoTamanho {
+				t.Errorf("WAL com %d bytes depois de abrir, esperado %d", info.Size(), esperadoTamanho)
+			}
+
+			// A próxima retirada não pode ficar emendada na cauda descartada
+			_, outras := reaberto.EscolherPacote(1)
+			reaberto.RemoverCartas(outras)
+			reaberto.wal.Close()
+			if final := abrirPersistente(t, dir); final.seq != esperadoSeq+1 || final.EmEstoque(outras) {
+				t.Errorf("retirada depois da cauda não recarregada (seq %d, esperado %d)", final.seq, esperadoSeq+1)
+			}
+		})
+	}
+}
+
+func TestStorePersistenteIgnoraWALCobertoPeloSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s := abrirPersistente(t, dir)
+	_, retiradas := s.EscolherPacote(2)
+	s.RemoverCartas(retiradas)
+	if err := s.Fechar(); err != nil {
+		t.Fatalf("fechar: %v", err)
+	}
+	_, total := s.GetStatusEstoque()
+
+	// Um registro antigo que sobrou no WAL (queda entre o rename e o truncate) não
+	// pode ser aplicado de novo
+	antigo := `{"seq":1,"operacao":"RETIRADA","ids":["qualquer"]}` + "\n"
+	if err := os.WriteFile(filepath.Join(dir, ARQUIVO_WAL), []byte(antigo), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reaberto := abrirPersistente(t, dir)
+	if _, got := reaberto.GetStatusEstoque(); got != total {
+		t.Errorf("estoque com %d cartas, esperado %d", got, total)
+	}
+	if reaberto.seq != 1 || reaberto.seqSnapshot != 1 {
+		t.Errorf("seq %d / snapshot %d, esperado 1 / 1", reaberto.seq, reaberto.seqSnapshot)
+	}
+}
+
+func TestStorePersistenteRemocaoSemWALMantemCartas(t *testing.T) {
+	s := abrirPersistente(t, t.TempDir())
+	_, inicial := s.GetStatusEstoque()
+	_, retiradas := s.EscolherPacote(3)
+
+	// Com o WAL fechado a gravação falha e a memória não pode mudar
+	s.wal.Close()
+	s.RemoverCartas(retiradas)
+
+	if _, total := s.GetStatusEstoque(); total != inicial {
+		t.Errorf("estoque com %d cartas, esperado %d", total, inicial)
+	}
+	if !s.EmEstoque(retiradas) {
+		t.Error("cartas saíram do estoque sem registro no WAL")
+	}
+	if s.seq != 0 {
+		t.Errorf("seq %d depois da falha, esperado 0", s.seq)
+	}
+}
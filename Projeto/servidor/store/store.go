@@ -1,6 +1,8 @@
 package store
 
 import (
+	"encoding/json"
+	"fmt"
 	"jogodistribuido/servidor/tipos"
 	"log"
 	"math/rand"
@@ -10,7 +12,12 @@ import (
 // StoreInterface define as operações que o Store de cartas expõe.
 type StoreInterface interface {
 	FormarPacote(tamanho int) []tipos.Carta
+	EscolherPacote(tamanho int) ([]tipos.Carta, []string)
+	RemoverCartas(ids []string)
+	EmEstoque(ids []string) bool
 	GetStatusEstoque() (map[string]int, int)
+	Exportar() (json.RawMessage, error)
+	Importar(dados json.RawMessage) error
 }
 
 // Store gerencia o estoque global de cartas.
@@ -21,27 +28,52 @@ type Store struct {
 
 // NewStore cria e inicializa um novo Store.
 func NewStore() *Store {
+	return NewStoreComSemente(rand.Int63())
+}
+
+// NewStoreComSemente cria um Store cujo estoque inicial é gerado a partir da semente.
+// Servidores com a mesma semente partem exatamente do mesmo estoque.
+func NewStoreComSemente(semente int64) *Store {
 	s := &Store{
 		Estoque: make(map[string][]tipos.Carta),
 	}
-	s.inicializarEstoque()
+	s.inicializarEstoque(semente)
 	return s
 }
 
+const charsetIDs = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
 func randomString(length int) string {
-	const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	b := make([]byte, length)
 	for i := range b {
-		b[i] = charset[rand.Intn(len(charset))]
+		b[i] = charsetIDs[rand.Intn(len(charsetIDs))]
 	}
 	return string(b)
 }
 
-func (s *Store) inicializarEstoque() {
+// randomStringDe é como randomString, mas usa o gerador informado (reprodutível).
+func randomStringDe(r *rand.Rand, length int) string {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = charsetIDs[r.Intn(len(charsetIDs))]
+	}
+	return string(b)
+}
+
+func (s *Store) inicializarEstoque(semente int64) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.Estoque = map[string][]tipos.Carta{
+	s.Estoque = gerarEstoque(rand.New(rand.NewSource(semente)))
+
+	log.Printf("Estoque inicializado: C=%d, U=%d, R=%d, L=%d",
+		len(s.Estoque["C"]), len(s.Estoque["U"]), len(s.Estoque["R"]), len(s.Estoque["L"]))
+}
+
+// gerarEstoque cria o estoque completo a partir de um gerador. Com a mesma
+// semente, o resultado é sempre o mesmo.
+func gerarEstoque(r *rand.Rand) map[string][]tipos.Carta {
+	estoque := map[string][]tipos.Carta{
 		"C": make([]tipos.Carta, 0),
 		"U": make([]tipos.Carta, 0),
 		"R": make([]tipos.Carta, 0),
@@ -56,21 +88,19 @@ func (s *Store) inicializarEstoque() {
 
 	for _, nome := range tiposCartas {
 		for i := 0; i < 100; i++ { // Comuns
-			s.Estoque["C"] = append(s.Estoque["C"], tipos.Carta{ID: randomString(5), Nome: nome, Naipe: naipes[rand.Intn(len(naipes))], Valor: 1 + rand.Intn(50), Raridade: "C"})
+			estoque["C"] = append(estoque["C"], tipos.Carta{ID: randomStringDe(r, 5), Nome: nome, Naipe: naipes[r.Intn(len(naipes))], Valor: 1 + r.Intn(50), Raridade: "C"})
 		}
 		for i := 0; i < 50; i++ { // Incomuns
-			s.Estoque["U"] = append(s.Estoque["U"], tipos.Carta{ID: randomString(5), Nome: nome, Naipe: naipes[rand.Intn(len(naipes))], Valor: 51 + rand.Intn(30), Raridade: "U"})
+			estoque["U"] = append(estoque["U"], tipos.Carta{ID: randomStringDe(r, 5), Nome: nome, Naipe: naipes[r.Intn(len(naipes))], Valor: 51 + r.Intn(30), Raridade: "U"})
 		}
 		for i := 0; i < 20; i++ { // Raras
-			s.Estoque["R"] = append(s.Estoque["R"], tipos.Carta{ID: randomString(5), Nome: nome, Naipe: naipes[rand.Intn(len(naipes))], Valor: 81 + rand.Intn(20), Raridade: "R"})
+			estoque["R"] = append(estoque["R"], tipos.Carta{ID: randomStringDe(r, 5), Nome: nome, Naipe: naipes[r.Intn(len(naipes))], Valor: 81 + r.Intn(20), Raridade: "R"})
 		}
 		for i := 0; i < 5; i++ { // Lendárias
-			s.Estoque["L"] = append(s.Estoque["L"], tipos.Carta{ID: randomString(5), Nome: nome, Naipe: naipes[rand.Intn(len(naipes))], Valor: 101 + rand.Intn(20), Raridade: "L"})
+			estoque["L"] = append(estoque["L"], tipos.Carta{ID: randomStringDe(r, 5), Nome: nome, Naipe: naipes[r.Intn(len(naipes))], Valor: 101 + r.Intn(20), Raridade: "L"})
 		}
 	}
-
-	log.Printf("Estoque inicializado: C=%d, U=%d, R=%d, L=%d",
-		len(s.Estoque["C"]), len(s.Estoque["U"]), len(s.Estoque["R"]), len(s.Estoque["L"]))
+	return estoque
 }
 
 func sampleRaridade() string {
@@ -91,7 +121,34 @@ func (s *Store) FormarPacote(tamanho int) []tipos.Carta {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
+	cartas, _ := retirarPacote(s.Estoque, tamanho)
+	return cartas
+}
+
+// EscolherPacote sorteia um pacote como FormarPacote, mas sem tirar as cartas do
+// estoque: quem chama propõe a retirada e ela só acontece em RemoverCartas.
+func (s *Store) EscolherPacote(tamanho int) ([]tipos.Carta, []string) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return escolherPacote(s.Estoque, tamanho)
+}
+
+// escolherPacote roda retirarPacote sobre uma cópia rasa do estoque. retirarPacote
+// só encurta as fatias, então o estoque original não muda. Assume o lock ativo.
+func escolherPacote(estoque map[string][]tipos.Carta, tamanho int) ([]tipos.Carta, []string) {
+	copia := make(map[string][]tipos.Carta, len(estoque))
+	for raridade, cartas := range estoque {
+		copia[raridade] = cartas
+	}
+	return retirarPacote(copia, tamanho)
+}
+
+// retirarPacote sorteia e remove `tamanho` cartas do estoque. Retorna o pacote e
+// os IDs que de fato saíram do estoque (cartas geradas quando o estoque acaba não
+// entram nessa lista). Assume que o chamador detém o lock do estoque.
+func retirarPacote(estoque map[string][]tipos.Carta, tamanho int) ([]tipos.Carta, []string) {
 	cartas := make([]tipos.Carta, 0, tamanho)
+	retiradas := make([]string, 0, tamanho)
 	for i := 0; i < tamanho; i++ {
 		raridade := sampleRaridade()
 		ordem := []string{"L", "R", "U", "C"}
@@ -111,28 +168,81 @@ func (s *Store) FormarPacote(tamanho int) []tipos.Carta {
 		encontrou := false
 		for j := start; j < len(ordem); j++ {
 			r := ordem[j]
-			if len(s.Estoque[r]) > 0 {
-				idx := len(s.Estoque[r]) - 1
-				carta = s.Estoque[r][idx]
-				s.Estoque[r] = s.Estoque[r][:idx]
+			if len(estoque[r]) > 0 {
+				idx := len(estoque[r]) - 1
+				carta = estoque[r][idx]
+				estoque[r] = estoque[r][:idx]
 				encontrou = true
 				break
 			}
 		}
-		if !encontrou {
+		if encontrou {
+			retiradas = append(retiradas, carta.ID)
+		} else {
 			carta = gerarCartaComum()
 		}
 		cartas = append(cartas, carta)
 	}
-	return cartas
+	return cartas, retiradas
+}
+
+// devolverCartas recoloca cartas no estoque (usado quando uma retirada não pôde
+// ser registrada). Assume que o chamador detém o lock do estoque.
+func devolverCartas(estoque map[string][]tipos.Carta, cartas []tipos.Carta, retiradas []string) {
+	ids := make(map[string]bool, len(retiradas))
+	for _, id := range retiradas {
+		ids[id] = true
+	}
+	for _, c := range cartas {
+		if ids[c.ID] {
+			estoque[c.Raridade] = append(estoque[c.Raridade], c)
+		}
+	}
+}
+
+// RemoverCartas retira do estoque as cartas informadas (retiradas replicadas do líder).
+func (s *Store) RemoverCartas(ids []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removerIDs(s.Estoque, ids)
+}
+
+// EmEstoque diz se todas as cartas informadas ainda estão no estoque.
+func (s *Store) EmEstoque(ids []string) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return todasPresentes(s.Estoque, ids)
 }
 
 func (s *Store) GetStatusEstoque() (map[string]int, int) {
 	s.mutex.RLock()
 	defer s.mutex.RUnlock()
+	return contarEstoque(s.Estoque)
+}
+
+// Exportar devolve o estoque para o snapshot do log replicado
+func (s *Store) Exportar() (json.RawMessage, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return json.Marshal(s.Estoque)
+}
+
+// Importar substitui o estoque pelo de um snapshot do log replicado
+func (s *Store) Importar(dados json.RawMessage) error {
+	var estoque map[string][]tipos.Carta
+	if err := json.Unmarshal(dados, &estoque); err != nil {
+		return fmt.Errorf("estoque do snapshot inválido: %v", err)
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Estoque = estoque
+	return nil
+}
+
+func contarEstoque(estoque map[string][]tipos.Carta) (map[string]int, int) {
 	status := make(map[string]int)
 	total := 0
-	for raridade, cartas := range s.Estoque {
+	for raridade, cartas := range estoque {
 		status[raridade] = len(cartas)
 		total += len(cartas)
 	}
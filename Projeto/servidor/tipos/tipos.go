@@ -1,6 +1,8 @@
 package tipos
 
 import (
+	"encoding/json"
+	"jogodistribuido/partida"
 	"jogodistribuido/protocolo"
 	"sync"
 	"time"
@@ -22,6 +24,16 @@ type Cliente struct {
 	Inventario []protocolo.Carta
 	Sala       *Sala
 	Mutex      sync.Mutex
+
+	NaFilaDesde time.Time // Quando entrou na FilaDeEspera (protegido pelo mutex da fila)
+}
+
+// OfertaTroca é uma proposta de troca esperando a resposta de Req.IDJogadorDesejado (só no Host)
+type OfertaTroca struct {
+	Req            protocolo.TrocarCartasReq
+	CartaOferecida Carta
+	CartaDesejada  Carta
+	ExpiraEm       time.Time
 }
 
 // Sala representa uma partida entre dois jogadores (possivelmente de servidores diferentes)
@@ -40,19 +52,29 @@ type Sala struct {
 	EventLog       []GameEvent // Log append-only de eventos da partida
 	Mutex          sync.Mutex
 	TurnoDe        string // ID do jogador que deve jogar
-}
+	Desistente     string // ID de quem perdeu por desistência (PLAYER_FORFEIT)
+	MotivoFim      string // Motivo do fim registrado no log (vazio quando as cartas acabam)
 
-// GameEvent representa um evento no log da partida
-type GameEvent struct {
-	EventSeq  int64       `json:"eventSeq"`  // Número sequencial do evento
-	MatchID   string      `json:"matchId"`   // ID da partida
-	Timestamp time.Time   `json:"timestamp"` // Quando o evento ocorreu
-	EventType string      `json:"eventType"` // Tipo do evento (CARD_PLAYED, ROUND_END, etc.)
-	PlayerID  string      `json:"playerId"`  // ID do jogador que gerou o evento
-	Data      interface{} `json:"data"`      // Dados específicos do evento
-	Signature string      `json:"signature"` // Assinatura HMAC do evento
+	PrazoTurno      time.Time      // Fim do prazo do jogador da vez (relógio do Host, fora do log)
+	PrazoProntos    time.Time      // Fim do prazo para os dois jogadores comprarem o pacote (lobby)
+	FinalizadaEm    time.Time      // Quando o coletor viu a sala finalizada pela primeira vez
+	TurnosExpirados map[string]int // ID -> prazos esgotados seguidos (usado pelo Host)
+
+	Serie           map[string]int  // Nome -> vitórias nas partidas anteriores da série de revanches
+	PedidosRevanche map[string]bool // ID -> aceitou a revanche (usado pelo Host)
+	Revanche        string          // ID da sala aberta pela revanche
+	Privada         bool            // Criada por código de convite (jogadores não voltam para a fila pública)
+	OfertaTroca     *OfertaTroca    // Proposta de troca pendente (só no Host)
+
+	UltimoEstadoHost *EstadoPartida // Último estado recebido do Host (usado pela Sombra no failover)
+	Epoca            int64          // Sobe a cada failover; estados de uma época anterior são recusados
+	HostAnterior     string         // Host substituído quando este servidor subiu a época (readmitido como Sombra)
 }
 
+// GameEvent representa um evento no log da partida (o formato é o do pacote partida,
+// compartilhado com o replay do cliente)
+type GameEvent = partida.Evento
+
 // EstadoPartida representa o estado completo de uma partida (para replicação)
 type EstadoPartida struct {
 	SalaID         string           `json:"sala_id"`
@@ -67,10 +89,15 @@ type EstadoPartida struct {
 	TurnoDe        string           `json:"turnoDe"`         // ID do jogador que deve jogar
 	VencedorJogada string           `json:"vencedor_jogada"` // Vencedor da jogada (se houver)
 	Jogadores      []JogadorEstado  `json:"jogadores"`       // Inventários dos jogadores (para sincronização)
+	Hash           string           `json:"hash,omitempty"`  // SHA-256 do estado derivado do EventLog
+	PrazoTurno     time.Time        `json:"prazo_turno"`     // Fim do prazo do turno, herdado pela Sombra no failover
+	Serie          map[string]int   `json:"serie,omitempty"` // Placar da série de revanches antes desta partida
+	Epoca          int64            `json:"epoca,omitempty"` // Época do Host que gerou o estado (ver Sala.Epoca)
 }
 
 type JogadorEstado struct {
 	ID         string  `json:"id"`
+	Nome       string  `json:"nome,omitempty"`
 	Inventario []Carta `json:"inventario"`
 }
 
@@ -98,6 +125,15 @@ type GameEventRequest struct {
 	Data      interface{} `json:"data"`      // Dados do evento
 	Token     string      `json:"token"`     // Token JWT
 	Signature string      `json:"signature"` // Assinatura HMAC
+
+	Automatica bool  `json:"automatica,omitempty"` // Jogada feita por um servidor quando o prazo do turno esgotou (nunca vem do cliente)
+	Epoca      int64 `json:"epoca,omitempty"`      // Época da sala na Sombra que encaminhou o evento (ver Sala.Epoca)
+}
+
+// AssumirSombraRequest é enviado pelo Host a um servidor escolhido para ser a nova Sombra
+type AssumirSombraRequest struct {
+	Host   string        `json:"host"`   // Servidor Host da partida
+	Estado EstadoPartida `json:"estado"` // Estado completo, incluindo EventLog e inventários
 }
 
 // GameReplicateRequest representa uma replicação de estado
@@ -105,6 +141,53 @@ type GameReplicateRequest struct {
 	MatchID   string        `json:"matchId"`   // ID da partida
 	EventSeq  int64         `json:"eventSeq"`  // Sequência do evento
 	State     EstadoPartida `json:"state"`     // Estado completo
+	Host      string        `json:"host"`      // Endereço do Host que replica (readmitido se estiver numa época vencida)
 	Token     string        `json:"token"`     // Token JWT
 	Signature string        `json:"signature"` // Assinatura HMAC
 }
+
+// EntradaLog é uma entrada do log replicado do cluster
+type EntradaLog struct {
+	Termo  int64           `json:"termo"`  // Termo do líder que criou a entrada
+	Indice int64           `json:"indice"` // Posição no log (começa em 1)
+	Tipo   string          `json:"tipo"`   // Tipo da entrada (NOOP, ESTOQUE_RETIRADA, ...)
+	Dados  json.RawMessage `json:"dados"`  // Payload específico do tipo
+}
+
+// AppendEntriesRequest é enviado pelo líder para replicar o log (ou como heartbeat, sem entradas)
+type AppendEntriesRequest struct {
+	Termo       int64        `json:"termo"`        // Termo do líder
+	Lider       string       `json:"lider"`        // Endereço do líder
+	PrevIndice  int64        `json:"prev_indice"`  // Índice da entrada que precede as novas
+	PrevTermo   int64        `json:"prev_termo"`   // Termo da entrada em PrevIndice
+	Entradas    []EntradaLog `json:"entradas"`     // Entradas a anexar
+	LiderCommit int64        `json:"lider_commit"` // Commit index do líder
+}
+
+// AppendEntriesResponse é a resposta de um seguidor ao AppendEntries
+type AppendEntriesResponse struct {
+	Termo        int64 `json:"termo"`         // Termo atual do seguidor
+	Sucesso      bool  `json:"sucesso"`       // true se o log casou em PrevIndice/PrevTermo
+	UltimoIndice int64 `json:"ultimo_indice"` // Último índice do seguidor (dica para o líder)
+}
+
+// SnapshotLog é o estado das máquinas de estados até Indice (inclusive). Substitui
+// as entradas compactadas do log replicado.
+type SnapshotLog struct {
+	Indice  int64                      `json:"indice"`  // Última entrada coberta pelo snapshot
+	Termo   int64                      `json:"termo"`   // Termo dessa entrada
+	Estados map[string]json.RawMessage `json:"estados"` // Nome do estado registrado -> conteúdo exportado
+}
+
+// InstallSnapshotRequest é enviado pelo líder ao seguidor que precisa de entradas já compactadas
+type InstallSnapshotRequest struct {
+	Termo    int64       `json:"termo"`    // Termo do líder
+	Lider    string      `json:"lider"`    // Endereço do líder
+	Snapshot SnapshotLog `json:"snapshot"` // Snapshot atual do líder
+}
+
+// InstallSnapshotResponse é a resposta de um seguidor ao InstallSnapshot
+type InstallSnapshotResponse struct {
+	Termo   int64 `json:"termo"`   // Termo atual do seguidor
+	Sucesso bool  `json:"sucesso"` // true se o seguidor está no snapshot (ou além dele)
+}
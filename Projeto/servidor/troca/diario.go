@@ -0,0 +1,172 @@
+package troca
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const EXTENSAO_ARQUIVO = ".json"
+
+// Diario guarda o estado de cada transação coordenada por este servidor, um arquivo
+// por troca, regravado (tmp + fsync + rename) a cada mudança de estado. As trocas
+// terminadas são apagadas por Coletar. Com `diretorio` vazio as transações ficam só
+// em memória e não sobrevivem a um reinício.
+type Diario struct {
+	mutex      sync.Mutex
+	transacoes map[string]Transacao // trocaID -> último estado gravado
+	diretorio  string
+}
+
+// NovoDiario abre o diário e carrega as transações já gravadas.
+func NovoDiario(diretorio string) (*Diario, error) {
+	d := &Diario{
+		transacoes: make(map[string]Transacao),
+		diretorio:  diretorio,
+	}
+	if diretorio == "" {
+		return d, nil
+	}
+
+	if err := os.MkdirAll(diretorio, 0o755); err != nil {
+		return nil, fmt.Errorf("erro ao criar diretório das trocas: %v", err)
+	}
+	entradas, err := os.ReadDir(diretorio)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler diário das trocas: %v", err)
+	}
+	for _, e := range entradas {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), EXTENSAO_ARQUIVO) {
+			continue
+		}
+		caminho := filepath.Join(diretorio, e.Name())
+		conteudo, err := os.ReadFile(caminho)
+		if err != nil {
+			log.Printf("[TROCA_TX] Erro ao ler %s: %v", caminho, err)
+			continue
+		}
+		var t Transacao
+		if err := json.Unmarshal(conteudo, &t); err != nil || t.ID == "" {
+			log.Printf("[TROCA_TX] Ignorando %s: %v", caminho, err)
+			continue
+		}
+		d.transacoes[t.ID] = t
+	}
+	log.Printf("[TROCA_TX] %d trocas carregadas de %s (%d pendentes)", len(d.transacoes), diretorio, len(d.Pendentes()))
+	return d, nil
+}
+
+// Gravar salva o estado atual da transação
+func (d *Diario) Gravar(t *Transacao) error {
+	t.AtualizadaEm = time.Now()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.diretorio != "" {
+		conteudo, err := json.Marshal(t)
+		if err != nil {
+			return err
+		}
+		if err := gravarArquivo(filepath.Join(d.diretorio, t.ID+EXTENSAO_ARQUIVO), conteudo); err != nil {
+			return fmt.Errorf("erro ao gravar troca %s: %v", t.ID, err)
+		}
+	}
+	d.transacoes[t.ID] = *t
+	return nil
+}
+
+// Coletar apaga as transações terminadas há mais de `idade` e devolve quantas saíram.
+// Um participante que ainda consulte uma delas recebe "não encontrada" e solta a
+// reserva, o mesmo que faria com a troca abortada; uma troca concluída já não deixou
+// reservas.
+func (d *Diario) Coletar(idade time.Duration) int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	apagadas := 0
+	for id, t := range d.transacoes {
+		if !t.Terminada() || time.Since(t.AtualizadaEm) <= idade {
+			continue
+		}
+		if d.diretorio != "" {
+			if err := removerArquivo(filepath.Join(d.diretorio, id+EXTENSAO_ARQUIVO)); err != nil {
+				log.Printf("[TROCA_TX] Erro ao apagar a troca %s do diário: %v", id, err)
+				continue
+			}
+		}
+		delete(d.transacoes, id)
+		apagadas++
+	}
+	return apagadas
+}
+
+// Buscar devolve o último estado gravado da transação
+func (d *Diario) Buscar(id string) (Transacao, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	t, ok := d.transacoes[id]
+	return t, ok
+}
+
+// Pendentes devolve cópias das transações que ainda não terminaram
+func (d *Diario) Pendentes() []*Transacao {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	pendentes := make([]*Transacao, 0)
+	for _, t := range d.transacoes {
+		if !t.Terminada() {
+			copia := t
+			pendentes = append(pendentes, &copia)
+		}
+	}
+	return pendentes
+}
+
+// gravarArquivo substitui o arquivo por `conteudo` (tmp + rename). O tmp e o
+// diretório passam por fsync antes de voltar: uma decisão confirmada ao chamador não
+// se perde numa queda do servidor.
+func gravarArquivo(caminho string, conteudo []byte) error {
+	tmp := caminho + ".tmp"
+	arquivo, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := arquivo.Write(conteudo); err != nil {
+		arquivo.Close()
+		return err
+	}
+	if err := arquivo.Sync(); err != nil {
+		arquivo.Close()
+		return err
+	}
+	if err := arquivo.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, caminho); err != nil {
+		return err
+	}
+	return sincronizarDiretorio(filepath.Dir(caminho))
+}
+
+// removerArquivo apaga o arquivo e sincroniza o diretório. Um arquivo que já não
+// existe não é erro.
+func removerArquivo(caminho string) error {
+	if err := os.Remove(caminho); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return sincronizarDiretorio(filepath.Dir(caminho))
+}
+
+func sincronizarDiretorio(diretorio string) error {
+	dir, err := os.Open(diretorio)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,88 @@
+package troca
+
+import (
+	"jogodistribuido/protocolo"
+	"sync"
+	"time"
+)
+
+// Oferta é uma proposta de troca fora de partida. Fica no servidor de quem a fez
+// (`Coordenador`), que executa a troca no aceite; o servidor do outro jogador guarda
+// uma cópia só para saber para onde encaminhar a resposta.
+type Oferta struct {
+	Req              protocolo.TrocarCartasReq `json:"req"`
+	CartaOferecida   protocolo.Carta           `json:"carta_oferecida"`
+	CartaDesejada    protocolo.Carta           `json:"carta_desejada"`
+	ServidorOferta   string                    `json:"servidor_oferta"`
+	ServidorDesejado string                    `json:"servidor_desejado"`
+	Coordenador      string                    `json:"coordenador"`
+	ExpiraEm         time.Time                 `json:"expira_em"`
+}
+
+// Ofertas guarda as propostas fora de partida conhecidas por este servidor
+type Ofertas struct {
+	mutex   sync.Mutex
+	ofertas map[string]Oferta // OfertaID -> Oferta
+}
+
+func NovasOfertas() *Ofertas {
+	return &Ofertas{ofertas: make(map[string]Oferta)}
+}
+
+// Registrar adiciona (ou substitui) a oferta e descarta as expiradas
+func (o *Ofertas) Registrar(oferta Oferta) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	agora := time.Now()
+	for id, existente := range o.ofertas {
+		if agora.After(existente.ExpiraEm) {
+			delete(o.ofertas, id)
+		}
+	}
+	o.ofertas[oferta.Req.OfertaID] = oferta
+}
+
+// Buscar devolve a oferta ainda dentro do prazo
+func (o *Ofertas) Buscar(id string) (Oferta, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	oferta, ok := o.ofertas[id]
+	if !ok || time.Now().After(oferta.ExpiraEm) {
+		return Oferta{}, false
+	}
+	return oferta, true
+}
+
+// Tomar remove e devolve a oferta, expirada ou não. No coordenador, é o que garante
+// que a oferta é aceita, recusada ou expirada uma vez só.
+func (o *Ofertas) Tomar(id string) (Oferta, bool) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	oferta, ok := o.ofertas[id]
+	delete(o.ofertas, id)
+	return oferta, ok
+}
+
+// FeitasPor devolve as ofertas ativas que o jogador fez e este servidor coordena
+func (o *Ofertas) FeitasPor(clienteID, coordenador string) []Oferta {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	feitas := make([]Oferta, 0)
+	agora := time.Now()
+	for _, oferta := range o.ofertas {
+		if oferta.Req.IDJogadorOferta == clienteID && oferta.Coordenador == coordenador && agora.Before(oferta.ExpiraEm) {
+			feitas = append(feitas, oferta)
+		}
+	}
+	return feitas
+}
+
+// Aviso é o corpo de /troca/oferta/avisar: uma mensagem do coordenador para um
+// jogador de outro servidor, com a oferta que esse servidor deve guardar (ou apagar,
+// se `Encerrada`)
+type Aviso struct {
+	ClienteID string             `json:"cliente_id"`
+	Mensagem  protocolo.Mensagem `json:"mensagem"`
+	Oferta    Oferta             `json:"oferta"`
+	Encerrada bool               `json:"encerrada,omitempty"`
+}
@@ -0,0 +1,164 @@
+package troca
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DIRETORIO_RESERVAS = "reservas" // Subdiretório do diário com as reservas dos participantes
+
+// Reserva é a carta que um participante separou ao votar "sim" no preparar. Ela só
+// é desfeita pela decisão do coordenador (confirmar ou abortar).
+type Reserva struct {
+	TrocaID     string    `json:"troca_id"`
+	ClienteID   string    `json:"cliente_id"`
+	CartaID     string    `json:"carta_id"`
+	CartaNome   string    `json:"carta_nome"`
+	Coordenador string    `json:"coordenador"` // Servidor a consultar se a decisão demorar
+	CriadaEm    time.Time `json:"criada_em"`
+}
+
+func (r Reserva) chave() string {
+	return r.TrocaID + "_" + r.ClienteID
+}
+
+// Reservas guarda as reservas deste servidor como participante, um arquivo por
+// reserva (tmp + fsync + rename), para que um reinício não solte uma carta prometida a uma
+// troca. Com `diretorio` vazio elas ficam só em memória.
+type Reservas struct {
+	mutex     sync.Mutex
+	reservas  map[string]Reserva // trocaID_clienteID -> reserva
+	diretorio string
+}
+
+// NovasReservas abre as reservas gravadas em `diretorio`/reservas.
+func NovasReservas(diretorio string) (*Reservas, error) {
+	r := &Reservas{reservas: make(map[string]Reserva)}
+	if diretorio == "" {
+		return r, nil
+	}
+	r.diretorio = filepath.Join(diretorio, DIRETORIO_RESERVAS)
+
+	if err := os.MkdirAll(r.diretorio, 0o755); err != nil {
+		return nil, fmt.Errorf("erro ao criar diretório das reservas: %v", err)
+	}
+	entradas, err := os.ReadDir(r.diretorio)
+	if err != nil {
+		return nil, fmt.Errorf("erro ao ler reservas de troca: %v", err)
+	}
+	for _, e := range entradas {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), EXTENSAO_ARQUIVO) {
+			continue
+		}
+		caminho := filepath.Join(r.diretorio, e.Name())
+		conteudo, err := os.ReadFile(caminho)
+		if err != nil {
+			log.Printf("[TROCA_TX] Erro ao ler %s: %v", caminho, err)
+			continue
+		}
+		var reserva Reserva
+		if err := json.Unmarshal(conteudo, &reserva); err != nil || reserva.TrocaID == "" {
+			log.Printf("[TROCA_TX] Ignorando %s: %v", caminho, err)
+			continue
+		}
+		r.reservas[reserva.chave()] = reserva
+	}
+	log.Printf("[TROCA_TX] %d reservas de troca carregadas de %s", len(r.reservas), r.diretorio)
+	return r, nil
+}
+
+// Reservar grava a reserva. É idempotente para a mesma troca; recusa a carta presa
+// a outra troca.
+func (r *Reservas) Reservar(reserva Reserva) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, existe := r.reservas[reserva.chave()]; existe {
+		return nil
+	}
+	for _, outra := range r.reservas {
+		if outra.ClienteID == reserva.ClienteID && outra.CartaID == reserva.CartaID {
+			return fmt.Errorf("%w: %s já está reservada para outra troca", ErrRecusado, reserva.CartaNome)
+		}
+	}
+	if r.diretorio != "" {
+		conteudo, err := json.Marshal(reserva)
+		if err != nil {
+			return err
+		}
+		if err := gravarArquivo(filepath.Join(r.diretorio, reserva.chave()+EXTENSAO_ARQUIVO), conteudo); err != nil {
+			return fmt.Errorf("erro ao gravar reserva %s: %v", reserva.chave(), err)
+		}
+	}
+	r.reservas[reserva.chave()] = reserva
+	return nil
+}
+
+// Liberar apaga a reserva. Devolve false se ela não existia mais.
+func (r *Reservas) Liberar(trocaID, clienteID string) bool {
+	chave := Reserva{TrocaID: trocaID, ClienteID: clienteID}.chave()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if _, existe := r.reservas[chave]; !existe {
+		return false
+	}
+	if r.diretorio != "" {
+		if err := removerArquivo(filepath.Join(r.diretorio, chave+EXTENSAO_ARQUIVO)); err != nil {
+			log.Printf("[TROCA_TX] Erro ao apagar a reserva %s: %v", chave, err)
+		}
+	}
+	delete(r.reservas, chave)
+	return true
+}
+
+// Buscar devolve a reserva do jogador para a troca
+func (r *Reservas) Buscar(trocaID, clienteID string) (Reserva, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	reserva, ok := r.reservas[Reserva{TrocaID: trocaID, ClienteID: clienteID}.chave()]
+	return reserva, ok
+}
+
+// Reservada diz se a carta do jogador está presa a alguma troca
+func (r *Reservas) Reservada(clienteID, cartaID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, reserva := range r.reservas {
+		if reserva.ClienteID == clienteID && reserva.CartaID == cartaID {
+			return true
+		}
+	}
+	return false
+}
+
+// DoJogador diz se o jogador tem alguma carta reservada
+func (r *Reservas) DoJogador(clienteID string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, reserva := range r.reservas {
+		if reserva.ClienteID == clienteID {
+			return true
+		}
+	}
+	return false
+}
+
+// Antigas devolve as reservas feitas há mais de `idade`
+func (r *Reservas) Antigas(idade time.Duration) []Reserva {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	antigas := make([]Reserva, 0)
+	for _, reserva := range r.reservas {
+		if time.Since(reserva.CriadaEm) > idade {
+			antigas = append(antigas, reserva)
+		}
+	}
+	return antigas
+}
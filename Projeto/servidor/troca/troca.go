@@ -0,0 +1,330 @@
+package troca
+
+import (
+	"errors"
+	"fmt"
+	"jogodistribuido/protocolo"
+	"log"
+	"sync"
+	"time"
+)
+
+// Estados de uma transação de troca. O coordenador grava o estado no diário antes de
+// cada fase: uma transação retomada antes de CONFIRMANDO é abortada; a partir dele,
+// é levada até o fim. Se um participante não confirma depois de TENTATIVAS_CONFIRMAR,
+// a transação fica SUSPENSA até o operador decidir (Resolver).
+const (
+	ESTADO_PREPARANDO  = "preparando"
+	ESTADO_CONFIRMANDO = "confirmando"
+	ESTADO_SUSPENSA    = "suspensa"
+	ESTADO_ABORTANDO   = "abortando"
+	ESTADO_CONCLUIDA   = "concluida"
+	ESTADO_ABORTADA    = "abortada"
+)
+
+// Decisões do operador sobre uma transação suspensa
+const (
+	RESOLVER_RETOMAR = "retomar" // Volta a pedir a confirmação aos participantes
+	RESOLVER_ABORTAR = "abortar" // Libera as reservas; só se nenhum lado confirmou
+)
+
+// Fases enviadas a cada participante em /troca/participar
+const (
+	FASE_PREPARAR  = "preparar"  // Reserva a carta que sai do inventário (voto "sim")
+	FASE_CONFIRMAR = "confirmar" // Troca a carta que sai pela carta que entra; não pode ser recusada
+	FASE_ABORTAR   = "abortar"   // Libera a reserva
+)
+
+const (
+	ESPERA_INICIAL       = 1 * time.Second  // Espera antes de repetir uma fase que falhou
+	ESPERA_MAXIMA        = 30 * time.Second // Limite da espera, que dobra a cada falha
+	TENTATIVAS_ABORT     = 3                // O abort desiste antes: o participante consulta a decisão depois
+	TENTATIVAS_CONFIRMAR = 120              // Cerca de uma hora de tentativas antes de suspender a troca
+)
+
+// ErrRecusado indica que o participante recusou a fase de vez (ex.: a carta não está
+// mais no inventário). Repetir o pedido não adianta.
+var ErrRecusado = errors.New("recusado pelo participante")
+
+// Lado é a parte da troca que acontece no servidor de um jogador
+type Lado struct {
+	Servidor   string          `json:"servidor"`
+	ClienteID  string          `json:"cliente_id"`
+	Nome       string          `json:"nome"`
+	CartaSai   protocolo.Carta `json:"carta_sai"`
+	CartaEntra protocolo.Carta `json:"carta_entra"`
+	Confirmado bool            `json:"confirmado,omitempty"`
+}
+
+// Transacao é uma troca entre dois jogadores, possivelmente em servidores diferentes
+type Transacao struct {
+	ID           string    `json:"id"`
+	SalaID       string    `json:"sala_id,omitempty"`
+	Estado       string    `json:"estado"`
+	Coordenador  string    `json:"coordenador"` // Servidor que executa a transação
+	Lados        [2]Lado   `json:"lados"`
+	Motivo       string    `json:"motivo,omitempty"` // Por que foi abortada
+	CriadaEm     time.Time `json:"criada_em"`
+	AtualizadaEm time.Time `json:"atualizada_em"`
+}
+
+func (t *Transacao) Terminada() bool {
+	return t.Estado == ESTADO_CONCLUIDA || t.Estado == ESTADO_ABORTADA
+}
+
+// Pedido é o corpo de /troca/participar: uma fase para um lado da troca
+type Pedido struct {
+	TrocaID         string `json:"troca_id"`
+	SalaID          string `json:"sala_id,omitempty"` // Vazio numa troca fora de partida
+	Coordenador     string `json:"coordenador"`
+	Fase            string `json:"fase"`
+	Lado            Lado   `json:"lado"`
+	Contraparte     string `json:"contraparte"` // Conta que recebe a carta deste lado
+	ContraparteNome string `json:"contraparte_nome"`
+}
+
+func (t *Transacao) pedido(fase string, lado Lado) Pedido {
+	outro := t.Lados[0]
+	if outro.ClienteID == lado.ClienteID {
+		outro = t.Lados[1]
+	}
+	return Pedido{
+		TrocaID:         t.ID,
+		SalaID:          t.SalaID,
+		Coordenador:     t.Coordenador,
+		Fase:            fase,
+		Lado:            lado,
+		Contraparte:     outro.ClienteID,
+		ContraparteNome: outro.Nome,
+	}
+}
+
+// Transporte entrega um pedido ao servidor do participante. Deve devolver um erro que
+// envolve ErrRecusado quando a recusa é definitiva.
+type Transporte func(servidor string, pedido Pedido) error
+
+// Coordenador executa as transações de troca em duas fases. O estado
+// de cada transação fica no diário, então um coordenador reiniciado retoma as trocas
+// que estavam em andamento (Recuperar).
+type Coordenador struct {
+	diario *Diario
+	enviar Transporte
+
+	// AoConfirmar é chamado depois que um lado confirmou a sua parte (ex.: para
+	// atualizar cópias do inventário); AoConcluir, depois que os dois lados confirmaram
+	AoConfirmar func(t Transacao, lado Lado)
+	AoConcluir  func(t Transacao)
+
+	mutex       sync.Mutex
+	emAndamento map[string]bool // Transações sendo executadas por este coordenador
+}
+
+func NovoCoordenador(diario *Diario, enviar Transporte) *Coordenador {
+	return &Coordenador{
+		diario:      diario,
+		enviar:      enviar,
+		emAndamento: make(map[string]bool),
+	}
+}
+
+// Executar leva a transação até CONCLUIDA ou ABORTADA e devolve nil se a troca
+// aconteceu. Depois do ponto de confirmação, espera o participante que estiver fora
+// do ar voltar: a reserva dele fica gravada até receber a decisão.
+func (c *Coordenador) Executar(t *Transacao) error {
+	t.Estado = ESTADO_PREPARANDO
+	if t.CriadaEm.IsZero() {
+		t.CriadaEm = time.Now()
+	}
+	if err := c.diario.Gravar(t); err != nil {
+		return fmt.Errorf("diário indisponível: %v", err)
+	}
+	return c.continuar(t)
+}
+
+// Recuperar retoma as transações que o diário mostra inacabadas. As que ainda não
+// chegaram ao ponto de confirmação são abortadas; as suspensas esperam o operador.
+func (c *Coordenador) Recuperar() {
+	for _, t := range c.diario.Pendentes() {
+		if t.Estado == ESTADO_SUSPENSA {
+			log.Printf("[TROCA_TX] Troca %s continua suspensa: %s", t.ID, t.Motivo)
+			continue
+		}
+		log.Printf("[TROCA_TX] Retomando a troca %s (%s)", t.ID, t.Estado)
+		if t.Estado == ESTADO_PREPARANDO {
+			t.Estado, t.Motivo = ESTADO_ABORTANDO, "coordenador reiniciado antes da confirmação"
+			c.gravar(t)
+		}
+		go func(t *Transacao) {
+			if err := c.continuar(t); err != nil {
+				log.Printf("[TROCA_TX] Troca %s retomada terminou abortada: %v", t.ID, err)
+			}
+		}(t)
+	}
+}
+
+// Buscar devolve a transação gravada no diário
+func (c *Coordenador) Buscar(id string) (Transacao, bool) {
+	return c.diario.Buscar(id)
+}
+
+// Resolver aplica a decisão do operador a uma transação suspensa e a continua em
+// segundo plano. Abortar só é aceito se nenhum lado confirmou: depois disso, desfazer
+// um lado duplicaria cartas.
+func (c *Coordenador) Resolver(id, decisao string) error {
+	t, ok := c.diario.Buscar(id)
+	if !ok {
+		return fmt.Errorf("troca %s não encontrada", id)
+	}
+	if t.Estado != ESTADO_SUSPENSA {
+		return fmt.Errorf("troca %s não está suspensa (%s)", id, t.Estado)
+	}
+	switch decisao {
+	case RESOLVER_RETOMAR:
+		t.Estado = ESTADO_CONFIRMANDO
+	case RESOLVER_ABORTAR:
+		for _, lado := range t.Lados {
+			if lado.Confirmado {
+				return fmt.Errorf("troca %s: %s já confirmou, só é possível retomar", id, lado.Nome)
+			}
+		}
+		t.Estado, t.Motivo = ESTADO_ABORTANDO, "abortada pelo operador"
+	default:
+		return fmt.Errorf("decisão desconhecida: %s", decisao)
+	}
+	if err := c.diario.Gravar(&t); err != nil {
+		return fmt.Errorf("diário indisponível: %v", err)
+	}
+	log.Printf("[TROCA_TX] Troca %s: operador decidiu %s", id, decisao)
+	go func() {
+		if err := c.continuar(&t); err != nil {
+			log.Printf("[TROCA_TX] Troca %s resolvida pelo operador terminou sem concluir: %v", t.ID, err)
+		}
+	}()
+	return nil
+}
+
+// Coletar apaga do diário as transações terminadas há mais de `idade`.
+func (c *Coordenador) Coletar(idade time.Duration) int {
+	return c.diario.Coletar(idade)
+}
+
+func (c *Coordenador) continuar(t *Transacao) error {
+	c.mutex.Lock()
+	if c.emAndamento[t.ID] {
+		c.mutex.Unlock()
+		return fmt.Errorf("troca %s já está em andamento", t.ID)
+	}
+	c.emAndamento[t.ID] = true
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.emAndamento, t.ID)
+		c.mutex.Unlock()
+	}()
+
+	for {
+		switch t.Estado {
+		case ESTADO_PREPARANDO:
+			c.preparar(t)
+		case ESTADO_CONFIRMANDO:
+			c.confirmar(t)
+		case ESTADO_ABORTANDO:
+			c.abortar(t)
+		case ESTADO_CONCLUIDA:
+			return nil
+		case ESTADO_ABORTADA:
+			return errors.New(t.Motivo)
+		case ESTADO_SUSPENSA:
+			return fmt.Errorf("troca suspensa até a decisão do operador: %s", t.Motivo)
+		default:
+			t.Estado, t.Motivo = ESTADO_ABORTANDO, "estado desconhecido: "+t.Estado
+		}
+	}
+}
+
+// preparar reserva as duas cartas. Qualquer falha aborta; se as duas foram
+// reservadas, grava CONFIRMANDO (ponto de confirmação).
+func (c *Coordenador) preparar(t *Transacao) {
+	for _, lado := range t.Lados {
+		if err := c.enviar(lado.Servidor, t.pedido(FASE_PREPARAR, lado)); err != nil {
+			t.Estado, t.Motivo = ESTADO_ABORTANDO, fmt.Sprintf("%s: %v", lado.Nome, err)
+			c.gravar(t)
+			return
+		}
+	}
+	t.Estado = ESTADO_CONFIRMANDO
+	if err := c.diario.Gravar(t); err != nil {
+		// Sem o ponto de confirmação gravado, a troca não pode ser retomada: aborta
+		t.Estado, t.Motivo = ESTADO_ABORTANDO, fmt.Sprintf("diário indisponível: %v", err)
+	}
+}
+
+// confirmar aplica a troca nos dois lados, repetindo enquanto um participante
+// estiver fora do ar. Quem votou "sim" mantém a carta reservada até a confirmação,
+// então ela não é recusada; uma recusa indica um participante com defeito. Na recusa,
+// ou depois de TENTATIVAS_CONFIRMAR, a troca é suspensa: desfazer o lado já
+// confirmado duplicaria cartas, então só o operador decide como continuar.
+func (c *Coordenador) confirmar(t *Transacao) {
+	for i := range t.Lados {
+		if t.Lados[i].Confirmado {
+			continue
+		}
+		lado := t.Lados[i]
+		if err := c.insistir(lado.Servidor, t.pedido(FASE_CONFIRMAR, lado), TENTATIVAS_CONFIRMAR); err != nil {
+			t.Estado, t.Motivo = ESTADO_SUSPENSA, fmt.Sprintf("%s não confirmou em %s: %v", lado.Nome, lado.Servidor, err)
+			c.gravar(t)
+			log.Printf("[TROCA_TX] Troca %s: ERRO, suspensa até a decisão do operador: %s", t.ID, t.Motivo)
+			return
+		}
+		t.Lados[i].Confirmado = true
+		c.gravar(t)
+		if c.AoConfirmar != nil {
+			c.AoConfirmar(*t, t.Lados[i])
+		}
+	}
+	t.Estado = ESTADO_CONCLUIDA
+	c.gravar(t)
+	log.Printf("[TROCA_TX] Troca %s concluída: %s <-> %s", t.ID, t.Lados[0].Nome, t.Lados[1].Nome)
+	if c.AoConcluir != nil {
+		c.AoConcluir(*t)
+	}
+}
+
+// abortar libera as reservas. Uma reserva que não for liberada aqui é liberada pelo
+// participante quando ele consultar a transação (GET /troca/transacao/:troca_id).
+func (c *Coordenador) abortar(t *Transacao) {
+	for _, lado := range t.Lados {
+		if err := c.insistir(lado.Servidor, t.pedido(FASE_ABORTAR, lado), TENTATIVAS_ABORT); err != nil {
+			log.Printf("[TROCA_TX] Troca %s: reserva de %s em %s não liberada: %v", t.ID, lado.Nome, lado.Servidor, err)
+		}
+	}
+	t.Estado = ESTADO_ABORTADA
+	c.gravar(t)
+	log.Printf("[TROCA_TX] Troca %s abortada: %s", t.ID, t.Motivo)
+}
+
+// insistir repete o pedido até o participante responder. Devolve nil no sucesso ou o
+// erro de uma recusa definitiva. Com `tentativas` > 0, desiste depois delas.
+func (c *Coordenador) insistir(servidor string, pedido Pedido, tentativas int) error {
+	espera := ESPERA_INICIAL
+	for n := 1; ; n++ {
+		err := c.enviar(servidor, pedido)
+		if err == nil || errors.Is(err, ErrRecusado) {
+			return err
+		}
+		if tentativas > 0 && n >= tentativas {
+			return err
+		}
+		log.Printf("[TROCA_TX] Troca %s: %s em %s falhou (%v); tentando de novo em %v", pedido.TrocaID, pedido.Fase, servidor, err, espera)
+		time.Sleep(espera)
+		if espera *= 2; espera > ESPERA_MAXIMA {
+			espera = ESPERA_MAXIMA
+		}
+	}
+}
+
+func (c *Coordenador) gravar(t *Transacao) {
+	if err := c.diario.Gravar(t); err != nil {
+		log.Printf("[TROCA_TX] Erro ao gravar a troca %s (%s) no diário: %v", t.ID, t.Estado, err)
+	}
+}
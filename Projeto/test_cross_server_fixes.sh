@@ -46,12 +46,12 @@ test_cross_server_matchmaking() {
     
     # Simula uma requisição de matchmaking
     echo "Simulando requisição de matchmaking..."
-    response=$(curl -s --connect-timeout 10 -X POST "http://servidor1:8080/matchmaking/solicitar_oponente" \
+    response=$(curl -s --connect-timeout 10 -X POST "http://servidor1:8080/matchmaking/fila/entrar" \
         -H "Content-Type: application/json" \
         -H "Authorization: Bearer $(echo 'servidor1' | base64)" \
-        -d '{"solicitante_id":"test123","solicitante_nome":"TestPlayer","servidor_origem":"servidor1:8080"}')
+        -d '{"cliente_id":"test123","nome":"TestPlayer","servidor":"servidor1:8080"}')
     
-    if echo "$response" | grep -q "partida_encontrada"; then
+    if echo "$response" | grep -q "na_fila"; then
         echo "✓ Matchmaking cross-server funcionando"
     else
         echo "✗ Matchmaking cross-server com problemas"
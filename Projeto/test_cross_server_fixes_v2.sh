@@ -50,11 +50,11 @@ test_cross_server_matchmaking() {
     
     # Simular solicitação de matchmaking
     echo "Enviando solicitação de matchmaking..."
-    response=$(curl -s -X POST "http://servidor1:8080/matchmaking/solicitar_oponente" \
+    response=$(curl -s -X POST "http://servidor1:8080/matchmaking/fila/entrar" \
         -H "Content-Type: application/json" \
-        -d '{"nome": "teste1", "servidor": "servidor1:8080"}' 2>/dev/null)
+        -d '{"cliente_id":"test123","nome":"TestPlayer","servidor":"servidor1:8080"}' 2>/dev/null)
     
-    if echo "$response" | grep -q "oponente"; then
+    if echo "$response" | grep -q "na_fila"; then
         echo "✅ Matchmaking cross-server funcionando"
     else
         echo "❌ Matchmaking cross-server com problemas"